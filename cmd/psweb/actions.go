@@ -0,0 +1,1173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"peerswap-web/cmd/psweb/bitcoin"
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
+	"peerswap-web/cmd/psweb/liquid"
+	"peerswap-web/cmd/psweb/ln"
+	"peerswap-web/cmd/psweb/ps"
+)
+
+// State-changing operations shared by the HTML forms and the JSON API
+
+// error caused by invalid user input rather than by a backend failure
+type inputError struct {
+	msg string
+}
+
+func (e *inputError) Error() string {
+	return e.msg
+}
+
+func badInput(msg string) error {
+	return &inputError{msg: msg}
+}
+
+// peg-in or BTC withdrawal request
+type PeginParams struct {
+	IsPegin         bool     `json:"isPegin"`    // false for BTC withdrawal
+	IsExternal      bool     `json:"isExternal"` // peg-in address will be funded externally
+	Amount          int64    `json:"amount"`
+	FeeRate         float64  `json:"feeRate"`
+	SelectedOutputs []string `json:"selectedOutputs"` // txid:vout
+	SubtractFee     bool     `json:"subtractFee"`
+	SendAddress     string   `json:"sendAddress"` // destination of BTC withdrawal
+	ClaimJoin       bool     `json:"claimJoin"`
+}
+
+// starts a peg-in or BTC withdrawal
+func startPegin(p *PeginParams) error {
+	if !p.IsExternal {
+		if p.Amount <= 0 {
+			return badInput("amount cannot be blank")
+		}
+
+		if p.FeeRate <= 0 {
+			return badInput("fee rate cannot be blank")
+		}
+
+		totalAmount := int64(0)
+
+		if len(p.SelectedOutputs) > 0 {
+			// check that outputs add up
+			cl, clean, er := ln.GetClient()
+			if er != nil {
+				return er
+			}
+			defer clean()
+
+			var utxos []ln.UTXO
+			ln.ListUnspent(cl, &utxos, int32(1))
+
+			for _, utxo := range utxos {
+				for _, output := range p.SelectedOutputs {
+					vin := utxo.TxidStr + ":" + strconv.FormatUint(uint64(utxo.OutputIndex), 10)
+					if vin == output {
+						totalAmount += utxo.AmountSat
+					}
+				}
+			}
+
+			if p.Amount > totalAmount {
+				return badInput("amount cannot exceed the sum of the selected outputs")
+			}
+		}
+
+		if p.SubtractFee {
+			if p.Amount != totalAmount {
+				return badInput("amount should add up to the sum of the selected outputs for 'substract fee' option to be used")
+			}
+		}
+
+		if !p.SubtractFee && p.Amount == totalAmount {
+			return badInput("'subtract fee' option should be used when amount adds up to the selected outputs")
+		}
+	}
+
+	address := ""
+	claimScript := ""
+	config.Config.PeginClaimJoin = false
+
+	if p.IsPegin {
+		// check that elements is fully synced
+		info, err := liquid.GetBlockchainInfo()
+		if err != nil {
+			return err
+		}
+		if info.InitialBlockDownload {
+			return errors.New("elements initial block download is not complete")
+		}
+
+		// test on a pre-existing tx that bitcon core can complete the peg
+		tx := "b61ec844027ce18fd3eb91fa7bed8abaa6809c4d3f6cf4952b8ebaa7cd46583a"
+		if config.Config.Chain == "testnet" {
+			// identify testnet blockchain
+			genesisHash, err := bitcoin.GetBlockHash(0)
+			if err != nil {
+				return err
+			}
+
+			if genesisHash == "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943" {
+				// testnet3
+				tx = "2c7ec5043fe8ee3cb4ce623212c0e52087d3151c9e882a04073cce1688d6fc1e"
+			} else {
+				// testnet4
+				tx = "0b387c3b7a8d9fad4d7a1ac2cba4958451c03d6c4fe63dfbe10cdb86d666cdd7"
+			}
+		}
+
+		_, err = bitcoin.GetTxOutProof(tx)
+		if err != nil {
+			// automatic fallback to getblock.io
+			config.Config.BitcoinHost = config.GetBlockIoHost()
+			config.Config.BitcoinUser = ""
+			config.Config.BitcoinPass = ""
+			_, err = bitcoin.GetTxOutProof(tx)
+			if err != nil {
+				return errors.New("GetTxOutProof failed, check BitcoinHost in Config")
+			} else {
+				// use getblock.io endpoint going forward
+				log.Println("Switching to getblock.io bitcoin host endpoint")
+				if err := config.Save(); err != nil {
+					return err
+				}
+			}
+		}
+
+		addr, err := liquid.GetPeginAddress()
+		if err != nil {
+			return err
+		}
+
+		address = addr.MainChainAddress
+		claimScript = addr.ClaimScript
+
+		if hasDiscountedvSize {
+			config.Config.PeginClaimJoin = p.ClaimJoin
+			if config.Config.PeginClaimJoin {
+				ln.ClaimStatus = "Awaiting funding tx to confirm"
+				if err := ln.SaveClaimJoin(); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		if p.SendAddress == "" {
+			return badInput("address cannot be blank")
+		}
+		address = p.SendAddress
+		claimScript = ""
+	}
+
+	if !p.IsExternal {
+		label := "Liquid Pegin"
+		if !p.IsPegin {
+			label = "BTC Withdrawal"
+		}
+
+		res, err := ln.SendCoinsWithUtxos(&p.SelectedOutputs, address, p.Amount, p.FeeRate, p.SubtractFee, label)
+		if err != nil {
+			return err
+		}
+
+		if p.IsPegin {
+			log.Println("New Peg-in TxId:", res.TxId, "RawHex:", res.RawHex, "Claim script:", claimScript)
+			duration := time.Duration(10*peginBlocks) * time.Minute
+			formattedDuration := time.Time{}.Add(duration).Format("15h 04m")
+			telegramSendMessage("⏰ Started peg in " + formatWithThousandSeparators(uint64(res.AmountSat)) + " sats. Time left: " + formattedDuration + ". TxId: `" + res.TxId + "`")
+		} else {
+			log.Println("BTC withdrawal pending, TxId:", res.TxId, "RawHex:", res.RawHex)
+			telegramSendMessage("⛓️ BTC withdrawal pending: " + formatWithThousandSeparators(uint64(res.AmountSat)) + " sats. TxId: `" + res.TxId + "`")
+		}
+		config.Config.PeginAmount = res.AmountSat
+		config.Config.PeginTxId = res.TxId
+		config.Config.PeginFeeRate = res.ExactSatVb
+	} else {
+		log.Println("Peg-in address for external funding:", address, "Claim script:", claimScript)
+		config.Config.PeginTxId = "external"
+	}
+
+	config.Config.PeginClaimScript = claimScript
+	config.Config.PeginAddress = address
+	config.Config.PeginReplacedTxId = ""
+
+	return config.Save()
+}
+
+// RBF or CPFP of the pending peg-in or BTC withdrawal
+// returns false if the tx has confirmed already
+func bumpPeginFee(fee float64) (bool, error) {
+	if config.Config.PeginTxId == "" || config.Config.PeginTxId == "external" {
+		return false, badInput("no pending peg-in")
+	}
+
+	confs, _ := peginConfirmations(config.Config.PeginTxId)
+	if confs > 0 {
+		// transaction has been confirmed already
+		return false, nil
+	}
+
+	label := "Liquid Peg-in"
+	if config.Config.PeginClaimScript == "" {
+		label = "BTC Withdrawal"
+	}
+
+	res, err := ln.BumpPeginFee(fee, label)
+	if err != nil {
+		return false, err
+	}
+
+	if ln.CanRBF() {
+		log.Println("RBF TxId:", res.TxId, "RawHex:", res.RawHex)
+		config.Config.PeginReplacedTxId = config.Config.PeginTxId
+		config.Config.PeginAmount = res.AmountSat
+		config.Config.PeginTxId = res.TxId
+	} else {
+		// txid not available, let's hope LND broadcasted it fine
+		log.Println("CPFP initiated")
+	}
+
+	// save the new rate, so the next bump cannot be lower
+	config.Config.PeginFeeRate = res.ExactSatVb
+
+	return true, config.Save()
+}
+
+// registers a tx funding the peg-in address externally
+func setExternalPegin(txid string) error {
+	if txid == "" {
+		return badInput("TxId is blank")
+	}
+
+	// find the funding output
+	var tx bitcoin.Transaction
+	_, err := bitcoin.GetRawTransaction(txid, &tx)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, out := range tx.Vout {
+		if out.ScriptPubKey.Address == config.Config.PeginAddress {
+			found = true
+			config.Config.PeginAmount = int64(toSats(out.Value))
+			break
+		}
+	}
+
+	if !found {
+		return badInput("the tx fails to pay the pegin address")
+	}
+
+	config.Config.PeginTxId = txid
+	config.Config.PeginFeeRate = 0
+
+	log.Println("External Funding TxId:", txid)
+	duration := time.Duration(10*(int32(peginBlocks)-tx.Confirmations)) * time.Minute
+	formattedDuration := time.Time{}.Add(duration).Format("15h 04m")
+	telegramSendMessage("⏰ Started peg in " + formatWithThousandSeparators(uint64(config.Config.PeginAmount)) + " sats. Time left: " + formattedDuration + ". TxId: `" + txid + "`")
+
+	return config.Save()
+}
+
+// abandons a peg-in awaiting external funding
+func cancelExternalPegin() error {
+	config.Config.PeginTxId = ""
+	config.Config.PeginClaimJoin = false
+	return config.Save()
+}
+
+// acknowledges BTC withdrawal
+func deletePeginTxId() error {
+	config.Config.PeginTxId = ""
+	return config.Save()
+}
+
+// enables or disables broadcasting of L-BTC balance to peers
+func setAdvertiseLiquidBalance(enabled bool) (string, error) {
+	if enabled && !config.Config.AllowSwapRequests {
+		return "", badInput("liquid swap requests are disabled")
+	}
+
+	if err := db.Save("Peers", "AdvertiseLiquidBalance", enabled); err != nil {
+		return "", err
+	}
+	ln.AdvertiseLiquidBalance = enabled
+
+	msg := "Broadcasting Liquid Balance is "
+	if ln.AdvertiseLiquidBalance {
+		msg += "Enabled"
+	} else {
+		msg += "Disabled"
+	}
+	return msg, nil
+}
+
+// enables or disables broadcasting of BTC balance to peers
+func setAdvertiseBitcoinBalance(enabled bool) (string, error) {
+	if enabled && (!config.Config.AllowSwapRequests || !config.Config.BitcoinSwaps) {
+		return "", badInput("bitcoin swap requests are disabled on configuration page")
+	}
+
+	if err := db.Save("Peers", "AdvertiseBitcoinBalance", enabled); err != nil {
+		return "", err
+	}
+	ln.AdvertiseBitcoinBalance = enabled
+
+	msg := "Broadcasting Bitcoin Balance is "
+	if ln.AdvertiseBitcoinBalance {
+		msg += "Enabled"
+	} else {
+		msg += "Disabled"
+	}
+	return msg, nil
+}
+
+// adds or updates auto fee rule, channelId == 0 means default rule
+// updateAll applies the changed fields to all custom rules
+func saveAutoFeeRule(channelId uint64, newRule ln.AutoFeeParams, updateAll bool) (string, error) {
+	if !ln.HasInboundFees() {
+		newRule.LowLiqDiscount = 0
+		newRule.InboundCurve = nil
+	}
+
+	if err := newRule.Validate(); err != nil {
+		return "", badInput(err.Error())
+	}
+
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	if _, isCustom := ln.AutoFeeRule(channelId); !isCustom {
+		updateAll = false
+	}
+
+	if updateAll {
+		msg := "All custom rules updated:"
+		old := reflect.ValueOf(*ln.AutoFee[channelId])
+		new := reflect.ValueOf(newRule)
+
+		// find what will be updated
+		for i := 0; i < old.NumField(); i++ {
+			if old.Field(i).Kind() != reflect.Int {
+				// schedules are edited per rule
+				continue
+			}
+			if old.Field(i).Int() != new.Field(i).Int() {
+				msg += fmt.Sprintf(" %s=%v", new.Type().Field(i).Name, new.Field(i).Interface())
+			}
+		}
+
+		// change copies, so that one invalid rule leaves all as they were
+		updated := make(map[uint64]ln.AutoFeeParams)
+		for id, rulePtr := range ln.AutoFee {
+			if rulePtr == nil {
+				continue
+			}
+			rule := *rulePtr
+			current := reflect.ValueOf(&rule).Elem()
+
+			for i := 0; i < old.NumField(); i++ {
+				if old.Field(i).Kind() != reflect.Int {
+					continue
+				}
+				if old.Field(i).Int() != new.Field(i).Int() {
+					if current.Field(i).CanSet() {
+						current.Field(i).SetInt(new.Field(i).Int())
+					} else {
+						return "", errors.New("unable to set the value of " + current.Type().Field(i).Name)
+					}
+				}
+			}
+
+			if err := rule.Validate(); err != nil {
+				return "", badInput("rule of channel " + strconv.FormatUint(id, 10) + ": " + err.Error())
+			}
+			updated[id] = rule
+		}
+
+		for id, rule := range updated {
+			*ln.AutoFee[id] = rule
+			// persist to db
+			if err := ln.SaveAutoFeeRule(id); err != nil {
+				return "", err
+			}
+		}
+
+		return msg, nil
+	}
+
+	rule := &ln.AutoFeeDefaults
+	// channelId == 0 means default rule
+	msg := "Default rule updated"
+
+	if channelId > 0 {
+		// custom rule
+		msg = "Custom rule updated"
+		if ln.AutoFee[channelId] == nil {
+			// schedules are inherited from the template or defaults
+			msg = "Custom rule added"
+		}
+		rule = ln.CustomAutoFeeRule(channelId)
+	}
+
+	if newRule.Schedules == nil {
+		// not submitted, keep the existing ones
+		newRule.Schedules = rule.Schedules
+	}
+
+	// clone the new data
+	*rule = newRule
+
+	// persist to db
+	var err error
+	if channelId > 0 {
+		err = ln.SaveAutoFeeRule(channelId)
+	} else {
+		err = ln.SaveAutoFeeDefaults()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return msg, nil
+}
+
+// adds or updates the rule for all channels with the peer
+func saveAutoFeePeerRule(peerId string, newRule ln.AutoFeeParams) (string, error) {
+	if peerId == "" {
+		return "", badInput("peer not found")
+	}
+
+	if !ln.HasInboundFees() {
+		newRule.LowLiqDiscount = 0
+		newRule.InboundCurve = nil
+	}
+
+	if err := newRule.Validate(); err != nil {
+		return "", badInput(err.Error())
+	}
+
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	msg := "Peer rule updated"
+	rule := ln.AutoFeePeer[peerId]
+	if rule == nil {
+		// add new, inheriting default schedules
+		rule = new(ln.AutoFeeParams)
+		rule.Schedules = slices.Clone(ln.AutoFeeDefaults.Schedules)
+		msg = "Peer rule added"
+	}
+
+	if newRule.Schedules == nil {
+		// not submitted, keep the existing ones
+		newRule.Schedules = rule.Schedules
+	}
+
+	*rule = newRule
+	ln.AutoFeePeer[peerId] = rule
+
+	// persist to db
+	if err := ln.SaveAutoFeePeerRule(peerId); err != nil {
+		return "", err
+	}
+
+	return msg, nil
+}
+
+// deletes peer rule, its channels fall back to their own rules
+func deleteAutoFeePeerRule(peerId string) (string, error) {
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	if ln.AutoFeePeerRule(peerId) == nil {
+		return "", nil
+	}
+
+	delete(ln.AutoFeePeer, peerId)
+	// persist to db
+	if err := ln.SaveAutoFeePeerRule(peerId); err != nil {
+		return "", err
+	}
+
+	return "Peer rule deleted", nil
+}
+
+// template names go into URLs
+var templateNameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,20}$`)
+
+// adds a template as a copy of the default rule
+func addAutoFeeTemplate(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !templateNameRegex.MatchString(name) {
+		return "", badInput("template name must be up to 20 lowercase letters, digits, - or _")
+	}
+
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	if ln.AutoFeeTemplates[name] != nil {
+		return "", badInput("template " + name + " already exists")
+	}
+
+	rule := ln.AutoFeeDefaults
+	rule.Schedules = slices.Clone(ln.AutoFeeDefaults.Schedules)
+	rule.InboundCurve = slices.Clone(ln.AutoFeeDefaults.InboundCurve)
+	ln.AutoFeeTemplates[name] = &rule
+
+	// persist to db
+	if err := ln.SaveAutoFeeTemplate(name); err != nil {
+		return "", err
+	}
+
+	return "Template " + name + " added", nil
+}
+
+// updates the template of all channels tagged with it
+func saveAutoFeeTemplate(name string, newRule ln.AutoFeeParams) (string, error) {
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	rule := ln.AutoFeeTemplates[name]
+	if rule == nil {
+		return "", badInput("template not found")
+	}
+
+	if !ln.HasInboundFees() {
+		newRule.LowLiqDiscount = 0
+		newRule.InboundCurve = nil
+	}
+
+	if err := newRule.Validate(); err != nil {
+		return "", badInput(err.Error())
+	}
+
+	if newRule.Schedules == nil {
+		// not submitted, keep the existing ones
+		newRule.Schedules = rule.Schedules
+	}
+
+	*rule = newRule
+
+	// persist to db
+	if err := ln.SaveAutoFeeTemplate(name); err != nil {
+		return "", err
+	}
+
+	return "Template " + name + " updated", nil
+}
+
+// deletes the template, its channels fall back to defaults
+func deleteAutoFeeTemplate(name string) (string, error) {
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	if ln.AutoFeeTemplates[name] == nil {
+		return "", nil
+	}
+
+	for _, channelId := range ln.TaggedChannels(name) {
+		delete(ln.AutoFeeTags, channelId)
+		if err := ln.SaveAutoFeeTag(channelId); err != nil {
+			return "", err
+		}
+	}
+
+	delete(ln.AutoFeeTemplates, name)
+	// persist to db
+	if err := ln.SaveAutoFeeTemplate(name); err != nil {
+		return "", err
+	}
+
+	return "Template " + name + " deleted", nil
+}
+
+// tags channels with the template, empty name removes their tags
+func tagChannels(name string, channelIds []uint64) (string, error) {
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	if name != "" && ln.AutoFeeTemplates[name] == nil {
+		return "", badInput("template not found")
+	}
+	if len(channelIds) == 0 {
+		return "", badInput("select at least one channel")
+	}
+
+	for _, channelId := range channelIds {
+		if name == "" {
+			delete(ln.AutoFeeTags, channelId)
+		} else {
+			ln.AutoFeeTags[channelId] = name
+		}
+		if err := ln.SaveAutoFeeTag(channelId); err != nil {
+			return "", err
+		}
+	}
+
+	if name == "" {
+		return fmt.Sprintf("Tags removed from %d channel(s)", len(channelIds)), nil
+	}
+	return fmt.Sprintf("%d channel(s) tagged %s", len(channelIds), name), nil
+}
+
+// in dry run AutoFee only records what it would set
+func toggleAutoFeeDryRun(channelId uint64, isOn bool) (string, error) {
+	if channelId == 0 {
+		return "", badInput("dry run is set per channel")
+	}
+
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	ln.AutoFeeDryRun[channelId] = isOn
+	if err := ln.SaveAutoFeeDryRun(channelId); err != nil {
+		return "", err
+	}
+
+	if isOn {
+		return "Dry run enabled, fee changes will only be logged", nil
+	}
+	return "Dry run disabled", nil
+}
+
+// limits how often AutoFee may update channel policies
+func saveAutoFeeBudget(budget ln.UpdateBudget) (string, error) {
+	if err := budget.Validate(); err != nil {
+		return "", badInput(err.Error())
+	}
+
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	ln.AutoFeeBudget = budget
+	if err := ln.SaveAutoFeeBudget(); err != nil {
+		return "", err
+	}
+
+	return "Update budget saved", nil
+}
+
+// adds rate schedule to the template if named, otherwise
+// to the channel's rule, channelId == 0 means default rule
+func addAutoFeeSchedule(channelId uint64, template string, schedule ln.AutoFeeSchedule) (string, error) {
+	if err := schedule.Validate(); err != nil {
+		return "", badInput(err.Error())
+	}
+
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	rule := &ln.AutoFeeDefaults
+	if template != "" {
+		rule = ln.AutoFeeTemplates[template]
+		if rule == nil {
+			return "", badInput("template not found")
+		}
+	} else if peerRule := ln.AutoFeePeerRule(peerNodeId[channelId]); channelId > 0 && peerRule != nil {
+		rule = peerRule
+	} else if channelId > 0 {
+		rule = ln.CustomAutoFeeRule(channelId)
+	}
+
+	// do not share the array with the rule it was cloned from
+	rule.Schedules = append(slices.Clone(rule.Schedules), schedule)
+
+	if err := saveScheduledRule(channelId, template); err != nil {
+		return "", err
+	}
+
+	return "Schedule " + schedule.String() + " added", nil
+}
+
+// removes rate schedule by its index
+func deleteAutoFeeSchedule(channelId uint64, template string, index int) (string, error) {
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	rule, isCustom := ln.AutoFeeRule(channelId)
+	if template != "" {
+		rule, isCustom = ln.AutoFeeTemplates[template], true
+		if rule == nil {
+			return "", badInput("template not found")
+		}
+	} else if peerRule := ln.AutoFeePeerRule(peerNodeId[channelId]); channelId > 0 && peerRule != nil {
+		rule, isCustom = peerRule, true
+	}
+	if channelId > 0 && !isCustom {
+		// do not edit the defaults or templates from a channel page
+		return "", badInput("channel has no custom rule")
+	}
+	if index < 0 || index >= len(rule.Schedules) {
+		return "", badInput("schedule not found")
+	}
+
+	rule.Schedules = slices.Delete(slices.Clone(rule.Schedules), index, index+1)
+
+	if err := saveScheduledRule(channelId, template); err != nil {
+		return "", err
+	}
+
+	return "Schedule deleted", nil
+}
+
+// persists the rule the schedule forms edited
+func saveScheduledRule(channelId uint64, template string) error {
+	if template != "" {
+		return ln.SaveAutoFeeTemplate(template)
+	}
+	if peerId := peerNodeId[channelId]; channelId > 0 && ln.AutoFeePeerRule(peerId) != nil {
+		return ln.SaveAutoFeePeerRule(peerId)
+	}
+	if channelId > 0 && ln.AutoFee[channelId] != nil {
+		return ln.SaveAutoFeeRule(channelId)
+	}
+	return ln.SaveAutoFeeDefaults()
+}
+
+// deletes custom auto fee rule, the channel falls back to defaults
+func deleteAutoFeeRule(channelId uint64) (string, error) {
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	if ln.AutoFee[channelId] == nil {
+		return "", nil
+	}
+
+	ln.AutoFee[channelId] = nil
+	// persist to db
+	if err := ln.SaveAutoFeeRule(channelId); err != nil {
+		return "", err
+	}
+
+	return "Custom rule deleted", nil
+}
+
+// channelId == 0 toggles global setting, -1 toggles all channels
+func toggleAutoFee(channelId int64, isEnabled bool) (string, error) {
+	cl, clean, er := ln.GetClient()
+	if er != nil {
+		return "", er
+	}
+	defer clean()
+
+	// Get all public Lightning channels
+	res, err := ln.ListPeers(cl, "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	msg := ""
+	if channelId == 0 {
+		// global setting
+		ln.AutoFeeEnabledAll = isEnabled
+		if err := ln.SaveAutoFeeEnabledAll(); err != nil {
+			return "", err
+		}
+		msg = "Global AutoFees "
+	} else if channelId == -1 {
+		// toggle for all channels
+		for _, peer := range res.GetPeers() {
+			for _, ch := range peer.Channels {
+				ln.AutoFeeEnabled[ch.ChannelId] = isEnabled
+				if err := ln.SaveAutoFeeEnabled(ch.ChannelId); err != nil {
+					return "", err
+				}
+			}
+		}
+		msg = "All per-channel AutoFees "
+
+	} else {
+		// toggle for a single channel
+		ln.AutoFeeEnabled[uint64(channelId)] = isEnabled
+		if err := ln.SaveAutoFeeEnabled(uint64(channelId)); err != nil {
+			return "", err
+		}
+
+	outerLoop:
+		for _, peer := range res.GetPeers() {
+			for _, ch := range peer.Channels {
+				if ch.ChannelId == uint64(channelId) {
+					msg = "AutoFees for " + getNodeAlias(peer.NodeId) + " "
+					break outerLoop
+				}
+			}
+		}
+	}
+
+	if isEnabled {
+		msg += "Enabled"
+	} else {
+		msg += "Disabled"
+	}
+
+	return msg, nil
+}
+
+// sets outbound or inbound fee rate and records it in the fee log
+func changeFeeRate(nodeId string, channelId uint64, feeRate int64, inbound bool) error {
+	if inbound {
+		if !ln.HasInboundFees() {
+			// CLN and LND < 0.18 cannot set inbound fees
+			return badInput("inbound fees are not allowed by your LN backend")
+		}
+
+		if feeRate > 0 {
+			// Only discounts are allowed for now
+			return badInput("inbound fee rate cannot be positive")
+		}
+	} else {
+		if feeRate < 0 {
+			return badInput("outbound fee rate cannot be negative")
+		}
+	}
+
+	if nodeId == "" {
+		nodeId = peerNodeId[channelId]
+	}
+
+	oldRate, err := ln.SetFeeRate(nodeId, channelId, feeRate, inbound, false)
+	if err != nil {
+		return err
+	}
+
+	// log change
+	ln.LogFee(channelId, oldRate, int(feeRate), inbound, true)
+
+	return nil
+}
+
+// sets outbound or inbound base fee
+func changeFeeBase(nodeId string, channelId uint64, feeBase int64, inbound bool) error {
+	if inbound {
+		if ln.IMPLEMENTATION == "CLN" || !ln.CanRBF() {
+			// CLN and LND < 0.18 cannot set inbound fees
+			return badInput("inbound fees are not allowed by your LN backend")
+		}
+
+		if feeBase > 0 {
+			// Only discounts are allowed for now
+			return badInput("inbound fee base cannot be positive")
+		}
+	} else {
+		if feeBase < 0 {
+			return badInput("outbound fee base cannot be negative")
+		}
+	}
+
+	if nodeId == "" {
+		nodeId = peerNodeId[channelId]
+	}
+
+	oldBase, err := ln.SetFeeRate(nodeId, channelId, feeBase, inbound, true)
+	if err != nil {
+		return err
+	}
+
+	if !inbound {
+		// log change
+		ln.LogPolicy(channelId, ln.POLICY_BASE_FEE, oldBase, int(feeBase), true)
+	}
+
+	return nil
+}
+
+// sets min or max HTLC size in sats
+func changeHtlcSize(nodeId string, channelId uint64, size int64, isMax bool) error {
+	if size < 0 {
+		return badInput("HTLC size cannot be negative")
+	}
+
+	if nodeId == "" {
+		nodeId = peerNodeId[channelId]
+	}
+
+	oldSize, err := ln.SetHtlcSize(nodeId, channelId, size*1000, isMax)
+	if err != nil {
+		return err
+	}
+
+	if isMax && oldSize != size*1000 {
+		// log change
+		ln.LogPolicy(channelId, ln.POLICY_MAX_HTLC, int(oldSize/1000), int(size), true)
+	}
+
+	return nil
+}
+
+// sends keysend message with an invitation to install PeerSwap
+func sendKeysendInvite(nodeId string, amount int64, message string) (string, error) {
+	err := ln.SendKeysendMessage(nodeId, amount, message)
+	if err != nil {
+		return "", err
+	}
+
+	msg := "Keysend invitation sent to " + getNodeAlias(nodeId)
+	log.Println(msg)
+
+	return msg, nil
+}
+
+// updates Liquid auto swap-in settings
+func setAutoSwap(nowEnabled bool, newAmount, maxAmount, newPPM, newPct uint64) (string, error) {
+	if newPct > 100 {
+		return "", badInput("target pct cannot exceed 100")
+	}
+
+	t := "Automatic swap-ins "
+	msg := ""
+
+	// Log only if something changed
+	if nowEnabled && (!config.Config.AutoSwapEnabled ||
+		config.Config.AutoSwapThresholdAmount != newAmount ||
+		config.Config.AutoSwapMaxAmount != maxAmount ||
+		config.Config.AutoSwapThresholdPPM != newPPM ||
+		config.Config.AutoSwapTargetPct != newPct) {
+		t += "Enabled"
+		msg = t
+		log.Println(t)
+	}
+
+	if config.Config.AutoSwapEnabled && !nowEnabled {
+		t += "Disabled"
+		msg = t
+		log.Println(t)
+	}
+
+	config.Config.AutoSwapThresholdPPM = newPPM
+	config.Config.AutoSwapThresholdAmount = newAmount
+	config.Config.AutoSwapMaxAmount = maxAmount
+	config.Config.AutoSwapTargetPct = newPct
+	config.Config.AutoSwapEnabled = nowEnabled
+
+	// Save config
+	if err := config.Save(); err != nil {
+		return "", err
+	}
+
+	return msg, nil
+}
+
+// updates Liquid auto swap-out settings
+func setAutoSwapOut(nowEnabled bool, thresholdPct, minAmount, maxAmount, targetPct uint64) (string, error) {
+	if thresholdPct > 100 {
+		return "", badInput("high-water mark cannot exceed 100%")
+	}
+	if targetPct >= thresholdPct {
+		return "", badInput("target pct must be below the high-water mark")
+	}
+	if minAmount > maxAmount {
+		return "", badInput("threshold amount cannot exceed max amount")
+	}
+
+	t := "Automatic swap-outs "
+	msg := ""
+
+	// Log only if something changed
+	if nowEnabled && (!config.Config.AutoSwapOutEnabled ||
+		config.Config.AutoSwapOutThresholdPct != thresholdPct ||
+		config.Config.AutoSwapOutThresholdAmount != minAmount ||
+		config.Config.AutoSwapOutMaxAmount != maxAmount ||
+		config.Config.AutoSwapOutTargetPct != targetPct) {
+		t += "Enabled"
+		msg = t
+		log.Println(t)
+	}
+
+	if config.Config.AutoSwapOutEnabled && !nowEnabled {
+		t += "Disabled"
+		msg = t
+		log.Println(t)
+	}
+
+	config.Config.AutoSwapOutThresholdPct = thresholdPct
+	config.Config.AutoSwapOutThresholdAmount = minAmount
+	config.Config.AutoSwapOutMaxAmount = maxAmount
+	config.Config.AutoSwapOutTargetPct = targetPct
+	config.Config.AutoSwapOutEnabled = nowEnabled
+
+	// Save config
+	if err := config.Save(); err != nil {
+		return "", err
+	}
+
+	return msg, nil
+}
+
+// updates BTC auto swap settings, swap-outs share the Liquid ones
+func setAutoSwapBtc(inEnabled, outEnabled bool, thresholdAmount, maxAmount uint64) (string, error) {
+	if (inEnabled || outEnabled) && !config.Config.BitcoinSwaps {
+		return "", badInput("BTC swaps are disabled")
+	}
+
+	msg := ""
+	for _, change := range []struct {
+		name       string
+		wasEnabled bool
+		nowEnabled bool
+	}{
+		{"swap-ins", config.Config.AutoSwapBtcEnabled, inEnabled},
+		{"swap-outs", config.Config.AutoSwapOutBtcEnabled, outEnabled},
+	} {
+		// Log only if something changed
+		t := ""
+		if change.nowEnabled && !change.wasEnabled {
+			t = "Automatic BTC " + change.name + " Enabled"
+		} else if change.wasEnabled && !change.nowEnabled {
+			t = "Automatic BTC " + change.name + " Disabled"
+		}
+		if t != "" {
+			log.Println(t)
+			if msg != "" {
+				msg += ", "
+			}
+			msg += t
+		}
+	}
+
+	config.Config.AutoSwapBtcThresholdAmount = thresholdAmount
+	config.Config.AutoSwapBtcMaxAmount = maxAmount
+	config.Config.AutoSwapBtcEnabled = inEnabled
+	config.Config.AutoSwapOutBtcEnabled = outEnabled
+
+	// Save config
+	if err := config.Save(); err != nil {
+		return "", err
+	}
+
+	return msg, nil
+}
+
+// updates how many swaps run at once, how long a peer rests between
+// auto swaps and within how many days their expected cost must pay back
+func setAutoSwapQueue(maxConcurrent, cooldownHours, paybackDays uint64) (string, error) {
+	if maxConcurrent == 0 || maxConcurrent > 10 {
+		return "", badInput("max concurrent swaps must be between 1 and 10")
+	}
+	if cooldownHours > 24*30 {
+		return "", badInput("peer cooldown cannot exceed 30 days")
+	}
+	if paybackDays > 365 {
+		return "", badInput("max payback cannot exceed 365 days")
+	}
+
+	config.Config.AutoSwapMaxConcurrent = maxConcurrent
+	config.Config.AutoSwapPeerCooldownHours = cooldownHours
+	config.Config.AutoSwapMaxPaybackDays = paybackDays
+
+	// Save config
+	if err := config.Save(); err != nil {
+		return "", err
+	}
+
+	return "Auto swap queue settings saved", nil
+}
+
+// generates new Liquid address, bech32m or blech32 (confidential)
+func newLiquidAddress(label string, bech32m bool) (string, error) {
+	addressType := "blech32"
+	if bech32m {
+		addressType = "bech32m"
+	}
+
+	return liquid.GetNewAddress(label, addressType)
+}
+
+// updates PeerSwap policy for the peer
+// action: addPeer, removePeer, suspectPeer or unsuspectPeer
+func updatePeerPolicy(action, nodeId string) error {
+	if nodeId == "" {
+		return badInput("node id is blank")
+	}
+
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	switch action {
+	case "addPeer":
+		_, err = ps.AddPeer(client, nodeId)
+	case "removePeer":
+		_, err = ps.RemovePeer(client, nodeId)
+	case "suspectPeer":
+		_, err = ps.AddSusPeer(client, nodeId)
+	case "unsuspectPeer":
+		_, err = ps.RemoveSusPeer(client, nodeId)
+	default:
+		err = badInput("unknown action " + action)
+	}
+
+	return err
+}
+
+// initiates a swap, returns swap id
+// from/to: ln, lbtc or btc
+func startSwap(channelId, swapAmount uint64, from, to string) (string, error) {
+	asset := from
+	direction := "in"
+	if asset == "ln" {
+		asset = to
+		direction = "out"
+	}
+	if asset == "ln" || from != "ln" && to != "ln" {
+		return "", badInput("invalid combination of assets")
+	}
+
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	var id string
+
+	switch direction {
+	case "in":
+		id, err = ps.SwapIn(client, swapAmount, channelId, asset, false)
+	case "out":
+		id, err = ps.SwapOut(client, swapAmount, channelId, asset, false)
+	}
+
+	if err != nil {
+		e := err.Error()
+		if e == "Request timed out" || strings.HasPrefix(e, "rpc error: code = Unavailable desc = rpc timeout reached") {
+			// sometimes the swap is pending anyway
+			res, er := ps.ListActiveSwaps(client)
+			if er != nil {
+				log.Println("ListActiveSwaps:", er)
+				return "", er
+			}
+			activeSwaps := res.GetSwaps()
+			if len(activeSwaps) == 1 {
+				// follow this id
+				id = activeSwaps[0].Id
+			} else {
+				// return the original error
+				log.Println("doSwap:", err)
+				return "", err
+			}
+		} else {
+			log.Println("doSwap:", err)
+			return "", err
+		}
+	}
+
+	return id, nil
+}
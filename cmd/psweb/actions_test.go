@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"peerswap-web/cmd/psweb/ln"
+)
+
+func TestDeleteAutoFeeScheduleWithoutCustomRule(t *testing.T) {
+	const channelId = 301
+	saved := ln.AutoFeeDefaults
+	defer func() { ln.AutoFeeDefaults = saved }()
+
+	ln.AutoFeeDefaults.Schedules = []ln.AutoFeeSchedule{{StartMin: 60, EndMin: 120}}
+	delete(ln.AutoFee, channelId)
+
+	_, err := deleteAutoFeeSchedule(channelId, "", 0)
+	var inputErr *inputError
+	if !errors.As(err, &inputErr) {
+		t.Fatalf("got %v, want input error", err)
+	}
+	if len(ln.AutoFeeDefaults.Schedules) != 1 {
+		t.Fatal("default schedule deleted from a channel page")
+	}
+}
+
+func TestSaveAutoFeeRuleUpdateAllValidates(t *testing.T) {
+	const channelId, otherId = 311, 312
+	defer delete(ln.AutoFee, channelId)
+	defer delete(ln.AutoFee, otherId)
+
+	rule := ln.AutoFeeDefaults
+	ln.AutoFee[channelId] = &rule
+	other := ln.AutoFeeDefaults
+	other.RevenueMaxPPM, other.RevenueMinPPM, other.RevenueStepPPM, other.RevenueDays = 500, 100, 50, 14
+	ln.AutoFee[otherId] = &other
+
+	// valid for the edited rule, not for the other one
+	newRule := rule
+	newRule.RevenueMinPPM = 600
+
+	_, err := saveAutoFeeRule(channelId, newRule, true)
+	var inputErr *inputError
+	if !errors.As(err, &inputErr) {
+		t.Fatalf("got %v, want input error", err)
+	}
+	if ln.AutoFee[channelId].RevenueMinPPM != 0 || ln.AutoFee[otherId].RevenueMinPPM != 100 {
+		t.Error("rules changed by a rejected update")
+	}
+}
@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/liquid"
+	"peerswap-web/cmd/psweb/ln"
+	"peerswap-web/cmd/psweb/ps"
+
+	"github.com/elementsproject/peerswap/peerswaprpc"
+
+	"github.com/gorilla/mux"
+)
+
+// JSON API v1, mirrors submitHandler actions
+
+// error body returned by the JSON API
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// generic success body
+type ApiResult struct {
+	Message string `json:"message,omitempty"`
+	Id      string `json:"id,omitempty"`
+	Address string `json:"address,omitempty"`
+	TxId    string `json:"txId,omitempty"`
+}
+
+func registerApiRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeApiError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeApiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	})
+	api.Use(requireJSON)
+
+	// swaps
+	api.HandleFunc("/swaps", apiSwapHandler).Methods(http.MethodPost)
+
+	// peers
+	api.HandleFunc("/peers/{nodeId}/allowed", apiPeerPolicyHandler("addPeer", "removePeer")).Methods(http.MethodPut, http.MethodDelete)
+	api.HandleFunc("/peers/{nodeId}/suspicious", apiPeerPolicyHandler("suspectPeer", "unsuspectPeer")).Methods(http.MethodPut, http.MethodDelete)
+	api.HandleFunc("/peers/{nodeId}/keysend", apiKeysendHandler).Methods(http.MethodPost)
+
+	// channel policies
+	api.HandleFunc("/channels/{channelId}/feerate", apiFeeRateHandler).Methods(http.MethodPut)
+	api.HandleFunc("/channels/{channelId}/feebase", apiFeeBaseHandler).Methods(http.MethodPut)
+	api.HandleFunc("/channels/{channelId}/htlc", apiHtlcSizeHandler).Methods(http.MethodPut)
+
+	// auto fees
+	api.HandleFunc("/autofee/rules/{channelId}", apiAutoFeeRuleHandler).Methods(http.MethodPut, http.MethodDelete)
+	api.HandleFunc("/autofee/peers/{nodeId}", apiAutoFeePeerRuleHandler).Methods(http.MethodPut, http.MethodDelete)
+	api.HandleFunc("/autofee/templates/{name}", apiAutoFeeTemplateHandler).Methods(http.MethodPut, http.MethodDelete)
+	api.HandleFunc("/autofee/tags/{channelId}", apiAutoFeeTagHandler).Methods(http.MethodPut, http.MethodDelete)
+	api.HandleFunc("/autofee/enabled/{channelId}", apiAutoFeeToggleHandler).Methods(http.MethodPut)
+	api.HandleFunc("/autofee/budget", apiAutoFeeBudgetHandler).Methods(http.MethodPut)
+	api.HandleFunc("/backtest/{channelId}", apiBacktestHandler).Methods(http.MethodGet, http.MethodPost)
+
+	// auto swaps
+	api.HandleFunc("/autoswap", apiAutoSwapHandler).Methods(http.MethodPut)
+	api.HandleFunc("/autoswap/out", apiAutoSwapOutHandler).Methods(http.MethodPut)
+	api.HandleFunc("/autoswap/btc", apiAutoSwapBtcHandler).Methods(http.MethodPut)
+	api.HandleFunc("/autoswap/queue", apiAutoSwapQueueHandler).Methods(http.MethodPut)
+
+	// peg-ins and BTC withdrawals
+	api.HandleFunc("/pegin", apiPeginHandler).Methods(http.MethodPost, http.MethodDelete)
+	api.HandleFunc("/pegin/bumpfee", apiBumpFeeHandler).Methods(http.MethodPost)
+	api.HandleFunc("/pegin/external", apiExternalPeginHandler).Methods(http.MethodPut, http.MethodDelete)
+
+	// wallets
+	api.HandleFunc("/advertise/{asset}", apiAdvertiseHandler).Methods(http.MethodPut)
+	api.HandleFunc("/bitcoin/address", apiBitcoinAddressHandler).Methods(http.MethodPost)
+	api.HandleFunc("/liquid/address", apiLiquidAddressHandler).Methods(http.MethodPost)
+	api.HandleFunc("/liquid/send", apiSendLiquidHandler).Methods(http.MethodPost)
+
+	// read-only
+	api.HandleFunc("/peers", apiPeersHandler).Methods(http.MethodGet)
+	api.HandleFunc("/peers/{nodeId}", apiPeersHandler).Methods(http.MethodGet)
+	api.HandleFunc("/swaps", apiSwapsHandler).Methods(http.MethodGet)
+	api.HandleFunc("/swaps/{id}", apiSwapsHandler).Methods(http.MethodGet)
+	api.HandleFunc("/balances", apiBalancesHandler).Methods(http.MethodGet)
+	api.HandleFunc("/autoswap/evaluate", apiAutoSwapEvaluateHandler).Methods(http.MethodGet)
+}
+
+// state-changing requests must be JSON, so that cross-site
+// form posts and beacons cannot reach them
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && (r.Method == http.MethodPost || r.ContentLength != 0) {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				writeApiError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be application/json")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeApiError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ApiError{Code: code, Message: message})
+}
+
+// maps errors returned by the shared actions to HTTP status
+func apiFail(w http.ResponseWriter, err error) {
+	var inErr *inputError
+	if errors.As(err, &inErr) {
+		writeApiError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	writeApiError(w, http.StatusBadGateway, "backend_error", err.Error())
+}
+
+// decodes JSON request body, unknown fields are rejected
+func decodeBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badInput("invalid request body: " + err.Error())
+	}
+	return nil
+}
+
+func channelIdVar(r *http.Request) (uint64, error) {
+	channelId, err := strconv.ParseUint(mux.Vars(r)["channelId"], 10, 64)
+	if err != nil {
+		return 0, badInput("invalid channel id")
+	}
+	return channelId, nil
+}
+
+func apiSwapHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChannelId uint64 `json:"channelId"`
+		Amount    uint64 `json:"amount"`
+		From      string `json:"from"` // ln, lbtc or btc
+		To        string `json:"to"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	id, err := startSwap(req.ChannelId, req.Amount, req.From, req.To)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ApiResult{Id: id})
+}
+
+// PUT applies putAction, DELETE applies deleteAction
+func apiPeerPolicyHandler(putAction, deleteAction string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := deleteAction
+		if r.Method == http.MethodPut {
+			action = putAction
+		}
+
+		if err := updatePeerPolicy(action, mux.Vars(r)["nodeId"]); err != nil {
+			apiFail(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, ApiResult{Message: "Peer policy updated"})
+	}
+}
+
+func apiKeysendHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Amount  int64  `json:"amount"`
+		Message string `json:"message"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := sendKeysendInvite(mux.Vars(r)["nodeId"], req.Amount, req.Message)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+type apiFeeRequest struct {
+	PeerNodeId string `json:"peerNodeId"` // optional
+	Inbound    bool   `json:"inbound"`
+	Value      int64  `json:"value"`
+}
+
+func apiFeeRateHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := channelIdVar(r)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	var req apiFeeRequest
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if err := changeFeeRate(req.PeerNodeId, channelId, req.Value, req.Inbound); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: "Fee rate updated to " + formatSigned(req.Value)})
+}
+
+func apiFeeBaseHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := channelIdVar(r)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	var req apiFeeRequest
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if err := changeFeeBase(req.PeerNodeId, channelId, req.Value, req.Inbound); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: "Fee base updated to " + formatSigned(req.Value)})
+}
+
+func apiHtlcSizeHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := channelIdVar(r)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	var req struct {
+		PeerNodeId string `json:"peerNodeId"` // optional
+		IsMax      bool   `json:"isMax"`
+		Size       int64  `json:"size"` // sats
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if err := changeHtlcSize(req.PeerNodeId, channelId, req.Size, req.IsMax); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: "HTLC size updated to " + formatSigned(req.Size) + " sats"})
+}
+
+// channelId 0 is the default rule
+// PUT body is ln.AutoFeeParams, ?updateAll=true applies changes to all custom rules
+func apiAutoFeeRuleHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := channelIdVar(r)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		msg, err := deleteAutoFeeRule(channelId)
+		if err != nil {
+			apiFail(w, err)
+			return
+		}
+		if msg == "" {
+			writeApiError(w, http.StatusNotFound, "not_found", "no custom rule for this channel")
+			return
+		}
+		writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+		return
+	}
+
+	var newRule ln.AutoFeeParams
+	if err := decodeBody(r, &newRule); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := saveAutoFeeRule(channelId, newRule, r.URL.Query().Get("updateAll") == "true")
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+// rule for all channels with the peer
+// PUT body is ln.AutoFeeParams
+func apiAutoFeePeerRuleHandler(w http.ResponseWriter, r *http.Request) {
+	peerId := mux.Vars(r)["nodeId"]
+
+	if r.Method == http.MethodDelete {
+		msg, err := deleteAutoFeePeerRule(peerId)
+		if err != nil {
+			apiFail(w, err)
+			return
+		}
+		if msg == "" {
+			writeApiError(w, http.StatusNotFound, "not_found", "no rule for this peer")
+			return
+		}
+		writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+		return
+	}
+
+	var newRule ln.AutoFeeParams
+	if err := decodeBody(r, &newRule); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := saveAutoFeePeerRule(peerId, newRule)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+// PUT body is ln.AutoFeeParams, the template is added if missing
+func apiAutoFeeTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if r.Method == http.MethodDelete {
+		msg, err := deleteAutoFeeTemplate(name)
+		if err != nil {
+			apiFail(w, err)
+			return
+		}
+		if msg == "" {
+			writeApiError(w, http.StatusNotFound, "not_found", "no such template")
+			return
+		}
+		writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+		return
+	}
+
+	var newRule ln.AutoFeeParams
+	if err := decodeBody(r, &newRule); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if err := newRule.Validate(); err != nil {
+		apiFail(w, badInput(err.Error()))
+		return
+	}
+
+	ln.AutoFeeMu.Lock()
+	exists := ln.AutoFeeTemplates[name] != nil
+	ln.AutoFeeMu.Unlock()
+
+	if !exists {
+		if _, err := addAutoFeeTemplate(name); err != nil {
+			apiFail(w, err)
+			return
+		}
+	}
+
+	msg, err := saveAutoFeeTemplate(name, newRule)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+// PUT body is {"template": name}, DELETE removes the tag
+func apiAutoFeeTagHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := channelIdVar(r)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	var req struct {
+		Template string `json:"template"`
+	}
+	if r.Method == http.MethodPut {
+		if err := decodeBody(r, &req); err != nil {
+			apiFail(w, err)
+			return
+		}
+		if req.Template == "" {
+			apiFail(w, badInput("template cannot be blank"))
+			return
+		}
+	}
+
+	msg, err := tagChannels(req.Template, []uint64{channelId})
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+// GET replays the current rule, POST a candidate one
+func apiBacktestHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := channelIdVar(r)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	ln.AutoFeeMu.Lock()
+	current, _ := ln.AutoFeeAppliedRule(channelId, peerNodeId[channelId])
+	req := struct {
+		Days int              `json:"days"`
+		Rule ln.AutoFeeParams `json:"rule"`
+	}{
+		Days: 30,
+		Rule: *current,
+	}
+	ln.AutoFeeMu.Unlock()
+
+	if r.Method == http.MethodPost {
+		if err := decodeBody(r, &req); err != nil {
+			apiFail(w, err)
+			return
+		}
+	} else if d := r.URL.Query().Get("days"); d != "" {
+		req.Days, err = strconv.Atoi(d)
+		if err != nil {
+			apiFail(w, badInput("invalid days"))
+			return
+		}
+	}
+
+	result, err := runBacktest(channelId, &req.Rule, req.Days)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// channelId 0 toggles global setting, -1 all channels
+func apiAutoFeeToggleHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := strconv.ParseInt(mux.Vars(r)["channelId"], 10, 64)
+	if err != nil || channelId < -1 {
+		apiFail(w, badInput("invalid channel id"))
+		return
+	}
+
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := toggleAutoFee(channelId, req.Enabled)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+func apiAutoFeeBudgetHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DailyUpdates        int `json:"dailyUpdates"`
+		ChannelDailyUpdates int `json:"channelDailyUpdates"`
+		CoalesceMinutes     int `json:"coalesceMinutes"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := saveAutoFeeBudget(ln.UpdateBudget(req))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+func apiAutoSwapHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled         bool   `json:"enabled"`
+		ThresholdAmount uint64 `json:"thresholdAmount"`
+		MaxAmount       uint64 `json:"maxAmount"`
+		ThresholdPPM    uint64 `json:"thresholdPPM"`
+		TargetPct       uint64 `json:"targetPct"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := setAutoSwap(req.Enabled, req.ThresholdAmount, req.MaxAmount, req.ThresholdPPM, req.TargetPct)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+func apiAutoSwapOutHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled         bool   `json:"enabled"`
+		ThresholdPct    uint64 `json:"thresholdPct"`
+		ThresholdAmount uint64 `json:"thresholdAmount"`
+		MaxAmount       uint64 `json:"maxAmount"`
+		TargetPct       uint64 `json:"targetPct"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := setAutoSwapOut(req.Enabled, req.ThresholdPct, req.ThresholdAmount, req.MaxAmount, req.TargetPct)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+func apiAutoSwapBtcHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled         bool   `json:"enabled"`
+		OutEnabled      bool   `json:"outEnabled"`
+		ThresholdAmount uint64 `json:"thresholdAmount"`
+		MaxAmount       uint64 `json:"maxAmount"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := setAutoSwapBtc(req.Enabled, req.OutEnabled, req.ThresholdAmount, req.MaxAmount)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+func apiAutoSwapQueueHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxConcurrent  uint64 `json:"maxConcurrent"`
+		CooldownHours  uint64 `json:"cooldownHours"`
+		MaxPaybackDays uint64 `json:"maxPaybackDays"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	msg, err := setAutoSwapQueue(req.MaxConcurrent, req.CooldownHours, req.MaxPaybackDays)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+// POST starts peg-in or BTC withdrawal, DELETE acknowledges completed withdrawal
+func apiPeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		if err := deletePeginTxId(); err != nil {
+			apiFail(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ApiResult{Message: "Peg-in cleared"})
+		return
+	}
+
+	var params PeginParams
+	if err := decodeBody(r, &params); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if err := startPegin(&params); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ApiResult{
+		TxId:    config.Config.PeginTxId,
+		Address: config.Config.PeginAddress,
+	})
+}
+
+func apiBumpFeeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FeeRate float64 `json:"feeRate"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	bumped, err := bumpPeginFee(req.FeeRate)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if !bumped {
+		writeApiError(w, http.StatusConflict, "already_confirmed", "transaction has been confirmed already")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: "New transaction broadcasted", TxId: config.Config.PeginTxId})
+}
+
+// PUT registers external funding tx, DELETE cancels external peg-in
+func apiExternalPeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		if err := cancelExternalPegin(); err != nil {
+			apiFail(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ApiResult{Message: "External peg-in cancelled"})
+		return
+	}
+
+	var req struct {
+		TxId string `json:"txId"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if err := setExternalPegin(req.TxId); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{TxId: req.TxId})
+}
+
+// asset: liquid or bitcoin
+func apiAdvertiseHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	var (
+		msg string
+		err error
+	)
+
+	switch mux.Vars(r)["asset"] {
+	case "liquid":
+		msg, err = setAdvertiseLiquidBalance(req.Enabled)
+	case "bitcoin":
+		msg, err = setAdvertiseBitcoinBalance(req.Enabled)
+	default:
+		err = badInput("asset must be liquid or bitcoin")
+	}
+
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApiResult{Message: msg})
+}
+
+func apiBitcoinAddressHandler(w http.ResponseWriter, r *http.Request) {
+	addr, err := ln.NewAddress()
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ApiResult{Address: addr})
+}
+
+func apiLiquidAddressHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label   string `json:"label"`
+		Bech32m bool   `json:"bech32m"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	addr, err := newLiquidAddress(req.Label, req.Bech32m)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ApiResult{Address: addr})
+}
+
+func apiSendLiquidHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Address         string `json:"address"`
+		Amount          uint64 `json:"amount"`
+		Comment         string `json:"comment"`
+		SubtractFee     bool   `json:"subtractFee"`
+		IgnoreBlindFail bool   `json:"ignoreBlindFail"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	if req.Address == "" || req.Amount == 0 {
+		apiFail(w, badInput("address and amount are required"))
+		return
+	}
+
+	txid, err := liquid.SendToAddress(req.Address, req.Amount, req.Comment, req.SubtractFee, true, req.IgnoreBlindFail)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ApiResult{TxId: txid})
+}
+
+// lightning channel with policies and flow stats
+type ApiChannel struct {
+	Info           *ln.ChanneInfo      `json:"info"`
+	Stats          *ln.ChannelStats    `json:"stats"`      // flows since StatsSince
+	StatsSince     int64               `json:"statsSince"` // unix timestamp
+	Forwarding     *ln.ForwardingStats `json:"forwarding"` // 7d, 30d and 6m totals
+	AutoFeeEnabled bool                `json:"autoFeeEnabled"`
+	AutoFeeCustom  bool                `json:"autoFeeCustom"`   // has custom rule
+	AutoFeePeer    bool                `json:"autoFeePeerRule"` // follows the peer rule
+	AutoFeeTag     string              `json:"autoFeeTag"`      // template name
+}
+
+// lightning peer as displayed on the home and peer pages
+type ApiPeer struct {
+	NodeId          string          `json:"nodeId"`
+	Alias           string          `json:"alias"`
+	IsPeerSwap      bool            `json:"isPeerSwap"`
+	Allowed         bool            `json:"allowed"`
+	Suspicious      bool            `json:"suspicious"`
+	SwapsAllowed    bool            `json:"swapsAllowed"`
+	SupportedAssets []string        `json:"supportedAssets"`
+	LiquidBalance   *ln.BalanceInfo `json:"liquidBalance,omitempty"`  // advertised by peer
+	BitcoinBalance  *ln.BalanceInfo `json:"bitcoinBalance,omitempty"` // advertised by peer
+	Channels        []*ApiChannel   `json:"channels"`
+}
+
+// swap with realized costs
+type ApiSwap struct {
+	Swap          *peerswaprpc.PrettyPrintSwap `json:"swap"`
+	State         string                       `json:"state"` // success, failed or pending
+	Cost          int64                        `json:"cost"`  // sats, negative is income
+	CostBreakdown string                       `json:"costBreakdown"`
+}
+
+// a channel considered for auto swap-in
+type ApiSwapEvaluation struct {
+	PeerId      string   `json:"peerId"`
+	PeerAlias   string   `json:"peerAlias"`
+	ChannelId   uint64   `json:"channelId"`
+	LocalPct    uint64   `json:"localPct"`
+	Amount      uint64   `json:"amount"`
+	PPM         uint64   `json:"ppm"`
+	Cost        uint64   `json:"cost"`        // expected, sats
+	PaybackDays *float64 `json:"paybackDays"` // null if not evaluated or never
+	Reason      string   `json:"reason"`      // rejected because, empty if eligible
+	Selected    bool     `json:"selected"`
+}
+
+// dry run of the auto swap-in
+type ApiSwapInReport struct {
+	Asset           string               `json:"asset"`
+	Enabled         bool                 `json:"enabled"`
+	Balance         uint64               `json:"balance"`
+	Reserve         uint64               `json:"reserve"`
+	ThresholdAmount uint64               `json:"thresholdAmount"`
+	Status          string               `json:"status"`
+	Channels        []*ApiSwapEvaluation `json:"channels"`
+}
+
+// wallet balances and balances advertised by peers
+type ApiBalances struct {
+	LiquidBalance       uint64                     `json:"liquidBalance"`
+	BitcoinBalance      int64                      `json:"bitcoinBalance"`
+	MempoolFeeRate      float64                    `json:"mempoolFeeRate"`
+	AdvertiseLiquid     bool                       `json:"advertiseLiquid"`
+	AdvertiseBitcoin    bool                       `json:"advertiseBitcoin"`
+	PeerLiquidBalances  map[string]*ln.BalanceInfo `json:"peerLiquidBalances"`
+	PeerBitcoinBalances map[string]*ln.BalanceInfo `json:"peerBitcoinBalances"`
+}
+
+// lists PeerSwap peers, ?showall adds the other Lightning peers
+// /peers/{nodeId} returns a list with that single peer
+// ?since=unix overrides the default 6 months horizon of channel stats
+func apiPeersHandler(w http.ResponseWriter, r *http.Request) {
+	nodeId := mux.Vars(r)["nodeId"]
+	_, showAll := r.URL.Query()["showall"]
+
+	since := time.Now().AddDate(0, -6, 0).Unix()
+	if s := r.URL.Query().Get("since"); s != "" {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			apiFail(w, badInput("invalid since timestamp"))
+			return
+		}
+		since = ts
+	}
+
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	defer cleanup()
+
+	res, err := ps.ListPeers(client)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	peers := res.GetPeers()
+
+	res2, err := ps.ReloadPolicyFile(client)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	allowlistedPeers := res2.GetAllowlistedPeers()
+	suspiciousPeers := res2.GetSuspiciousPeerList()
+
+	cl, clean, er := ln.GetClient()
+	if er != nil {
+		apiFail(w, er)
+		return
+	}
+	defer clean()
+
+	var otherPeers []*peerswaprpc.PeerSwapPeer
+
+	if nodeId != "" {
+		if peer := findPeerById(peers, nodeId); peer != nil {
+			peers = []*peerswaprpc.PeerSwapPeer{peer}
+		} else {
+			// search among all Lightning peers
+			peers = nil
+			res, err := ln.ListPeers(cl, nodeId, nil)
+			if err != nil || len(res.GetPeers()) == 0 {
+				writeApiError(w, http.StatusNotFound, "not_found", "peer not found")
+				return
+			}
+			otherPeers = res.GetPeers()
+		}
+	} else if showAll {
+		// make a list of peerswap peers
+		var psIds []string
+		for _, peer := range peers {
+			psIds = append(psIds, peer.NodeId)
+		}
+
+		// get the remaining Lightning peers
+		res, err := ln.ListPeers(cl, "", &psIds)
+		if err != nil {
+			apiFail(w, err)
+			return
+		}
+		otherPeers = res.GetPeers()
+	}
+
+	result := []*ApiPeer{}
+
+	for i, peer := range append(peers, otherPeers...) {
+		liquidBalance, _ := ln.LiquidBalances.Read(peer.NodeId)
+		bitcoinBalance, _ := ln.BitcoinBalances.Read(peer.NodeId)
+
+		p := ApiPeer{
+			NodeId:          peer.NodeId,
+			Alias:           getNodeAlias(peer.NodeId),
+			IsPeerSwap:      i < len(peers),
+			Allowed:         stringIsInSlice(peer.NodeId, allowlistedPeers),
+			Suspicious:      stringIsInSlice(peer.NodeId, suspiciousPeers),
+			SwapsAllowed:    peer.SwapsAllowed,
+			SupportedAssets: peer.SupportedAssets,
+			LiquidBalance:   liquidBalance,
+			BitcoinBalance:  bitcoinBalance,
+			Channels:        []*ApiChannel{},
+		}
+
+		for _, ch := range peer.Channels {
+			info := ln.GetChannelInfo(cl, ch.ChannelId, peer.NodeId)
+			info.LocalBalance = ch.GetLocalBalance()
+			info.RemoteBalance = ch.GetRemoteBalance()
+			info.Active = ch.GetActive()
+			if info.Capacity > 0 {
+				info.LocalPct = info.LocalBalance * 100 / info.Capacity
+			}
+
+			ln.AutoFeeMu.Lock()
+			_, isCustom := ln.AutoFeeRule(ch.ChannelId)
+			enabled := ln.AutoFeeEnabledAll && ln.AutoFeeEnabled[ch.ChannelId]
+			hasPeerRule := ln.AutoFeePeerRule(peer.NodeId) != nil
+			tag := ln.AutoFeeTags[ch.ChannelId]
+			ln.AutoFeeMu.Unlock()
+
+			p.Channels = append(p.Channels, &ApiChannel{
+				Info:           info,
+				Stats:          ln.GetChannelStats(ch.ChannelId, uint64(since)),
+				StatsSince:     since,
+				Forwarding:     ln.GetForwardingStats(ch.ChannelId),
+				AutoFeeEnabled: enabled,
+				AutoFeeCustom:  isCustom,
+				AutoFeePeer:    hasPeerRule,
+				AutoFeeTag:     tag,
+			})
+		}
+
+		result = append(result, &p)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// lists swaps with their costs
+// filters: ?id=nodeId&state=success|failed|pending&role=sender|receiver
+// /swaps/{id} returns a list with that single swap
+func apiSwapsHandler(w http.ResponseWriter, r *http.Request) {
+	swapId := mux.Vars(r)["id"]
+
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	defer cleanup()
+
+	var swaps []*peerswaprpc.PrettyPrintSwap
+
+	if swapId != "" {
+		res, err := ps.GetSwap(client, swapId)
+		if err != nil {
+			writeApiError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		}
+		swaps = append(swaps, res.GetSwap())
+	} else {
+		res, err := ps.ListSwaps(client)
+		if err != nil {
+			apiFail(w, err)
+			return
+		}
+		swaps = res.GetSwaps()
+	}
+
+	query := r.URL.Query()
+	nodeId := query.Get("id")
+	state := query.Get("state")
+	role := query.Get("role")
+
+	result := []*ApiSwap{}
+
+	for _, swap := range swaps {
+		if nodeId != "" && swap.PeerNodeId != nodeId && swap.InitiatorNodeId != nodeId {
+			continue
+		}
+		if state != "" && simplifySwapState(swap.State) != state {
+			continue
+		}
+		if role != "" && swap.Role != role {
+			continue
+		}
+
+		cost, breakdown := swapCost(swap)
+
+		result = append(result, &ApiSwap{
+			Swap:          swap,
+			State:         simplifySwapState(swap.State),
+			Cost:          cost,
+			CostBreakdown: breakdown,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func apiBalancesHandler(w http.ResponseWriter, r *http.Request) {
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	defer cleanup()
+
+	res, err := ps.LiquidGetBalance(client)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	cl, clean, er := ln.GetClient()
+	if er != nil {
+		apiFail(w, er)
+		return
+	}
+	defer clean()
+
+	writeJSON(w, http.StatusOK, ApiBalances{
+		LiquidBalance:       res.GetSatAmount(),
+		BitcoinBalance:      ln.ConfirmedWalletBalance(cl),
+		MempoolFeeRate:      mempoolFeeRate,
+		AdvertiseLiquid:     ln.AdvertiseLiquidBalance,
+		AdvertiseBitcoin:    ln.AdvertiseBitcoinBalance,
+		PeerLiquidBalances:  ln.LiquidBalances.Copy(),
+		PeerBitcoinBalances: ln.BitcoinBalances.Copy(),
+	})
+}
+
+// explains what an auto swap-in would do now and why, ?asset=lbtc|btc
+func apiAutoSwapEvaluateHandler(w http.ResponseWriter, r *http.Request) {
+	asset := r.URL.Query().Get("asset")
+	if asset == "" {
+		asset = "lbtc"
+	}
+	if asset != "lbtc" && asset != "btc" {
+		apiFail(w, badInput("asset must be lbtc or btc"))
+		return
+	}
+
+	report, err := swapInReport(asset)
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+
+	result := ApiSwapInReport{
+		Asset:           report.Asset,
+		Enabled:         report.Enabled,
+		Balance:         report.Balance,
+		Reserve:         report.Reserve,
+		ThresholdAmount: report.ThresholdAmount,
+		Status:          report.Status,
+		Channels:        []*ApiSwapEvaluation{},
+	}
+
+	for _, e := range report.Channels {
+		evaluation := &ApiSwapEvaluation{
+			PeerId:    e.PeerId,
+			PeerAlias: e.PeerAlias,
+			ChannelId: e.ChannelId,
+			LocalPct:  e.LocalPct,
+			Amount:    e.Amount,
+			PPM:       e.PPM,
+			Cost:      e.Cost,
+			Reason:    e.Reason,
+			Selected:  e.Selected,
+		}
+		// JSON has no infinity
+		if e.Cost > 0 && !math.IsInf(e.Payback, 1) {
+			days := e.Payback
+			evaluation.PaybackDays = &days
+		}
+		result.Channels = append(result.Channels, evaluation)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
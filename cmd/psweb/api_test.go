@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireJSON(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := requireJSON(ok)
+
+	for _, tc := range []struct {
+		method      string
+		contentType string
+		body        string
+		want        int
+	}{
+		{http.MethodGet, "", "", http.StatusNoContent},
+		{http.MethodPost, "application/json", `{}`, http.StatusNoContent},
+		{http.MethodPost, "application/json; charset=utf-8", `{}`, http.StatusNoContent},
+		{http.MethodPut, "", "", http.StatusNoContent},
+		// cross-site form posts
+		{http.MethodPost, "application/x-www-form-urlencoded", "channelId=1", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", "", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "multipart/form-data; boundary=x", "--x--", http.StatusUnsupportedMediaType},
+	} {
+		r := httptest.NewRequest(tc.method, "/api/v1/swaps", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %q: got %d, want %d", tc.method, tc.contentType, w.Code, tc.want)
+		}
+	}
+}
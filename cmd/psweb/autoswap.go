@@ -0,0 +1,604 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
+	"peerswap-web/cmd/psweb/ln"
+	"peerswap-web/cmd/psweb/ps"
+	"peerswap-web/cmd/psweb/safemap"
+)
+
+// Auto swaps go through a queue. Every minute the best candidate of each
+// enabled direction and asset is queued, unless one is already waiting,
+// then waiting swaps start while fewer than AutoSwapMaxConcurrent auto
+// swaps are running, manual swaps do not take their slots. Failures are
+// classified: the transient ones are retried with backoff, refunds that
+// cost on-chain fees disable the policy, and every peer rests for
+// AutoSwapPeerCooldownHours after an auto swap.
+
+const (
+	// first retry delay, doubles with every attempt
+	AUTOSWAP_RETRY_MINUTES = 10
+	AUTOSWAP_MAX_ATTEMPTS  = 3
+	// waiting swaps are dropped after that, the next candidate is fresh
+	AUTOSWAP_QUEUE_HOURS = 6
+	// a started swap that peerswap cannot find is given up after that
+	AUTOSWAP_LOST_HOURS = 24
+	// decisions kept in memory for display
+	AUTOSWAP_HISTORY_SIZE = 50
+)
+
+// failure classes
+const (
+	FAILURE_TRANSIENT = iota // nothing was spent, retry
+	FAILURE_PEER             // cancelled before the opening tx, rest the peer
+	FAILURE_COSTLY           // refunded on-chain, stop the policy
+)
+
+// a queued or running auto swap
+type AutoSwapJob struct {
+	Direction string // swap-in or swap-out
+	SwapParams
+	QueuedTS  int64
+	NextTS    int64  // not started before
+	Attempts  int    // failed to start or retried
+	LastError string // of the last attempt
+	SwapId    string // while running
+	StartedTS int64
+}
+
+// a decision of the scheduler
+type AutoSwapEvent struct {
+	TimeStamp int64
+	Direction string
+	Asset     string
+	ChannelId uint64
+	PeerId    string
+	PeerAlias string
+	Amount    uint64
+	SwapId    string
+	Decision  string // queued, started, retry, completed, failed, dropped or held
+	Reason    string
+}
+
+var (
+	autoSwapJobs    = make(map[uint64]*AutoSwapJob) // by channel id
+	autoSwapEvents  []*AutoSwapEvent                // the latest, oldest first
+	autoSwapPeerTS  = make(map[string]int64)        // when the last auto swap with the peer ended
+	autoSwapMu      sync.Mutex
+	autoSwapQueue   = db.NewTable[*AutoSwapJob]("AutoSwapQueue") // by channel id
+	autoSwapHistory = db.NewLog[*AutoSwapEvent]("AutoSwapHistory")
+	// when the payback limit last held off a channel, by direction, asset and channel
+	paybackHeldTS = safemap.New[string, int64]()
+)
+
+func loadAutoSwaps() error {
+	jobs, err := autoSwapQueue.All()
+	if err != nil {
+		return err
+	}
+
+	autoSwapMu.Lock()
+	defer autoSwapMu.Unlock()
+
+	for _, job := range jobs {
+		autoSwapJobs[job.ChannelId] = job
+	}
+
+	return autoSwapHistory.ForEach(func(e *AutoSwapEvent) {
+		if e.Decision == "completed" || e.Decision == "failed" {
+			autoSwapPeerTS[e.PeerId] = e.TimeStamp
+		}
+		autoSwapEvents = append(autoSwapEvents, e)
+		if len(autoSwapEvents) > AUTOSWAP_HISTORY_SIZE {
+			autoSwapEvents = autoSwapEvents[1:]
+		}
+	})
+}
+
+// queued and running auto swaps, oldest first
+func autoSwapQueueCopy() []AutoSwapJob {
+	autoSwapMu.Lock()
+	defer autoSwapMu.Unlock()
+
+	var list []AutoSwapJob
+	for _, job := range autoSwapJobs {
+		list = append(list, *job)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].QueuedTS != list[j].QueuedTS {
+			return list[i].QueuedTS < list[j].QueuedTS
+		}
+		return list[i].ChannelId < list[j].ChannelId
+	})
+
+	return list
+}
+
+// the latest decisions, newest first
+func autoSwapHistoryCopy() []AutoSwapEvent {
+	autoSwapMu.Lock()
+	defer autoSwapMu.Unlock()
+
+	list := make([]AutoSwapEvent, len(autoSwapEvents))
+	for i, e := range autoSwapEvents {
+		list[len(list)-1-i] = *e
+	}
+	return list
+}
+
+func saveAutoSwapJob(job *AutoSwapJob) {
+	autoSwapMu.Lock()
+	autoSwapJobs[job.ChannelId] = job
+	autoSwapMu.Unlock()
+
+	if err := autoSwapQueue.Put(strconv.FormatUint(job.ChannelId, 10), job); err != nil {
+		log.Println(err)
+	}
+}
+
+func deleteAutoSwapJob(channelId uint64) {
+	autoSwapMu.Lock()
+	delete(autoSwapJobs, channelId)
+	autoSwapMu.Unlock()
+
+	if err := autoSwapQueue.Delete(strconv.FormatUint(channelId, 10)); err != nil {
+		log.Println(err)
+	}
+}
+
+func logAutoSwap(job *AutoSwapJob, decision, reason string) {
+	e := &AutoSwapEvent{
+		TimeStamp: time.Now().Unix(),
+		Direction: job.Direction,
+		Asset:     job.Asset,
+		ChannelId: job.ChannelId,
+		PeerId:    job.PeerId,
+		PeerAlias: job.PeerAlias,
+		Amount:    job.Amount,
+		SwapId:    job.SwapId,
+		Decision:  decision,
+		Reason:    reason,
+	}
+
+	autoSwapMu.Lock()
+	if decision == "completed" || decision == "failed" {
+		autoSwapPeerTS[job.PeerId] = e.TimeStamp
+	}
+	autoSwapEvents = append(autoSwapEvents, e)
+	if len(autoSwapEvents) > AUTOSWAP_HISTORY_SIZE {
+		autoSwapEvents = autoSwapEvents[1:]
+	}
+	autoSwapMu.Unlock()
+
+	if err := autoSwapHistory.Append(e); err != nil {
+		log.Println(err)
+	}
+}
+
+// why a new auto swap cannot target the channel yet, empty if it can:
+// something is queued for it or its peer, or the peer rests
+func autoSwapHold(peerId string, channelId uint64) string {
+	autoSwapMu.Lock()
+	defer autoSwapMu.Unlock()
+
+	for _, job := range autoSwapJobs {
+		if job.ChannelId == channelId {
+			return "queued"
+		}
+		if job.PeerId == peerId {
+			return "peer has a queued swap"
+		}
+	}
+
+	cooldown := int64(config.Config.AutoSwapPeerCooldownHours) * 3600
+	if autoSwapPeerTS[peerId] > time.Now().Unix()-cooldown {
+		return "peer cooling off"
+	}
+	return ""
+}
+
+func autoSwapAllowed(peerId string, channelId uint64) bool {
+	return autoSwapHold(peerId, channelId) == ""
+}
+
+// whether the policy already has a swap waiting to start
+func autoSwapWaiting(direction, asset string) bool {
+	autoSwapMu.Lock()
+	defer autoSwapMu.Unlock()
+
+	for _, job := range autoSwapJobs {
+		if job.SwapId == "" && job.Direction == direction && job.Asset == asset {
+			return true
+		}
+	}
+	return false
+}
+
+func autoSwapsEnabled() bool {
+	for _, asset := range []string{"lbtc", "btc"} {
+		if enabled, _, _ := autoSwapInPolicy(asset); enabled || autoSwapOutEnabled(asset) {
+			return true
+		}
+	}
+	return false
+}
+
+// what the failed auto swap cost, by its final state
+func classifySwapFailure(state string) int {
+	switch state {
+	case "State_ClaimedCoop", "State_ClaimedCsv":
+		// the opening tx was refunded
+		return FAILURE_COSTLY
+	case "State_SwapCanceled", "State_SendCancel":
+		return FAILURE_PEER
+	}
+	return FAILURE_TRANSIENT
+}
+
+// wait before the next attempt
+func retryDelay(attempts int) time.Duration {
+	return AUTOSWAP_RETRY_MINUTES * time.Minute << max(attempts-1, 0)
+}
+
+// own balance available for a swap-in of the asset and the reserve to keep
+func swapInBalance(asset string) (uint64, uint64, error) {
+	if asset == "btc" {
+		cl, clean, err := ln.GetClient()
+		if err != nil {
+			return 0, 0, err
+		}
+		defer clean()
+		return uint64(max(ln.ConfirmedWalletBalance(cl), 0)), swapInReserve(asset, btcSwapFeeRate()), nil
+	}
+
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cleanup()
+
+	res, err := ps.LiquidGetBalance(client)
+	if err != nil {
+		return 0, 0, err
+	}
+	return res.GetSatAmount(), swapInReserve(asset, 0), nil
+}
+
+// queues the best candidate of every enabled policy with none waiting
+func queueAutoSwaps() {
+	for _, asset := range []string{"lbtc", "btc"} {
+		if enabled, thresholdAmount, _ := autoSwapInPolicy(asset); enabled && !autoSwapWaiting("swap-in", asset) {
+			balance, reserve, err := swapInBalance(asset)
+			if err == nil && balance >= thresholdAmount && balance > reserve {
+				evaluations, err := evaluateSwapIn(asset)
+				if err == nil {
+					for _, e := range evaluations {
+						if e.Selected && e.Amount > 0 {
+							queueAutoSwap("swap-in", &e.SwapParams)
+						} else if e.Reason == "payback too long" {
+							logPaybackHold("swap-in", &e.SwapParams)
+						}
+					}
+				}
+			}
+		}
+
+		if autoSwapOutEnabled(asset) && !autoSwapWaiting("swap-out", asset) {
+			var candidate SwapParams
+			held := func(p *SwapParams) { logPaybackHold("swap-out", p) }
+			if err := searchSwapOutCandidate(asset, &candidate, held); err == nil && candidate.Amount > 0 {
+				queueAutoSwap("swap-out", &candidate)
+			}
+		}
+	}
+}
+
+func queueAutoSwap(direction string, candidate *SwapParams) {
+	now := time.Now().Unix()
+	job := &AutoSwapJob{
+		Direction:  direction,
+		SwapParams: *candidate,
+		QueuedTS:   now,
+		NextTS:     now,
+	}
+	saveAutoSwapJob(job)
+	logAutoSwap(job, "queued", "channel's PPM: "+formatWithThousandSeparators(candidate.PPM)+
+		", expected cost: "+formatWithThousandSeparators(candidate.Cost)+", payback: "+formatPayback(candidate.Payback))
+}
+
+// records once a day per channel that the payback limit holds off
+// an auto swap, so that the user learns why nothing is queued
+func logPaybackHold(direction string, p *SwapParams) {
+	key := direction + " " + p.Asset + " " + strconv.FormatUint(p.ChannelId, 10)
+	now := time.Now().Unix()
+	if ts, ok := paybackHeldTS.Read(key); ok && ts > now-86_400 {
+		return
+	}
+	paybackHeldTS.Write(key, now)
+
+	reason := "never pays back"
+	if !math.IsInf(p.Payback, 1) {
+		reason = "payback " + formatPayback(p.Payback) + " over max " +
+			strconv.FormatUint(config.Config.AutoSwapMaxPaybackDays, 10) + " days"
+	}
+	reason += ", expected cost: " + formatWithThousandSeparators(p.Cost)
+
+	logAutoSwap(&AutoSwapJob{Direction: direction, SwapParams: *p}, "held", reason)
+	log.Println("Auto " + direction + " with " + p.PeerAlias + " held: " + reason)
+}
+
+// removes the job and lets its peer rest
+func finishAutoSwap(job *AutoSwapJob, decision, reason string) {
+	deleteAutoSwapJob(job.ChannelId)
+	logAutoSwap(job, decision, reason)
+
+	if decision == "failed" {
+		log.Println("Auto " + job.Direction + " with " + job.PeerAlias + " failed: " + reason)
+		telegramSendMessage("🤖 Auto " + job.Direction + " with " + job.PeerAlias + " failed: " + reason)
+	} else {
+		log.Println("Auto " + job.Direction + " with " + job.PeerAlias + " " + decision)
+	}
+}
+
+// an attempt failed before anything was spent, try again later
+func retryAutoSwap(job *AutoSwapJob, reason string) {
+	job.Attempts++
+	if job.Attempts >= AUTOSWAP_MAX_ATTEMPTS {
+		finishAutoSwap(job, "failed", reason+", gave up after "+strconv.Itoa(job.Attempts)+" attempts")
+		return
+	}
+
+	delay := retryDelay(job.Attempts)
+	job.SwapId = ""
+	job.NextTS = time.Now().Add(delay).Unix()
+	job.LastError = reason
+	saveAutoSwapJob(job)
+	logAutoSwap(job, "retry", reason+", next attempt in "+delay.String())
+}
+
+// the swap ended in a failed state
+func failedAutoSwap(job *AutoSwapJob, state string) {
+	switch classifySwapFailure(state) {
+	case FAILURE_COSTLY:
+		// to avoid paying more fees
+		disableAutoSwapPolicy(job.Direction, job.Asset)
+		finishAutoSwap(job, "failed", state+", automatic "+swapAssetName(job.Asset)+" "+job.Direction+"s disabled")
+	case FAILURE_PEER:
+		finishAutoSwap(job, "failed", state+", the peer rests for "+strconv.FormatUint(config.Config.AutoSwapPeerCooldownHours, 10)+"h")
+	default:
+		retryAutoSwap(job, state)
+	}
+}
+
+func disableAutoSwapPolicy(direction, asset string) {
+	switch {
+	case direction == "swap-in" && asset == "btc":
+		config.Config.AutoSwapBtcEnabled = false
+	case direction == "swap-in":
+		config.Config.AutoSwapEnabled = false
+	case asset == "btc":
+		config.Config.AutoSwapOutBtcEnabled = false
+	default:
+		config.Config.AutoSwapOutEnabled = false
+	}
+	config.Save()
+	log.Println("Automatic " + swapAssetName(asset) + " " + direction + "s Disabled")
+}
+
+// follows the running auto swaps, queues new candidates
+// and starts the waiting ones while there are free slots
+func runAutoSwaps() {
+	if !autoSwapsEnabled() && len(autoSwapQueueCopy()) == 0 {
+		return
+	}
+
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	now := time.Now().Unix()
+
+	for _, job := range autoSwapQueueCopy() {
+		if job.SwapId == "" {
+			continue
+		}
+
+		res, err := ps.GetSwap(client, job.SwapId)
+		if err != nil {
+			log.Println("GetSwap:", err)
+			if job.StartedTS < now-AUTOSWAP_LOST_HOURS*3600 {
+				finishAutoSwap(&job, "failed", "swap "+job.SwapId+" not found")
+			}
+			continue
+		}
+
+		state := res.GetSwap().State
+		switch simplifySwapState(state) {
+		case "success":
+			finishAutoSwap(&job, "completed", "")
+		case "failed":
+			failedAutoSwap(&job, state)
+		}
+	}
+
+	queueAutoSwaps()
+
+	// auto swaps still running
+	active := uint64(0)
+	for _, job := range autoSwapQueueCopy() {
+		if job.SwapId != "" {
+			active++
+		}
+	}
+
+	for _, job := range autoSwapQueueCopy() {
+		if job.SwapId != "" || job.NextTS > now {
+			continue
+		}
+
+		if job.QueuedTS < now-AUTOSWAP_QUEUE_HOURS*3600 {
+			finishAutoSwap(&job, "dropped", "waited over "+strconv.Itoa(AUTOSWAP_QUEUE_HOURS)+"h")
+			continue
+		}
+
+		if active >= config.Config.AutoSwapMaxConcurrent {
+			// keep waiting for a free slot
+			continue
+		}
+
+		amount := job.Amount
+		swapId := ""
+
+		if job.Direction == "swap-in" {
+			enabled, thresholdAmount, _ := autoSwapInPolicy(job.Asset)
+			if !enabled {
+				finishAutoSwap(&job, "dropped", "swap-ins disabled")
+				continue
+			}
+
+			balance, reserve, err := swapInBalance(job.Asset)
+			if err != nil {
+				continue
+			}
+			if balance < thresholdAmount || balance <= reserve {
+				// spent by an earlier swap
+				finishAutoSwap(&job, "dropped", "balance below threshold")
+				continue
+			}
+
+			amount = min(amount, balance-reserve)
+			swapId, err = ps.SwapIn(client, amount, job.ChannelId, job.Asset, false)
+			if err != nil {
+				log.Println("AutoSwap error:", err)
+				retryAutoSwap(&job, err.Error())
+				continue
+			}
+		} else {
+			if !autoSwapOutEnabled(job.Asset) {
+				finishAutoSwap(&job, "dropped", "swap-outs disabled")
+				continue
+			}
+
+			swapId, err = ps.SwapOut(client, amount, job.ChannelId, job.Asset, false)
+			if err != nil {
+				log.Println("Auto Swap-Out error:", err)
+				retryAutoSwap(&job, err.Error())
+				continue
+			}
+		}
+
+		active++
+		job.Amount = amount
+		job.SwapId = swapId
+		job.StartedTS = now
+		saveAutoSwapJob(&job)
+		logAutoSwap(&job, "started", "")
+
+		// Log swap id
+		log.Println("Initiated Auto "+job.Direction+", id: "+swapId+", Peer: "+job.PeerAlias+", "+swapAssetName(job.Asset)+" Amount: "+formatWithThousandSeparators(amount)+", Channel's PPM: ", formatWithThousandSeparators(job.PPM))
+
+		// Send telegram
+		telegramSendMessage("🤖 Initiated Auto " + job.Direction + " with " + job.PeerAlias + " for " + formatWithThousandSeparators(amount) + " " + swapAssetName(job.Asset) + " sats. Channel's PPM: " + formatWithThousandSeparators(job.PPM))
+	}
+}
+
+// dry run of the automatic swap-in of the asset
+type SwapInReport struct {
+	Asset           string
+	Enabled         bool
+	Balance         uint64
+	Reserve         uint64
+	ThresholdAmount uint64
+	Status          string // what the next run would do
+	Channels        []*SwapEvaluation
+}
+
+// explains what an automatic swap-in of the asset would do now and why,
+// eligible channels first by PPM, then the rejected ones
+func swapInReport(asset string) (*SwapInReport, error) {
+	enabled, thresholdAmount, _ := autoSwapInPolicy(asset)
+
+	balance, reserve, err := swapInBalance(asset)
+	if err != nil {
+		return nil, err
+	}
+
+	evaluations, err := evaluateSwapIn(asset)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SwapInReport{
+		Asset:           asset,
+		Enabled:         enabled,
+		Balance:         balance,
+		Reserve:         reserve,
+		ThresholdAmount: thresholdAmount,
+		Channels:        evaluations,
+	}
+
+	var selected *SwapEvaluation
+	for _, e := range evaluations {
+		if e.Selected {
+			selected = e
+		}
+	}
+
+	switch {
+	case !enabled:
+		report.Status = "Disabled"
+	case autoSwapWaiting("swap-in", asset):
+		report.Status = "A swap-in is waiting in the queue"
+	case balance < thresholdAmount || balance <= reserve:
+		report.Status = "Balance below threshold"
+	case selected == nil:
+		report.Status = "No eligible channels"
+	default:
+		report.Status = "Would swap in " + formatWithThousandSeparators(min(selected.Amount, balance-reserve)) + " with " + selected.PeerAlias
+	}
+
+	sort.SliceStable(report.Channels, func(i, j int) bool {
+		a, b := report.Channels[i], report.Channels[j]
+		if (a.Reason == "") != (b.Reason == "") {
+			return a.Reason == ""
+		}
+		return a.PPM > b.PPM
+	})
+
+	return report, nil
+}
+
+// rejected channels by reason, as "not a sink: 3, inactive: 1"
+func (r *SwapInReport) RejectedSummary() string {
+	counts := make(map[string]int)
+	var reasons []string
+	for _, e := range r.Channels {
+		if e.Reason == "" {
+			continue
+		}
+		if counts[e.Reason] == 0 {
+			reasons = append(reasons, e.Reason)
+		}
+		counts[e.Reason]++
+	}
+
+	summary := ""
+	for _, reason := range reasons {
+		if summary != "" {
+			summary += ", "
+		}
+		summary += reason + ": " + strconv.Itoa(counts[reason])
+	}
+	return summary
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"peerswap-web/cmd/psweb/config"
+)
+
+func TestClassifySwapFailure(t *testing.T) {
+	for state, want := range map[string]int{
+		"State_ClaimedCoop":  FAILURE_COSTLY,
+		"State_ClaimedCsv":   FAILURE_COSTLY,
+		"State_SwapCanceled": FAILURE_PEER,
+		"State_SendCancel":   FAILURE_PEER,
+		"":                   FAILURE_TRANSIENT,
+	} {
+		if got := classifySwapFailure(state); got != want {
+			t.Errorf("%q: got %d, want %d", state, got, want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range []time.Duration{10 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("attempt %d: got %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestAutoSwapRetriesThenCoolsOff(t *testing.T) {
+	setupStateTest(t)
+	config.Config.AutoSwapPeerCooldownHours = 24
+	t.Cleanup(func() {
+		autoSwapJobs = make(map[uint64]*AutoSwapJob)
+		autoSwapPeerTS = make(map[string]int64)
+		autoSwapEvents = nil
+	})
+
+	const peerId, channelId = "02peer", 801
+
+	queueAutoSwap("swap-out", &SwapParams{PeerId: peerId, ChannelId: channelId, Asset: "lbtc", Amount: 1_000_000})
+	if autoSwapHold(peerId, channelId) != "queued" || autoSwapHold(peerId, 802) != "peer has a queued swap" || !autoSwapWaiting("swap-out", "lbtc") {
+		t.Fatal("queued swap does not hold off its peer")
+	}
+
+	for i := 1; i < AUTOSWAP_MAX_ATTEMPTS; i++ {
+		job := autoSwapQueueCopy()[0]
+		retryAutoSwap(&job, "peer offline")
+		if got := autoSwapQueueCopy(); len(got) != 1 || got[0].Attempts != i || got[0].NextTS <= time.Now().Unix() {
+			t.Fatalf("attempt %d: got %+v, want one job waiting to retry", i, got)
+		}
+	}
+
+	job := autoSwapQueueCopy()[0]
+	retryAutoSwap(&job, "peer offline")
+	if len(autoSwapQueueCopy()) != 0 {
+		t.Fatal("job still queued after the last attempt")
+	}
+
+	history := autoSwapHistoryCopy()
+	if len(history) != AUTOSWAP_MAX_ATTEMPTS+1 || history[0].Decision != "failed" || history[len(history)-1].Decision != "queued" {
+		t.Errorf("got %+v, want queued, retries and failed", history)
+	}
+
+	// the peer rests, other peers do not
+	if autoSwapHold(peerId, channelId) != "peer cooling off" {
+		t.Error("peer did not cool off")
+	}
+	if !autoSwapAllowed("03other", 803) {
+		t.Error("other peer held off")
+	}
+
+	// the queue and the cooldown survive a restart
+	queueAutoSwap("swap-in", &SwapParams{PeerId: "03other", ChannelId: 803, Asset: "btc", Amount: 2_000_000})
+	autoSwapJobs = make(map[uint64]*AutoSwapJob)
+	autoSwapPeerTS = make(map[string]int64)
+	autoSwapEvents = nil
+	if err := loadAutoSwaps(); err != nil {
+		t.Fatal(err)
+	}
+	if got := autoSwapQueueCopy(); len(got) != 1 || got[0].ChannelId != 803 {
+		t.Errorf("got %+v, want the swap-in queued", got)
+	}
+	if autoSwapAllowed(peerId, channelId) {
+		t.Error("cooldown lost on restart")
+	}
+}
+
+func TestRejectedSummary(t *testing.T) {
+	report := &SwapInReport{Channels: []*SwapEvaluation{
+		{Selected: true},
+		{Reason: "not a sink"},
+		{Reason: "inactive"},
+		{Reason: "not a sink"},
+		{},
+	}}
+
+	if got, want := report.RejectedSummary(), "not a sink: 2, inactive: 1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLogPaybackHoldOnceADay(t *testing.T) {
+	setupStateTest(t)
+	config.Config.AutoSwapMaxPaybackDays = 30
+	t.Cleanup(func() {
+		autoSwapEvents = nil
+		paybackHeldTS.Delete("swap-out lbtc 804")
+	})
+
+	p := &SwapParams{PeerAlias: "peer", PeerId: "02peer", ChannelId: 804, Asset: "lbtc", Amount: 1_000_000, Cost: 500, Payback: 45}
+	logPaybackHold("swap-out", p)
+	logPaybackHold("swap-out", p)
+
+	history := autoSwapHistoryCopy()
+	if len(history) != 1 || history[0].Decision != "held" || history[0].Reason != "payback 45.0 days over max 30 days, expected cost: 500" {
+		t.Fatalf("got %+v, want one held decision", history)
+	}
+	if !autoSwapAllowed("02peer", 804) {
+		t.Error("held channel cooling off")
+	}
+}
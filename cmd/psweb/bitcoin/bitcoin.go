@@ -10,6 +10,7 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"time"
 
 	"peerswap-web/cmd/psweb/config"
@@ -17,6 +18,9 @@ import (
 	"golang.org/x/net/proxy"
 )
 
+// failed calls, for metrics
+var RpcErrors atomic.Uint64
+
 // A RPCClient represents a JSON RPC client (over HTTP(s)).
 type RPCClient struct {
 	serverAddr string
@@ -125,9 +129,11 @@ func (c *RPCClient) call(method string, params interface{}, uriPath string) (rr
 // handleError handle error returned by client.call
 func handleError(err error, r *rpcResponse) error {
 	if err != nil {
+		RpcErrors.Add(1)
 		return err
 	}
 	if r != nil && r.Err != nil {
+		RpcErrors.Add(1)
 		return fmt.Errorf(r.Err.Message)
 	}
 
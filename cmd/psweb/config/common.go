@@ -52,6 +52,26 @@ type Configuration struct {
 	ServerIPs               string
 	SecurePort              string
 	Password                string
+	// HTTPS port for bearer token clients without a certificate, empty to disable
+	TokenPort string
+
+	// swap-outs from source channels above the high-water mark
+	AutoSwapOutEnabled         bool
+	AutoSwapOutThresholdPct    uint64 // high-water mark, local balance % of capacity
+	AutoSwapOutThresholdAmount uint64 // minimum swap amount
+	AutoSwapOutMaxAmount       uint64
+	AutoSwapOutTargetPct       uint64
+
+	// BTC auto swaps, the thresholds above are for L-BTC
+	AutoSwapBtcEnabled         bool
+	AutoSwapBtcThresholdAmount uint64 // on-chain balance to wait for
+	AutoSwapBtcMaxAmount       uint64
+	AutoSwapOutBtcEnabled      bool // with the swap-out settings above
+
+	// auto swap queue
+	AutoSwapMaxConcurrent     uint64 // running auto swaps, manual ones not counted
+	AutoSwapPeerCooldownHours uint64 // after an auto swap with the peer ends
+	AutoSwapMaxPaybackDays    uint64 // for the expected cost, 0 for no limit
 }
 
 var Config Configuration
@@ -86,6 +106,15 @@ func Load(dataDir string, network string) {
 	Config.AutoSwapMaxAmount = 10_000_000
 	Config.AutoSwapThresholdPPM = 300
 	Config.AutoSwapTargetPct = 70
+	Config.AutoSwapOutThresholdPct = 80
+	Config.AutoSwapOutThresholdAmount = 1_000_000
+	Config.AutoSwapOutMaxAmount = 10_000_000
+	Config.AutoSwapOutTargetPct = 50
+	Config.AutoSwapBtcThresholdAmount = 2_000_000
+	Config.AutoSwapBtcMaxAmount = 10_000_000
+	Config.AutoSwapMaxConcurrent = 1
+	Config.AutoSwapPeerCooldownHours = 24
+	Config.AutoSwapMaxPaybackDays = 0
 	Config.SecureConnection = false
 	Config.SecurePort = "1985"
 
@@ -1,25 +1,144 @@
 package db
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"os"
 	"path"
 	"peerswap-web/cmd/psweb/config"
+	"sync"
+	"time"
 
 	"go.etcd.io/bbolt"
 )
 
-// Save saves any object to the Bolt database
-func Save(bucketName string, key string, value interface{}) {
-	// Open the Bolt database
-	db, err := bbolt.Open(path.Join(config.Config.DataDir, "psweb.db"), 0600, nil)
+// returned by Load and repositories when nothing was saved yet
+var ErrNotFound = errors.New("not found")
+
+var (
+	// long-lived handle, opened once on start
+	bolt *bbolt.DB
+	// write-locked while the handle is swapped,
+	// background loops keep using it meanwhile
+	boltMu sync.RWMutex
+)
+
+// Open opens psweb.db in the data folder
+func Open() error {
+	boltMu.Lock()
+	defer boltMu.Unlock()
+	return openBolt()
+}
+
+func openBolt() error {
+	if bolt != nil {
+		return nil
+	}
+
+	db, err := bbolt.Open(dbPath(), 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	bolt = db
+	return nil
+}
+
+func dbPath() string {
+	return path.Join(config.Config.DataDir, "psweb.db")
+}
+
+// Close flushes and closes the database
+func Close() {
+	boltMu.Lock()
+	defer boltMu.Unlock()
+	closeBolt()
+}
+
+func closeBolt() {
+	if bolt != nil {
+		bolt.Close()
+		bolt = nil
+	}
+}
+
+// WriteTo writes a consistent copy of the open database
+func WriteTo(w io.Writer) error {
+	return view(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// Check opens a database file read-only and returns its schema version
+func Check(filePath string) (int, error) {
+	f, err := bbolt.Open(filePath, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	version := 0
+	err = f.View(func(tx *bbolt.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// Replace swaps psweb.db with the given file and reopens it,
+// the old database is kept as psweb.db.pre-import.bak
+func Replace(filePath string) error {
+	boltMu.Lock()
+	defer boltMu.Unlock()
+
+	if bolt == nil {
+		return errors.New("database is not open")
+	}
+
+	err := bolt.View(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(dbPath()+".pre-import.bak", 0600)
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	closeBolt()
+	if err := os.Rename(filePath, dbPath()); err != nil {
+		openBolt()
+		return err
+	}
+
+	return openBolt()
+}
+
+func update(fn func(tx *bbolt.Tx) error) error {
+	boltMu.RLock()
+	defer boltMu.RUnlock()
+
+	if bolt == nil {
+		return errors.New("database is not open")
 	}
-	defer db.Close()
+	return bolt.Update(fn)
+}
+
+func view(fn func(tx *bbolt.Tx) error) error {
+	boltMu.RLock()
+	defer boltMu.RUnlock()
+
+	if bolt == nil {
+		return errors.New("database is not open")
+	}
+	return bolt.View(fn)
+}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
+// Save saves any object to the Bolt database
+func Save(bucketName string, key string, value interface{}) error {
+	err := update(func(tx *bbolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
 		if err != nil {
 			return err
@@ -32,28 +151,197 @@ func Save(bucketName string, key string, value interface{}) {
 	})
 
 	if err != nil {
-		log.Printf("Failed to persist %s to db: %s", key, err)
+		return fmt.Errorf("failed to persist %s to db: %w", key, err)
 	}
+	return nil
 }
 
 // Load loads any object from the Bolt database
-func Load(bucketName string, key string, result interface{}) {
-	// Open the Bolt database
-	db, err := bbolt.Open(path.Join(config.Config.DataDir, "psweb.db"), 0600, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-
-	db.View(func(tx *bbolt.Tx) error {
+// returns ErrNotFound if the key was never saved
+func Load(bucketName string, key string, result interface{}) error {
+	return view(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
 		if b == nil {
-			return fmt.Errorf("bucket %s not found", bucketName)
+			return ErrNotFound
 		}
 		data := b.Get([]byte(key))
 		if data == nil {
-			return fmt.Errorf("key %s not found in bucket %s", key, bucketName)
+			return ErrNotFound
 		}
 		return json.Unmarshal(data, result)
 	})
 }
+
+// Delete removes the key from the Bolt database
+func Delete(bucketName string, key string) error {
+	return update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Value is a typed repository of a single object
+type Value[T any] struct {
+	bucket string
+	key    string
+}
+
+func NewValue[T any](bucket, key string) *Value[T] {
+	return &Value[T]{bucket: bucket, key: key}
+}
+
+// Get returns ErrNotFound if nothing was saved yet
+func (v *Value[T]) Get() (T, error) {
+	var result T
+	err := Load(v.bucket, v.key, &result)
+	return result, err
+}
+
+func (v *Value[T]) Put(value T) error {
+	return Save(v.bucket, v.key, value)
+}
+
+// Table is a typed repository of objects stored under own keys,
+// so that changing one does not rewrite the others
+type Table[T any] struct {
+	bucket string
+}
+
+func NewTable[T any](bucket string) *Table[T] {
+	return &Table[T]{bucket: bucket}
+}
+
+func (t *Table[T]) Put(key string, value T) error {
+	return Save(t.bucket, key, value)
+}
+
+func (t *Table[T]) Delete(key string) error {
+	return Delete(t.bucket, key)
+}
+
+// All returns every object keyed by its key
+func (t *Table[T]) All() (map[string]T, error) {
+	result := make(map[string]T)
+	err := view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(t.bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, data []byte) error {
+			var v T
+			if err := json.Unmarshal(data, &v); err != nil {
+				return fmt.Errorf("%s/%s: %w", t.bucket, k, err)
+			}
+			result[string(k)] = v
+			return nil
+		})
+	})
+	return result, err
+}
+
+// Log is a typed append-only repository,
+// adding an entry does not rewrite the history
+type Log[T any] struct {
+	bucket string
+}
+
+func NewLog[T any](bucket string) *Log[T] {
+	return &Log[T]{bucket: bucket}
+}
+
+func (l *Log[T]) Append(values ...T) error {
+	return update(func(tx *bbolt.Tx) error {
+		return appendTx(tx, l.bucket, values)
+	})
+}
+
+// ForEach calls fn with every entry in the order they were added
+func (l *Log[T]) ForEach(fn func(value T)) error {
+	return view(func(tx *bbolt.Tx) error {
+		return forEachTx(tx, l.bucket, fn)
+	})
+}
+
+func appendTx[T any](tx *bbolt.Tx, bucketName string, values []T) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err = b.Put(key, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func forEachTx[T any](tx *bbolt.Tx, bucketName string, fn func(value T)) error {
+	b := tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(_, data []byte) error {
+		var v T
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		fn(v)
+		return nil
+	})
+}
+
+// Append adds values to an append-only bucket under sequential keys
+// and saves the download cursor in the same transaction
+func Append[T any](bucketName string, values []T, cursor interface{}) error {
+	return update(func(tx *bbolt.Tx) error {
+		if err := appendTx(tx, bucketName, values); err != nil {
+			return err
+		}
+
+		c, err := tx.CreateBucketIfNotExists([]byte("Cursors"))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(cursor)
+		if err != nil {
+			return err
+		}
+		return c.Put([]byte(bucketName), data)
+	})
+}
+
+// LoadAll calls fn with every value of an append-only bucket
+// in the order they were added, returns the saved cursor
+func LoadAll[T any](bucketName string, cursor interface{}, fn func(value T)) error {
+	return view(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte("Cursors"))
+		if c == nil {
+			// nothing saved yet
+			return nil
+		}
+		data := c.Get([]byte(bucketName))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, cursor); err != nil {
+			return err
+		}
+
+		return forEachTx(tx, bucketName, fn)
+	})
+}
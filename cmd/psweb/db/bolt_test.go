@@ -0,0 +1,61 @@
+package db
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"peerswap-web/cmd/psweb/config"
+)
+
+// background loops keep writing while the database is replaced
+func TestReplaceWhileWriting(t *testing.T) {
+	openTestDB(t)
+
+	imported := path.Join(config.Config.DataDir, "import.db")
+	f, err := os.Create(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				if err := Save("Test", "Counter", i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	if err := Replace(imported); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+
+	// reopened
+	if err := Save("Test", "Counter", -1); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := Load("Test", "Counter", &n); err != nil || n != -1 {
+		t.Fatalf("loaded %d: %v", n, err)
+	}
+	if _, err := os.Stat(dbPath() + ".pre-import.bak"); err != nil {
+		t.Fatalf("no pre-import backup: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"peerswap-web/cmd/psweb/config"
+	"strconv"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	SCHEMA_BUCKET = "Schema"
+	SCHEMA_KEY    = "Version"
+)
+
+// rolls back a dry run transaction
+var errDryRun = errors.New("dry run")
+
+type Migration struct {
+	Version int
+	Name    string
+	// returns the number of records migrated
+	Up func(tx *bbolt.Tx) (int, error)
+}
+
+// append only, never renumber or edit released migrations
+var migrations = []Migration{
+	{1, "move custom AutoFee rules to AutoFeeRules", func(tx *bbolt.Tx) (int, error) {
+		return moveMap(tx, "AutoFees", "AutoFee", "AutoFeeRules")
+	}},
+	{2, "move AutoFeeEnabled flags to own bucket", func(tx *bbolt.Tx) (int, error) {
+		return moveMap(tx, "AutoFees", "AutoFeeEnabled", "AutoFeeEnabled")
+	}},
+	{3, "move AutoFeeLog to append-only log", migrateFeeLog},
+	{4, "move SwapRebates to own bucket", func(tx *bbolt.Tx) (int, error) {
+		return moveMap(tx, "Swaps", "SwapRebates", "SwapRebates")
+	}},
+	{5, "move txFee cache to TxFees", func(tx *bbolt.Tx) (int, error) {
+		return moveMap(tx, "Swaps", "txFee", "TxFees")
+	}},
+	{6, "merge ClaimJoin variables into State", migrateClaimJoin},
+}
+
+// SchemaVersion is the version this build expects
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func schemaVersion(tx *bbolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(SCHEMA_BUCKET))
+	if b == nil {
+		return 0, nil
+	}
+	data := b.Get([]byte(SCHEMA_KEY))
+	if data == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(data))
+}
+
+func setSchemaVersion(tx *bbolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(SCHEMA_BUCKET))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(SCHEMA_KEY), []byte(strconv.Itoa(version)))
+}
+
+// Migrate brings psweb.db to the current schema version
+// A backup copy is made before the first migration is applied
+// dryRun applies nothing and only logs what would be done
+func Migrate(dryRun bool) error {
+	boltMu.RLock()
+	defer boltMu.RUnlock()
+
+	if bolt == nil {
+		return errors.New("database is not open")
+	}
+
+	var (
+		current int
+		isEmpty = true
+	)
+
+	err := bolt.View(func(tx *bbolt.Tx) error {
+		var err error
+		current, err = schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		return tx.ForEach(func(_ []byte, _ *bbolt.Bucket) error {
+			isEmpty = false
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	latest := SchemaVersion()
+
+	if current > latest {
+		return fmt.Errorf("psweb.db schema v%d is newer than v%d supported by this version", current, latest)
+	}
+
+	if current == latest {
+		return nil
+	}
+
+	if isEmpty {
+		// new database, nothing to migrate
+		if dryRun {
+			log.Printf("Dry run: new database would start at schema v%d", latest)
+			return nil
+		}
+		return bolt.Update(func(tx *bbolt.Tx) error {
+			return setSchemaVersion(tx, latest)
+		})
+	}
+
+	if dryRun {
+		// apply all in one transaction and roll it back
+		err = bolt.Update(func(tx *bbolt.Tx) error {
+			for _, m := range migrations {
+				if m.Version <= current {
+					continue
+				}
+				n, err := m.Up(tx)
+				if err != nil {
+					return fmt.Errorf("migration v%d failed: %w", m.Version, err)
+				}
+				log.Printf("Dry run: migration v%d (%s) would move %d records", m.Version, m.Name, n)
+			}
+			return errDryRun
+		})
+		if errors.Is(err, errDryRun) {
+			return nil
+		}
+		return err
+	}
+
+	backup := path.Join(config.Config.DataDir, fmt.Sprintf("psweb.db.v%d.bak", current))
+	err = bolt.View(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(backup, 0600)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot backup psweb.db: %w", err)
+	}
+	log.Println("Saved psweb.db backup to", backup)
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		// each migration commits together with its version
+		err = bolt.Update(func(tx *bbolt.Tx) error {
+			n, err := m.Up(tx)
+			if err != nil {
+				return err
+			}
+			log.Printf("Applied migration v%d (%s), %d records", m.Version, m.Name, n)
+			return setSchemaVersion(tx, m.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("migration v%d failed: %w", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// moves a map saved under one key into a bucket with a key per entry
+// existing target bucket takes precedence over the legacy map
+func moveMap(tx *bbolt.Tx, fromBucket, fromKey, toBucket string) (int, error) {
+	from := tx.Bucket([]byte(fromBucket))
+	if from == nil {
+		return 0, nil
+	}
+	data := from.Get([]byte(fromKey))
+	if data == nil {
+		return 0, nil
+	}
+
+	n := 0
+	if tx.Bucket([]byte(toBucket)) == nil {
+		var legacy map[string]json.RawMessage
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return 0, err
+		}
+
+		to, err := tx.CreateBucket([]byte(toBucket))
+		if err != nil {
+			return 0, err
+		}
+
+		for key, value := range legacy {
+			if bytes.Equal(value, []byte("null")) {
+				// deleted entry
+				continue
+			}
+			if err := to.Put([]byte(key), value); err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
+
+	return n, from.Delete([]byte(fromKey))
+}
+
+// the log was a map of channel id to the array of events,
+// even older versions saved a single event per channel
+func migrateFeeLog(tx *bbolt.Tx) (int, error) {
+	from := tx.Bucket([]byte("AutoFees"))
+	if from == nil {
+		return 0, nil
+	}
+	data := from.Get([]byte("AutoFeeLog"))
+	if data == nil {
+		return 0, nil
+	}
+
+	n := 0
+	if tx.Bucket([]byte("AutoFeeLog")) == nil {
+		var legacy map[string]json.RawMessage
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return 0, err
+		}
+
+		var entries []json.RawMessage
+		for key, value := range legacy {
+			channelId, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				log.Printf("Dropped AutoFeeLog of channel %q, kept in the backup", key)
+				continue
+			}
+
+			var events []map[string]json.RawMessage
+			if json.Unmarshal(value, &events) != nil {
+				var event map[string]json.RawMessage
+				if json.Unmarshal(value, &event) != nil || event == nil {
+					log.Printf("Dropped AutoFeeLog of channel %d, kept in the backup: %s", channelId, value)
+					continue
+				}
+				// single event per channel
+				events = append(events, event)
+			}
+
+			for _, event := range events {
+				// flat entry with embedded event
+				event["ChannelId"] = json.RawMessage(strconv.FormatUint(channelId, 10))
+				entry, err := json.Marshal(event)
+				if err != nil {
+					return 0, err
+				}
+				entries = append(entries, entry)
+			}
+		}
+
+		if err := appendTx(tx, "AutoFeeLog", entries); err != nil {
+			return 0, err
+		}
+		n = len(entries)
+	}
+
+	return n, from.Delete([]byte("AutoFeeLog"))
+}
+
+// every variable had its own key
+func migrateClaimJoin(tx *bbolt.Tx) (int, error) {
+	b := tx.Bucket([]byte("ClaimJoin"))
+	if b == nil {
+		return 0, nil
+	}
+
+	fields := map[string]string{
+		"ClaimJoinHandler":   "ClaimJoinHandler",
+		"ClaimJoinHandlerTS": "ClaimJoinHandlerTS",
+		"ClaimBlockHeight":   "ClaimBlockHeight",
+		"JoinBlockHeight":    "JoinBlockHeight",
+		"ClaimStatus":        "ClaimStatus",
+		"MyRole":             "MyRole",
+		"keyToNodeId":        "KeyToNodeId",
+		"ClaimParties":       "ClaimParties",
+		"claimPSET":          "ClaimPSET",
+	}
+
+	state := make(map[string]json.RawMessage)
+	for oldKey, field := range fields {
+		if data := b.Get([]byte(oldKey)); data != nil {
+			state[field] = json.RawMessage(bytes.Clone(data))
+		}
+	}
+
+	if len(state) == 0 {
+		return 0, nil
+	}
+
+	if b.Get([]byte("State")) == nil {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return 0, err
+		}
+		if err := b.Put([]byte("State"), data); err != nil {
+			return 0, err
+		}
+	}
+
+	for oldKey := range fields {
+		if err := b.Delete([]byte(oldKey)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(state), nil
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"peerswap-web/cmd/psweb/config"
+
+	"go.etcd.io/bbolt"
+)
+
+type testEvent struct {
+	ChannelId uint64
+	TimeStamp int64
+	OldRate   int
+	NewRate   int
+}
+
+func openTestDB(t *testing.T) {
+	t.Helper()
+	config.Config.DataDir = t.TempDir()
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Close)
+}
+
+// psweb.db as saved before the schema was versioned
+func saveLegacy(t *testing.T) {
+	t.Helper()
+	for _, v := range []struct {
+		bucket, key string
+		value       interface{}
+	}{
+		{"AutoFees", "AutoFee", map[string]interface{}{"101": map[string]int{"NormalRate": 300}, "102": nil}},
+		{"AutoFees", "AutoFeeEnabled", map[string]bool{"101": true}},
+		{"AutoFees", "AutoFeeLog", map[string]interface{}{
+			"101": []testEvent{{TimeStamp: 1, OldRate: 100, NewRate: 200}, {TimeStamp: 2, OldRate: 200, NewRate: 300}},
+			// even older single event
+			"102": testEvent{TimeStamp: 3, OldRate: 500, NewRate: 400},
+			"103": "garbage",
+		}},
+		{"Swaps", "SwapRebates", map[string]int64{"swap1": 1000}},
+		{"Swaps", "txFee", map[string]int64{"tx1": 250}},
+		{"ClaimJoin", "ClaimBlockHeight", 850000},
+		{"ClaimJoin", "MyRole", "lead"},
+	} {
+		if err := Save(v.bucket, v.key, v.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func currentVersion(t *testing.T) int {
+	t.Helper()
+	version := 0
+	if err := view(func(tx *bbolt.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	openTestDB(t)
+	saveLegacy(t)
+
+	if err := Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := currentVersion(t); v != SchemaVersion() {
+		t.Fatalf("schema v%d, want v%d", v, SchemaVersion())
+	}
+	if _, err := os.Stat(path.Join(config.Config.DataDir, "psweb.db.v0.bak")); err != nil {
+		t.Fatalf("no backup: %v", err)
+	}
+
+	rules, err := NewTable[map[string]int]("AutoFeeRules").All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules["101"]["NormalRate"] != 300 {
+		t.Fatalf("rules %v", rules)
+	}
+
+	var events []testEvent
+	if err := NewLog[testEvent]("AutoFeeLog").ForEach(func(e testEvent) {
+		events = append(events, e)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	perChannel := make(map[uint64]int)
+	for _, e := range events {
+		perChannel[e.ChannelId]++
+	}
+	if len(events) != 3 || perChannel[101] != 2 || perChannel[102] != 1 {
+		t.Fatalf("fee log %+v", events)
+	}
+
+	var state map[string]interface{}
+	if err := Load("ClaimJoin", "State", &state); err != nil {
+		t.Fatal(err)
+	}
+	if state["MyRole"] != "lead" || state["ClaimBlockHeight"] != float64(850000) {
+		t.Fatalf("ClaimJoin state %v", state)
+	}
+
+	for _, legacy := range [][2]string{
+		{"AutoFees", "AutoFee"},
+		{"AutoFees", "AutoFeeEnabled"},
+		{"AutoFees", "AutoFeeLog"},
+		{"Swaps", "SwapRebates"},
+		{"Swaps", "txFee"},
+		{"ClaimJoin", "MyRole"},
+	} {
+		var v interface{}
+		if err := Load(legacy[0], legacy[1], &v); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s/%s left behind", legacy[0], legacy[1])
+		}
+	}
+
+	// up to date
+	if err := Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateDryRunRollsBack(t *testing.T) {
+	openTestDB(t)
+	saveLegacy(t)
+
+	if err := Migrate(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := currentVersion(t); v != 0 {
+		t.Fatalf("dry run set schema v%d", v)
+	}
+	if _, err := os.Stat(path.Join(config.Config.DataDir, "psweb.db.v0.bak")); !os.IsNotExist(err) {
+		t.Fatalf("dry run made a backup: %v", err)
+	}
+
+	var legacy map[string]interface{}
+	if err := Load("AutoFees", "AutoFeeLog", &legacy); err != nil || len(legacy) != 3 {
+		t.Fatalf("legacy log %v: %v", legacy, err)
+	}
+	if err := view(func(tx *bbolt.Tx) error {
+		for _, bucket := range []string{"AutoFeeRules", "AutoFeeEnabled", "AutoFeeLog", "SwapRebates", "TxFees"} {
+			if tx.Bucket([]byte(bucket)) != nil {
+				return errors.New(bucket + " created")
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the real run still applies everything
+	if err := Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t); v != SchemaVersion() {
+		t.Fatalf("schema v%d, want v%d", v, SchemaVersion())
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	openTestDB(t)
+
+	if err := Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t); v != SchemaVersion() {
+		t.Fatalf("schema v%d, want v%d", v, SchemaVersion())
+	}
+	if _, err := os.Stat(path.Join(config.Config.DataDir, "psweb.db.v0.bak")); !os.IsNotExist(err) {
+		t.Fatalf("backup of an empty database: %v", err)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	openTestDB(t)
+
+	if err := update(func(tx *bbolt.Tx) error {
+		return setSchemaVersion(tx, SchemaVersion()+1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(false); err == nil {
+		t.Fatal("migrated a newer schema")
+	}
+}
@@ -0,0 +1,121 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// event kinds
+const (
+	FORWARD = "forward" // settled forward
+	FEE     = "fee"     // fee rate change
+	SWAP    = "swap"    // swap state transition
+	PEGIN   = "pegin"   // peg-in confirmation progress
+	BALANCE = "balance" // peer advertised its balance
+)
+
+// slow subscribers lose events rather than block the publisher
+const BUFFER_SIZE = 64
+
+type Event struct {
+	Id        uint64 // increases with every event of this process
+	Kind      string
+	TimeStamp int64
+	Data      []byte // json
+}
+
+type Forward struct {
+	ChannelIdIn  uint64 `json:"channelIdIn"`
+	ChannelIdOut uint64 `json:"channelIdOut"`
+	AmountIn     uint64 `json:"amountIn"`
+	AmountOut    uint64 `json:"amountOut"`
+	FeeMsat      uint64 `json:"feeMsat"`
+}
+
+type Fee struct {
+	ChannelId uint64 `json:"channelId"`
+	OldRate   int    `json:"oldRate"`
+	NewRate   int    `json:"newRate"`
+	IsInbound bool   `json:"isInbound"`
+	IsManual  bool   `json:"isManual"`
+}
+
+type Swap struct {
+	Id       string `json:"id"`
+	OldState string `json:"oldState"`
+	NewState string `json:"newState"`
+}
+
+type Pegin struct {
+	TxId          string `json:"txId"`
+	Confirmations int32  `json:"confirmations"`
+	Target        int32  `json:"target"`
+	Status        string `json:"status"`
+}
+
+type Balance struct {
+	NodeId string `json:"nodeId"`
+	Asset  string `json:"asset"`
+	Amount uint64 `json:"amount"`
+}
+
+var (
+	mu          sync.Mutex
+	subscribers = make(map[chan *Event]struct{})
+	lastId      uint64
+)
+
+// Subscribe returns a channel receiving all published events
+// and a function to cancel the subscription
+func Subscribe() (chan *Event, func()) {
+	ch := make(chan *Event, BUFFER_SIZE)
+
+	mu.Lock()
+	subscribers[ch] = struct{}{}
+	mu.Unlock()
+
+	return ch, func() {
+		mu.Lock()
+		delete(subscribers, ch)
+		mu.Unlock()
+	}
+}
+
+// HasSubscribers tells if anyone is listening
+func HasSubscribers() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(subscribers) > 0
+}
+
+// Publish sends event to all subscribers without blocking
+func Publish(kind string, data any) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	lastId++
+	e := &Event{
+		Id:        lastId,
+		Kind:      kind,
+		TimeStamp: time.Now().Unix(),
+		Data:      b,
+	}
+
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+			// buffer full, drop
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
+	"peerswap-web/cmd/psweb/ln"
+
+	"github.com/alexmullins/zip"
+)
+
+// bump when the archive layout changes
+const STATE_ARCHIVE_VERSION = 1
+
+// files inside the state archive
+const (
+	MANIFEST_FILE = "manifest.json"
+	CONFIG_FILE   = "pswebconfig.json"
+	DB_FILE       = "psweb.db"
+)
+
+type stateManifest struct {
+	ArchiveVersion int
+	SchemaVersion  int
+	Implementation string
+	Chain          string
+	Version        string
+	Created        int64
+}
+
+// writes psweb.db and pswebconfig.json to an encrypted zip in the data folder
+// returns the file name
+func exportState(password string) (string, error) {
+	if password == "" {
+		return "", badInput("password cannot be blank")
+	}
+
+	fileName := time.Now().Format("2006-01-02") + "_psweb_state.zip"
+	filePath := filepath.Join(config.Config.DataDir, fileName)
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeStateArchive(f, password)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+func writeStateArchive(f io.Writer, password string) error {
+	zipw := zip.NewWriter(f)
+
+	manifest, err := json.MarshalIndent(stateManifest{
+		ArchiveVersion: STATE_ARCHIVE_VERSION,
+		SchemaVersion:  db.SchemaVersion(),
+		Implementation: ln.IMPLEMENTATION,
+		Chain:          config.Config.Chain,
+		Version:        VERSION,
+		Created:        time.Now().Unix(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	cfg, err := json.MarshalIndent(config.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range []struct {
+		name  string
+		write func(w io.Writer) error
+	}{
+		{MANIFEST_FILE, func(w io.Writer) error {
+			_, err := w.Write(manifest)
+			return err
+		}},
+		{CONFIG_FILE, func(w io.Writer) error {
+			_, err := w.Write(cfg)
+			return err
+		}},
+		{DB_FILE, db.WriteTo},
+	} {
+		w, err := zipw.Encrypt(entry.name, password)
+		if err != nil {
+			return err
+		}
+		if err = entry.write(w); err != nil {
+			return fmt.Errorf("cannot export %s: %w", entry.name, err)
+		}
+	}
+
+	return zipw.Close()
+}
+
+// validates the archive and replaces psweb.db and pswebconfig.json,
+// psweb must be restarted to load the restored state
+func importState(r io.ReaderAt, size int64, password string) error {
+	if password == "" {
+		return badInput("password cannot be blank")
+	}
+
+	zipr, err := zip.NewReader(r, size)
+	if err != nil {
+		return badInput("not a psweb state archive")
+	}
+
+	files := make(map[string][]byte)
+	for _, f := range zipr.File {
+		if !f.IsEncrypted() {
+			return badInput("archive is not encrypted: " + f.Name)
+		}
+		f.SetPassword(password)
+		rc, err := f.Open()
+		if err != nil {
+			return badInput("wrong password or corrupt archive")
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return badInput("wrong password or corrupt archive")
+		}
+		files[f.Name] = data
+	}
+
+	for _, name := range []string{MANIFEST_FILE, CONFIG_FILE, DB_FILE} {
+		if files[name] == nil {
+			return badInput("archive is missing " + name)
+		}
+	}
+
+	var manifest stateManifest
+	if err := json.Unmarshal(files[MANIFEST_FILE], &manifest); err != nil {
+		return badInput("invalid manifest: " + err.Error())
+	}
+
+	if manifest.ArchiveVersion > STATE_ARCHIVE_VERSION {
+		return badInput("archive was made by a newer version " + manifest.Version)
+	}
+	if manifest.Implementation != ln.IMPLEMENTATION {
+		return badInput("archive was made for " + manifest.Implementation)
+	}
+	if manifest.Chain != config.Config.Chain {
+		return badInput("archive was made for " + manifest.Chain)
+	}
+
+	var cfg config.Configuration
+	if err := json.Unmarshal(files[CONFIG_FILE], &cfg); err != nil {
+		return badInput("invalid " + CONFIG_FILE + ": " + err.Error())
+	}
+
+	// validate the database before touching the live one
+	tmpPath := filepath.Join(config.Config.DataDir, DB_FILE+".import")
+	if err := os.WriteFile(tmpPath, files[DB_FILE], 0600); err != nil {
+		return err
+	}
+
+	version, err := db.Check(tmpPath)
+	if err == nil && version > db.SchemaVersion() {
+		err = fmt.Errorf("schema v%d is newer than supported", version)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return badInput("invalid " + DB_FILE + ": " + err.Error())
+	}
+
+	if err := db.Replace(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	restoreConfig(&cfg)
+	if err := config.Save(); err != nil {
+		return errors.New("psweb.db restored, but " + CONFIG_FILE + " failed: " + err.Error())
+	}
+
+	return nil
+}
+
+// copies preferences and pending peg-in from the archive,
+// while connections, credentials and locations stay of this install
+func restoreConfig(cfg *config.Configuration) {
+	c := &config.Config
+
+	c.AllowSwapRequests = cfg.AllowSwapRequests
+	c.ColorScheme = cfg.ColorScheme
+	c.BitcoinApi = cfg.BitcoinApi
+	c.LiquidApi = cfg.LiquidApi
+	c.NodeApi = cfg.NodeApi
+	c.MaxHistory = cfg.MaxHistory
+	c.BitcoinSwaps = cfg.BitcoinSwaps
+	c.ElementsBackupAmount = cfg.ElementsBackupAmount
+
+	c.PeginClaimScript = cfg.PeginClaimScript
+	c.PeginTxId = cfg.PeginTxId
+	c.PeginReplacedTxId = cfg.PeginReplacedTxId
+	c.PeginAddress = cfg.PeginAddress
+	c.PeginAmount = cfg.PeginAmount
+	c.PeginFeeRate = cfg.PeginFeeRate
+	c.PeginClaimJoin = cfg.PeginClaimJoin
+
+	c.AutoSwapEnabled = cfg.AutoSwapEnabled
+	c.AutoSwapThresholdAmount = cfg.AutoSwapThresholdAmount
+	c.AutoSwapMaxAmount = cfg.AutoSwapMaxAmount
+	c.AutoSwapThresholdPPM = cfg.AutoSwapThresholdPPM
+	c.AutoSwapTargetPct = cfg.AutoSwapTargetPct
+
+	c.AutoSwapOutEnabled = cfg.AutoSwapOutEnabled
+	c.AutoSwapOutThresholdPct = cfg.AutoSwapOutThresholdPct
+	c.AutoSwapOutThresholdAmount = cfg.AutoSwapOutThresholdAmount
+	c.AutoSwapOutMaxAmount = cfg.AutoSwapOutMaxAmount
+	c.AutoSwapOutTargetPct = cfg.AutoSwapOutTargetPct
+
+	c.AutoSwapBtcEnabled = cfg.AutoSwapBtcEnabled
+	c.AutoSwapBtcThresholdAmount = cfg.AutoSwapBtcThresholdAmount
+	c.AutoSwapBtcMaxAmount = cfg.AutoSwapBtcMaxAmount
+	c.AutoSwapOutBtcEnabled = cfg.AutoSwapOutBtcEnabled
+
+	c.AutoSwapMaxConcurrent = cfg.AutoSwapMaxConcurrent
+	c.AutoSwapPeerCooldownHours = cfg.AutoSwapPeerCooldownHours
+	c.AutoSwapMaxPaybackDays = cfg.AutoSwapMaxPaybackDays
+}
+
+// imports an archive received as bytes
+func importStateBytes(data []byte, password string) error {
+	return importState(bytes.NewReader(data), int64(len(data)), password)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
+)
+
+func setupStateTest(t *testing.T) {
+	t.Helper()
+	saved := config.Config
+	t.Cleanup(func() { config.Config = saved })
+
+	config.Config = config.Configuration{
+		DataDir:      t.TempDir(),
+		Chain:        "mainnet",
+		ListenPort:   "1984",
+		ElementsPass: "rpcpass",
+		ColorScheme:  "dark",
+		PeginTxId:    "abcd",
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if err := db.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadNodeIds(t *testing.T) map[uint64]string {
+	t.Helper()
+	ids := make(map[uint64]string)
+	if err := db.Load("Peers", "NodeId", &ids); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestExportImportState(t *testing.T) {
+	setupStateTest(t)
+
+	if err := db.Save("Peers", "NodeId", map[uint64]string{1: "exported"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName, err := exportState("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(config.Config.DataDir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changed after the export
+	if err := db.Save("Peers", "NodeId", map[uint64]string{1: "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	config.Config.ColorScheme = "light"
+	config.Config.PeginTxId = ""
+	config.Config.ListenPort = "8080"
+	config.Config.ElementsPass = "newpass"
+
+	for _, password := range []string{"wrong", ""} {
+		err := importStateBytes(data, password)
+		var inputErr *inputError
+		if !errors.As(err, &inputErr) {
+			t.Fatalf("password %q: got %v, want input error", password, err)
+		}
+		if ids := loadNodeIds(t); ids[1] != "changed" {
+			t.Fatalf("password %q replaced the database: %v", password, ids)
+		}
+		if config.Config.ColorScheme != "light" {
+			t.Fatalf("password %q restored the config", password)
+		}
+	}
+
+	if err := importStateBytes(data, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := loadNodeIds(t); ids[1] != "exported" {
+		t.Fatalf("database not restored: %v", ids)
+	}
+	if _, err := os.Stat(filepath.Join(config.Config.DataDir, "psweb.db.pre-import.bak")); err != nil {
+		t.Fatalf("no pre-import backup: %v", err)
+	}
+
+	// preferences restored, this install kept
+	c := config.Config
+	if c.ColorScheme != "dark" || c.PeginTxId != "abcd" {
+		t.Fatalf("preferences not restored: %q %q", c.ColorScheme, c.PeginTxId)
+	}
+	if c.ListenPort != "8080" || c.ElementsPass != "newpass" {
+		t.Fatalf("install settings overwritten: %q %q", c.ListenPort, c.ElementsPass)
+	}
+}
+
+func TestImportStateWrongChain(t *testing.T) {
+	setupStateTest(t)
+
+	fileName, err := exportState("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(config.Config.DataDir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Config.Chain = "testnet"
+	var inputErr *inputError
+	if err := importStateBytes(data, "secret"); !errors.As(err, &inputErr) {
+		t.Fatalf("got %v, want input error", err)
+	}
+}
+
+// exports the state, then imports it into a fresh install of the same chain
+// and fails if any of the settings did not come back
+func testConfigRoundTrip(t *testing.T, settings ...string) {
+	t.Helper()
+
+	fileName, err := exportState("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(config.Config.DataDir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported := config.Config
+	config.Config = config.Configuration{DataDir: exported.DataDir, Chain: exported.Chain}
+	if err := importStateBytes(data, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range settings {
+		got := reflect.ValueOf(config.Config).FieldByName(name)
+		want := reflect.ValueOf(exported).FieldByName(name)
+		if !want.IsValid() || want.IsZero() {
+			t.Fatalf("%s is not set before the export", name)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestImportStateRestoresAutoSwaps(t *testing.T) {
+	setupStateTest(t)
+
+	c := &config.Config
+	c.AutoSwapEnabled = true
+	c.AutoSwapThresholdAmount = 2_000_000
+	c.AutoSwapMaxAmount = 10_000_000
+	c.AutoSwapThresholdPPM = 300
+	c.AutoSwapTargetPct = 60
+	c.AutoSwapOutEnabled = true
+	c.AutoSwapOutThresholdPct = 80
+	c.AutoSwapOutThresholdAmount = 200_000
+	c.AutoSwapOutMaxAmount = 5_000_000
+	c.AutoSwapOutTargetPct = 50
+	c.AutoSwapBtcEnabled = true
+	c.AutoSwapBtcThresholdAmount = 1_000_000
+	c.AutoSwapBtcMaxAmount = 20_000_000
+	c.AutoSwapOutBtcEnabled = true
+	c.AutoSwapMaxConcurrent = 3
+	c.AutoSwapPeerCooldownHours = 48
+	c.AutoSwapMaxPaybackDays = 90
+
+	testConfigRoundTrip(t,
+		"AutoSwapEnabled",
+		"AutoSwapThresholdAmount",
+		"AutoSwapMaxAmount",
+		"AutoSwapThresholdPPM",
+		"AutoSwapTargetPct",
+		"AutoSwapOutEnabled",
+		"AutoSwapOutThresholdPct",
+		"AutoSwapOutThresholdAmount",
+		"AutoSwapOutMaxAmount",
+		"AutoSwapOutTargetPct",
+		"AutoSwapBtcEnabled",
+		"AutoSwapBtcThresholdAmount",
+		"AutoSwapBtcMaxAmount",
+		"AutoSwapOutBtcEnabled",
+		"AutoSwapMaxConcurrent",
+		"AutoSwapPeerCooldownHours",
+		"AutoSwapMaxPaybackDays",
+	)
+}
@@ -11,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -162,45 +161,47 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type Page struct {
-		Authenticated     bool
-		AllowSwapRequests bool
-		BitcoinSwaps      bool
-		ErrorMessage      string
-		PopUpMessage      string
-		ColorScheme       string
-		LiquidBalance     uint64
-		ListPeers         string
-		OtherPeers        string
-		ListSwaps         string
-		BitcoinBalance    uint64
-		Filter            bool
-		MempoolFeeRate    float64
-		AutoSwapEnabled   bool
-		PeginPending      bool
-		ClaimJoinInvite   bool
-		AdvertiseLiquid   bool
-		AdvertiseBitcoin  bool
+		Authenticated      bool
+		AllowSwapRequests  bool
+		BitcoinSwaps       bool
+		ErrorMessage       string
+		PopUpMessage       string
+		ColorScheme        string
+		LiquidBalance      uint64
+		ListPeers          string
+		OtherPeers         string
+		ListSwaps          string
+		BitcoinBalance     uint64
+		Filter             bool
+		MempoolFeeRate     float64
+		AutoSwapEnabled    bool
+		AutoSwapOutEnabled bool
+		PeginPending       bool
+		ClaimJoinInvite    bool
+		AdvertiseLiquid    bool
+		AdvertiseBitcoin   bool
 	}
 
 	data := Page{
-		Authenticated:     config.Config.SecureConnection && config.Config.Password != "",
-		AllowSwapRequests: config.Config.AllowSwapRequests,
-		BitcoinSwaps:      config.Config.BitcoinSwaps,
-		ErrorMessage:      errorMessage,
-		PopUpMessage:      popupMessage,
-		MempoolFeeRate:    mempoolFeeRate,
-		ColorScheme:       config.Config.ColorScheme,
-		LiquidBalance:     satAmount,
-		ListPeers:         peerTable,
-		OtherPeers:        nonPeerTable,
-		ListSwaps:         listSwaps,
-		BitcoinBalance:    uint64(btcBalance),
-		Filter:            nodeId != "" || state != "" || role != "",
-		AutoSwapEnabled:   config.Config.AutoSwapEnabled,
-		PeginPending:      config.Config.PeginTxId != "" && config.Config.PeginClaimScript != "",
-		ClaimJoinInvite:   ln.ClaimJoinHandler != "",
-		AdvertiseLiquid:   ln.AdvertiseLiquidBalance,
-		AdvertiseBitcoin:  ln.AdvertiseBitcoinBalance,
+		Authenticated:      config.Config.SecureConnection && config.Config.Password != "",
+		AllowSwapRequests:  config.Config.AllowSwapRequests,
+		BitcoinSwaps:       config.Config.BitcoinSwaps,
+		ErrorMessage:       errorMessage,
+		PopUpMessage:       popupMessage,
+		MempoolFeeRate:     mempoolFeeRate,
+		ColorScheme:        config.Config.ColorScheme,
+		LiquidBalance:      satAmount,
+		ListPeers:          peerTable,
+		OtherPeers:         nonPeerTable,
+		ListSwaps:          listSwaps,
+		BitcoinBalance:     uint64(btcBalance),
+		Filter:             nodeId != "" || state != "" || role != "",
+		AutoSwapEnabled:    config.Config.AutoSwapEnabled,
+		AutoSwapOutEnabled: config.Config.AutoSwapOutEnabled,
+		PeginPending:       config.Config.PeginTxId != "" && config.Config.PeginClaimScript != "",
+		ClaimJoinInvite:    ln.ClaimJoinHandler != "",
+		AdvertiseLiquid:    ln.AdvertiseLiquidBalance,
+		AdvertiseBitcoin:   ln.AdvertiseBitcoinBalance,
 	}
 
 	// executing template named "homepage" with retries
@@ -269,39 +270,30 @@ func peerHandler(w http.ResponseWriter, r *http.Request) {
 	receiverInFee := int64(0)
 	receiverOutFee := int64(0)
 	cost := int64(0)
-	new := false
-	persist := false // have new tx fees to persist
 
 	for _, swap := range swaps {
 		switch swap.Type + swap.Role {
 		case "swap-insender":
 			if swap.PeerNodeId == id {
-				cost, _, new = swapCost(swap)
+				cost, _ = swapCost(swap)
 				senderInFee += cost
 			}
 		case "swap-outsender":
 			if swap.PeerNodeId == id {
-				cost, _, new = swapCost(swap)
+				cost, _ = swapCost(swap)
 				senderOutFee += cost
 			}
 		case "swap-outreceiver":
 			if swap.InitiatorNodeId == id {
-				cost, _, new = swapCost(swap)
+				cost, _ = swapCost(swap)
 				receiverOutFee += cost
 			}
 		case "swap-inreceiver":
 			if swap.InitiatorNodeId == id {
-				cost, _, new = swapCost(swap)
+				cost, _ = swapCost(swap)
 				receiverInFee += cost
 			}
 		}
-
-		persist = persist || new
-	}
-
-	// save to db
-	if persist {
-		db.Save("Swaps", "txFee", txFee)
 	}
 
 	senderInFeePPM := int64(0)
@@ -396,8 +388,12 @@ func peerHandler(w http.ResponseWriter, r *http.Request) {
 		keysendSats = max(keysendSats, info.OurMinHtlc)
 
 		// add AF info
-		if ln.AutoFeeEnabledAll && ln.AutoFeeEnabled[ch.ChannelId] {
-			rates, custom := ln.AutoFeeRatesSummary(ch.ChannelId)
+		ln.AutoFeeMu.Lock()
+		enabled := ln.AutoFeeEnabledAll && ln.AutoFeeEnabled[ch.ChannelId]
+		rates, custom := ln.AutoFeeRatesSummary(ch.ChannelId, peer.NodeId)
+		ln.AutoFeeMu.Unlock()
+
+		if enabled {
 			if custom {
 				rates = "*" + rates
 			}
@@ -448,7 +444,7 @@ func peerHandler(w http.ResponseWriter, r *http.Request) {
 	selectedChannel := peer.Channels[maxRemoteBalanceIndex].ChannelId
 	channelCapacity := peer.Channels[maxRemoteBalanceIndex].RemoteBalance + peer.Channels[maxRemoteBalanceIndex].LocalBalance
 
-	if ptr := ln.LiquidBalances[peer.NodeId]; ptr != nil {
+	if ptr, ok := ln.LiquidBalances.Read(peer.NodeId); ok {
 		if ptr.Amount < 100_000 {
 			peerLiquidBalance = "<100k"
 		} else {
@@ -468,7 +464,7 @@ func peerHandler(w http.ResponseWriter, r *http.Request) {
 
 	peerBitcoinBalance := ""
 	maxBitcoinSwapOut := uint64(0)
-	if ptr := ln.BitcoinBalances[peer.NodeId]; ptr != nil {
+	if ptr, ok := ln.BitcoinBalances.Read(peer.NodeId); ok {
 		if ptr.Amount < 100_000 {
 			peerBitcoinBalance = "<100k"
 		} else {
@@ -690,40 +686,49 @@ func bitcoinHandler(w http.ResponseWriter, r *http.Request) {
 	defer clean()
 
 	type Page struct {
-		Authenticated       bool
-		ErrorMessage        string
-		PopUpMessage        string
-		ColorScheme         string
-		BitcoinBalance      uint64
-		Outputs             *[]ln.UTXO
-		PeginTxId           string
-		IsPegin             bool // false for ordinary BTC withdrawal
-		IsExternal          bool
-		PeginAddress        string
-		PeginAmount         uint64
-		BitcoinApi          string
-		Confirmations       int32
-		TargetConfirmations int32
-		Progress            int32
-		Duration            string
-		FeeRate             float64
-		LiquidFeeRate       float64
-		MempoolFeeRate      float64
-		SuggestedFeeRate    float64
-		MinBumpFeeRate      float64
-		CanBump             bool
-		CanRBF              bool
-		IsCLN               bool
-		BitcoinAddress      string
-		AdvertiseEnabled    bool
-		BitcoinSwaps        bool
-		HasDiscountedvSize  bool
-		CanClaimJoin        bool
-		IsClaimJoin         bool
-		ClaimJoinStatus     string
-		HasClaimJoinPending bool
-		ClaimJoinETA        int
-		ClaimJointTimeLimit string
+		Authenticated        bool
+		ErrorMessage         string
+		PopUpMessage         string
+		ColorScheme          string
+		BitcoinBalance       uint64
+		Outputs              *[]ln.UTXO
+		PeginTxId            string
+		IsPegin              bool // false for ordinary BTC withdrawal
+		IsExternal           bool
+		PeginAddress         string
+		PeginAmount          uint64
+		BitcoinApi           string
+		Confirmations        int32
+		TargetConfirmations  int32
+		Progress             int32
+		Duration             string
+		FeeRate              float64
+		LiquidFeeRate        float64
+		MempoolFeeRate       float64
+		SuggestedFeeRate     float64
+		MinBumpFeeRate       float64
+		CanBump              bool
+		CanRBF               bool
+		IsCLN                bool
+		BitcoinAddress       string
+		AdvertiseEnabled     bool
+		BitcoinSwaps         bool
+		HasDiscountedvSize   bool
+		CanClaimJoin         bool
+		IsClaimJoin          bool
+		ClaimJoinStatus      string
+		HasClaimJoinPending  bool
+		ClaimJoinETA         int
+		ClaimJointTimeLimit  string
+		AutoSwapEnabled      bool
+		AutoSwapOutEnabled   bool
+		AutoSwapThreshold    uint64
+		AutoSwapMaxAmount    uint64
+		SwapFeeRate          float64 // sat/vB expected for BTC swaps
+		SwapInCost           uint64  // on-chain fee of a BTC swap-in
+		SwapOutCost          uint64  // on-chain fees of a BTC swap-out
+		AutoSwapCandidate    *SwapParams
+		AutoSwapOutCandidate *SwapParams
 	}
 
 	btcBalance := ln.ConfirmedWalletBalance(cl)
@@ -776,45 +781,66 @@ func bitcoinHandler(w http.ResponseWriter, r *http.Request) {
 
 	progress := confs * 100 / int32(maxConfs)
 
+	swapFeeRate := 0.0
+	var candidate, outCandidate SwapParams
+	if config.Config.BitcoinSwaps {
+		swapFeeRate = btcSwapFeeRate()
+		if err := findSwapInCandidate("btc", &candidate); err != nil {
+			log.Printf("unable findSwapInCandidate: %v", err)
+		}
+		if err := findSwapOutCandidate("btc", &outCandidate); err != nil {
+			log.Printf("unable findSwapOutCandidate: %v", err)
+		}
+	}
+
 	formattedDuration := time.Time{}.Add(duration).Format("15h 04m")
 	if duration < 0 {
 		formattedDuration = "Past due"
 	}
 
 	data := Page{
-		Authenticated:       config.Config.SecureConnection && config.Config.Password != "",
-		ErrorMessage:        errorMessage,
-		PopUpMessage:        popupMessage,
-		ColorScheme:         config.Config.ColorScheme,
-		BitcoinBalance:      uint64(btcBalance),
-		Outputs:             &utxos,
-		PeginTxId:           config.Config.PeginTxId,
-		IsPegin:             config.Config.PeginClaimScript != "",
-		IsExternal:          isExternal,
-		PeginAddress:        config.Config.PeginAddress,
-		PeginAmount:         uint64(config.Config.PeginAmount),
-		BitcoinApi:          config.Config.BitcoinApi,
-		Confirmations:       confs,
-		TargetConfirmations: maxConfs,
-		Progress:            progress,
-		Duration:            formattedDuration,
-		FeeRate:             config.Config.PeginFeeRate,
-		MempoolFeeRate:      mempoolFeeRate,
-		LiquidFeeRate:       liquid.EstimateFee(),
-		SuggestedFeeRate:    math.Ceil(fee*100) / 100,
-		MinBumpFeeRate:      math.Ceil((config.Config.PeginFeeRate+1)*100) / 100,
-		CanBump:             canBump,
-		CanRBF:              ln.CanRBF(),
-		IsCLN:               ln.IMPLEMENTATION == "CLN",
-		BitcoinAddress:      addr,
-		AdvertiseEnabled:    ln.AdvertiseBitcoinBalance,
-		BitcoinSwaps:        config.Config.BitcoinSwaps,
-		CanClaimJoin:        hasDiscountedvSize,
-		IsClaimJoin:         config.Config.PeginClaimJoin,
-		ClaimJoinStatus:     ln.ClaimStatus,
-		HasClaimJoinPending: ln.ClaimJoinHandler != "",
-		ClaimJointTimeLimit: cjTimeLimit,
-		ClaimJoinETA:        cjETA,
+		Authenticated:        config.Config.SecureConnection && config.Config.Password != "",
+		ErrorMessage:         errorMessage,
+		PopUpMessage:         popupMessage,
+		ColorScheme:          config.Config.ColorScheme,
+		BitcoinBalance:       uint64(btcBalance),
+		Outputs:              &utxos,
+		PeginTxId:            config.Config.PeginTxId,
+		IsPegin:              config.Config.PeginClaimScript != "",
+		IsExternal:           isExternal,
+		PeginAddress:         config.Config.PeginAddress,
+		PeginAmount:          uint64(config.Config.PeginAmount),
+		BitcoinApi:           config.Config.BitcoinApi,
+		Confirmations:        confs,
+		TargetConfirmations:  maxConfs,
+		Progress:             progress,
+		Duration:             formattedDuration,
+		FeeRate:              config.Config.PeginFeeRate,
+		MempoolFeeRate:       mempoolFeeRate,
+		LiquidFeeRate:        liquid.EstimateFee(),
+		SuggestedFeeRate:     math.Ceil(fee*100) / 100,
+		MinBumpFeeRate:       math.Ceil((config.Config.PeginFeeRate+1)*100) / 100,
+		CanBump:              canBump,
+		CanRBF:               ln.CanRBF(),
+		IsCLN:                ln.IMPLEMENTATION == "CLN",
+		BitcoinAddress:       addr,
+		AdvertiseEnabled:     ln.AdvertiseBitcoinBalance,
+		BitcoinSwaps:         config.Config.BitcoinSwaps,
+		CanClaimJoin:         hasDiscountedvSize,
+		IsClaimJoin:          config.Config.PeginClaimJoin,
+		ClaimJoinStatus:      ln.ClaimStatus,
+		HasClaimJoinPending:  ln.ClaimJoinHandler != "",
+		ClaimJointTimeLimit:  cjTimeLimit,
+		ClaimJoinETA:         cjETA,
+		AutoSwapEnabled:      config.Config.AutoSwapBtcEnabled,
+		AutoSwapOutEnabled:   config.Config.AutoSwapOutBtcEnabled,
+		AutoSwapThreshold:    config.Config.AutoSwapBtcThresholdAmount,
+		AutoSwapMaxAmount:    config.Config.AutoSwapBtcMaxAmount,
+		SwapFeeRate:          swapFeeRate,
+		SwapInCost:           uint64(math.Ceil(swapFeeRate * BTC_SWAP_IN_VSIZE)),
+		SwapOutCost:          uint64(math.Ceil(swapFeeRate * BTC_SWAP_OUT_VSIZE)),
+		AutoSwapCandidate:    &candidate,
+		AutoSwapOutCandidate: &outCandidate,
 	}
 
 	// executing template named "bitcoin"
@@ -845,24 +871,22 @@ func peginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		isPegin := r.FormValue("isPegin") == "true"
-		isExternal := r.FormValue("externalButton") != ""
-
-		var (
-			amount int64
-			fee    float64
-		)
-
-		selectedOutputs := r.Form["selected_outputs[]"]
-		subtractFeeFromAmount := r.FormValue("subtractfee") == "on"
+		params := PeginParams{
+			IsPegin:         r.FormValue("isPegin") == "true",
+			IsExternal:      r.FormValue("externalButton") != "",
+			SelectedOutputs: r.Form["selected_outputs[]"],
+			SubtractFee:     r.FormValue("subtractfee") == "on",
+			SendAddress:     r.FormValue("sendAddress"),
+			ClaimJoin:       r.FormValue("claimJoin") == "on",
+		}
 
-		if !isExternal {
+		if !params.IsExternal {
 			if r.FormValue("peginAmount") == "" {
 				redirectWithError(w, r, "/bitcoin?", errors.New("amount cannot be blank"))
 				return
 			}
 
-			amount, err = strconv.ParseInt(r.FormValue("peginAmount"), 10, 64)
+			params.Amount, err = strconv.ParseInt(r.FormValue("peginAmount"), 10, 64)
 			if err != nil {
 				redirectWithError(w, r, "/bitcoin?", err)
 				return
@@ -873,165 +897,14 @@ func peginHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			fee, err = strconv.ParseFloat(r.FormValue("feeRate"), 64)
-			if err != nil {
-				redirectWithError(w, r, "/bitcoin?", err)
-				return
-			}
-
-			totalAmount := int64(0)
-
-			if len(selectedOutputs) > 0 {
-				// check that outputs add up
-
-				cl, clean, er := ln.GetClient()
-				if er != nil {
-					redirectWithError(w, r, "/config?", er)
-					return
-				}
-				defer clean()
-
-				var utxos []ln.UTXO
-				ln.ListUnspent(cl, &utxos, int32(1))
-
-				for _, utxo := range utxos {
-					for _, output := range selectedOutputs {
-						vin := utxo.TxidStr + ":" + strconv.FormatUint(uint64(utxo.OutputIndex), 10)
-						if vin == output {
-							totalAmount += utxo.AmountSat
-						}
-					}
-				}
-
-				if amount > totalAmount {
-					redirectWithError(w, r, "/bitcoin?", errors.New("amount cannot exceed the sum of the selected outputs"))
-					return
-				}
-			}
-
-			if subtractFeeFromAmount {
-				if amount != totalAmount {
-					redirectWithError(w, r, "/bitcoin?", errors.New("amount should add up to the sum of the selected outputs for 'substract fee' option to be used"))
-					return
-				}
-			}
-
-			if !subtractFeeFromAmount && amount == totalAmount {
-				redirectWithError(w, r, "/bitcoin?", errors.New("'subtract fee' option should be used when amount adds up to the selected outputs"))
-				return
-			}
-		}
-
-		address := ""
-		claimScript := ""
-		config.Config.PeginClaimJoin = false
-
-		if isPegin {
-			// check that elements is fully synced
-			info, err := liquid.GetBlockchainInfo()
-			if err != nil {
-				redirectWithError(w, r, "/bitcoin?", err)
-				return
-			}
-			if info.InitialBlockDownload {
-				redirectWithError(w, r, "/bitcoin?", errors.New("elements initial block download is not complete"))
-				return
-			}
-
-			// test on a pre-existing tx that bitcon core can complete the peg
-			tx := "b61ec844027ce18fd3eb91fa7bed8abaa6809c4d3f6cf4952b8ebaa7cd46583a"
-			if config.Config.Chain == "testnet" {
-				// identify testnet blockchain
-				genesisHash, err := bitcoin.GetBlockHash(0)
-				if err != nil {
-					redirectWithError(w, r, "/bitcoin?", err)
-					return
-				}
-
-				if genesisHash == "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943" {
-					// testnet3
-					tx = "2c7ec5043fe8ee3cb4ce623212c0e52087d3151c9e882a04073cce1688d6fc1e"
-				} else {
-					// testnet4
-					tx = "0b387c3b7a8d9fad4d7a1ac2cba4958451c03d6c4fe63dfbe10cdb86d666cdd7"
-				}
-			}
-
-			_, err = bitcoin.GetTxOutProof(tx)
-			if err != nil {
-				// automatic fallback to getblock.io
-				config.Config.BitcoinHost = config.GetBlockIoHost()
-				config.Config.BitcoinUser = ""
-				config.Config.BitcoinPass = ""
-				_, err = bitcoin.GetTxOutProof(tx)
-				if err != nil {
-					redirectWithError(w, r, "/bitcoin?", errors.New("GetTxOutProof failed, check BitcoinHost in Config"))
-					return
-				} else {
-					// use getblock.io endpoint going forward
-					log.Println("Switching to getblock.io bitcoin host endpoint")
-					if err := config.Save(); err != nil {
-						redirectWithError(w, r, "/bitcoin?", err)
-						return
-					}
-				}
-			}
-
-			addr, err := liquid.GetPeginAddress()
-			if err != nil {
-				redirectWithError(w, r, "/bitcoin?", err)
-				return
-			}
-
-			address = addr.MainChainAddress
-			claimScript = addr.ClaimScript
-
-			if hasDiscountedvSize {
-				config.Config.PeginClaimJoin = r.FormValue("claimJoin") == "on"
-				if config.Config.PeginClaimJoin {
-					ln.ClaimStatus = "Awaiting funding tx to confirm"
-					db.Save("ClaimJoin", "ClaimStatus", ln.ClaimStatus)
-				}
-			}
-		} else {
-			address = r.FormValue("sendAddress")
-			claimScript = ""
-		}
-
-		if !isExternal {
-			label := "Liquid Pegin"
-			if !isPegin {
-				label = "BTC Withdrawal"
-			}
-
-			res, err := ln.SendCoinsWithUtxos(&selectedOutputs, address, amount, fee, subtractFeeFromAmount, label)
+			params.FeeRate, err = strconv.ParseFloat(r.FormValue("feeRate"), 64)
 			if err != nil {
 				redirectWithError(w, r, "/bitcoin?", err)
 				return
 			}
-
-			if isPegin {
-				log.Println("New Peg-in TxId:", res.TxId, "RawHex:", res.RawHex, "Claim script:", claimScript)
-				duration := time.Duration(10*peginBlocks) * time.Minute
-				formattedDuration := time.Time{}.Add(duration).Format("15h 04m")
-				telegramSendMessage("⏰ Started peg in " + formatWithThousandSeparators(uint64(res.AmountSat)) + " sats. Time left: " + formattedDuration + ". TxId: `" + res.TxId + "`")
-			} else {
-				log.Println("BTC withdrawal pending, TxId:", res.TxId, "RawHex:", res.RawHex)
-				telegramSendMessage("⛓️ BTC withdrawal pending: " + formatWithThousandSeparators(uint64(res.AmountSat)) + " sats. TxId: `" + res.TxId + "`")
-			}
-			config.Config.PeginAmount = res.AmountSat
-			config.Config.PeginTxId = res.TxId
-			config.Config.PeginFeeRate = res.ExactSatVb
-		} else {
-			log.Println("Peg-in address for external funding:", address, "Claim script:", claimScript)
-			config.Config.PeginTxId = "external"
 		}
 
-		config.Config.PeginClaimScript = claimScript
-		config.Config.PeginAddress = address
-		config.Config.PeginReplacedTxId = ""
-
-		if err := config.Save(); err != nil {
+		if err := startPegin(&params); err != nil {
 			redirectWithError(w, r, "/bitcoin?", err)
 			return
 		}
@@ -1057,44 +930,15 @@ func bumpfeeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if config.Config.PeginTxId == "" || config.Config.PeginTxId == "external" {
-			redirectWithError(w, r, "/bitcoin?", errors.New("no pending peg-in"))
-			return
-		}
-
-		confs, _ := peginConfirmations(config.Config.PeginTxId)
-		if confs > 0 {
-			// transaction has been confirmed already
-			http.Redirect(w, r, "/bitcoin", http.StatusSeeOther)
-			return
-		}
-
-		label := "Liquid Peg-in"
-		if config.Config.PeginClaimScript == "" {
-			label = "BTC Withdrawal"
-		}
-
-		res, err := ln.BumpPeginFee(fee, label)
+		bumped, err := bumpPeginFee(fee)
 		if err != nil {
 			redirectWithError(w, r, "/bitcoin?", err)
 			return
 		}
 
-		if ln.CanRBF() {
-			log.Println("RBF TxId:", res.TxId, "RawHex:", res.RawHex)
-			config.Config.PeginReplacedTxId = config.Config.PeginTxId
-			config.Config.PeginAmount = res.AmountSat
-			config.Config.PeginTxId = res.TxId
-		} else {
-			// txid not available, let's hope LND broadcasted it fine
-			log.Println("CPFP initiated")
-		}
-
-		// save the new rate, so the next bump cannot be lower
-		config.Config.PeginFeeRate = res.ExactSatVb
-
-		if err := config.Save(); err != nil {
-			redirectWithError(w, r, "/bitcoin?", err)
+		if !bumped {
+			// transaction has been confirmed already
+			http.Redirect(w, r, "/bitcoin", http.StatusSeeOther)
 			return
 		}
 
@@ -1115,6 +959,56 @@ type FeeLog struct {
 	NewRate   int64
 	IsInbound bool
 	IsManual  bool
+	Schedule  string
+	Policy    string
+}
+
+// rule template as listed on the af page
+type afTemplate struct {
+	Name     string
+	Channels int // tagged with it
+}
+
+// queued AutoFee update as listed on the af page
+type afPending struct {
+	ln.PendingFee
+	Alias   string
+	TimeAgo string
+	TimeUTC string
+	Status  string
+}
+
+// a queued auto swap or a scheduler decision on the liquid page
+type autoSwapRow struct {
+	SwapParams
+	Direction string
+	TimeAgo   string
+	TimeUTC   string
+	Status    string
+}
+
+// a channel considered for swap-in on the liquid page
+type autoSwapEvaluationRow struct {
+	SwapEvaluation
+	Payback string
+}
+
+func newAutoSwapRow(ts int64, direction string, params *SwapParams, status string) autoSwapRow {
+	return autoSwapRow{
+		SwapParams: *params,
+		Direction:  direction,
+		TimeAgo:    timePassedAgo(time.Unix(ts, 0)),
+		TimeUTC:    time.Unix(ts, 0).UTC().Format(time.RFC1123),
+		Status:     status,
+	}
+}
+
+// the af page the schedule forms were submitted from
+func afPage(r *http.Request) string {
+	if template := r.FormValue("template"); template != "" {
+		return "/af?template=" + template
+	}
+	return "/af?id=" + r.FormValue("channelId")
 }
 
 func afHandler(w http.ResponseWriter, r *http.Request) {
@@ -1129,7 +1023,18 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rule, isCustom := ln.AutoFeeRule(channelId)
+	// the page renders the rules themselves, keep AutoFee from changing them
+	ln.AutoFeeMu.Lock()
+	defer ln.AutoFeeMu.Unlock()
+
+	// template editing page
+	template := r.URL.Query().Get("template")
+	if ln.AutoFeeTemplates[template] == nil {
+		template = ""
+	} else {
+		channelId = 0
+		peerName = "Template " + template
+	}
 
 	// Get Lightning client
 	cl, clean, er := ln.GetClient()
@@ -1142,6 +1047,7 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 	var channelList []*ln.AutoFeeStatus
 	anyEnabled := false
 	peerId := ""
+	peerChannels := 0
 
 	// Get all public Lightning channels
 	res, err := ln.ListPeers(cl, "", nil)
@@ -1166,8 +1072,8 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 	for _, peer := range res.GetPeers() {
 		alias := getNodeAlias(peer.NodeId)
 		for _, ch := range peer.Channels {
-			rule, custom := ln.AutoFeeRatesSummary(ch.ChannelId)
-			af, _ := ln.AutoFeeRule(ch.ChannelId)
+			rule, custom := ln.AutoFeeRatesSummary(ch.ChannelId, peer.NodeId)
+			af, isPeerRule := ln.AutoFeeAppliedRule(ch.ChannelId, peer.NodeId)
 
 			if peerNodeId[ch.ChannelId] == "" {
 				peerNodeId[ch.ChannelId] = peer.NodeId
@@ -1182,11 +1088,14 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 
 			channelList = append(channelList, &ln.AutoFeeStatus{
 				Enabled:     ln.AutoFeeEnabled[ch.ChannelId],
+				DryRun:      ln.AutoFeeDryRun[ch.ChannelId],
 				Capacity:    ch.LocalBalance + ch.RemoteBalance,
 				Alias:       alias,
 				LocalPct:    ch.LocalBalance * 100 / (ch.LocalBalance + ch.RemoteBalance),
 				Rule:        rule,
 				Custom:      custom,
+				PeerRule:    isPeerRule,
+				Tag:         ln.AutoFeeTags[ch.ChannelId],
 				AutoFee:     af,
 				FeeRate:     outboundFeeRates[ch.ChannelId],
 				InboundRate: inboundFeeRates[ch.ChannelId],
@@ -1198,6 +1107,7 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 			if ch.ChannelId == channelId {
 				peerName = alias
 				peerId = peer.NodeId
+				peerChannels = len(peer.Channels)
 				capacity = ch.LocalBalance + ch.RemoteBalance
 				localPct = ch.LocalBalance * 100 / (ch.LocalBalance + ch.RemoteBalance)
 			}
@@ -1210,7 +1120,9 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 
 	// persist Node Ids to db for offline and closed channels retrieval
 	if persistNodeIds {
-		db.Save("Peers", "NodeId", peerNodeId)
+		if err := db.Save("Peers", "NodeId", peerNodeId); err != nil {
+			log.Println(err)
+		}
 	}
 
 	if peerId == "" {
@@ -1218,6 +1130,22 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 		channelId = 0
 	}
 
+	rule, isCustom := ln.AutoFeeRule(channelId)
+	if template != "" {
+		rule = ln.AutoFeeTemplates[template]
+	}
+	peerRule := ln.AutoFeePeerRule(peerId)
+	if peerRule != nil {
+		// overrides the channel rule
+		rule = peerRule
+	}
+	// the channel's tag, whether its rule is inherited from the template
+	tag := ""
+	if channelId > 0 {
+		tag = ln.AutoFeeTags[channelId]
+	}
+	_, activeSchedule := ln.ScheduledRule(rule, time.Now())
+
 	// sort by LocalPct ascending
 	sort.Slice(channelList, func(i, j int) bool {
 		return channelList[i].LocalPct < channelList[j].LocalPct
@@ -1253,8 +1181,8 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	startTS := time.Now().AddDate(0, 0, -days).Unix()
 
-	for id := range ln.AutoFeeLog {
-		for _, event := range ln.AutoFeeLog[id] {
+	for id, events := range ln.FeeLogCopy() {
+		for _, event := range events {
 			if event.TimeStamp > startTS {
 				// either all or specific channel
 				if channelId == 0 || channelId == id {
@@ -1269,6 +1197,8 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 						NewRate:   int64(event.NewRate),
 						IsInbound: event.IsInbound,
 						IsManual:  event.IsManual,
+						Schedule:  event.Schedule,
+						Policy:    event.Policy,
 					})
 				}
 			}
@@ -1280,6 +1210,31 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 		return feeLog[i].TimeStamp > feeLog[j].TimeStamp
 	})
 
+	var shadowLog []FeeLog
+
+	for id, events := range ln.ShadowLogSince(startTS) {
+		// either all or specific channel
+		if channelId == 0 || channelId == id {
+			for _, event := range events {
+				shadowLog = append(shadowLog, FeeLog{
+					TimeStamp: event.TimeStamp,
+					TimeUTC:   time.Unix(event.TimeStamp, 0).UTC().Format(time.RFC1123),
+					TimeAgo:   timePassedAgo(time.Unix(event.TimeStamp, 0)),
+					Alias:     getNodeAlias(peerNodeId[id]),
+					ChannelId: id,
+					OldRate:   int64(event.OldRate),
+					NewRate:   int64(event.NewRate),
+					IsInbound: event.IsInbound,
+				})
+			}
+		}
+	}
+
+	// sort by TimeStamp descending
+	sort.Slice(shadowLog, func(i, j int) bool {
+		return shadowLog[i].TimeStamp > shadowLog[j].TimeStamp
+	})
+
 	forwardsLog := ln.ForwardsLog(channelId, startTS)
 
 	for i, f := range *forwardsLog {
@@ -1289,6 +1244,23 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 		(*forwardsLog)[i].TimeUTC = time.Unix(int64(f.TS), 0).UTC().Format(time.RFC1123)
 	}
 
+	var pending []afPending
+	for _, p := range ln.PendingFeeUpdates(channelId) {
+		status := "Due"
+		if p.Deferred {
+			status = "Daily budget used up"
+		} else if wait := p.ReadyTS() - time.Now().Unix(); wait > 0 {
+			status = fmt.Sprintf("Coalescing for %d min", (wait+59)/60)
+		}
+		pending = append(pending, afPending{
+			PendingFee: p,
+			Alias:      getNodeAlias(peerNodeId[p.ChannelId]),
+			TimeAgo:    timePassedAgo(time.Unix(p.QueuedTS, 0)),
+			TimeUTC:    time.Unix(p.QueuedTS, 0).UTC().Format(time.RFC1123),
+			Status:     status,
+		})
+	}
+
 	type Page struct {
 		Authenticated  bool
 		ErrorMessage   string
@@ -1305,17 +1277,45 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 		GlobalEnabled  bool
 		ChannelList    []*ln.AutoFeeStatus
 		Params         *ln.AutoFeeParams
+		ActiveSchedule int // index or -1
+		Weekdays       []string
 		CustomRule     bool
-		Enabled        bool // for the displayed channel
-		AnyEnabled     bool // for any channel
+		PeerRule       bool   // applies to all channels with the peer
+		PeerChannels   int    // channels with the peer
+		Template       string // edited template
+		Tag            string // template the displayed channel is tagged with
+		Templates      []afTemplate
+		TemplateNames  []string // suggested for new templates
+		Enabled        bool     // for the displayed channel
+		AnyEnabled     bool     // for any channel
 		HasInboundFees bool
 		Chart          *[]ln.DataPoint
 		FeeLog         []FeeLog
+		ShadowLog      []FeeLog
+		Pending        []afPending // waiting to be sent
+		Budget         ln.UpdateBudget
+		UpdatesToday   int  // by AutoFee in the last 24h, all channels
+		ChannelUpdates int  // by AutoFee in the last 24h, the displayed channel
+		DryRun         bool // for the displayed channel
 		ForwardsLog    *[]ln.DataPoint
+		Revenue        []*ln.RateRevenue // by outbound rate, in revenue mode
 		RedColor       string
 		GreenColor     string
 	}
 
+	var templates []afTemplate
+	for _, name := range ln.TemplateList() {
+		templates = append(templates, afTemplate{
+			Name:     name,
+			Channels: len(ln.TaggedChannels(name)),
+		})
+	}
+
+	var revenue []*ln.RateRevenue
+	if channelId > 0 && rule.RevenueMaxPPM > 0 {
+		revenue = ln.RevenueByRate(channelId, int(feeRate), rule.RevenueDays)
+	}
+
 	redColor := "red"
 	greenColor := "green"
 	if config.Config.ColorScheme == "dark" {
@@ -1339,13 +1339,28 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 		ChannelId:      channelId,
 		ChannelList:    channelList,
 		Params:         rule,
+		ActiveSchedule: activeSchedule,
+		Weekdays:       ln.Weekdays,
 		CustomRule:     isCustom,
+		PeerRule:       peerRule != nil,
+		PeerChannels:   peerChannels,
+		Template:       template,
+		Tag:            tag,
+		Templates:      templates,
+		TemplateNames:  ln.TemplateNames,
 		Enabled:        ln.AutoFeeEnabled[channelId],
 		AnyEnabled:     anyEnabled,
 		HasInboundFees: ln.HasInboundFees(),
 		Chart:          chart,
 		FeeLog:         feeLog,
+		ShadowLog:      shadowLog,
+		Pending:        pending,
+		Budget:         ln.AutoFeeBudget,
+		UpdatesToday:   ln.UpdatesToday(0),
+		ChannelUpdates: ln.UpdatesToday(channelId),
+		DryRun:         ln.AutoFeeDryRun[channelId],
 		ForwardsLog:    forwardsLog,
+		Revenue:        revenue,
 		RedColor:       redColor,
 		GreenColor:     greenColor,
 	}
@@ -1354,6 +1369,158 @@ func afHandler(w http.ResponseWriter, r *http.Request) {
 	executeTemplate(w, "af", data)
 }
 
+// replays the channel's forwards with the candidate rule
+func runBacktest(channelId uint64, rule *ln.AutoFeeParams, days int) (*ln.BacktestResult, error) {
+	cl, clean, err := ln.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	defer clean()
+
+	res, err := ln.ListPeers(cl, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	outboundFeeRates := make(map[uint64]int64)
+	inboundFeeRates := make(map[uint64]int64)
+	ln.FeeReport(cl, outboundFeeRates, inboundFeeRates)
+
+	for _, peer := range res.GetPeers() {
+		for _, ch := range peer.Channels {
+			if ch.ChannelId == channelId {
+				result, err := ln.Backtest(channelId, rule, ch.LocalBalance+ch.RemoteBalance, ch.LocalBalance, int(outboundFeeRates[channelId]), days)
+				if err != nil {
+					return nil, badInput(err.Error())
+				}
+				return result, nil
+			}
+		}
+	}
+
+	return nil, badInput("channel not found")
+}
+
+// candidate rule fields can be passed as query parameters
+func backtestRule(r *http.Request, rule ln.AutoFeeParams) (*ln.AutoFeeParams, error) {
+	fields := map[string]*int{
+		"lowLiqPct":         &rule.LowLiqPct,
+		"lowLiqRate":        &rule.LowLiqRate,
+		"excessPct":         &rule.ExcessPct,
+		"normalRate":        &rule.NormalRate,
+		"excessRate":        &rule.ExcessRate,
+		"inactivityDays":    &rule.InactivityDays,
+		"inactivityDropPPM": &rule.InactivityDropPPM,
+		"inactivityDropPct": &rule.InactivityDropPct,
+		"coolOffHours":      &rule.CoolOffHours,
+	}
+
+	for name, field := range fields {
+		keys, ok := r.URL.Query()[name]
+		if ok && len(keys[0]) > 0 {
+			value, err := strconv.Atoi(keys[0])
+			if err != nil {
+				return nil, badInput("invalid " + name)
+			}
+			*field = value
+		}
+	}
+
+	return &rule, nil
+}
+
+func backtestHandler(w http.ResponseWriter, r *http.Request) {
+	channelId := uint64(0)
+	keys, ok := r.URL.Query()["id"]
+	if ok && len(keys) == 1 {
+		id, err := strconv.ParseUint(keys[0], 10, 64)
+		if err == nil {
+			channelId = id
+		}
+	}
+
+	if channelId == 0 {
+		redirectWithError(w, r, "/af?", errors.New("select a channel to backtest"))
+		return
+	}
+
+	days := 30
+	keys, ok = r.URL.Query()["days"]
+	if ok && len(keys[0]) > 0 {
+		d, err := strconv.Atoi(keys[0])
+		if err != nil {
+			redirectWithError(w, r, "/af?id="+strconv.FormatUint(channelId, 10)+"&", err)
+			return
+		}
+		days = d
+	}
+
+	ln.AutoFeeMu.Lock()
+	current, _ := ln.AutoFeeAppliedRule(channelId, peerNodeId[channelId])
+	applied := *current
+	ln.AutoFeeMu.Unlock()
+
+	rule, err := backtestRule(r, applied)
+	if err != nil {
+		redirectWithError(w, r, "/af?id="+strconv.FormatUint(channelId, 10)+"&", err)
+		return
+	}
+
+	result, err := runBacktest(channelId, rule, days)
+	if err != nil {
+		redirectWithError(w, r, "/af?id="+strconv.FormatUint(channelId, 10)+"&", err)
+		return
+	}
+
+	//check for error errorMessage to display
+	errorMessage := ""
+	keys, ok = r.URL.Query()["err"]
+	if ok && len(keys[0]) > 0 {
+		errorMessage = keys[0]
+	}
+
+	type Page struct {
+		Authenticated  bool
+		ErrorMessage   string
+		PopUpMessage   string
+		MempoolFeeRate float64
+		ColorScheme    string
+		ChannelId      uint64
+		PeerName       string
+		Days           int
+		MaxDays        int
+		Params         *ln.AutoFeeParams
+		Result         *ln.BacktestResult
+		RedColor       string
+		GreenColor     string
+	}
+
+	redColor := "red"
+	greenColor := "green"
+	if config.Config.ColorScheme == "dark" {
+		redColor = "pink"
+		greenColor = "lightgreen"
+	}
+
+	data := Page{
+		Authenticated:  config.Config.SecureConnection && config.Config.Password != "",
+		ErrorMessage:   errorMessage,
+		MempoolFeeRate: mempoolFeeRate,
+		ColorScheme:    config.Config.ColorScheme,
+		ChannelId:      channelId,
+		PeerName:       getNodeAlias(peerNodeId[channelId]),
+		Days:           days,
+		MaxDays:        ln.BACKTEST_MAX_DAYS,
+		Params:         rule,
+		Result:         result,
+		RedColor:       redColor,
+		GreenColor:     greenColor,
+	}
+
+	// executing template named "backtest"
+	executeTemplate(w, "backtest", data)
+}
+
 func swapHandler(w http.ResponseWriter, r *http.Request) {
 	keys, ok := r.URL.Query()["id"]
 	if !ok || len(keys[0]) < 1 {
@@ -1523,7 +1690,7 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	swapData += `<tr><td style="text-align: right">LndChanId:</td><td>`
 	swapData += strconv.FormatUint(uint64(swap.LndChanId), 10)
 
-	cost, breakdown, persist := swapCost(swap)
+	cost, breakdown := swapCost(swap)
 	if cost != 0 {
 		ppm := cost * 1_000_000 / int64(swap.Amount)
 
@@ -1543,11 +1710,6 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 			swapData += `<tr><td style="text-align: right">PPM:</td><td>`
 			swapData += formatSigned(ppm)
 		}
-
-		// save to db
-		if persist {
-			db.Save("Swaps", "txFee", txFee)
-		}
 	}
 
 	swapData += `</td></tr>
@@ -1563,6 +1725,11 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func configHandler(w http.ResponseWriter, r *http.Request) {
+	renderConfig(w, r, "")
+}
+
+// newToken is shown once, in the response to its creation
+func renderConfig(w http.ResponseWriter, r *http.Request, newToken string) {
 	//check for error message to display
 	errorMessage := ""
 	keys, ok := r.URL.Query()["err"]
@@ -1593,12 +1760,26 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 		Implementation  string
 		HTTPS           string
 		IsPossibleHTTPS bool // disabled on Umbrel
+		ApiTokens       []ApiTokenView
+		NewApiToken     string
+	}
+
+	//check for pop-up message to display
+	popupMessage := ""
+	keys, ok = r.URL.Query()["msg"]
+	if ok && len(keys[0]) > 0 {
+		popupMessage = keys[0]
+	}
+
+	if newToken != "" {
+		// the secret must not be cached
+		w.Header().Set("Cache-Control", "no-store")
 	}
 
 	data := Page{
 		Authenticated:   config.Config.SecureConnection && config.Config.Password != "",
 		ErrorMessage:    errorMessage,
-		PopUpMessage:    "",
+		PopUpMessage:    popupMessage,
 		MempoolFeeRate:  mempoolFeeRate,
 		ColorScheme:     config.Config.ColorScheme,
 		Config:          config.Config,
@@ -1607,6 +1788,8 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 		Implementation:  ln.IMPLEMENTATION,
 		HTTPS:           "https://" + hostname + ".local:" + config.Config.SecurePort,
 		IsPossibleHTTPS: os.Getenv("NO_HTTPS") == "",
+		ApiTokens:       listApiTokens(),
+		NewApiToken:     newToken,
 	}
 
 	// executing template named "config"
@@ -1767,10 +1950,33 @@ func liquidHandler(w http.ResponseWriter, r *http.Request) {
 
 	satAmount := res2.GetSatAmount()
 
+	// explains the swap-in candidate
+	report, err := swapInReport("lbtc")
+	if err != nil {
+		log.Printf("unable swapInReport: %v", err)
+		redirectWithError(w, r, "/liquid?", err)
+		return
+	}
+
 	var candidate SwapParams
+	var evaluations []autoSwapEvaluationRow
+
+	for _, e := range report.Channels {
+		if e.Selected {
+			candidate = e.SwapParams
+		}
+		row := autoSwapEvaluationRow{SwapEvaluation: *e}
+		if e.Cost > 0 {
+			// evaluated that far
+			row.Payback = formatPayback(e.Payback)
+		}
+		evaluations = append(evaluations, row)
+	}
 
-	if err := findSwapInCandidate(&candidate); err != nil {
-		log.Printf("unable findSwapInCandidate: %v", err)
+	var outCandidate SwapParams
+
+	if err := findSwapOutCandidate("lbtc", &outCandidate); err != nil {
+		log.Printf("unable findSwapOutCandidate: %v", err)
 		redirectWithError(w, r, "/liquid?", err)
 		return
 	}
@@ -1781,6 +1987,30 @@ func liquidHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	now := time.Now().Unix()
+	var queue, history []autoSwapRow
+	for _, job := range autoSwapQueueCopy() {
+		status := "Waiting for a free slot"
+		if job.SwapId != "" {
+			status = "Running: " + job.SwapId
+		} else if job.NextTS > now {
+			status = fmt.Sprintf("Retry in %d min: %s", (job.NextTS-now+59)/60, job.LastError)
+		}
+		queue = append(queue, newAutoSwapRow(job.QueuedTS, job.Direction, &job.SwapParams, status))
+	}
+	for _, e := range autoSwapHistoryCopy() {
+		status := e.Decision
+		if e.Reason != "" {
+			status += ": " + e.Reason
+		}
+		history = append(history, newAutoSwapRow(e.TimeStamp, e.Direction, &SwapParams{
+			PeerAlias: e.PeerAlias,
+			ChannelId: e.ChannelId,
+			Asset:     e.Asset,
+			Amount:    e.Amount,
+		}, status))
+	}
+
 	type Page struct {
 		Authenticated           bool
 		ErrorMessage            string
@@ -1798,6 +2028,19 @@ func liquidHandler(w http.ResponseWriter, r *http.Request) {
 		AutoSwapThresholdPPM    uint64
 		AutoSwapCandidate       *SwapParams
 		AutoSwapTargetPct       uint64
+		AutoSwapOutEnabled      bool
+		AutoSwapOutThresholdPct uint64
+		AutoSwapOutMinAmount    uint64
+		AutoSwapOutMaxAmount    uint64
+		AutoSwapOutTargetPct    uint64
+		AutoSwapOutCandidate    *SwapParams
+		AutoSwapMaxConcurrent   uint64
+		AutoSwapCooldownHours   uint64
+		AutoSwapPaybackDays     uint64
+		AutoSwapQueue           []autoSwapRow
+		AutoSwapHistory         []autoSwapRow
+		AutoSwapStatus          string
+		AutoSwapEvaluations     []autoSwapEvaluationRow
 		AdvertiseEnabled        bool
 		DescriptorsWallet       bool
 	}
@@ -1819,6 +2062,19 @@ func liquidHandler(w http.ResponseWriter, r *http.Request) {
 		AutoSwapThresholdPPM:    config.Config.AutoSwapThresholdPPM,
 		AutoSwapTargetPct:       config.Config.AutoSwapTargetPct,
 		AutoSwapCandidate:       &candidate,
+		AutoSwapOutEnabled:      config.Config.AutoSwapOutEnabled,
+		AutoSwapOutThresholdPct: config.Config.AutoSwapOutThresholdPct,
+		AutoSwapOutMinAmount:    config.Config.AutoSwapOutThresholdAmount,
+		AutoSwapOutMaxAmount:    config.Config.AutoSwapOutMaxAmount,
+		AutoSwapOutTargetPct:    config.Config.AutoSwapOutTargetPct,
+		AutoSwapOutCandidate:    &outCandidate,
+		AutoSwapMaxConcurrent:   config.Config.AutoSwapMaxConcurrent,
+		AutoSwapCooldownHours:   config.Config.AutoSwapPeerCooldownHours,
+		AutoSwapPaybackDays:     config.Config.AutoSwapMaxPaybackDays,
+		AutoSwapQueue:           queue,
+		AutoSwapHistory:         history,
+		AutoSwapStatus:          report.Status,
+		AutoSwapEvaluations:     evaluations,
 		AdvertiseEnabled:        ln.AdvertiseLiquidBalance,
 		DescriptorsWallet:       walletInfo.Descriptors,
 	}
@@ -1837,110 +2093,46 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 
 		action := r.FormValue("action")
 
-		client, cleanup, err := ps.GetClient(config.Config.RpcHost)
-		if err != nil {
-			redirectWithError(w, r, "/config?", err)
-			return
-		}
-		defer cleanup()
-
 		switch action {
 		case "externalPeginTxId":
 			if r.FormValue("externalPeginCancel") != "" {
-				config.Config.PeginTxId = ""
-				config.Config.PeginClaimJoin = false
+				cancelExternalPegin()
 			} else {
-				txid := r.FormValue("peginTxId")
-				if txid == "" {
-					redirectWithError(w, r, "/bitcoin?", errors.New("TxId is blank"))
-					return
-				}
-
-				// find the funding output
-				var tx bitcoin.Transaction
-				_, err := bitcoin.GetRawTransaction(txid, &tx)
-				if err != nil {
+				if err := setExternalPegin(r.FormValue("peginTxId")); err != nil {
 					redirectWithError(w, r, "/bitcoin?", err)
 					return
 				}
-
-				found := false
-				for _, out := range tx.Vout {
-					if out.ScriptPubKey.Address == config.Config.PeginAddress {
-						found = true
-						config.Config.PeginAmount = int64(toSats(out.Value))
-						break
-					}
-				}
-
-				if !found {
-					redirectWithError(w, r, "/bitcoin?", errors.New("the tx fails to pay the pegin address"))
-					return
-				}
-
-				config.Config.PeginTxId = txid
-				config.Config.PeginFeeRate = 0
-
-				log.Println("External Funding TxId:", txid)
-				duration := time.Duration(10*(int32(peginBlocks)-tx.Confirmations)) * time.Minute
-				formattedDuration := time.Time{}.Add(duration).Format("15h 04m")
-				telegramSendMessage("⏰ Started peg in " + formatWithThousandSeparators(uint64(config.Config.PeginAmount)) + " sats. Time left: " + formattedDuration + ". TxId: `" + txid + "`")
 			}
 
-			config.Save()
-
 			// all done, display tx confirmations
 			http.Redirect(w, r, "/bitcoin", http.StatusSeeOther)
 			return
 
 		case "advertiseLiquidBalance":
-			enabled := r.FormValue("enabled") == "on"
-			if enabled && !config.Config.AllowSwapRequests {
-				redirectWithError(w, r, "/liquid?", errors.New("liquid swap requests are disabled"))
+			msg, err := setAdvertiseLiquidBalance(r.FormValue("enabled") == "on")
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
 				return
 			}
 
-			ln.AdvertiseLiquidBalance = enabled
-			db.Save("Peers", "AdvertiseLiquidBalance", ln.AdvertiseLiquidBalance)
-
-			msg := "Broadcasting Liquid Balance is "
-
-			if ln.AdvertiseLiquidBalance {
-				msg += "Enabled"
-			} else {
-				msg += "Disabled"
-			}
-
 			// all done, display confirmation
 			http.Redirect(w, r, "/liquid?msg="+msg, http.StatusSeeOther)
 			return
 
 		case "advertiseBitcoinBalance":
-			enabled := r.FormValue("enabled") == "on"
-			if enabled && (!config.Config.AllowSwapRequests || !config.Config.BitcoinSwaps) {
-				redirectWithError(w, r, "/bitcoin?", errors.New("bitcoin swap requests are disabled on configuration page"))
+			msg, err := setAdvertiseBitcoinBalance(r.FormValue("enabled") == "on")
+			if err != nil {
+				redirectWithError(w, r, "/bitcoin?", err)
 				return
 			}
 
-			ln.AdvertiseBitcoinBalance = enabled
-			db.Save("Peers", "AdvertiseBitcoinBalance", ln.AdvertiseBitcoinBalance)
-
-			msg := "Broadcasting Bitcoin Balance is "
-
-			if ln.AdvertiseBitcoinBalance {
-				msg += "Enabled"
-			} else {
-				msg += "Disabled"
-			}
-
 			// all done, display confirmation
 			http.Redirect(w, r, "/bitcoin?msg="+msg, http.StatusSeeOther)
 			return
 
 		case "deleteTxId":
 			// acknowledges BTC withdrawal
-			config.Config.PeginTxId = ""
-			if err := config.Save(); err != nil {
+			if err := deletePeginTxId(); err != nil {
 				redirectWithError(w, r, "/bitcoin?", err)
 				return
 			}
@@ -2023,152 +2215,254 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			for field, value := range map[string]*int{
+				"peerFloorPct":   &newRule.PeerFloorPct,
+				"peerCeilingPct": &newRule.PeerCeilingPct,
+				"competitorPct":  &newRule.CompetitorPct,
+				"revenueMaxPPM":  &newRule.RevenueMaxPPM,
+				"revenueMinPPM":  &newRule.RevenueMinPPM,
+				"revenueStepPPM": &newRule.RevenueStepPPM,
+				"revenueDays":    &newRule.RevenueDays,
+				"maxHtlcPct":     &newRule.MaxHtlcPct,
+				"baseFeePolicy":  &newRule.BaseFeePolicy,
+				"baseFeeMsat":    &newRule.BaseFeeMsat,
+			} {
+				*value, err = strconv.Atoi(r.FormValue(field))
+				if err != nil {
+					redirectWithError(w, r, "/af?", err)
+					return
+				}
+			}
+
 			if ln.HasInboundFees() {
 				newRule.LowLiqDiscount, err = strconv.Atoi(r.FormValue("lowLiqDiscount"))
 				if err != nil {
 					redirectWithError(w, r, "/af?", err)
 					return
 				}
-			}
-			rule := &ln.AutoFeeDefaults
-			msg := ""
-			updateAll := false
 
-			if _, isCustom := ln.AutoFeeRule(channelId); isCustom {
-				updateAll = r.FormValue("update_all") != ""
+				newRule.InboundCurve, err = ln.ParseInboundCurve(r.FormValue("inboundCurve"))
+				if err != nil {
+					redirectWithError(w, r, "/af?", badInput(err.Error()))
+					return
+				}
 			}
 
-			if updateAll {
-				msg = "All custom rules updated:"
-				old := reflect.ValueOf(*ln.AutoFee[channelId])
-				new := reflect.ValueOf(newRule)
+			msg := ""
+			updateAll := r.FormValue("update_all") != ""
 
-				// find what will be updated
-				for i := 0; i < old.NumField(); i++ {
-					if old.Field(i).Int() != new.Field(i).Int() {
-						msg += fmt.Sprintf(" %s=%v", new.Type().Field(i).Name, new.Field(i).Interface())
-					}
+			if template := r.FormValue("template"); template != "" {
+				if r.FormValue("delete_button") != "" {
+					msg, err = deleteAutoFeeTemplate(template)
+					template = ""
+				} else {
+					msg, err = saveAutoFeeTemplate(template, newRule)
+				}
+				if err != nil {
+					redirectWithError(w, r, "/af?template="+template+"&", err)
+					return
 				}
 
-				for _, rulePtr := range ln.AutoFee {
-					if rulePtr == nil {
-						continue
-					}
-					// Use Elem() to get the underlying struct from the pointer
-					current := reflect.ValueOf(rulePtr).Elem()
-
-					for i := 0; i < old.NumField(); i++ {
-						if old.Field(i).Int() != new.Field(i).Int() {
-							if current.Field(i).CanSet() {
-								current.Field(i).SetInt(new.Field(i).Int())
-							} else {
-								redirectWithError(w, r, "/af?", errors.New("unable to set the value of "+current.Type().Field(i).Name))
-								return
-							}
-						}
-					}
+				// all done, display confirmation
+				http.Redirect(w, r, "/af?template="+template+"&msg="+msg, http.StatusSeeOther)
+				return
+			} else if r.FormValue("peerRule") != "" {
+				// for all channels with the peer
+				peerId := peerNodeId[channelId]
+				if r.FormValue("delete_button") != "" {
+					msg, err = deleteAutoFeePeerRule(peerId)
+				} else {
+					msg, err = saveAutoFeePeerRule(peerId, newRule)
+				}
+				if err != nil {
+					redirectWithError(w, r, "/af?id="+r.FormValue("channelId")+"&", err)
+					return
 				}
+			} else if updateAll || r.FormValue("update_button") != "" {
+				msg, err = saveAutoFeeRule(channelId, newRule, updateAll)
+				if err != nil {
+					redirectWithError(w, r, "/af?", err)
+					return
+				}
+			} else if r.FormValue("delete_button") != "" {
+				msg, err = deleteAutoFeeRule(channelId)
+				if err != nil {
+					redirectWithError(w, r, "/af?", err)
+					return
+				}
+			}
 
-				// persist to db
-				db.Save("AutoFees", "AutoFee", ln.AutoFee)
+			// all done, display confirmation
+			http.Redirect(w, r, "/af?id="+r.FormValue("channelId")+"&msg="+msg, http.StatusSeeOther)
+			return
 
-			} else if r.FormValue("update_button") != "" {
-				// channelId == 0 means default rule
-				msg = "Default rule updated"
+		case "toggleDryRun":
+			channelId, err := strconv.ParseUint(r.FormValue("channelId"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
 
-				if channelId > 0 {
-					// custom rule
-					msg = "Custom rule updated"
-					if ln.AutoFee[channelId] == nil {
-						// add new
-						ln.AutoFee[channelId] = new(ln.AutoFeeParams)
-						msg = "Custom rule added"
-					}
-					rule = ln.AutoFee[channelId]
-				}
+			msg, err := toggleAutoFeeDryRun(channelId, r.FormValue("enabled") == "on")
+			if err != nil {
+				redirectWithError(w, r, "/af?id="+r.FormValue("channelId")+"&", err)
+				return
+			}
+
+			// all done, display confirmation
+			http.Redirect(w, r, "/af?id="+r.FormValue("channelId")+"&msg="+msg, http.StatusSeeOther)
+			return
+
+		case "addFeeSchedule":
+			channelId, err := strconv.ParseUint(r.FormValue("channelId"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
 
-				// clone the new data
-				*rule = newRule
+			var schedule ln.AutoFeeSchedule
 
-				// persist to db
-				if channelId > 0 {
-					db.Save("AutoFees", "AutoFee", ln.AutoFee)
-				} else {
-					db.Save("AutoFees", "AutoFeeDefaults", ln.AutoFeeDefaults)
+			for _, d := range r.Form["days"] {
+				day, err := strconv.Atoi(d)
+				if err != nil || day < 0 || day > 6 {
+					redirectWithError(w, r, "/af?", badInput("invalid day "+d))
+					return
 				}
-			} else if r.FormValue("delete_button") != "" {
-				if ln.AutoFee[channelId] != nil {
-					// delete custom rule
-					ln.AutoFee[channelId] = nil
-					msg = "Custom rule deleted"
-					// persist to db
-					db.Save("AutoFees", "AutoFee", ln.AutoFee)
+				schedule.Days |= 1 << day
+			}
+
+			for field, value := range map[string]*int{
+				"startTime": &schedule.StartMin,
+				"endTime":   &schedule.EndMin,
+			} {
+				t, err := time.Parse("15:04", r.FormValue(field))
+				if err != nil {
+					redirectWithError(w, r, "/af?", err)
+					return
+				}
+				*value = t.Hour()*60 + t.Minute()
+			}
+
+			for field, value := range map[string]*int{
+				"lowLiqRate": &schedule.LowLiqRate,
+				"normalRate": &schedule.NormalRate,
+				"excessRate": &schedule.ExcessRate,
+			} {
+				*value, err = strconv.Atoi(r.FormValue(field))
+				if err != nil {
+					redirectWithError(w, r, "/af?", err)
+					return
 				}
 			}
 
+			msg, err := addAutoFeeSchedule(channelId, r.FormValue("template"), schedule)
+			if err != nil {
+				redirectWithError(w, r, afPage(r)+"&", err)
+				return
+			}
+
 			// all done, display confirmation
-			http.Redirect(w, r, "/af?id="+r.FormValue("channelId")+"&msg="+msg, http.StatusSeeOther)
+			http.Redirect(w, r, afPage(r)+"&msg="+msg, http.StatusSeeOther)
 			return
 
-		case "toggleAutoFee":
-			channelId, err := strconv.ParseInt(r.FormValue("channelId"), 10, 64)
+		case "deleteFeeSchedule":
+			channelId, err := strconv.ParseUint(r.FormValue("channelId"), 10, 64)
 			if err != nil {
 				redirectWithError(w, r, "/af?", err)
 				return
 			}
 
-			isEnabled := r.FormValue("enabled") == "on"
+			index, err := strconv.Atoi(r.FormValue("index"))
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
 
-			cl, clean, er := ln.GetClient()
-			if er != nil {
-				redirectWithError(w, r, "/config?", er)
+			msg, err := deleteAutoFeeSchedule(channelId, r.FormValue("template"), index)
+			if err != nil {
+				redirectWithError(w, r, afPage(r)+"&", err)
 				return
 			}
-			defer clean()
 
-			// Get all public Lightning channels
-			res, err := ln.ListPeers(cl, "", nil)
+			// all done, display confirmation
+			http.Redirect(w, r, afPage(r)+"&msg="+msg, http.StatusSeeOther)
+			return
+
+		case "addAutoFeeTemplate":
+			msg, err := addAutoFeeTemplate(r.FormValue("name"))
 			if err != nil {
-				redirectWithError(w, r, "/?", err)
+				redirectWithError(w, r, "/af?", err)
 				return
 			}
 
-			msg := ""
-			if channelId == 0 {
-				// global setting
-				ln.AutoFeeEnabledAll = isEnabled
-				db.Save("AutoFees", "AutoFeeEnabledAll", ln.AutoFeeEnabledAll)
-				msg = "Global AutoFees "
-			} else if channelId == -1 {
-				// toggle for all channels
-				for _, peer := range res.GetPeers() {
-					for _, ch := range peer.Channels {
-						ln.AutoFeeEnabled[ch.ChannelId] = isEnabled
-					}
-				}
-				db.Save("AutoFees", "AutoFeeEnabled", ln.AutoFeeEnabled)
-				msg = "All per-channel AutoFees "
+			// all done, display confirmation
+			http.Redirect(w, r, "/af?msg="+msg, http.StatusSeeOther)
+			return
 
-			} else {
-				// toggle for a single channel
-				ln.AutoFeeEnabled[uint64(channelId)] = isEnabled
-				db.Save("AutoFees", "AutoFeeEnabled", ln.AutoFeeEnabled)
-
-			outerLoop:
-				for _, peer := range res.GetPeers() {
-					for _, ch := range peer.Channels {
-						if ch.ChannelId == uint64(channelId) {
-							msg = "AutoFees for " + getNodeAlias(peer.NodeId) + " "
-							break outerLoop
-						}
-					}
+		case "tagChannels":
+			var channelIds []uint64
+			for _, id := range r.Form["channelIds"] {
+				channelId, err := strconv.ParseUint(id, 10, 64)
+				if err != nil {
+					redirectWithError(w, r, "/af?", err)
+					return
 				}
+				channelIds = append(channelIds, channelId)
 			}
 
-			if isEnabled {
-				msg += "Enabled"
-			} else {
-				msg += "Disabled"
+			msg, err := tagChannels(r.FormValue("template"), channelIds)
+			if err != nil {
+				redirectWithError(w, r, "/af?id="+r.FormValue("nextId")+"&", err)
+				return
+			}
+
+			// all done, display confirmation
+			http.Redirect(w, r, "/af?id="+r.FormValue("nextId")+"&msg="+msg, http.StatusSeeOther)
+			return
+
+		case "saveAutoFeeBudget":
+			var budget ln.UpdateBudget
+			var err error
+
+			budget.DailyUpdates, err = strconv.Atoi(r.FormValue("dailyUpdates"))
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
+
+			budget.ChannelDailyUpdates, err = strconv.Atoi(r.FormValue("channelDailyUpdates"))
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
+
+			budget.CoalesceMinutes, err = strconv.Atoi(r.FormValue("coalesceMinutes"))
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
+
+			msg, err := saveAutoFeeBudget(budget)
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
+
+			// all done, display confirmation
+			http.Redirect(w, r, "/af?msg="+msg, http.StatusSeeOther)
+			return
+
+		case "toggleAutoFee":
+			channelId, err := strconv.ParseInt(r.FormValue("channelId"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
+			}
+
+			msg, err := toggleAutoFee(channelId, r.FormValue("enabled") == "on")
+			if err != nil {
+				redirectWithError(w, r, "/af?", err)
+				return
 			}
 
 			// all done, display confirmation
@@ -2192,34 +2486,12 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 
 			inbound := r.FormValue("direction") == "inbound"
 
-			if inbound {
-				if !ln.HasInboundFees() {
-					// CLN and LND < 0.18 cannot set inbound fees
-					redirectWithError(w, r, nextPage, errors.New("inbound fees are not allowed by your LN backend"))
-					return
-				}
-
-				if feeRate > 0 {
-					// Only discounts are allowed for now
-					redirectWithError(w, r, nextPage, errors.New("inbound fee rate cannot be positive"))
-					return
-				}
-			} else {
-				if feeRate < 0 {
-					redirectWithError(w, r, nextPage, errors.New("outbound fee rate cannot be negative"))
-					return
-				}
-			}
-
-			oldRate, err := ln.SetFeeRate(r.FormValue("peerNodeId"), channelId, feeRate, inbound, false)
+			err = changeFeeRate(r.FormValue("peerNodeId"), channelId, feeRate, inbound)
 			if err != nil {
 				redirectWithError(w, r, nextPage, err)
 				return
 			}
 
-			// log change
-			ln.LogFee(channelId, oldRate, int(feeRate), inbound, true)
-
 			// all good, display confirmation
 			msg := strings.Title(r.FormValue("direction")) + " fee rate updated to " + formatSigned(feeRate)
 			http.Redirect(w, r, nextPage+"msg="+msg, http.StatusSeeOther)
@@ -2242,26 +2514,7 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 
 			inbound := r.FormValue("direction") == "inbound"
 
-			if inbound {
-				if ln.IMPLEMENTATION == "CLN" || !ln.CanRBF() {
-					// CLN and LND < 0.18 cannot set inbound fees
-					redirectWithError(w, r, nextPage, errors.New("inbound fees are not allowed by your LN backend"))
-					return
-				}
-
-				if feeBase > 0 {
-					// Only discounts are allowed for now
-					redirectWithError(w, r, nextPage, errors.New("inbound fee base cannot be positive"))
-					return
-				}
-			} else {
-				if feeBase < 0 {
-					redirectWithError(w, r, nextPage, errors.New("outbound fee base cannot be negative"))
-					return
-				}
-			}
-
-			_, err = ln.SetFeeRate(r.FormValue("peerNodeId"), channelId, feeBase, inbound, true)
+			err = changeFeeBase(r.FormValue("peerNodeId"), channelId, feeBase, inbound)
 			if err != nil {
 				redirectWithError(w, r, nextPage, err)
 				return
@@ -2289,7 +2542,7 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 
 			isMax := r.FormValue("minMax") == "max"
 
-			err = ln.SetHtlcSize(r.FormValue("peerNodeId"), channelId, size*1000, isMax)
+			err = changeHtlcSize(r.FormValue("peerNodeId"), channelId, size, isMax)
 			if err != nil {
 				redirectWithError(w, r, nextPage, err)
 				return
@@ -2314,9 +2567,32 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 
+		case "createToken":
+			token, err := createApiToken(r.FormValue("tokenName"), r.Form["scopes"])
+			if err != nil {
+				redirectWithError(w, r, "/config?", err)
+				return
+			}
+
+			log.Println("API token created:", r.FormValue("tokenName"))
+
+			// displayed once, to the creator only
+			renderConfig(w, r, token)
+			return
+
+		case "revokeToken":
+			if err := revokeApiToken(r.FormValue("tokenId")); err != nil {
+				redirectWithError(w, r, "/config?", err)
+				return
+			}
+
+			log.Println("API token revoked:", r.FormValue("tokenName"))
+
+			http.Redirect(w, r, "/config?msg=API token revoked", http.StatusSeeOther)
+			return
+
 		case "keySend":
 			dest := r.FormValue("nodeId")
-			message := r.FormValue("keysendMessage")
 
 			amount, err := strconv.ParseInt(r.FormValue("keysendAmount"), 10, 64)
 			if err != nil {
@@ -2324,16 +2600,12 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			err = ln.SendKeysendMessage(dest, amount, message)
+			msg, err := sendKeysendInvite(dest, amount, r.FormValue("keysendMessage"))
 			if err != nil {
 				redirectWithError(w, r, "/peer?id="+dest+"&", err)
 				return
 			}
 
-			msg := "Keysend invitation sent to " + getNodeAlias(dest)
-
-			log.Println(msg)
-
 			// Load main page with all pees and a pop-up message
 			http.Redirect(w, r, "/?showall&msg="+msg, http.StatusSeeOther)
 			return
@@ -2363,35 +2635,43 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			nowEnabled := r.FormValue("autoSwapEnabled") == "on"
-			t := "Automatic swap-ins "
-			msg := ""
+			msg, err := setAutoSwap(r.FormValue("autoSwapEnabled") == "on", newAmount, maxAmount, newPPM, newPct)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
+			}
+
+			// Reload liquid page with pop-up
+			http.Redirect(w, r, "/liquid?msg="+msg, http.StatusSeeOther)
+			return
 
-			// Log only if something changed
-			if nowEnabled && (!config.Config.AutoSwapEnabled ||
-				config.Config.AutoSwapThresholdAmount != newAmount ||
-				config.Config.AutoSwapMaxAmount != maxAmount ||
-				config.Config.AutoSwapThresholdPPM != newPPM ||
-				config.Config.AutoSwapTargetPct != newPct) {
-				t += "Enabled"
-				msg = t
-				log.Println(t)
+		case "setAutoSwapOut":
+			thresholdPct, err := strconv.ParseUint(r.FormValue("thresholdPct"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
 			}
 
-			if config.Config.AutoSwapEnabled && !nowEnabled {
-				t += "Disabled"
-				msg = t
-				log.Println(t)
+			minAmount, err := strconv.ParseUint(r.FormValue("thresholdAmount"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
+			}
+
+			maxAmount, err := strconv.ParseUint(r.FormValue("maxAmount"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
 			}
 
-			config.Config.AutoSwapThresholdPPM = newPPM
-			config.Config.AutoSwapThresholdAmount = newAmount
-			config.Config.AutoSwapMaxAmount = maxAmount
-			config.Config.AutoSwapTargetPct = newPct
-			config.Config.AutoSwapEnabled = nowEnabled
+			targetPct, err := strconv.ParseUint(r.FormValue("targetPct"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
+			}
 
-			// Save config
-			if err := config.Save(); err != nil {
+			msg, err := setAutoSwapOut(r.FormValue("autoSwapOutEnabled") == "on", thresholdPct, minAmount, maxAmount, targetPct)
+			if err != nil {
 				redirectWithError(w, r, "/liquid?", err)
 				return
 			}
@@ -2400,6 +2680,58 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/liquid?msg="+msg, http.StatusSeeOther)
 			return
 
+		case "setAutoSwapQueue":
+			maxConcurrent, err := strconv.ParseUint(r.FormValue("maxConcurrent"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
+			}
+
+			cooldownHours, err := strconv.ParseUint(r.FormValue("cooldownHours"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
+			}
+
+			paybackDays, err := strconv.ParseUint(r.FormValue("paybackDays"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
+			}
+
+			msg, err := setAutoSwapQueue(maxConcurrent, cooldownHours, paybackDays)
+			if err != nil {
+				redirectWithError(w, r, "/liquid?", err)
+				return
+			}
+
+			// Reload liquid page with pop-up
+			http.Redirect(w, r, "/liquid?msg="+msg, http.StatusSeeOther)
+			return
+
+		case "setAutoSwapBtc":
+			thresholdAmount, err := strconv.ParseUint(r.FormValue("thresholdAmount"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/bitcoin?", err)
+				return
+			}
+
+			maxAmount, err := strconv.ParseUint(r.FormValue("maxAmount"), 10, 64)
+			if err != nil {
+				redirectWithError(w, r, "/bitcoin?", err)
+				return
+			}
+
+			msg, err := setAutoSwapBtc(r.FormValue("autoSwapEnabled") == "on", r.FormValue("autoSwapOutEnabled") == "on", thresholdAmount, maxAmount)
+			if err != nil {
+				redirectWithError(w, r, "/bitcoin?", err)
+				return
+			}
+
+			// Reload bitcoin page with pop-up
+			http.Redirect(w, r, "/bitcoin?msg="+msg, http.StatusSeeOther)
+			return
+
 		case "newBitcoinAddress":
 			addr, err := ln.NewAddress()
 			if err != nil {
@@ -2413,13 +2745,7 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 			return
 
 		case "newAddress":
-			label := r.FormValue("addressLabel")
-			addressType := "blech32"
-			if r.FormValue("bech32m") == "on" {
-				addressType = "bech32m"
-			}
-
-			addr, err := liquid.GetNewAddress(label, addressType)
+			addr, err := newLiquidAddress(r.FormValue("addressLabel"), r.FormValue("bech32m") == "on")
 			if err != nil {
 				redirectWithError(w, r, "/liquid?", err)
 				return
@@ -2451,43 +2777,9 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 			// Redirect to liquid page with TxId
 			http.Redirect(w, r, "/liquid?txid="+txid, http.StatusSeeOther)
 			return
-		case "addPeer":
-			nodeId := r.FormValue("nodeId")
-			_, err := ps.AddPeer(client, nodeId)
-			if err != nil {
-				redirectWithError(w, r, "/peer?id="+nodeId+"&", err)
-				return
-			}
-			// Redirect to peer page
-			http.Redirect(w, r, "/peer?id="+nodeId, http.StatusSeeOther)
-			return
-
-		case "removePeer":
-			nodeId := r.FormValue("nodeId")
-			_, err := ps.RemovePeer(client, nodeId)
-			if err != nil {
-				redirectWithError(w, r, "/peer?id="+nodeId+"&", err)
-				return
-			}
-			// Redirect to peer page
-			http.Redirect(w, r, "/peer?id="+nodeId, http.StatusSeeOther)
-			return
-
-		case "suspectPeer":
-			nodeId := r.FormValue("nodeId")
-			_, err := ps.AddSusPeer(client, nodeId)
-			if err != nil {
-				redirectWithError(w, r, "/peer?id="+nodeId+"&", err)
-				return
-			}
-			// Redirect to peer page
-			http.Redirect(w, r, "/peer?id="+nodeId, http.StatusSeeOther)
-			return
-
-		case "unsuspectPeer":
+		case "addPeer", "removePeer", "suspectPeer", "unsuspectPeer":
 			nodeId := r.FormValue("nodeId")
-			_, err := ps.RemoveSusPeer(client, nodeId)
-			if err != nil {
+			if err := updatePeerPolicy(action, nodeId); err != nil {
 				redirectWithError(w, r, "/peer?id="+nodeId+"&", err)
 				return
 			}
@@ -2509,51 +2801,12 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			var id string
-			asset := r.FormValue("from")
-			direction := "in"
-			if asset == "ln" {
-				asset = r.FormValue("to")
-				direction = "out"
-			}
-			if asset == "ln" || r.FormValue("from") != "ln" && r.FormValue("to") != "ln" {
-				redirectWithError(w, r, "/peer?id="+nodeId+"&", errors.New("invalid combination of assets"))
+			id, err := startSwap(channelId, swapAmount, r.FormValue("from"), r.FormValue("to"))
+			if err != nil {
+				redirectWithError(w, r, "/peer?id="+nodeId+"&", err)
 				return
 			}
 
-			switch direction {
-			case "in":
-				id, err = ps.SwapIn(client, swapAmount, channelId, asset, false)
-			case "out":
-				id, err = ps.SwapOut(client, swapAmount, channelId, asset, false)
-			}
-
-			if err != nil {
-				e := err.Error()
-				if e == "Request timed out" || strings.HasPrefix(e, "rpc error: code = Unavailable desc = rpc timeout reached") {
-					// sometimes the swap is pending anyway
-					res, er := ps.ListActiveSwaps(client)
-					if er != nil {
-						log.Println("ListActiveSwaps:", er)
-						redirectWithError(w, r, "/peer?id="+nodeId+"&", er)
-						return
-					}
-					activeSwaps := res.GetSwaps()
-					if len(activeSwaps) == 1 {
-						// follow this id
-						id = activeSwaps[0].Id
-					} else {
-						// display the original error
-						log.Println("doSwap:", err)
-						redirectWithError(w, r, "/peer?id="+nodeId+"&", err)
-						return
-					}
-				} else {
-					log.Println("doSwap:", err)
-					redirectWithError(w, r, "/peer?id="+nodeId+"&", err)
-					return
-				}
-			}
 			// Redirect to swap page to follow the swap
 			http.Redirect(w, r, "/swap?id="+id, http.StatusSeeOther)
 
@@ -2644,12 +2897,16 @@ func saveConfigHandler(w http.ResponseWriter, r *http.Request) {
 		// disable broadcasting
 		if !allowSwapRequests {
 			ln.AdvertiseLiquidBalance = false
-			db.Save("Peers", "AdvertiseLiquidBalance", ln.AdvertiseLiquidBalance)
+			if err := db.Save("Peers", "AdvertiseLiquidBalance", false); err != nil {
+				log.Println(err)
+			}
 		}
 
 		if !allowSwapRequests || !bitcoinSwaps {
 			ln.AdvertiseBitcoinBalance = false
-			db.Save("Peers", "AdvertiseBitcoinBalance", ln.AdvertiseBitcoinBalance)
+			if err := db.Save("Peers", "AdvertiseBitcoinBalance", false); err != nil {
+				log.Println(err)
+			}
 		}
 
 		mustRestart := false
@@ -2723,6 +2980,7 @@ func stopHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Stop requested")
 	go func() {
 		ps.Stop()
+		db.Close()
 		os.Exit(0) // Exit the program
 	}()
 }
@@ -2778,6 +3036,61 @@ func backupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// downloads encrypted archive of psweb state
+func exportStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileName, err := exportState(r.FormValue("password"))
+	if err != nil {
+		redirectWithError(w, r, "/config?", err)
+		return
+	}
+
+	log.Println("State exported to", fileName)
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	http.ServeFile(w, r, filepath.Join(config.Config.DataDir, fileName))
+
+	// Delete zip archive
+	err = os.Remove(filepath.Join(config.Config.DataDir, fileName))
+	if err != nil {
+		log.Println("Error deleting zip file:", err)
+	}
+}
+
+// restores psweb state from uploaded archive and restarts
+func importStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(64 << 20); err != nil {
+		redirectWithError(w, r, "/config?", err)
+		return
+	}
+
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		redirectWithError(w, r, "/config?", err)
+		return
+	}
+	defer file.Close()
+
+	if err := importState(file, header.Size, r.FormValue("password")); err != nil {
+		redirectWithError(w, r, "/config?", err)
+		return
+	}
+
+	log.Println("State imported from", header.Filename)
+
+	// reload everything
+	showRestartScreen(w, r, config.Config.SecureConnection, config.Config.Password, true)
+}
+
 func downloadCaHandler(w http.ResponseWriter, r *http.Request) {
 	fileName := "CA.crt"
 	// Set the Content-Disposition header to suggest a filename
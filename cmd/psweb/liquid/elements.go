@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"peerswap-web/cmd/psweb/config"
@@ -18,6 +19,9 @@ import (
 	"github.com/alexmullins/zip"
 )
 
+// failed calls, for metrics
+var RpcErrors atomic.Uint64
+
 // A RPCClient represents a JSON RPC client (over HTTP(s)).
 type RPCClient struct {
 	serverAddr string
@@ -126,9 +130,11 @@ func (c *RPCClient) call(method string, params interface{}, uriPath string) (rr
 // handleError handle error returned by client.call
 func handleError(err error, r *rpcResponse) error {
 	if err != nil {
+		RpcErrors.Add(1)
 		return err
 	}
 	if r != nil && r.Err != nil {
+		RpcErrors.Add(1)
 		return fmt.Errorf(r.Err.Message)
 	}
 
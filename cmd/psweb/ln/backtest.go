@@ -0,0 +1,204 @@
+package ln
+
+import (
+	"errors"
+	"time"
+)
+
+// the longest period forwards are kept for
+const BACKTEST_MAX_DAYS = 180
+
+// replay step between forwards, AutoFee runs every minute
+// but cool-off and inactivity are counted in hours and days
+const BACKTEST_STEP = int64(3600)
+
+type BacktestPoint struct {
+	TS         int64
+	ActualRate int
+	SimRate    int
+	LiqPct     int
+}
+
+type BacktestResult struct {
+	ChannelId uint64
+	FromTS    int64
+	ToTS      int64
+	Rule      *AutoFeeParams
+	// outbound forwards replayed
+	Forwards int
+	Volume   uint64
+	// fees in sats, simulated ones assume the same forwards at the simulated rate
+	ActualFees    float64
+	SimulatedFees float64
+	// outbound fee rate changes
+	ActualChanges    int
+	SimulatedChanges int
+	// forwards that paid less than the simulated rate and might not have happened
+	Pricier       int
+	PricierVolume uint64
+	StartLiqPct   int
+	EndLiqPct     int
+	// points where either rate changed
+	Trajectory []BacktestPoint
+}
+
+// Backtest replays the channel's forwards of the last days with the candidate rule
+// and compares the fee rates and revenue to what actually happened.
+// Local balance is reconstructed backwards from the current one,
+// HTLC failures are not recorded and their bumps are not simulated.
+func Backtest(channelId uint64, params *AutoFeeParams, capacity, localBalance uint64, currentRate int, days int) (*BacktestResult, error) {
+	if days < 1 || days > BACKTEST_MAX_DAYS {
+		return nil, errors.New("days must be between 1 and 180")
+	}
+	if capacity == 0 {
+		return nil, errors.New("channel has no capacity")
+	}
+
+	now := time.Now().Unix()
+	from := time.Now().AddDate(0, 0, -days).Unix()
+
+	// older forwards tell when the channel was last active
+	return replay(channelId, params, *ForwardsLog(channelId, 0), feeEvents(channelId, false),
+		capacity, localBalance, currentRate, from, now), nil
+}
+
+// replays forwards sorted descending and the logged fee changes between from and now
+func replay(channelId uint64, params *AutoFeeParams, forwards []DataPoint, feeLog []*AutoFeeEvent,
+	capacity, localBalance uint64, currentRate int, from, now int64) *BacktestResult {
+	lastForward := int64(0)
+	n := 0
+	for _, f := range forwards {
+		if int64(f.TS) >= from {
+			n++
+		} else if f.ChanIdOut == channelId {
+			lastForward = int64(f.TS)
+			break
+		}
+	}
+	forwards = forwards[:n]
+
+	// balance at the start of the period
+	balance := localBalance
+	for _, f := range forwards {
+		if f.ChanIdOut == channelId {
+			balance += f.Amount
+		}
+		if f.ChanIdIn == channelId {
+			balance -= min(balance, f.Amount+uint64(f.Fee))
+		}
+	}
+	balance = min(balance, capacity)
+
+	// actual outbound fee changes, ascending
+	var events []*AutoFeeEvent
+	lastUpdate := int64(0)
+	for _, e := range feeLog {
+		if e.IsInbound || !e.IsRate() {
+			continue
+		}
+		if e.TimeStamp < from {
+			lastUpdate = e.TimeStamp
+		} else {
+			events = append(events, e)
+		}
+	}
+
+	actualRate := currentRate
+	if len(events) > 0 {
+		actualRate = events[0].OldRate
+	}
+
+	liqPct := func() int {
+		return int(balance * 100 / capacity)
+	}
+
+	res := BacktestResult{
+		ChannelId:   channelId,
+		FromTS:      from,
+		ToTS:        now,
+		Rule:        params,
+		StartLiqPct: liqPct(),
+	}
+
+	// the candidate rule takes over from the actual rate
+	simRate := actualRate
+	_, lastIndex := ScheduledRule(params, time.Unix(from, 0))
+
+	addPoint := func(ts int64) {
+		res.Trajectory = append(res.Trajectory, BacktestPoint{
+			TS:         ts,
+			ActualRate: actualRate,
+			SimRate:    simRate,
+			LiqPct:     liqPct(),
+		})
+	}
+	addPoint(from)
+
+	step := func(ts int64) {
+		changed := false
+		for len(events) > 0 && events[0].TimeStamp <= ts {
+			actualRate = events[0].NewRate
+			res.ActualChanges++
+			events = events[1:]
+			changed = true
+		}
+
+		t := time.Unix(ts, 0)
+		p, index := ScheduledRule(params, t)
+		newRate := 0
+		if index != lastIndex {
+			// new rate set applies right away
+			lastIndex = index
+			newRate = regimeRate(p, liqPct())
+		} else {
+			newRate = nextAutoFee(p, liqPct(), simRate, t, lastUpdate, lastForward)
+		}
+
+		if newRate != simRate {
+			simRate = newRate
+			lastUpdate = ts
+			res.SimulatedChanges++
+			changed = true
+		}
+
+		if changed {
+			addPoint(ts)
+		}
+	}
+
+	i := len(forwards) - 1
+	for ts := from + BACKTEST_STEP; ; ts += BACKTEST_STEP {
+		ts = min(ts, now)
+
+		for ; i >= 0 && int64(forwards[i].TS) <= ts; i-- {
+			f := forwards[i]
+			if f.ChanIdOut == channelId {
+				res.Forwards++
+				res.Volume += f.Amount
+				res.ActualFees += f.Fee
+				res.SimulatedFees += float64(f.Amount) * float64(simRate) / 1_000_000
+				if uint64(simRate) > f.PPM {
+					res.Pricier++
+					res.PricierVolume += f.Amount
+				}
+				balance -= min(balance, f.Amount)
+				lastForward = int64(f.TS)
+			}
+			if f.ChanIdIn == channelId {
+				balance = min(balance+f.Amount+uint64(f.Fee), capacity)
+			}
+			step(int64(f.TS))
+		}
+
+		step(ts)
+
+		if ts == now {
+			break
+		}
+	}
+
+	res.EndLiqPct = liqPct()
+	addPoint(now)
+
+	return &res
+}
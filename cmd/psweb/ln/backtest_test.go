@@ -0,0 +1,133 @@
+package ln
+
+import (
+	"testing"
+	"time"
+)
+
+func testRule() *AutoFeeParams {
+	return &AutoFeeParams{
+		LowLiqPct:         10,
+		LowLiqRate:        1000,
+		ExcessPct:         75,
+		NormalRate:        300,
+		ExcessRate:        50,
+		InactivityDays:    7,
+		InactivityDropPPM: 10,
+		InactivityDropPct: 5,
+		CoolOffHours:      12,
+	}
+}
+
+// every rate the replay proposes must be what the live path
+// would set given the same last update and liquidity
+func TestReplayMatchesCalculateAutoFee(t *testing.T) {
+	const channelId = 101
+	params := testRule()
+	now := time.Now().Unix()
+	from := now - 30*24*3600
+
+	res := replay(channelId, params, nil, nil, 1_000_000, 800_000, 500, from, now)
+	defer delete(AutoFeeLog, channelId)
+
+	if res.StartLiqPct != 80 || res.EndLiqPct != 80 {
+		t.Fatalf("liquidity %d%% -> %d%%, want 80%%", res.StartLiqPct, res.EndLiqPct)
+	}
+
+	lastUpdate := int64(0)
+	prev := res.Trajectory[0]
+	checked := 0
+	for _, p := range res.Trajectory[1:] {
+		if p.SimRate == prev.SimRate {
+			continue
+		}
+
+		// shift the replayed moment to now
+		AutoFeeLog[channelId] = nil
+		if lastUpdate > 0 {
+			AutoFeeLog[channelId] = []*AutoFeeEvent{{
+				TimeStamp: now - (p.TS - lastUpdate),
+				NewRate:   prev.SimRate,
+			}}
+		}
+		if got, _ := calculateAutoFee(channelId, params, p.LiqPct, prev.SimRate, false); got != p.SimRate {
+			t.Fatalf("at %d replay proposed %d, calculateAutoFee %d", p.TS, p.SimRate, got)
+		}
+
+		if lastUpdate > 0 {
+			// an hour earlier the cool-off had not passed
+			AutoFeeLog[channelId][0].TimeStamp += BACKTEST_STEP
+			if got, _ := calculateAutoFee(channelId, params, p.LiqPct, prev.SimRate, false); got != prev.SimRate {
+				t.Fatalf("at %d calculateAutoFee changed %d to %d during cool-off", p.TS-BACKTEST_STEP, prev.SimRate, got)
+			}
+		}
+
+		lastUpdate = p.TS
+		prev = p
+		checked++
+	}
+
+	if checked == 0 || checked != res.SimulatedChanges {
+		t.Fatalf("checked %d of %d simulated changes", checked, res.SimulatedChanges)
+	}
+	if prev.SimRate != params.ExcessRate {
+		t.Fatalf("rate dropped to %d, want the floor %d", prev.SimRate, params.ExcessRate)
+	}
+	if first := res.Trajectory[1]; first.SimRate != (500-10)*95/100 || first.TS != from+BACKTEST_STEP {
+		t.Fatalf("first drop to %d at %d", first.SimRate, first.TS-from)
+	}
+}
+
+func TestReplayForwards(t *testing.T) {
+	const channelId = 102
+	params := testRule()
+	params.InactivityDays = 30
+	now := time.Now().Unix()
+	from := now - 5*24*3600
+	outTS := from + 2*24*3600
+
+	// descending, as ForwardsLog returns them
+	forwards := []DataPoint{
+		{TS: uint64(outTS), Amount: 200_000, Fee: 100, PPM: 500, ChanIdIn: 7, ChanIdOut: channelId},
+		{TS: uint64(from - 24*3600), Amount: 100_000, Fee: 50, PPM: 500, ChanIdIn: 7, ChanIdOut: channelId},
+	}
+	feeLog := []*AutoFeeEvent{
+		{TimeStamp: from - 3600, OldRate: 200, NewRate: 300},
+		{TimeStamp: from + 3*24*3600, OldRate: 300, NewRate: 700},
+		{TimeStamp: from + 3*24*3600, OldRate: 0, NewRate: -50, IsInbound: true},
+	}
+
+	res := replay(channelId, params, forwards, feeLog, 1_000_000, 50_000, 700, from, now)
+
+	if res.StartLiqPct != 25 || res.EndLiqPct != 5 {
+		t.Fatalf("liquidity %d%% -> %d%%, want 25%% -> 5%%", res.StartLiqPct, res.EndLiqPct)
+	}
+	if res.Forwards != 1 || res.Volume != 200_000 {
+		t.Fatalf("replayed %d forwards of %d sats", res.Forwards, res.Volume)
+	}
+	if res.ActualFees != 100 || res.SimulatedFees != 60 {
+		t.Fatalf("fees actual %v simulated %v, want 100 and 60", res.ActualFees, res.SimulatedFees)
+	}
+	if res.Pricier != 0 {
+		t.Fatalf("%d forwards priced below the simulated rate", res.Pricier)
+	}
+	if res.ActualChanges != 1 || res.SimulatedChanges != 1 {
+		t.Fatalf("changes actual %d simulated %d, want 1 and 1", res.ActualChanges, res.SimulatedChanges)
+	}
+
+	var raised *BacktestPoint
+	for i := range res.Trajectory {
+		if res.Trajectory[i].SimRate == params.LowLiqRate {
+			raised = &res.Trajectory[i]
+			break
+		}
+	}
+	if raised == nil || raised.TS != outTS || raised.LiqPct != 5 {
+		t.Fatalf("rate not raised at the forward that drained the channel: %+v", raised)
+	}
+
+	last := res.Trajectory[len(res.Trajectory)-1]
+	if last.ActualRate != 700 || last.SimRate != params.LowLiqRate {
+		t.Fatalf("ended at actual %d simulated %d", last.ActualRate, last.SimRate)
+	}
+}
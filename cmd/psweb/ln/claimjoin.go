@@ -21,7 +21,6 @@ import (
 
 	"peerswap-web/cmd/psweb/bitcoin"
 	"peerswap-web/cmd/psweb/config"
-	"peerswap-web/cmd/psweb/db"
 	"peerswap-web/cmd/psweb/liquid"
 	"peerswap-web/cmd/psweb/ps"
 )
@@ -91,35 +90,34 @@ type ClaimParty struct {
 }
 
 // runs after restart, to continue if peg-in is ongoing
-func loadClaimJoinDB() {
-	db.Load("ClaimJoin", "ClaimJoinHandler", &ClaimJoinHandler)
-	db.Load("ClaimJoin", "ClaimJoinHandlerTS", &ClaimJoinHandlerTS)
-	db.Load("ClaimJoin", "ClaimBlockHeight", &ClaimBlockHeight)
-	db.Load("ClaimJoin", "JoinBlockHeight", &JoinBlockHeight)
-	db.Load("ClaimJoin", "ClaimStatus", &ClaimStatus)
-
-	db.Load("ClaimJoin", "MyRole", &MyRole)
-	db.Load("ClaimJoin", "keyToNodeId", &keyToNodeId)
-	db.Load("ClaimJoin", "ClaimParties", &ClaimParties)
+func loadClaimJoinDB() error {
+	if err := loadClaimJoin(); err != nil {
+		return err
+	}
 
 	if MyRole != "none" {
 		if config.Config.PeginTxId == "" {
 			// was claimed already
 			resetClaimJoin()
-			return
+			return nil
 		}
 
-		var serializedKey []byte
-		db.Load("ClaimJoin", "serializedPrivateKey", &serializedKey)
+		serializedKey, err := claimJoinKey.Get()
+		if err != nil {
+			return err
+		}
 		myPrivateKey, _ = btcec.PrivKeyFromBytes(serializedKey)
 		log.Println("Continue as", MyRole, MyPublicKey())
 
-		if MyRole == "initiator" {
-			db.Load("ClaimJoin", "claimPSET", &claimPSET)
+		if MyRole != "initiator" {
+			// only the initiator continues with the saved PSET
+			claimPSET = ""
 		}
 	} else if ClaimJoinHandler != "" {
 		log.Println("Continue with ClaimJoin invite from", ClaimJoinHandler)
 	}
+
+	return nil
 }
 
 // runs every block
@@ -141,7 +139,7 @@ create_pset:
 			EndClaimJoin("", err.Error())
 			return
 		}
-		db.Save("ClaimJoin", "claimPSET", &claimPSET)
+		persistClaimJoin()
 	}
 
 	decoded, err := liquid.DecodePSET(claimPSET)
@@ -163,7 +161,7 @@ create_pset:
 	if len(analyzed.Outputs) != numOutputs || len(decoded.Inputs) != len(ClaimParties) {
 		log.Printf("Malformed PSET with %d inputs and %d outputs, trying again", len(decoded.Inputs), len(analyzed.Outputs))
 		claimPSET = ""
-		db.Save("ClaimJoin", "claimPSET", &claimPSET)
+		persistClaimJoin()
 
 		errorCounter++
 		if errorCounter < 10 {
@@ -211,7 +209,7 @@ create_pset:
 					ClaimBlockHeight: ClaimBlockHeight,
 				}, true) {
 					log.Println(ClaimStatus)
-					db.Save("ClaimJoin", "ClaimStatus", &ClaimStatus)
+					persistClaimJoin()
 				}
 
 				return
@@ -254,7 +252,7 @@ create_pset:
 				}
 				ClaimStatus += " done"
 				log.Println(ClaimStatus)
-				db.Save("ClaimJoin", "ClaimStatus", &ClaimStatus)
+				persistClaimJoin()
 			} else {
 				serializedPset, err := base64.StdEncoding.DecodeString(claimPSET)
 				if err != nil {
@@ -269,7 +267,7 @@ create_pset:
 					ClaimBlockHeight: ClaimBlockHeight,
 				}, true) {
 					log.Println(ClaimStatus)
-					db.Save("ClaimJoin", "ClaimStatus", &ClaimStatus)
+					persistClaimJoin()
 
 				}
 				return
@@ -334,8 +332,7 @@ create_pset:
 			ClaimStatus = "Redo to improve fee"
 			claimPSET = ""
 
-			db.Save("ClaimJoin", "claimPSET", &claimPSET)
-			db.Save("ClaimJoin", "ClaimStatus", &ClaimStatus)
+			persistClaimJoin()
 
 			errorCounter = 0
 			goto create_pset
@@ -361,13 +358,11 @@ create_pset:
 func kickPeer(pubKey, reason string) {
 	if ok := removeClaimParty(pubKey); ok {
 		ClaimStatus = "Kicked out " + pubKey + ", total participants: " + strconv.Itoa(len(ClaimParties))
-		// persist to db
-		db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
 		log.Println(ClaimStatus, "for", reason)
 		// erase PSET to start over
 		claimPSET = ""
 		// persist to db
-		db.Save("ClaimJoin", "claimPSET", claimPSET)
+		persistClaimJoin()
 		// inform the offender
 		SendCoordination(pubKey, &Coordination{
 			Action: "refuse_add",
@@ -419,7 +414,7 @@ func Broadcast(fromNodeId string, message *Message) bool {
 	if keyToNodeId[message.Sender] == "" {
 		// store path for relaying further encrypted messages
 		keyToNodeId[message.Sender] = fromNodeId
-		db.Save("ClaimJoin", "keyToNodeId", keyToNodeId)
+		persistClaimJoin()
 	}
 
 	// react to received broadcast
@@ -444,8 +439,7 @@ func Broadcast(fromNodeId string, message *Message) bool {
 				log.Println("Initiator collision, switching to 'none'")
 				MyRole = "none"
 				ClaimJoinHandler = ""
-				db.Save("ClaimJoin", "MyRole", MyRole)
-				db.Save("ClaimJoin", "ClaimJoinHandler", ClaimJoinHandler)
+				persistClaimJoin()
 			}
 		} else if MyRole == "joiner" {
 			// already joined another group, ignore
@@ -473,10 +467,7 @@ func Broadcast(fromNodeId string, message *Message) bool {
 			log.Println(ClaimStatus, "from", ClaimJoinHandler, "via", GetAlias(fromNodeId))
 
 			// persist to db
-			db.Save("ClaimJoin", "ClaimJoinHandler", ClaimJoinHandler)
-			db.Save("ClaimJoin", "ClaimJoinHandlerTS", ClaimJoinHandlerTS)
-			db.Save("ClaimJoin", "JoinBlockHeight", JoinBlockHeight)
-			db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
+			persistClaimJoin()
 		}
 
 	case "pegin_ended":
@@ -520,7 +511,7 @@ func Broadcast(fromNodeId string, message *Message) bool {
 		} else {
 			// forget the route only
 			keyToNodeId[message.Sender] = ""
-			db.Save("ClaimJoin", "keyToNodeId", keyToNodeId)
+			persistClaimJoin()
 		}
 	}
 
@@ -599,7 +590,7 @@ func Process(message *Message, senderNodeId string) {
 		// save source key map
 		keyToNodeId[message.Sender] = senderNodeId
 		// persist to db
-		db.Save("ClaimJoin", "keyToNodeId", keyToNodeId)
+		persistClaimJoin()
 	}
 
 	if message.Destination == MyPublicKey() {
@@ -652,10 +643,8 @@ func Process(message *Message, senderNodeId string) {
 						Status:           status,
 					}, false) {
 						ClaimBlockHeight = max(ClaimBlockHeight, msg.ClaimBlockHeight)
-						db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
-
 						ClaimStatus = "Added new peer, total participants: " + strconv.Itoa(len(ClaimParties))
-						db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
+						persistClaimJoin()
 						log.Println("Added "+msg.Joiner.PubKey+", total:", len(ClaimParties))
 						sendToGroup("Another peer joined, total participants: " + strconv.Itoa(len(ClaimParties)))
 					}
@@ -680,13 +669,11 @@ func Process(message *Message, senderNodeId string) {
 
 				if removeClaimParty(msg.Joiner.PubKey) {
 					ClaimStatus = "Removed a peer, total participants: " + strconv.Itoa(len(ClaimParties))
-					// persist to db
-					db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
 					log.Println(ClaimStatus)
 					// erase PSET to start over
 					claimPSET = ""
 					// persist to db
-					db.Save("ClaimJoin", "claimPSET", claimPSET)
+					persistClaimJoin()
 					sendToGroup("One peer left, total participants: " + strconv.Itoa(len(ClaimParties)))
 				} else {
 					log.Println("Cannot remove peer, not in the list")
@@ -699,10 +686,7 @@ func Process(message *Message, senderNodeId string) {
 				ClaimStatus = msg.Status
 				log.Println(ClaimStatus)
 				// persist to db
-				db.Save("ClaimJoin", "MyRole", MyRole)
-				db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
-				db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
-				db.Save("ClaimJoin", "ClaimJoinHandler", ClaimJoinHandler)
+				persistClaimJoin()
 
 			case "refuse_add":
 				log.Println(msg.Status)
@@ -754,9 +738,7 @@ func Process(message *Message, senderNodeId string) {
 							MyRole = "none"
 							log.Println(ClaimStatus)
 
-							db.Save("ClaimJoin", "MyRole", &MyRole)
-							db.Save("ClaimJoin", "ClaimStatus", &ClaimStatus)
-							db.Save("ClaimJoin", "ClaimJoinHandler", &ClaimJoinHandler)
+							persistClaimJoin()
 						}
 					}
 					return
@@ -771,10 +753,8 @@ func Process(message *Message, senderNodeId string) {
 					ClaimStatus = msg.Status
 					log.Println(ClaimStatus)
 
-					db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
-
 					// Save the received claimPSET
-					db.Save("ClaimJoin", "claimPSET", &claimPSET)
+					persistClaimJoin()
 
 					// execute onBlock to continue signing
 					OnBlock(ClaimBlockHeight)
@@ -797,8 +777,7 @@ func Process(message *Message, senderNodeId string) {
 				ClaimStatus = msg.Status + " done"
 				log.Println(ClaimStatus)
 
-				db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
-				db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
+				persistClaimJoin()
 
 				serializedPset, err := base64.StdEncoding.DecodeString(claimPSET)
 				if err != nil {
@@ -866,14 +845,11 @@ func forgetPubKey(destination string) {
 			MyRole = "none"
 			ClaimStatus = "Unable to contact Initiator, resetting"
 			log.Println(ClaimStatus)
-			db.Save("ClaimJoin", "MyRole", MyRole)
-			db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
 		}
 		ClaimJoinHandler = ""
-		db.Save("ClaimJoin", "ClaimJoinHandler", ClaimJoinHandler)
 	}
 	keyToNodeId[destination] = ""
-	db.Save("ClaimJoin", "keyToNodeId", keyToNodeId)
+	persistClaimJoin()
 }
 
 // called for claim join initiator after his pegin funding tx confirms
@@ -898,9 +874,7 @@ func InitiateClaimJoin(claimBlockHeight uint32) bool {
 			ClaimParties = append(ClaimParties, *party)
 			ClaimBlockHeight = claimBlockHeight
 			JoinBlockHeight = claimBlockHeight - 1
-			db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
-			db.Save("ClaimJoin", "JoinBlockHeight", JoinBlockHeight)
-			db.Save("ClaimJoin", "ClaimParties", ClaimParties)
+			persistClaimJoin()
 			// new invitation timestamp
 			ts = uint64(time.Now().Unix())
 		} else {
@@ -923,8 +897,7 @@ func InitiateClaimJoin(claimBlockHeight uint32) bool {
 			ClaimJoinHandlerTS = ts
 			ClaimStatus = "Invites sent, awaiting peers to join"
 			// persist to db
-			db.Save("ClaimJoin", "ClaimJoinHandlerTS", ClaimJoinHandlerTS)
-			db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
+			persistClaimJoin()
 		}
 		return true
 	}
@@ -965,13 +938,7 @@ func resetClaimJoin() {
 	keyToNodeId = make(map[string]string)
 
 	// persist to db
-	db.Save("ClaimJoin", "ClaimParties", ClaimParties)
-	db.Save("ClaimJoin", "ClaimJoinHandler", ClaimJoinHandler)
-	db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
-	db.Save("ClaimJoin", "JoinBlockHeight", JoinBlockHeight)
-	db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
-	db.Save("ClaimJoin", "MyRole", MyRole)
-	db.Save("ClaimJoin", "keyToNodeId", keyToNodeId)
+	persistClaimJoin()
 }
 
 // called for ClaimJoin joiner candidate after his pegin funding tx confirms
@@ -1032,8 +999,7 @@ func JoinClaimJoin(claimBlockHeight uint32) bool {
 		}
 		ClaimParties = append(ClaimParties, *cp)
 		ClaimBlockHeight = claimBlockHeight
-		db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
-		db.Save("ClaimJoin", "ClaimParties", ClaimParties)
+		persistClaimJoin()
 	}
 
 	if SendCoordination(ClaimJoinHandler, &Coordination{
@@ -1045,7 +1011,7 @@ func JoinClaimJoin(claimBlockHeight uint32) bool {
 		joinCounter++
 		ClaimStatus = "Responded to invitation, awaiting confirmation"
 		// persist to db
-		db.Save("ClaimJoin", "ClaimStatus", ClaimStatus)
+		persistClaimJoin()
 		return true
 	}
 
@@ -1143,7 +1109,7 @@ func addClaimParty(newParty *ClaimParty) (bool, string) {
 	ClaimParties = append(ClaimParties, *newParty)
 
 	// persist to db
-	db.Save("ClaimJoin", "ClaimParties", ClaimParties)
+	persistClaimJoin()
 
 	return true, "Successfully joined, total participants: " + strconv.Itoa(len(ClaimParties))
 }
@@ -1170,13 +1136,13 @@ func removeClaimParty(pubKey string) bool {
 	if claimBlockHeight < ClaimBlockHeight {
 		ClaimBlockHeight = claimBlockHeight
 		// persist to db
-		db.Save("ClaimJoin", "ClaimBlockHeight", ClaimBlockHeight)
+		persistClaimJoin()
 	}
 
 	ClaimParties = newClaimParties
 
 	// persist to db
-	db.Save("ClaimJoin", "ClaimParties", ClaimParties)
+	persistClaimJoin()
 
 	return true
 }
@@ -1348,7 +1314,9 @@ func savePrivateKey() {
 		return
 	}
 	data := myPrivateKey.Serialize()
-	db.Save("ClaimJoin", "serializedPrivateKey", data)
+	if err := claimJoinKey.Put(data); err != nil {
+		log.Println("Failed to persist ClaimJoin key:", err)
+	}
 }
 
 // checks that the new PSET has the same input/output count
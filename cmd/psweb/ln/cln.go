@@ -15,13 +15,17 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"peerswap-web/cmd/psweb/bitcoin"
 	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
+	"peerswap-web/cmd/psweb/events"
 	"peerswap-web/cmd/psweb/safemap"
 
 	"github.com/elementsproject/glightning/glightning"
+	"github.com/elementsproject/glightning/jrpc2"
 	"github.com/elementsproject/peerswap/peerswaprpc"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -37,12 +41,16 @@ var (
 	forwardsIn        = safemap.New[uint64, []Forwarding]()
 	forwardsOut       = safemap.New[uint64, []Forwarding]()
 	forwardsLastIndex uint64
-	downloadComplete  bool
-	// track timestamp of the last failed forward
-	failedForwardTS = safemap.New[uint64, int64]()
-	lightning       *glightning.Lightning
+	// channel_htlcs rows below this id are persisted in psweb.db
+	htlcsLastIndex   uint64
+	downloadComplete bool
+	historyLoaded    bool
+	// one incremental forwards download at a time
+	forwardsMu sync.Mutex
+	lightning  *glightning.Lightning
 	// cln database calls take too long, cache them
 	htlcsCache    = safemap.New[string, []HTLC]()               // by shortChannelId
+	htlcsCached   = safemap.New[htlcKey, struct{}]()            // to skip duplicates
 	invoicesCache = safemap.New[string, ListInvoicesResponse]() // by PaymentHash
 	sendpaysCache = safemap.New[string, ListSendPaysResponse]() // by PaymentHash
 	// sqlite3 channel Id mapped to short_channel_id
@@ -81,6 +89,7 @@ func GetClient() (*glightning.Lightning, func(), error) {
 		lightning = glightning.NewLightning()
 		err := lightning.StartUp(RPC_FILE, config.Config.RpcHost)
 		if err != nil {
+			RpcErrors.Add(1)
 			log.Println("Cannot start glightning client")
 			return nil, nil, err
 		}
@@ -91,10 +100,19 @@ func GetClient() (*glightning.Lightning, func(), error) {
 	return lightning, cleanup, nil
 }
 
+// count failed calls for metrics
+func clnRequest(client *glightning.Lightning, m jrpc2.Method, resp interface{}) error {
+	err := client.Request(m, resp)
+	if err != nil {
+		RpcErrors.Add(1)
+	}
+	return err
+}
+
 func ConfirmedWalletBalance(client *glightning.Lightning) int64 {
 	var response map[string]interface{}
 
-	err := client.Request(&glightning.ListFundsRequest{}, &response)
+	err := clnRequest(client, &glightning.ListFundsRequest{}, &response)
 	if err != nil {
 		log.Println("ListFunds:", err)
 		return 0
@@ -125,7 +143,7 @@ func ListUnspent(client *glightning.Lightning, list *[]UTXO, minConfs int32) err
 	tip := res.Blockheight
 
 	var response map[string]interface{}
-	err = client.Request(&glightning.ListFundsRequest{}, &response)
+	err = clnRequest(client, &glightning.ListFundsRequest{}, &response)
 	if err != nil {
 		log.Println("ListFunds:", err)
 		return err
@@ -254,7 +272,7 @@ func BumpPeginFee(newFeeRate float64, label string) (*SentResult, error) {
 	}
 
 	var res UtxoPsbtResponse
-	err = client.Request(&UtxoPsbtRequest{
+	err = clnRequest(client, &UtxoPsbtRequest{
 		Satoshi:     "all",
 		Feerate:     "3000perkb",
 		StartWeight: 0,
@@ -268,7 +286,7 @@ func BumpPeginFee(newFeeRate float64, label string) (*SentResult, error) {
 	}
 
 	var res2 UnreserveInputsResponse
-	err = client.Request(&UnreserveInputsRequest{
+	err = clnRequest(client, &UnreserveInputsRequest{
 		Reserve: 1000,
 		PSBT:    res.PSBT,
 	}, &res2)
@@ -373,7 +391,7 @@ func SendCoinsWithUtxos(utxos *[]string, addr string, amount int64, feeRate floa
 	}
 
 	var res WithdrawResult
-	err = client.Request(&WithdrawRequest{
+	err = clnRequest(client, &WithdrawRequest{
 		Destination: addr,
 		Satoshi:     amountStr,
 		FeeRate:     fmt.Sprint(uint(feeRate*multiplier)) + "perkb",
@@ -446,6 +464,12 @@ func (r *ListForwardsRequest) Name() string {
 // queries lightningd.sqlite3 channel_htlcs table to pull
 // htlcs into htlcsCache map sorted by short channel id
 func CacheHTLCs(where string) int {
+	return cacheHTLCs(where, false)
+}
+
+// moveCursor advances htlcsLastIndex past the resolved htlcs,
+// only valid when scanning all rows above it
+func cacheHTLCs(where string, moveCursor bool) int {
 	// refresh full channel id into short mapping
 	client, clean, err := GetClient()
 	if err != nil {
@@ -454,7 +478,7 @@ func CacheHTLCs(where string) int {
 	defer clean()
 
 	var response map[string]interface{}
-	err = client.Request(&ListPeerChannelsRequest{}, &response)
+	err = clnRequest(client, &ListPeerChannelsRequest{}, &response)
 	if err != nil {
 		log.Println("ListPeerChannelsRequest:", err)
 		return 0
@@ -481,15 +505,15 @@ func CacheHTLCs(where string) int {
 	}
 
 	// Open a database connection
-	db, err := sql.Open("sqlite3", config.Config.LightningDir+"/"+folder+"/lightningd.sqlite3")
+	sqlDb, err := sql.Open("sqlite3", config.Config.LightningDir+"/"+folder+"/lightningd.sqlite3")
 	if err != nil {
 		log.Println("Error opening database:", err)
 		return 0
 	}
-	defer db.Close()
+	defer sqlDb.Close()
 
 	// refresh full channel Ids
-	rows, err := db.Query("SELECT id, full_channel_id FROM channels")
+	rows, err := sqlDb.Query("SELECT id, full_channel_id FROM channels")
 	if err != nil {
 		log.Println("Error executing query:", err)
 		return 0
@@ -524,10 +548,16 @@ func CacheHTLCs(where string) int {
 	limit := 1000
 	offset := 0
 
+	var (
+		added        []HTLC
+		maxId        uint64
+		minPendingId uint64
+	)
+
 	// Get the HTLCs
 	for {
 		query := fmt.Sprintf("SELECT channel_id, id, cltv_expiry, msatoshi, payment_hash, hstate FROM channel_htlcs WHERE %s LIMIT %d OFFSET %d", where, limit, offset)
-		rows, err = db.Query(query)
+		rows, err = sqlDb.Query(query)
 		if err != nil {
 			log.Println("Error executing query:", err)
 			return 0
@@ -560,8 +590,17 @@ func CacheHTLCs(where string) int {
 				if hstate > 9 {
 					htlc.Direction = "out"
 				}
-				appendHTLC(htlc)
+				if appendHTLC(htlc) {
+					added = append(added, htlc)
+				}
 				numHtlcs++
+
+				if htlc.Id > maxId {
+					maxId = htlc.Id
+				}
+				if !htlcIsResolved(htlc) && (minPendingId == 0 || htlc.Id < minPendingId) {
+					minPendingId = htlc.Id
+				}
 			} else {
 				log.Println("Short channel id is missing for SQL channel id", cid)
 			}
@@ -578,21 +617,41 @@ func CacheHTLCs(where string) int {
 		offset += limit
 	}
 
+	if moveCursor {
+		if minPendingId > 0 {
+			// pending htlcs must be checked again
+			htlcsLastIndex = minPendingId - 1
+		} else if maxId > htlcsLastIndex {
+			htlcsLastIndex = maxId
+		}
+	}
+
+	if len(added) > 0 || moveCursor {
+		if err := db.Append("Htlcs", added, htlcsLastIndex); err != nil {
+			log.Println("Failed to persist HTLCs:", err)
+		}
+	}
+
 	return numHtlcs
 }
 
 // cache routing history per channel from cln
 func cacheForwards(client *glightning.Lightning) int {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
 	// refresh history
 	var newForwards struct {
 		Forwards []Forwarding `json:"forwards"`
 	}
 
 	totalForwards := 0
+	// do not publish the history downloaded on startup
+	initialLoad := forwardsLastIndex == 0
 
 	for {
 		// get incremental history
-		err := client.Request(&ListForwardsRequest{
+		err := clnRequest(client, &ListForwardsRequest{
 			Index: "created",
 			Start: forwardsLastIndex,
 			Limit: 1000,
@@ -605,36 +664,31 @@ func cacheForwards(client *glightning.Lightning) int {
 		n := len(newForwards.Forwards)
 		if n > 0 {
 			forwardsLastIndex = newForwards.Forwards[n-1].CreatedIndex + 1
+			var records []Forwarding
 			for _, f := range newForwards.Forwards {
-				chOut := ConvertClnToLndChannelId(f.OutChannel)
 				if f.Status == "settled" && f.OutMsat >= IGNORE_FORWARDS_MSAT {
 					chIn := ConvertClnToLndChannelId(f.InChannel)
-
-					fi, ok := forwardsIn.Read(chIn)
-					if !ok {
-						fi = []Forwarding{} // Initialize an empty slice if the key does not exist
-					}
-					fi = append(fi, f)         // Append the new forwarding record
-					forwardsIn.Write(chIn, fi) // Write the updated slice
-
-					fo, ok := forwardsOut.Read(chOut)
-					if !ok {
-						fo = []Forwarding{} // Initialize an empty slice if the key does not exist
-					}
-					fo = append(fo, f)           // Append the new forwarding record
-					forwardsOut.Write(chOut, fo) // Write the updated slice
-
-					// save for autofees
-					LastForwardTS.Write(chOut, int64(f.ResolvedTime))
-					// forget last failed attempt
-					failedForwardTS.Write(chOut, 0)
-				} else {
-					// catch not enough balance error
-					if f.FailCode == 4103 {
-						failedForwardTS.Write(chOut, int64(f.ReceivedTime))
+					chOut := ConvertClnToLndChannelId(f.OutChannel)
+
+					appendForward(f)
+					records = append(records, f)
+
+					if !initialLoad {
+						events.Publish(events.FORWARD, &events.Forward{
+							ChannelIdIn:  chIn,
+							ChannelIdOut: chOut,
+							AmountIn:     (f.OutMsat + f.FeeMsat) / 1000,
+							AmountOut:    f.OutMsat / 1000,
+							FeeMsat:      f.FeeMsat,
+						})
 					}
 				}
 			}
+
+			// persist with the cursor, so that restarts only fetch the delta
+			if err := db.Append("Forwards", records, forwardsLastIndex); err != nil {
+				log.Println("Failed to persist forwards:", err)
+			}
 			totalForwards += n
 		} else {
 			break
@@ -644,6 +698,57 @@ func cacheForwards(client *glightning.Lightning) int {
 	return totalForwards
 }
 
+func appendForward(f Forwarding) {
+	chIn := ConvertClnToLndChannelId(f.InChannel)
+	chOut := ConvertClnToLndChannelId(f.OutChannel)
+
+	fi, ok := forwardsIn.Read(chIn)
+	if !ok {
+		fi = []Forwarding{} // Initialize an empty slice if the key does not exist
+	}
+	fi = append(fi, f)         // Append the new forwarding record
+	forwardsIn.Write(chIn, fi) // Write the updated slice
+
+	fo, ok := forwardsOut.Read(chOut)
+	if !ok {
+		fo = []Forwarding{} // Initialize an empty slice if the key does not exist
+	}
+	fo = append(fo, f)           // Append the new forwarding record
+	forwardsOut.Write(chOut, fo) // Write the updated slice
+
+	// save for autofees
+	LastForwardTS.Write(chOut, int64(f.ResolvedTime))
+}
+
+// load persisted history, HTLCs expiring after fromBlock,
+// and set cursors for incremental downloads
+func loadHistory(fromBlock uint32) {
+	start := time.Now()
+	total := 0
+
+	// listforwards has no time limit, neither does the cache
+	err := db.LoadAll("Forwards", &forwardsLastIndex, func(f Forwarding) {
+		appendForward(f)
+		total++
+	})
+	if err != nil {
+		log.Println("Failed to load forwards:", err)
+	}
+
+	err = db.LoadAll("Htlcs", &htlcsLastIndex, func(htlc HTLC) {
+		if htlc.Expiry > uint64(fromBlock) && appendHTLC(htlc) {
+			total++
+		}
+	})
+	if err != nil {
+		log.Println("Failed to load HTLCs:", err)
+	}
+
+	if total > 0 {
+		log.Printf("Loaded %d history records from db in %.2f seconds", total, time.Since(start).Seconds())
+	}
+}
+
 // get routing statistics for a channel
 func GetForwardingStats(lndChannelId uint64) *ForwardingStats {
 	var (
@@ -740,6 +845,46 @@ func GetForwardingStats(lndChannelId uint64) *ForwardingStats {
 	return &result
 }
 
+// get lifetime routing totals for a channel
+func GetForwardingTotals(lndChannelId uint64) *ForwardingTotals {
+	var (
+		result       ForwardingTotals
+		amountOut    uint64
+		amountIn     uint64
+		feeMsat      uint64
+		assistedMsat uint64
+	)
+
+	fo, ok := forwardsOut.Read(lndChannelId)
+	if ok {
+		for _, e := range fo {
+			if e.OutMsat >= IGNORE_FORWARDS_MSAT {
+				result.CountOut++
+				amountOut += e.OutMsat
+				feeMsat += e.FeeMsat
+			}
+		}
+	}
+
+	fi, ok := forwardsIn.Read(lndChannelId)
+	if ok {
+		for _, e := range fi {
+			if e.OutMsat >= IGNORE_FORWARDS_MSAT {
+				result.CountIn++
+				amountIn += e.OutMsat
+				assistedMsat += e.FeeMsat
+			}
+		}
+	}
+
+	result.AmountOut = amountOut / 1000
+	result.AmountIn = amountIn / 1000
+	result.FeeSat = feeMsat / 1000
+	result.AssistedFeeSat = assistedMsat / 1000
+
+	return &result
+}
+
 // Payment represents the structure of the payment data
 type Payment struct {
 	Status         string `json:"status"`
@@ -868,7 +1013,7 @@ func GetChannelInfo(client *glightning.Lightning, lndChannelId uint64, nodeId st
 
 	var response map[string]interface{}
 
-	err := client.Request(&ListPeerChannelsRequest{
+	err := clnRequest(client, &ListPeerChannelsRequest{
 		PeerId: nodeId,
 	}, &response)
 	if err != nil {
@@ -913,7 +1058,7 @@ func NewAddress() (string, error) {
 		Taproot    string `json:"p2tr"`
 	}
 
-	err = client.Request(&glightning.NewAddrRequest{
+	err = clnRequest(client, &glightning.NewAddrRequest{
 		AddressType: "p2tr",
 	}, &res)
 	if err != nil {
@@ -1013,7 +1158,7 @@ func SendKeysendMessage(destPubkey string, amountSats int64, message string) err
 	var res KeySendResponse
 
 	// Send the keysend payment
-	err = client.Request(&KeySendRequest{
+	err = clnRequest(client, &KeySendRequest{
 		Destination: destPubkey,
 		AmountMsat:  amountSats * 1000,
 		Tlvs: map[string]string{
@@ -1069,8 +1214,19 @@ func DownloadAll() bool {
 	}
 
 	// look back 6 months only
-	where := fmt.Sprintf("cltv_expiry > %d", blockHeight-26_352)
-	numHtlcs := CacheHTLCs(where)
+	fromBlock := blockHeight - 26_352
+
+	if !historyLoaded {
+		// restore from db to download only the delta
+		loadHistory(fromBlock)
+		historyLoaded = true
+	}
+
+	where := fmt.Sprintf("cltv_expiry > %d", fromBlock)
+	if htlcsLastIndex > 0 {
+		where = fmt.Sprintf("id > %d", htlcsLastIndex)
+	}
+	numHtlcs := cacheHTLCs(where, true)
 
 	downloadComplete = true
 
@@ -1083,7 +1239,7 @@ func DownloadAll() bool {
 
 		var res ListHtlcsResponse
 		// cache all HTLCs
-		err = client.Request(&ListHtlcsRequest{}, &res)
+		err = clnRequest(client, &ListHtlcsRequest{}, &res)
 		if err != nil {
 			// CLN not ready
 			return false
@@ -1129,23 +1285,43 @@ func DownloadAll() bool {
 	return true
 }
 
-func appendHTLC(htlc HTLC) {
+func htlcIsResolved(htlc HTLC) bool {
+	return htlc.State == "SENT_REMOVE_ACK_REVOCATION" || htlc.State == "RCVD_REMOVE_ACK_REVOCATION"
+}
+
+// htlc ids are counted per channel and direction
+type htlcKey struct {
+	shortChannelId string
+	id             uint64
+	direction      string
+}
+
+// returns true if the htlc was not cached before
+func appendHTLC(htlc HTLC) bool {
 	// ignore unsettled
-	if htlc.State != "SENT_REMOVE_ACK_REVOCATION" && htlc.State != "RCVD_REMOVE_ACK_REVOCATION" {
-		return
+	if !htlcIsResolved(htlc) {
+		return false
 	}
+	key := htlcKey{htlc.ShortChannelId, htlc.Id, htlc.Direction}
+	if _, ok := htlcsCached.Read(key); ok {
+		// already cached
+		return false
+	}
+	htlcsCached.Write(key, struct{}{})
+
 	htlcs, ok := htlcsCache.Read(htlc.ShortChannelId)
 	if !ok {
 		htlcs = []HTLC{} // Initialize an empty slice if the key does not exist
 	}
 	htlcs = append(htlcs, htlc)                  // Append the new HTLC
 	htlcsCache.Write(htlc.ShortChannelId, htlcs) // Write the updated slice
+	return true
 }
 
 func GetInvoice(client *glightning.Lightning, request *ListInvoicesRequest) (ListInvoicesResponse, error) {
 	inv, ok := invoicesCache.Read(request.PaymentHash)
 	if !ok { // fetch from cln
-		err := client.Request(request, &inv)
+		err := clnRequest(client, request, &inv)
 		if err != nil {
 			return inv, err
 		}
@@ -1196,7 +1372,7 @@ func fetchPaymentsStats(client *glightning.Lightning, timeStamp uint64, channelI
 					// can be a rebalance in, check timestamp and record the stats
 					pmt, ok := sendpaysCache.Read(htlc.PaymentHash)
 					if !ok { // fetch from cln
-						err := client.Request(&ListSendPaysRequest{
+						err := clnRequest(client, &ListSendPaysRequest{
 							PaymentHash: htlc.PaymentHash,
 						}, &pmt)
 						if err != nil {
@@ -1218,7 +1394,7 @@ func fetchPaymentsStats(client *glightning.Lightning, timeStamp uint64, channelI
 				// direction out, look for payments
 				pmt, ok := sendpaysCache.Read(htlc.PaymentHash)
 				if !ok { // fetch from cln
-					err := client.Request(&ListSendPaysRequest{
+					err := clnRequest(client, &ListSendPaysRequest{
 						PaymentHash: htlc.PaymentHash,
 					}, &pmt)
 					if err != nil {
@@ -1265,7 +1441,7 @@ func EstimateFee() float64 {
 func FeeReport(client *glightning.Lightning, outboundFeeRates map[uint64]int64, inboundFeeRates map[uint64]int64) error {
 	var response map[string]interface{}
 
-	err := client.Request(&ListPeerChannelsRequest{}, &response)
+	err := clnRequest(client, &ListPeerChannelsRequest{}, &response)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -1316,7 +1492,7 @@ func SetFeeRate(peerNodeId string,
 	clnChId := ConvertLndToClnChannelId(channelId)
 
 	var response map[string]interface{}
-	err = client.Request(&ListPeerChannelsRequest{}, &response)
+	err = clnRequest(client, &ListPeerChannelsRequest{}, &response)
 	if err != nil {
 		return 0, err
 	}
@@ -1329,7 +1505,11 @@ func SetFeeRate(peerNodeId string,
 		channelMap := channel.(map[string]interface{})
 		if channelMap["short_channel_id"] != nil {
 			if clnChId == channelMap["short_channel_id"].(string) {
-				oldRate = int(channelMap["fee_proportional_millionths"].(float64))
+				if isBase {
+					oldRate = int(channelMap["fee_base_msat"].(float64))
+				} else {
+					oldRate = int(channelMap["fee_proportional_millionths"].(float64))
+				}
 				break
 			}
 		}
@@ -1349,7 +1529,7 @@ func SetFeeRate(peerNodeId string,
 		return oldRate, errors.New("rate was already set")
 	}
 
-	err = client.Request(&req, &res)
+	err = clnRequest(client, &req, &res)
 	if err != nil {
 		log.Println("SetFeeRate:", err)
 		return oldRate, err
@@ -1358,44 +1538,260 @@ func SetFeeRate(peerNodeId string,
 	return oldRate, nil
 }
 
-// set min or max HTLC size (Msat!!!) for a channel
+// set min or max HTLC size (Msat!!!) for a channel, return old size
 func SetHtlcSize(peerNodeId string,
 	channelId uint64,
 	htlcMsat int64,
-	isMax bool) error {
+	isMax bool) (int64, error) {
 
 	client, cleanup, err := GetClient()
 	if err != nil {
 		log.Println("SetHtlcSize:", err)
-		return err
+		return 0, err
 	}
 	defer cleanup()
 
+	clnChId := ConvertLndToClnChannelId(channelId)
+
+	var response map[string]interface{}
+	err = clnRequest(client, &ListPeerChannelsRequest{}, &response)
+	if err != nil {
+		return 0, err
+	}
+
+	key := "htlc_minimum_msat"
+	if isMax {
+		key = "htlc_maximum_msat"
+	}
+
+	oldSize := int64(0)
+
+	// Iterate over channels to get old size
+	channels := response["channels"].([]interface{})
+	for _, channel := range channels {
+		channelMap := channel.(map[string]interface{})
+		if channelMap["short_channel_id"] != nil {
+			if clnChId == channelMap["short_channel_id"].(string) {
+				oldSize = int64(ourPolicyValue(channelMap, key))
+				break
+			}
+		}
+	}
+
+	if oldSize == htlcMsat {
+		// nothing to do
+		return oldSize, nil
+	}
+
 	var req SetChannelRequest
 	var res map[string]interface{}
 
-	req.Id = ConvertLndToClnChannelId(channelId)
+	req.Id = clnChId
 	if isMax {
 		req.HtlcMaxMsat = htlcMsat
 	} else {
 		req.HtlcMinMsat = htlcMsat
 	}
 
-	err = client.Request(&req, &res)
+	err = clnRequest(client, &req, &res)
 	if err != nil {
 		log.Println("SetHtlcSize:", err)
-		return err
+		return oldSize, err
 	}
 
-	return nil
+	return oldSize, nil
 }
 
 func HasInboundFees() bool {
 	return false
 }
 
+type ListChannelsRequest struct {
+	Destination string `json:"destination,omitempty"`
+}
+
+func (r ListChannelsRequest) Name() string {
+	return "listchannels"
+}
+
+// rates other nodes charge toward the peer
+func competitorRates(client *glightning.Lightning, peerId string) []int {
+	var res struct {
+		Channels []struct {
+			Source          string `json:"source"`
+			Active          bool   `json:"active"`
+			FeePerMillionth int    `json:"fee_per_millionth"`
+		} `json:"channels"`
+	}
+
+	if err := clnRequest(client, &ListChannelsRequest{Destination: peerId}, &res); err != nil {
+		log.Println("ListChannels:", err)
+		return nil
+	}
+
+	var rates []int
+	for _, ch := range res.Channels {
+		if ch.Source == MyNodeId || !ch.Active {
+			continue
+		}
+		rates = append(rates, ch.FeePerMillionth)
+	}
+
+	return rates
+}
+
+// WIRE_TEMPORARY_CHANNEL_FAILURE, the local balance was insufficient
+const FAILCODE_INSUFFICIENT_BALANCE = 4103
+
+// forward_event notification, reacts like subscribeForwards does on LND
+func OnForwardEvent(outChannel string, status string, failCode int) {
+	if outChannel == "" || !downloadComplete {
+		// the timer covers the start
+		return
+	}
+
+	htlcFail := status == "local_failed" && failCode == FAILCODE_INSUFFICIENT_BALANCE
+	if status != "settled" && !htlcFail {
+		return
+	}
+
+	client, cleanup, err := GetClient()
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	if !htlcFail {
+		// record the forward before calculating with the new balance
+		cacheForwards(client)
+	}
+
+	applyAutoFee(client, ConvertClnToLndChannelId(outChannel), htlcFail)
+}
+
+// called after individual forward settles or fails
+func applyAutoFee(client *glightning.Lightning, channelId uint64, htlcFail bool) {
+	AutoFeeMu.Lock()
+	defer AutoFeeMu.Unlock()
+
+	run, dryRun := autoFeeMode(channelId)
+	if !run {
+		return
+	}
+
+	var response map[string]interface{}
+	if clnRequest(client, &ListPeerChannelsRequest{}, &response) != nil {
+		return
+	}
+
+	clnChId := ConvertLndToClnChannelId(channelId)
+	var channelMap map[string]interface{}
+	var normal []map[string]interface{}
+	for _, channel := range response["channels"].([]interface{}) {
+		ch := channel.(map[string]interface{})
+		if ch["state"].(string) != "CHANNELD_NORMAL" || ch["short_channel_id"] == nil {
+			continue
+		}
+		if ch["short_channel_id"].(string) == clnChId {
+			channelMap = ch
+		}
+		normal = append(normal, ch)
+	}
+	if channelMap == nil {
+		return
+	}
+
+	peerId := channelMap["peer_id"].(string)
+	var channels []peerChannel
+	for _, ch := range normal {
+		if ch["peer_id"].(string) == peerId {
+			channels = append(channels, peerChannel{
+				ChannelId: ConvertClnToLndChannelId(ch["short_channel_id"].(string)),
+				Local:     uint64(ch["to_us_msat"].(float64) / 1000),
+				Capacity:  uint64(ch["total_msat"].(float64) / 1000),
+			})
+		}
+	}
+
+	params, isPeerRule := AutoFeeAppliedRule(channelId, peerId)
+
+	oldFee := int(channelMap["fee_proportional_millionths"].(float64))
+	if dryRun {
+		oldFee = simulatedRate(channelId, oldFee, false)
+	}
+	newFee := oldFee
+	liqPct := int(channelMap["to_us_msat"].(float64) * 100 / channelMap["total_msat"].(float64))
+	note := ""
+
+	if htlcFail && !dryRun {
+		// max HTLC above the local balance fails
+		applyPolicyLimits(peerId, channelId, params, ownPolicy{
+			LocalMsat:    uint64(channelMap["to_us_msat"].(float64)),
+			CapacityMsat: uint64(channelMap["total_msat"].(float64)),
+			MinHtlcMsat:  ourPolicyValue(channelMap, "htlc_minimum_msat"),
+			MaxHtlcMsat:  ourPolicyValue(channelMap, "htlc_maximum_msat"),
+			BaseFeeMsat:  int(channelMap["fee_base_msat"].(float64)),
+		})
+	}
+
+	if isPeerRule {
+		// the timer sets the rates of all the peer's channels together
+		if htlcFail && !dryRun {
+			bumpPeerRule(peerId, params, peerLiqPct(channels), oldFee)
+		}
+		return
+	}
+
+	if htlcFail {
+		if liqPct < params.LowLiqPct {
+			// increase fee to help prevent further failed HTLCs
+			newFee += params.FailedBumpPPM
+
+			if !dryRun {
+				// bump LowLiqRate
+				CustomAutoFeeRule(channelId).LowLiqRate = newFee
+				// persist to db
+				if err := SaveAutoFeeRule(channelId); err != nil {
+					log.Println("Failed to persist auto fee rule:", err)
+				}
+			}
+		} else if liqPct > params.LowLiqPct {
+			// move threshold
+			if !dryRun {
+				moveLowLiqThreshold(channelId, params.FailedMoveThreshold)
+			}
+			return
+		}
+	} else {
+		newFee, note = calculateAutoFee(channelId, params, liqPct, oldFee, dryRun)
+		newFee = peerFeeBounds(params, newFee, peerFeeRate(channelMap), func() []int {
+			return competitorRates(client, peerId)
+		})
+	}
+
+	// set the new rate
+	if newFee != oldFee {
+		if dryRun {
+			recordShadowFee(channelId, oldFee, newFee, false)
+			logScheduleNote(channelId, note, true)
+		} else if !lastFeeIsTheSame(channelId, newFee, false, false) {
+			// FlushFeeUpdates sends it with other triggers coalesced
+			// and logs the schedule note once it is set
+			queueFeeUpdate(peerId, channelId, oldFee, newFee, false, note)
+		}
+	} else {
+		// the current rate is right again, nothing to send
+		cancelFeeUpdate(channelId, false)
+		logScheduleNote(channelId, note, dryRun)
+	}
+}
+
 func ApplyAutoFees() {
-	if !AutoFeeEnabledAll {
+	AutoFeeMu.Lock()
+	enabled := AutoFeeEnabledAll || anyDryRun()
+	AutoFeeMu.Unlock()
+
+	if !enabled {
 		return
 	}
 
@@ -1408,14 +1804,17 @@ func ApplyAutoFees() {
 	// incrementally refresh
 	cacheForwards(client)
 
+	AutoFeeMu.Lock()
+	defer AutoFeeMu.Unlock()
+
 	var response map[string]interface{}
-	if client.Request(&ListPeerChannelsRequest{}, &response) != nil {
+	if clnRequest(client, &ListPeerChannelsRequest{}, &response) != nil {
 		return
 	}
 
 	// Iterate over channels to set fees
-	channels := response["channels"].([]interface{})
-	for _, channel := range channels {
+	var channels []map[string]interface{}
+	for _, channel := range response["channels"].([]interface{}) {
 		channelMap := channel.(map[string]interface{})
 
 		if channelMap["state"].(string) != "CHANNELD_NORMAL" ||
@@ -1424,61 +1823,147 @@ func ApplyAutoFees() {
 			continue
 		}
 
+		channels = append(channels, channelMap)
+	}
+
+	// the first channel with the peer decides for the peer rule
+	sort.Slice(channels, func(i, j int) bool {
+		return ConvertClnToLndChannelId(channels[i]["short_channel_id"].(string)) <
+			ConvertClnToLndChannelId(channels[j]["short_channel_id"].(string))
+	})
+
+	byPeer := make(map[string][]peerChannel)
+	for _, channelMap := range channels {
+		peerId := channelMap["peer_id"].(string)
+		byPeer[peerId] = append(byPeer[peerId], peerChannel{
+			ChannelId: ConvertClnToLndChannelId(channelMap["short_channel_id"].(string)),
+			Local:     uint64(channelMap["to_us_msat"].(float64) / 1000),
+			Capacity:  uint64(channelMap["total_msat"].(float64) / 1000),
+		})
+	}
+	peerRates := make(map[string]peerRate)
+	competitors := make(competitorCache)
+
+	for _, channelMap := range channels {
 		channelId := ConvertClnToLndChannelId(channelMap["short_channel_id"].(string))
+		peerId := channelMap["peer_id"].(string)
 
-		if !AutoFeeEnabled[channelId] {
+		run, dryRun := autoFeeMode(channelId)
+		if !run {
 			// not enabled
 			continue
 		}
 
-		params := &AutoFeeDefaults
-		if AutoFee[channelId] != nil {
-			// channel has custom parameters
-			params = AutoFee[channelId]
-		}
+		params, isPeerRule := AutoFeeAppliedRule(channelId, peerId)
 
 		oldFee := int(channelMap["fee_proportional_millionths"].(float64))
-		newFee := oldFee
+		if dryRun {
+			oldFee = simulatedRate(channelId, oldFee, false)
+		}
 		liqPct := int(channelMap["to_us_msat"].(float64) * 100 / channelMap["total_msat"].(float64))
 
-		// check 10 minutes back to be sure
-		ts, ok := LastForwardTS.Read(channelId)
-		if ok && ts > time.Now().Add(-time.Duration(10*time.Minute)).Unix() {
-			// forget failed HTLC to prevent duplicate action
-			failedForwardTS.Write(channelId, 0)
-
-			if liqPct <= params.LowLiqPct {
-				// bump fee
-				newFee += params.FailedBumpPPM
+		// failed HTLCs are handled as they happen by OnForwardEvent
+		var newFee int
+		var note string
+		if decided, ok := peerRates[peerId]; isPeerRule && ok {
+			newFee, note = decided.rate, decided.note
+		} else {
+			if isPeerRule {
+				newFee, note = calculatePeerAutoFee(channelId, byPeer[peerId], params, oldFee, dryRun)
 			} else {
-				// move threshold or do nothing
-				moveLowLiqThreshold(channelId, params.FailedMoveThreshold)
-				return
+				newFee, note = calculateAutoFee(channelId, params, liqPct, oldFee, dryRun)
+			}
+			newFee = peerFeeBounds(params, newFee, peerFeeRate(channelMap), func() []int {
+				return competitors.rates(peerId, func() []int {
+					return competitorRates(client, peerId)
+				})
+			})
+			if isPeerRule {
+				peerRates[peerId] = peerRate{newFee, note}
 			}
-		}
-
-		// if no Fail Bump
-		if newFee == oldFee {
-			newFee = calculateAutoFee(channelId, params, liqPct, oldFee)
 		}
 
 		// set the new rate
 		if newFee != oldFee {
-			// check if the fee was already set
-			if lastFeeIsTheSame(channelId, newFee, false) {
-				continue
+			if dryRun {
+				recordShadowFee(channelId, oldFee, newFee, false)
+				logScheduleNote(channelId, note, true)
+			} else if !lastFeeIsTheSame(channelId, newFee, false, false) {
+				// FlushFeeUpdates sends it with other triggers coalesced
+				// and logs the schedule note once it is set
+				queueFeeUpdate(peerId, channelId, oldFee, newFee, false, note)
+			}
+		} else {
+			// the current rate is right again, nothing to send
+			cancelFeeUpdate(channelId, false)
+			logScheduleNote(channelId, note, dryRun)
+		}
+
+		if !dryRun {
+			applyPolicyLimits(peerId, channelId, params, ownPolicy{
+				LocalMsat:    uint64(channelMap["to_us_msat"].(float64)),
+				CapacityMsat: uint64(channelMap["total_msat"].(float64)),
+				MinHtlcMsat:  ourPolicyValue(channelMap, "htlc_minimum_msat"),
+				MaxHtlcMsat:  ourPolicyValue(channelMap, "htlc_maximum_msat"),
+				BaseFeeMsat:  int(channelMap["fee_base_msat"].(float64)),
+			})
+		}
+
+		if HasInboundFees() {
+			// listpeerchannels does not report it, use the last one set
+			inboundRate := 0
+			if last := lastAutoFeeLog(channelId, true, false); last != nil {
+				inboundRate = last.NewRate
+			}
+			if dryRun {
+				inboundRate = simulatedRate(channelId, inboundRate, true)
+			}
+			if isPeerRule {
+				// inbound fee follows the combined liquidity
+				liqPct = peerLiqPct(byPeer[peerId])
 			}
 
-			peerId := channelMap["peer_id"].(string)
-			_, err = SetFeeRate(peerId, channelId, int64(newFee), false, false)
-			if err == nil && !lastFeeIsTheSame(channelId, newFee, false) {
-				// log the last change
-				LogFee(channelId, oldFee, newFee, false, false)
+			inboundRateToSet, toSet := inboundTarget(channelId, params, liqPct, inboundRate, newFee, dryRun)
+
+			if toSet && dryRun {
+				recordShadowFee(channelId, inboundRate, inboundRateToSet, true)
+			} else if toSet && !lastFeeIsTheSame(channelId, inboundRateToSet, true, false) {
+				queueFeeUpdate(peerId, channelId, inboundRate, inboundRateToSet, true, "")
+			} else if !toSet {
+				cancelFeeUpdate(channelId, true)
 			}
 		}
 	}
 }
 
+// the peer's rate toward us, 0 before its channel update
+func peerFeeRate(channelMap map[string]interface{}) int {
+	updates, ok := channelMap["updates"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	remote, ok := updates["remote"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	rate, _ := remote["fee_proportional_millionths"].(float64)
+	return int(rate)
+}
+
+// our channel update value, 0 before it is known
+func ourPolicyValue(channelMap map[string]interface{}, key string) uint64 {
+	updates, ok := channelMap["updates"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	local, ok := updates["local"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	value, _ := local[key].(float64)
+	return uint64(value)
+}
+
 func PlotPPM(lndChannelId uint64) *[]DataPoint {
 	var plot []DataPoint
 
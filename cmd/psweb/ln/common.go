@@ -3,15 +3,19 @@ package ln
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
 	"math"
-	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"peerswap-web/cmd/psweb/config"
 	"peerswap-web/cmd/psweb/db"
+	"peerswap-web/cmd/psweb/events"
 	"peerswap-web/cmd/psweb/safemap"
 
 	"github.com/btcsuite/btcd/chaincfg"
@@ -29,15 +33,26 @@ const (
 
 var (
 	// lightning payments from swap out initiator to receiver
-	SwapRebates = make(map[string]int64)
+	SwapRebates = safemap.New[string, int64]()
 	MyNodeAlias string
 	MyNodeId    string
 
 	AutoFeeEnabledAll bool
 	// maps to LND channel Id
-	AutoFee         = make(map[uint64]*AutoFeeParams)
-	AutoFeeLog      = make(map[uint64][]*AutoFeeEvent)
-	AutoFeeEnabled  = make(map[uint64]bool)
+	AutoFee        = make(map[uint64]*AutoFeeParams)
+	AutoFeeLog     = make(map[uint64][]*AutoFeeEvent)
+	AutoFeeEnabled = make(map[uint64]bool)
+	// by peer node id, for all channels with the peer
+	AutoFeePeer = make(map[string]*AutoFeeParams)
+	// record proposed changes without setting them
+	AutoFeeDryRun    = make(map[uint64]bool)
+	AutoFeeShadowLog = make(map[uint64][]*AutoFeeEvent)
+	// guards both logs, appended by the AutoFee timer and manual changes
+	feeLogMu sync.RWMutex
+	// guards the rules and flags above, failed HTLCs change rules while
+	// the timer reads them and web handlers edit them
+	AutoFeeMu sync.Mutex
+
 	AutoFeeDefaults = AutoFeeParams{
 		FailedBumpPPM:     10,
 		LowLiqPct:         10,
@@ -56,8 +71,8 @@ var (
 	LastForwardTS = safemap.New[uint64, int64]()
 
 	// received via custom messages, per peer nodeId
-	LiquidBalances  = make(map[string]*BalanceInfo)
-	BitcoinBalances = make(map[string]*BalanceInfo)
+	LiquidBalances  = safemap.New[string, *BalanceInfo]()
+	BitcoinBalances = safemap.New[string, *BalanceInfo]()
 
 	// sent via custom messages
 	SentLiquidBalances  = make(map[string]*BalanceInfo)
@@ -68,6 +83,9 @@ var (
 	// better broadcast them to prevent that behavior
 	AdvertiseLiquidBalance  = true
 	AdvertiseBitcoinBalance = true
+
+	// failed LND or CLN calls, for metrics
+	RpcErrors atomic.Uint64
 )
 
 type PaymentInfo struct {
@@ -114,6 +132,16 @@ type ForwardingStats struct {
 	AssistedPPM6m     uint64
 }
 
+// lifetime routing totals for metrics
+type ForwardingTotals struct {
+	CountOut       uint64
+	CountIn        uint64
+	AmountOut      uint64
+	AmountIn       uint64
+	FeeSat         uint64
+	AssistedFeeSat uint64
+}
+
 type ChannelStats struct {
 	RoutedOut      uint64
 	RoutedIn       uint64
@@ -156,9 +184,12 @@ type AutoFeeStatus struct {
 	Capacity    uint64
 	LocalPct    uint64
 	Enabled     bool
+	DryRun      bool
 	Rule        string
 	AutoFee     *AutoFeeParams
 	Custom      bool
+	PeerRule    bool   // applies to all channels with the peer
+	Tag         string // template name
 	FeeRate     int64
 	InboundRate int64
 	DaysNoFlow  int
@@ -190,6 +221,109 @@ type AutoFeeParams struct {
 	CoolOffHours int
 	// inbound fee (<0 = discount) when liquidity is below LowLiqPct
 	LowLiqDiscount int
+	// inbound fee by liquidity % instead of LowLiqDiscount, ascending
+	InboundCurve []InboundPoint `json:",omitempty"`
+	// outbound rate floor as % of the peer's rate toward us, 0 = off
+	PeerFloorPct int
+	// outbound rate ceiling as % of the peer's rate toward us, 0 = off
+	PeerCeilingPct int
+	// ceiling as % of the median rate other nodes charge toward the peer, 0 = off
+	CompetitorPct int
+	// above LowLiqPct step toward the rate earning the most sats/day
+	// instead of dropping on inactivity, 0 = off
+	RevenueMaxPPM int
+	RevenueMinPPM int
+	// the largest change per step
+	RevenueStepPPM int
+	// forwarding history compared
+	RevenueDays int
+	// max HTLC as % of local balance, 0 = off
+	MaxHtlcPct int
+	// BASE_FEE_MANUAL or BASE_FEE_FIXED
+	BaseFeePolicy int
+	// outbound base fee kept by BASE_FEE_FIXED
+	BaseFeeMsat int
+	// alternate rates by time of day and day of week, first active wins
+	Schedules []AutoFeeSchedule `json:",omitempty"`
+}
+
+// rejects what AutoFee cannot work with: negative values, percentages
+// over 100, a positive discount, an invalid inbound curve or schedule,
+// and contradicting peer bounds or revenue settings
+// thresholds and rates may come in any order, as the form always allowed
+func (p *AutoFeeParams) Validate() error {
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"FailedBumpPPM", p.FailedBumpPPM},
+		{"FailedMoveThreshold", p.FailedMoveThreshold},
+		{"LowLiqRate", p.LowLiqRate},
+		{"NormalRate", p.NormalRate},
+		{"ExcessRate", p.ExcessRate},
+		{"InactivityDays", p.InactivityDays},
+		{"InactivityDropPPM", p.InactivityDropPPM},
+		{"CoolOffHours", p.CoolOffHours},
+		{"PeerFloorPct", p.PeerFloorPct},
+		{"PeerCeilingPct", p.PeerCeilingPct},
+		{"CompetitorPct", p.CompetitorPct},
+		{"RevenueMaxPPM", p.RevenueMaxPPM},
+		{"RevenueMinPPM", p.RevenueMinPPM},
+		{"RevenueStepPPM", p.RevenueStepPPM},
+		{"RevenueDays", p.RevenueDays},
+		{"BaseFeeMsat", p.BaseFeeMsat},
+	} {
+		if v.value < 0 {
+			return errors.New(v.name + " cannot be negative")
+		}
+	}
+
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"LowLiqPct", p.LowLiqPct},
+		{"ExcessPct", p.ExcessPct},
+		{"InactivityDropPct", p.InactivityDropPct},
+		{"MaxHtlcPct", p.MaxHtlcPct},
+	} {
+		if v.value < 0 || v.value > 100 {
+			return errors.New(v.name + " must be between 0 and 100")
+		}
+	}
+
+	if p.LowLiqDiscount > 0 {
+		return errors.New("LowLiqDiscount cannot be positive")
+	}
+	if err := p.validateInboundCurve(); err != nil {
+		return err
+	}
+	if p.PeerCeilingPct > 0 && p.PeerFloorPct > p.PeerCeilingPct {
+		return errors.New("PeerFloorPct cannot be above PeerCeilingPct")
+	}
+	if p.RevenueMaxPPM > 0 {
+		if p.RevenueMinPPM > p.RevenueMaxPPM {
+			return errors.New("RevenueMinPPM cannot be above RevenueMaxPPM")
+		}
+		if p.RevenueStepPPM == 0 {
+			return errors.New("RevenueStepPPM must be positive")
+		}
+		if p.RevenueDays < 1 || p.RevenueDays > BACKTEST_MAX_DAYS {
+			return fmt.Errorf("RevenueDays must be between 1 and %d", BACKTEST_MAX_DAYS)
+		}
+	}
+
+	if p.BaseFeePolicy != BASE_FEE_MANUAL && p.BaseFeePolicy != BASE_FEE_FIXED {
+		return errors.New("unknown BaseFeePolicy")
+	}
+
+	for i := range p.Schedules {
+		if err := p.Schedules[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 type AutoFeeEvent struct {
@@ -198,6 +332,15 @@ type AutoFeeEvent struct {
 	NewRate   int
 	IsInbound bool
 	IsManual  bool
+	// schedule transition, not a fee change
+	Schedule string `json:",omitempty"`
+	// POLICY_BASE_FEE or POLICY_MAX_HTLC change, not a fee rate
+	Policy string `json:",omitempty"`
+}
+
+// a fee rate change
+func (e *AutoFeeEvent) IsRate() bool {
+	return e.Schedule == "" && e.Policy == ""
 }
 
 // for chart plotting and forwards log
@@ -327,19 +470,19 @@ func OnMyCustomMessage(nodeId string, payload []byte) {
 	case "balance":
 		// received information
 		ts := time.Now().Unix()
+		// replaced, not updated in place, as readers keep the pointer
 		if msg.Asset == "lbtc" {
-			if LiquidBalances[nodeId] == nil {
-				LiquidBalances[nodeId] = new(BalanceInfo)
-			}
-			LiquidBalances[nodeId].Amount = msg.Amount
-			LiquidBalances[nodeId].TimeStamp = ts
+			LiquidBalances.Write(nodeId, &BalanceInfo{Amount: msg.Amount, TimeStamp: ts})
 		}
 		if msg.Asset == "btc" {
-			if BitcoinBalances[nodeId] == nil {
-				BitcoinBalances[nodeId] = new(BalanceInfo)
-			}
-			BitcoinBalances[nodeId].Amount = msg.Amount
-			BitcoinBalances[nodeId].TimeStamp = ts
+			BitcoinBalances.Write(nodeId, &BalanceInfo{Amount: msg.Amount, TimeStamp: ts})
+		}
+		if msg.Asset == "lbtc" || msg.Asset == "btc" {
+			events.Publish(events.BALANCE, &events.Balance{
+				NodeId: nodeId,
+				Asset:  msg.Asset,
+				Amount: msg.Amount,
+			})
 		}
 	}
 }
@@ -370,18 +513,26 @@ func AutoFeeRule(channelId uint64) (*AutoFeeParams, bool) {
 		// channel has custom parameters
 		params = AutoFee[channelId]
 		isCustom = true
+	} else if template, _ := AutoFeeTemplate(channelId); template != nil {
+		// channel is tagged
+		params = template
 	}
 	return params, isCustom
 }
 
 // returns a string representation for the rule and whether it is not default
-func AutoFeeRatesSummary(channelId uint64) (string, bool) {
-	params, isCustom := AutoFeeRule(channelId)
+func AutoFeeRatesSummary(channelId uint64, peerId string) (string, bool) {
+	params, isPeerRule := AutoFeeAppliedRule(channelId, peerId)
+	_, isCustom := AutoFeeRule(channelId)
+	isCustom = isCustom || isPeerRule
 
 	excess := strconv.Itoa(params.ExcessRate)
 	normal := strconv.Itoa(params.NormalRate)
 	low := strconv.Itoa(params.LowLiqRate)
 	disc := strconv.Itoa(params.LowLiqDiscount)
+	if len(params.InboundCurve) > 0 {
+		disc = "curve"
+	}
 
 	summary := excess + "/" + normal + "/" + low
 	if HasInboundFees() {
@@ -390,56 +541,90 @@ func AutoFeeRatesSummary(channelId uint64) (string, bool) {
 	return summary, isCustom
 }
 
-func LoadDB() {
+func LoadDB() error {
+	// one failing repository should not leave the others empty
+	var errs []error
+
 	// load ClaimJoin variables
-	loadClaimJoinDB()
+	if err := loadClaimJoinDB(); err != nil {
+		errs = append(errs, fmt.Errorf("ClaimJoin: %w", err))
+	}
 
 	// load rebates from db
-	db.Load("Swaps", "SwapRebates", &SwapRebates)
+	if err := loadSwapRebates(); err != nil {
+		errs = append(errs, fmt.Errorf("swap rebates: %w", err))
+	}
 
 	// load auto fees from db
-	db.Load("AutoFees", "AutoFeeEnabledAll", &AutoFeeEnabledAll)
-	db.Load("AutoFees", "AutoFeeEnabled", &AutoFeeEnabled)
-	db.Load("AutoFees", "AutoFee", &AutoFee)
-	db.Load("AutoFees", "AutoFeeDefaults", &AutoFeeDefaults)
+	if err := loadAutoFees(); err != nil {
+		errs = append(errs, fmt.Errorf("auto fees: %w", err))
+	}
 
 	// on or off
-	db.Load("Peers", "AdvertiseLiquidBalance", &AdvertiseLiquidBalance)
-	db.Load("Peers", "AdvertiseBitcoinBalance", &AdvertiseBitcoinBalance)
+	for key, value := range map[string]*bool{
+		"AdvertiseLiquidBalance":  &AdvertiseLiquidBalance,
+		"AdvertiseBitcoinBalance": &AdvertiseBitcoinBalance,
+	} {
+		if err := db.Load("Peers", key, value); err != nil && !errors.Is(err, db.ErrNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
 
-	// drop non-array legacy log
-	var log map[uint64]interface{}
-	db.Load("AutoFees", "AutoFeeLog", &log)
+	return errors.Join(errs...)
+}
 
-	if len(log) == 0 {
-		return
+// returns the new rate and the schedule note to log once it is set
+func calculateAutoFee(channelId uint64, params *AutoFeeParams, liqPct int, oldFee int, dryRun bool) (int, string) {
+	lastForward, _ := LastForwardTS.Read(channelId)
+	return autoFeeRate(channelId, params, liqPct, oldFee, lastForward, dryRun)
+}
+
+// channelId keeps the fee log the rule continues from
+func autoFeeRate(channelId uint64, params *AutoFeeParams, liqPct int, oldFee int, lastForward int64, dryRun bool) (int, string) {
+	now := time.Now()
+	params, index := ScheduledRule(params, now)
+	if note := scheduleTransition(channelId, params, index, dryRun); note != "" {
+		// new rate set applies right away
+		return regimeRate(params, liqPct), note
+	}
+
+	lastUpdate := int64(0)
+	lastLog := lastAutoFeeLog(channelId, false, dryRun)
+	if lastLog != nil {
+		lastUpdate = lastLog.TimeStamp
 	}
 
-	// Use reflection to determine the type
-	for _, data := range log {
-		v := reflect.ValueOf(data)
-		if v.Kind() == reflect.Slice {
-			// Type is map[uint64][]*AutoFeeEvent, load again
-			db.Load("AutoFees", "AutoFeeLog", &AutoFeeLog)
-			return
+	if params.RevenueMaxPPM > 0 && liqPct >= params.LowLiqPct {
+		if lastUpdate >= now.Add(-time.Duration(params.CoolOffHours)*time.Hour).Unix() {
+			return oldFee, ""
 		}
+		return revenueStep(params, RevenueByRate(channelId, oldFee, params.RevenueDays), oldFee), ""
 	}
+
+	return nextAutoFee(params, liqPct, oldFee, now, lastUpdate, lastForward), ""
 }
 
-func calculateAutoFee(channelId uint64, params *AutoFeeParams, liqPct int, oldFee int) int {
+// the rate of the liquidity regime
+func regimeRate(params *AutoFeeParams, liqPct int) int {
+	if liqPct < params.LowLiqPct {
+		return params.LowLiqRate
+	} else if liqPct < params.ExcessPct {
+		return params.NormalRate
+	}
+	return params.ExcessRate
+}
+
+// one step of the fee rate logic at the time now
+// lastUpdate is the time of the last outbound fee change,
+// lastForward of the last outbound forward, 0 if none
+func nextAutoFee(params *AutoFeeParams, liqPct int, oldFee int, now time.Time, lastUpdate int64, lastForward int64) int {
 	newFee := oldFee
 	if liqPct >= params.LowLiqPct {
 		// normal or high liquidity regime, check if fee can be dropped
-		lastUpdate := int64(0)
-		lastLog := LastAutoFeeLog(channelId, false)
-		if lastLog != nil {
-			lastUpdate = lastLog.TimeStamp
-		}
-
 		// must be definitely above threshold and cool-off period passed
-		if liqPct > params.LowLiqPct && lastUpdate < time.Now().Add(-time.Duration(params.CoolOffHours)*time.Hour).Unix() {
+		if liqPct > params.LowLiqPct && lastUpdate < now.Add(-time.Duration(params.CoolOffHours)*time.Hour).Unix() {
 			// check the inactivity period
-			if ts, ok := LastForwardTS.Read(channelId); !ok || ok && ts < time.Now().AddDate(0, 0, -params.InactivityDays).Unix() {
+			if lastForward < now.AddDate(0, 0, -params.InactivityDays).Unix() {
 				// decrease the fee
 				newFee -= params.InactivityDropPPM
 				newFee = newFee * (100 - params.InactivityDropPct) / 100
@@ -470,27 +655,77 @@ func msatToSatUp(msat uint64) uint64 {
 	return sat
 }
 
-// returns last log entry
+// returns last fee change
 func LastAutoFeeLog(channelId uint64, isInbound bool) *AutoFeeEvent {
-	// Loop backwards through the array
-	for i := len(AutoFeeLog[channelId]) - 1; i >= 0; i-- {
-		if AutoFeeLog[channelId][i].IsInbound == isInbound {
-			return AutoFeeLog[channelId][i]
+	return lastAutoFeeLog(channelId, isInbound, false)
+}
+
+// events are only appended, so the returned slice
+// can be read after the lock is released
+func feeEvents(channelId uint64, dryRun bool) []*AutoFeeEvent {
+	feeLogMu.RLock()
+	defer feeLogMu.RUnlock()
+	if dryRun {
+		return AutoFeeShadowLog[channelId]
+	}
+	return AutoFeeLog[channelId]
+}
+
+// FeeLogCopy returns the fee log of all channels for reading
+func FeeLogCopy() map[uint64][]*AutoFeeEvent {
+	feeLogMu.RLock()
+	defer feeLogMu.RUnlock()
+	m := make(map[uint64][]*AutoFeeEvent, len(AutoFeeLog))
+	for channelId, events := range AutoFeeLog {
+		m[channelId] = events
+	}
+	return m
+}
+
+// adds the event to memory and db
+func appendFeeLog(channelId uint64, event *AutoFeeEvent, dryRun bool) {
+	feeLogMu.Lock()
+	if dryRun {
+		AutoFeeShadowLog[channelId] = append(AutoFeeShadowLog[channelId], event)
+	} else {
+		AutoFeeLog[channelId] = append(AutoFeeLog[channelId], event)
+	}
+	feeLogMu.Unlock()
+
+	if dryRun {
+		if err := shadowLog.Append(&feeLogEntry{
+			ChannelId:    channelId,
+			AutoFeeEvent: *event,
+		}); err != nil {
+			log.Println("Failed to persist shadow fee log:", err)
 		}
+		return
+	}
+
+	if err := feeLog.Append(&feeLogEntry{
+		ChannelId:    channelId,
+		AutoFeeEvent: *event,
+	}); err != nil {
+		log.Println("Failed to persist fee log:", err)
 	}
-	return nil
 }
 
 func LogFee(channelId uint64, oldRate int, newRate int, isInbound bool, isManual bool) {
-	AutoFeeLog[channelId] = append(AutoFeeLog[channelId], &AutoFeeEvent{
+	appendFeeLog(channelId, &AutoFeeEvent{
 		TimeStamp: time.Now().Unix(),
 		OldRate:   oldRate,
 		NewRate:   newRate,
 		IsInbound: isInbound,
 		IsManual:  isManual,
+	}, false)
+
+	events.Publish(events.FEE, &events.Fee{
+		ChannelId: channelId,
+		OldRate:   oldRate,
+		NewRate:   newRate,
+		IsInbound: isInbound,
+		IsManual:  isManual,
 	})
-	// persist to db
-	db.Save("AutoFees", "AutoFeeLog", AutoFeeLog)
 }
 
 func moveLowLiqThreshold(channelId uint64, bump int) {
@@ -498,18 +733,15 @@ func moveLowLiqThreshold(channelId uint64, bump int) {
 		return
 	}
 
-	if AutoFee[channelId] == nil {
-		// add custom parameters
-		AutoFee[channelId] = new(AutoFeeParams)
-		// clone default values
-		*AutoFee[channelId] = AutoFeeDefaults
-	}
+	rule := CustomAutoFeeRule(channelId)
 
 	// do not allow reaching high liquidity threshold
-	if AutoFee[channelId].LowLiqPct+bump < AutoFee[channelId].ExcessPct {
-		AutoFee[channelId].LowLiqPct += bump
+	if rule.LowLiqPct+bump < rule.ExcessPct {
+		rule.LowLiqPct += bump
 		// persist to db
-		db.Save("AutoFees", "AutoFee", AutoFee)
+		if err := SaveAutoFeeRule(channelId); err != nil {
+			log.Println("Failed to persist auto fee rule:", err)
+		}
 	}
 
 }
@@ -552,20 +784,22 @@ func processInvoice(memo string, valueMsat int64) bool {
 }
 
 func saveSwapRabate(swapId string, rebate int64) {
-	_, exists := SwapRebates[swapId]
+	_, exists := SwapRebates.Read(swapId)
 	if exists {
 		// already existed
 		return
 	}
 	// save rebate payment
-	SwapRebates[swapId] = rebate
+	SwapRebates.Write(swapId, rebate)
 	// persist to db
-	db.Save("Swaps", "SwapRebates", SwapRebates)
+	if err := saveSwapRebate(swapId, rebate); err != nil {
+		log.Println("Failed to persist swap rebate:", err)
+	}
 }
 
 // check if the last logged fee rate is the same as newFee
-func lastFeeIsTheSame(channelId uint64, newFee int, isInbound bool) bool {
-	lastFee := LastAutoFeeLog(channelId, isInbound)
+func lastFeeIsTheSame(channelId uint64, newFee int, isInbound bool, dryRun bool) bool {
+	lastFee := lastAutoFeeLog(channelId, isInbound, dryRun)
 	if lastFee != nil {
 		if newFee == lastFee.NewRate && time.Now().Unix()-lastFee.TimeStamp < 86_400 { // only care about the last 24h
 			return true
@@ -0,0 +1,76 @@
+package ln
+
+import (
+	"testing"
+)
+
+func TestAutoFeeParamsValidate(t *testing.T) {
+	defaults := AutoFeeDefaults
+	if err := defaults.Validate(); err != nil {
+		t.Fatalf("defaults rejected: %v", err)
+	}
+
+	for name, mutate := range map[string]func(p *AutoFeeParams){
+		"negative LowLiqPct":       func(p *AutoFeeParams) { p.LowLiqPct = -1 },
+		"ExcessPct above 100":      func(p *AutoFeeParams) { p.ExcessPct = 101 },
+		"negative CoolOffHours":    func(p *AutoFeeParams) { p.CoolOffHours = -24 },
+		"positive discount":        func(p *AutoFeeParams) { p.LowLiqDiscount = 10 },
+		"invalid schedule":         func(p *AutoFeeParams) { p.Schedules = []AutoFeeSchedule{{StartMin: 1440}} },
+		"negative CompetitorPct":   func(p *AutoFeeParams) { p.CompetitorPct = -1 },
+		"peer floor above ceiling": func(p *AutoFeeParams) { p.PeerFloorPct, p.PeerCeilingPct = 150, 120 },
+		"revenue min above max": func(p *AutoFeeParams) {
+			p.RevenueMaxPPM, p.RevenueMinPPM, p.RevenueStepPPM, p.RevenueDays = 500, 600, 50, 14
+		},
+		"revenue without step":    func(p *AutoFeeParams) { p.RevenueMaxPPM, p.RevenueStepPPM, p.RevenueDays = 500, 0, 14 },
+		"revenue without days":    func(p *AutoFeeParams) { p.RevenueMaxPPM, p.RevenueStepPPM, p.RevenueDays = 500, 50, 0 },
+		"MaxHtlcPct above 100":    func(p *AutoFeeParams) { p.MaxHtlcPct = 101 },
+		"unknown base fee policy": func(p *AutoFeeParams) { p.BaseFeePolicy = 2 },
+		"negative base fee":       func(p *AutoFeeParams) { p.BaseFeeMsat = -1 },
+	} {
+		p := AutoFeeDefaults
+		mutate(&p)
+		if p.Validate() == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+
+	// rules saved before Validate existed
+	p := AutoFeeDefaults
+	p.LowLiqPct, p.ExcessPct = 80, 50
+	p.ExcessRate, p.NormalRate, p.LowLiqRate = 2000, 400, 100
+	if err := p.Validate(); err != nil {
+		t.Errorf("unordered thresholds and rates rejected: %v", err)
+	}
+}
+
+// the AutoFee timer appends while web handlers read, run with -race
+func TestFeeLogConcurrentAccess(t *testing.T) {
+	const channelId = 201
+	defer func() {
+		feeLogMu.Lock()
+		delete(AutoFeeLog, channelId)
+		feeLogMu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			appendFeeLog(channelId, &AutoFeeEvent{TimeStamp: int64(i), NewRate: i}, false)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		for _, events := range FeeLogCopy() {
+			for _, e := range events {
+				_ = e.NewRate
+			}
+		}
+		_ = LastAutoFeeLog(channelId, false)
+	}
+	<-done
+
+	if last := LastAutoFeeLog(channelId, false); last == nil || last.NewRate != 199 {
+		t.Fatalf("last logged event %+v", last)
+	}
+}
@@ -0,0 +1,99 @@
+package ln
+
+import (
+	"time"
+)
+
+// channels in dry run get their fee changes recorded
+// to AutoFeeShadowLog instead of being set
+
+// whether auto fees run for the channel, and only simulated
+func autoFeeMode(channelId uint64) (run bool, dryRun bool) {
+	dryRun = AutoFeeDryRun[channelId]
+	return dryRun || (AutoFeeEnabledAll && AutoFeeEnabled[channelId]), dryRun
+}
+
+func anyDryRun() bool {
+	for _, dryRun := range AutoFeeDryRun {
+		if dryRun {
+			return true
+		}
+	}
+	return false
+}
+
+// last fee change of the given direction
+func lastEvent(events []*AutoFeeEvent, isInbound bool) *AutoFeeEvent {
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].IsRate() && events[i].IsInbound == isInbound {
+			return events[i]
+		}
+	}
+	return nil
+}
+
+// last schedule transition
+func lastNote(events []*AutoFeeEvent) *AutoFeeEvent {
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Schedule != "" {
+			return events[i]
+		}
+	}
+	return nil
+}
+
+// the simulation continues from the real history,
+// so the newest of the two logs counts
+func newest(real, shadow *AutoFeeEvent) *AutoFeeEvent {
+	if shadow != nil && (real == nil || shadow.TimeStamp >= real.TimeStamp) {
+		return shadow
+	}
+	return real
+}
+
+func lastAutoFeeLog(channelId uint64, isInbound bool, dryRun bool) *AutoFeeEvent {
+	last := lastEvent(feeEvents(channelId, false), isInbound)
+	if dryRun {
+		return newest(last, lastEvent(feeEvents(channelId, true), isInbound))
+	}
+	return last
+}
+
+// the rate as if the proposed changes were applied
+func simulatedRate(channelId uint64, actualRate int, isInbound bool) int {
+	real := lastEvent(feeEvents(channelId, false), isInbound)
+	shadow := lastEvent(feeEvents(channelId, true), isInbound)
+	if shadow != nil && newest(real, shadow) == shadow {
+		return shadow.NewRate
+	}
+	return actualRate
+}
+
+// records what would have been set
+func recordShadowFee(channelId uint64, oldRate int, newRate int, isInbound bool) {
+	if lastFeeIsTheSame(channelId, newRate, isInbound, true) {
+		return
+	}
+
+	appendFeeLog(channelId, &AutoFeeEvent{
+		TimeStamp: time.Now().Unix(),
+		OldRate:   oldRate,
+		NewRate:   newRate,
+		IsInbound: isInbound,
+	}, true)
+}
+
+// proposals made since fromTS, oldest first
+func ShadowLogSince(fromTS int64) map[uint64][]*AutoFeeEvent {
+	result := make(map[uint64][]*AutoFeeEvent)
+	feeLogMu.RLock()
+	defer feeLogMu.RUnlock()
+	for channelId, events := range AutoFeeShadowLog {
+		for _, e := range events {
+			if e.TimeStamp >= fromTS && e.IsRate() {
+				result[channelId] = append(result[channelId], e)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,89 @@
+package ln
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoFeeMode(t *testing.T) {
+	const channelId = 401
+	savedAll := AutoFeeEnabledAll
+	defer func() {
+		AutoFeeEnabledAll = savedAll
+		delete(AutoFeeEnabled, channelId)
+		delete(AutoFeeDryRun, channelId)
+	}()
+
+	for _, tc := range []struct {
+		enabledAll, enabled, dryRun bool
+		wantRun                     bool
+	}{
+		{false, false, false, false},
+		{true, false, false, false},
+		{false, true, false, false},
+		{true, true, false, true},
+		// simulation does not need auto fees enabled
+		{false, false, true, true},
+		{true, true, true, true},
+	} {
+		AutoFeeEnabledAll = tc.enabledAll
+		AutoFeeEnabled[channelId] = tc.enabled
+		AutoFeeDryRun[channelId] = tc.dryRun
+
+		run, dryRun := autoFeeMode(channelId)
+		if run != tc.wantRun || dryRun != tc.dryRun {
+			t.Errorf("all=%v enabled=%v dryRun=%v: got run=%v dryRun=%v", tc.enabledAll, tc.enabled, tc.dryRun, run, dryRun)
+		}
+	}
+}
+
+// proposals go to the shadow log only and the simulation
+// continues from them
+func TestRecordShadowFee(t *testing.T) {
+	const channelId = 402
+	defer delete(AutoFeeLog, channelId)
+	defer delete(AutoFeeShadowLog, channelId)
+
+	start := time.Now().Unix()
+	AutoFeeLog[channelId] = []*AutoFeeEvent{{TimeStamp: start - 3600, OldRate: 100, NewRate: 200}}
+
+	if got := simulatedRate(channelId, 200, false); got != 200 {
+		t.Fatalf("simulated rate %d before any proposal", got)
+	}
+
+	recordShadowFee(channelId, 200, 150, false)
+	// same proposal again
+	recordShadowFee(channelId, 200, 150, false)
+
+	if n := len(feeEvents(channelId, false)); n != 1 {
+		t.Fatalf("dry run wrote %d events to the real log", n-1)
+	}
+	if n := len(feeEvents(channelId, true)); n != 1 {
+		t.Fatalf("%d shadow events, want 1", n)
+	}
+	if got := simulatedRate(channelId, 200, false); got != 150 {
+		t.Fatalf("simulated rate %d, want the proposed 150", got)
+	}
+	if last := lastAutoFeeLog(channelId, false, true); last.NewRate != 150 {
+		t.Fatalf("dry run cool-off counts from %d", last.NewRate)
+	}
+	if last := lastAutoFeeLog(channelId, false, false); last.NewRate != 200 {
+		t.Fatalf("live cool-off counts from the proposal %d", last.NewRate)
+	}
+
+	// a real change made later takes over
+	AutoFeeLog[channelId] = append(AutoFeeLog[channelId], &AutoFeeEvent{TimeStamp: time.Now().Unix() + 1, OldRate: 200, NewRate: 500, IsManual: true})
+	if got := simulatedRate(channelId, 500, false); got != 500 {
+		t.Fatalf("simulated rate %d after a manual change", got)
+	}
+
+	// schedule notes are not proposals
+	logScheduleNote(channelId, BASE_RATES+" test", true)
+	since := ShadowLogSince(start)
+	if len(since[channelId]) != 1 || since[channelId][0].NewRate != 150 {
+		t.Fatalf("proposals since start: %+v", since[channelId])
+	}
+	if len(ShadowLogSince(time.Now().Unix() + 10)[channelId]) != 0 {
+		t.Fatal("old proposals reported")
+	}
+}
@@ -0,0 +1,141 @@
+package ln
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the inbound curve sets the inbound rate by local liquidity %,
+// interpolating between its points. Negative rates are discounts,
+// positive ones surcharges. When set it replaces LowLiqDiscount.
+
+const (
+	INBOUND_CURVE_MAX_POINTS = 10
+	// smaller moves along the curve are not worth the gossip
+	INBOUND_MIN_CHANGE_PPM = 10
+)
+
+type InboundPoint struct {
+	LiqPct int
+	Rate   int // ppm
+}
+
+// rate at liqPct, flat before the first and after the last point
+func inboundCurveRate(curve []InboundPoint, liqPct int) int {
+	if len(curve) == 0 {
+		return 0
+	}
+	if liqPct <= curve[0].LiqPct {
+		return curve[0].Rate
+	}
+	for i := 1; i < len(curve); i++ {
+		a, b := curve[i-1], curve[i]
+		if liqPct <= b.LiqPct {
+			return a.Rate + (b.Rate-a.Rate)*(liqPct-a.LiqPct)/(b.LiqPct-a.LiqPct)
+		}
+	}
+	return curve[len(curve)-1].Rate
+}
+
+// the lowest outbound rate the rule sets
+func (p *AutoFeeParams) minOutboundRate() int {
+	rate := p.ExcessRate
+	for _, s := range p.Schedules {
+		rate = min(rate, s.ExcessRate)
+	}
+	if p.RevenueMaxPPM > 0 {
+		rate = min(rate, p.RevenueMinPPM)
+	}
+	return rate
+}
+
+func (p *AutoFeeParams) validateInboundCurve() error {
+	if len(p.InboundCurve) > INBOUND_CURVE_MAX_POINTS {
+		return fmt.Errorf("InboundCurve cannot have more than %d points", INBOUND_CURVE_MAX_POINTS)
+	}
+
+	floor := p.minOutboundRate()
+	for i, point := range p.InboundCurve {
+		if point.LiqPct < 0 || point.LiqPct > 100 {
+			return errors.New("InboundCurve liquidity % must be between 0 and 100")
+		}
+		if i > 0 && point.LiqPct <= p.InboundCurve[i-1].LiqPct {
+			return errors.New("InboundCurve liquidity % must increase")
+		}
+		if point.Rate+floor < 0 {
+			return fmt.Errorf("InboundCurve discount of %d at %d%% exceeds the lowest outbound rate %d", -point.Rate, point.LiqPct, floor)
+		}
+	}
+
+	return nil
+}
+
+// "pct:rate" pairs separated by commas
+func (p *AutoFeeParams) InboundCurveString() string {
+	var points []string
+	for _, point := range p.InboundCurve {
+		points = append(points, strconv.Itoa(point.LiqPct)+":"+strconv.Itoa(point.Rate))
+	}
+	return strings.Join(points, ", ")
+}
+
+// parses "pct:rate" pairs separated by commas, empty means no curve
+func ParseInboundCurve(s string) ([]InboundPoint, error) {
+	var curve []InboundPoint
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		pct, rate, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, errors.New("inbound curve point " + pair + " is not pct:rate")
+		}
+		var point InboundPoint
+		var err error
+		if point.LiqPct, err = strconv.Atoi(strings.TrimSpace(pct)); err != nil {
+			return nil, errors.New("invalid inbound curve liquidity % " + pct)
+		}
+		if point.Rate, err = strconv.Atoi(strings.TrimSpace(rate)); err != nil {
+			return nil, errors.New("invalid inbound curve rate " + rate)
+		}
+		curve = append(curve, point)
+	}
+	return curve, nil
+}
+
+// returns the inbound rate to set and whether it has to change
+// outboundRate is the one being set, the sum cannot go negative
+func inboundTarget(channelId uint64, params *AutoFeeParams, liqPct int, inboundRate int, outboundRate int, dryRun bool) (int, bool) {
+	lastFee := lastAutoFeeLog(channelId, true, dryRun)
+	coolOff := time.Now().Add(-time.Duration(params.CoolOffHours) * time.Hour).Unix()
+
+	if len(params.InboundCurve) == 0 {
+		if liqPct < params.LowLiqPct && inboundRate > params.LowLiqDiscount {
+			// set inbound fee discount
+			return params.LowLiqDiscount, true
+		} else if liqPct > params.LowLiqPct && inboundRate < 0 {
+			// remove discount unless it was set manually or CoolOffHours did not pass
+			if lastFee != nil && !lastFee.IsManual && lastFee.TimeStamp < coolOff {
+				return 0, true
+			}
+		}
+		return 0, false
+	}
+
+	if lastFee != nil && lastFee.IsManual && lastFee.TimeStamp > coolOff {
+		// manual change holds off the curve
+		return 0, false
+	}
+
+	target := max(inboundCurveRate(params.InboundCurve, liqPct), -outboundRate)
+	diff := max(target, inboundRate) - min(target, inboundRate)
+	if diff == 0 || diff < INBOUND_MIN_CHANGE_PPM && target != 0 {
+		return 0, false
+	}
+
+	return target, true
+}
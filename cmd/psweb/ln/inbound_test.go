@@ -0,0 +1,94 @@
+package ln
+
+import (
+	"testing"
+)
+
+func TestInboundCurveRate(t *testing.T) {
+	curve := []InboundPoint{{20, -200}, {60, 0}, {100, 100}}
+	for _, tc := range []struct {
+		liqPct int
+		want   int
+	}{
+		{0, -200},
+		{20, -200},
+		{40, -100},
+		{60, 0},
+		{80, 50},
+		{100, 100},
+	} {
+		if got := inboundCurveRate(curve, tc.liqPct); got != tc.want {
+			t.Errorf("%d%%: got %d, want %d", tc.liqPct, got, tc.want)
+		}
+	}
+
+	if got := inboundCurveRate(nil, 50); got != 0 {
+		t.Errorf("no curve: got %d, want 0", got)
+	}
+}
+
+func TestValidateInboundCurve(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params AutoFeeParams
+		ok     bool
+	}{
+		{"none", AutoFeeParams{ExcessRate: 100}, true},
+		{"within outbound", AutoFeeParams{ExcessRate: 100, InboundCurve: []InboundPoint{{0, -100}, {50, 0}, {100, 200}}}, true},
+		{"exceeds outbound", AutoFeeParams{ExcessRate: 100, InboundCurve: []InboundPoint{{0, -101}}}, false},
+		{"exceeds schedule", AutoFeeParams{ExcessRate: 100, Schedules: []AutoFeeSchedule{{ExcessRate: 50}},
+			InboundCurve: []InboundPoint{{0, -80}}}, false},
+		{"exceeds revenue floor", AutoFeeParams{ExcessRate: 100, RevenueMaxPPM: 500, RevenueMinPPM: 20,
+			InboundCurve: []InboundPoint{{0, -30}}}, false},
+		{"not ascending", AutoFeeParams{InboundCurve: []InboundPoint{{50, 0}, {50, 10}}}, false},
+		{"out of range", AutoFeeParams{InboundCurve: []InboundPoint{{101, 0}}}, false},
+	} {
+		if err := tc.params.validateInboundCurve(); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+func TestParseInboundCurve(t *testing.T) {
+	curve, err := ParseInboundCurve(" 0:-300, 30 : -100,60:0, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := AutoFeeParams{InboundCurve: curve}
+	if got := params.InboundCurveString(); got != "0:-300, 30:-100, 60:0" {
+		t.Errorf("got %q", got)
+	}
+
+	if curve, err := ParseInboundCurve(""); err != nil || curve != nil {
+		t.Errorf("blank: got %v %v, want no curve", curve, err)
+	}
+
+	for _, s := range []string{"10", "a:1", "10:b"} {
+		if _, err := ParseInboundCurve(s); err == nil {
+			t.Errorf("%q: parsed", s)
+		}
+	}
+}
+
+func TestInboundTargetCurve(t *testing.T) {
+	const channelId = 701
+	params := &AutoFeeParams{CoolOffHours: 12, InboundCurve: []InboundPoint{{0, -300}, {50, 0}}}
+
+	for _, tc := range []struct {
+		name                  string
+		liqPct, inbound, rate int
+		want                  int
+		wantSet               bool
+	}{
+		{"discount", 0, 0, 500, -300, true},
+		{"clamped by outbound", 0, 0, 200, -200, true},
+		{"small move", 24, -150, 500, 0, false},
+		{"removal", 60, -5, 500, 0, true},
+		{"unchanged", 60, 0, 500, 0, false},
+	} {
+		got, toSet := inboundTarget(channelId, params, tc.liqPct, tc.inbound, tc.rate, false)
+		if toSet != tc.wantSet || toSet && got != tc.want {
+			t.Errorf("%s: got %d %v, want %d %v", tc.name, got, toSet, tc.want, tc.wantSet)
+		}
+	}
+}
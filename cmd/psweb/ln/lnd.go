@@ -23,6 +23,7 @@ import (
 	"peerswap-web/cmd/psweb/bitcoin"
 	"peerswap-web/cmd/psweb/config"
 	"peerswap-web/cmd/psweb/db"
+	"peerswap-web/cmd/psweb/events"
 	"peerswap-web/cmd/psweb/safemap"
 
 	"github.com/elementsproject/peerswap/peerswaprpc"
@@ -48,6 +49,23 @@ const (
 	IMPLEMENTATION = "LND"
 )
 
+// compact payment record persisted to psweb.db
+type paymentRecord struct {
+	ChanIdOut     uint64 // first hop
+	ChanIdIn      uint64 // last hop
+	IsRebalance   bool
+	AttemptTimeNs int64
+	TotalAmtMsat  int64
+	TotalFeesMsat int64
+}
+
+// compact invoice htlc record persisted to psweb.db
+type invoiceRecord struct {
+	ChanId     uint64
+	AmtMsat    uint64
+	AcceptTime int64
+}
+
 type InflightHTLC struct {
 	OutgoingChannelId uint64
 	IncomingHtlcId    uint64
@@ -72,13 +90,13 @@ var (
 	// cache peer addresses for reconnects
 	peerAddresses = safemap.New[string, []*lnrpc.NodeAddress]()
 
-	// las index for invoice subscriptions
+	// highest settle index seen, invoices settled after it
+	// are replayed by the subscription
 	lastInvoiceSettleIndex uint64
 
 	// last timestamps for downloads
 	lastForwardCreationTs uint64
 	lastPaymentCreationTs int64
-	lastInvoiceCreationTs int64
 
 	// default lock id used by LND
 	internalLockId = []byte{
@@ -96,6 +114,7 @@ var (
 	}
 
 	downloadComplete bool
+	historyLoaded    bool
 )
 
 func lndConnection() (*grpc.ClientConn, error) {
@@ -131,6 +150,8 @@ func lndConnection() (*grpc.ClientConn, error) {
 		grpc.WithTransportCredentials(tlsCreds),
 		grpc.WithBlock(),
 		grpc.WithPerRPCCredentials(macCred),
+		grpc.WithChainUnaryInterceptor(countUnaryErrors),
+		grpc.WithChainStreamInterceptor(countStreamErrors),
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -138,12 +159,30 @@ func lndConnection() (*grpc.ClientConn, error) {
 
 	conn, err := grpc.DialContext(ctx, host, opts...)
 	if err != nil {
+		RpcErrors.Add(1)
 		return nil, err
 	}
 
 	return conn, nil
 }
 
+// count failed calls for metrics
+func countUnaryErrors(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		RpcErrors.Add(1)
+	}
+	return err
+}
+
+func countStreamErrors(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		RpcErrors.Add(1)
+	}
+	return stream, err
+}
+
 func GetClient() (lnrpc.LightningClient, func(), error) {
 	conn, err := lndConnection()
 	if err != nil {
@@ -764,16 +803,17 @@ func GetBlockHeight() uint32 {
 
 // return false on error
 func downloadInvoices(client lnrpc.LightningClient) bool {
+	if lastInvoiceSettleIndex > 0 {
+		// subscribing from the settle index replays the delta,
+		// including older invoices settled since
+		return true
+	}
+
 	// only go back 6 months for itinial download
 	startTs := uint64(time.Now().AddDate(0, -6, 0).Unix())
 	offset := uint64(0)
 	totalInvoices := uint64(0)
 
-	// incremental download
-	if lastInvoiceCreationTs > 0 {
-		startTs = uint64(lastInvoiceCreationTs) + 1
-	}
-
 	// benchmark time
 	start := time.Now()
 
@@ -792,17 +832,17 @@ func downloadInvoices(client lnrpc.LightningClient) bool {
 			return false
 		}
 
+		var records []*invoiceRecord
 		for _, invoice := range res.Invoices {
-			appendInvoice(invoice)
+			records = append(records, appendInvoice(invoice)...)
 		}
 
 		n := len(res.Invoices)
-		totalInvoices += uint64(n)
-
 		if n > 0 {
-			// settle index for subscription
-			lastInvoiceSettleIndex = res.Invoices[n-1].SettleIndex
+			saveInvoices(records)
 		}
+		totalInvoices += uint64(n)
+
 		if n < 100 {
 			// all invoices retrieved
 			break
@@ -853,23 +893,11 @@ func downloadForwards(client lnrpc.LightningClient) bool {
 		}
 
 		// sort by in and out channels
+		var records []*lnrpc.ForwardingEvent
 		for _, event := range res.ForwardingEvents {
 			if event.AmtOutMsat >= IGNORE_FORWARDS_MSAT {
-				fi, ok := forwardsIn.Read(event.ChanIdIn)
-				if !ok {
-					fi = []*lnrpc.ForwardingEvent{} // Initialize an empty slice if the key does not exist
-				}
-				fi = append(fi, event)               // Append the new forwarding record
-				forwardsIn.Write(event.ChanIdIn, fi) // Write the updated slice
-
-				fo, ok := forwardsOut.Read(event.ChanIdOut)
-				if !ok {
-					fo = []*lnrpc.ForwardingEvent{} // Initialize an empty slice if the key does not exist
-				}
-				fo = append(fo, event)                 // Append the new forwarding record
-				forwardsOut.Write(event.ChanIdOut, fo) // Write the updated slice
-
-				LastForwardTS.Write(event.ChanIdOut, int64(event.TimestampNs/1_000_000_000))
+				appendForward(event)
+				records = append(records, event)
 			}
 		}
 
@@ -879,6 +907,7 @@ func downloadForwards(client lnrpc.LightningClient) bool {
 		if n > 0 {
 			// store the last timestamp
 			lastForwardCreationTs = res.ForwardingEvents[n-1].TimestampNs / 1_000_000_000
+			saveForwards(records)
 		}
 		if n < 50000 {
 			// all events retrieved
@@ -929,8 +958,9 @@ func downloadPayments(client lnrpc.LightningClient) bool {
 		}
 
 		// will only append settled ones
+		var records []*paymentRecord
 		for _, payment := range res.Payments {
-			appendPayment(payment)
+			records = append(records, appendPayment(payment)...)
 		}
 
 		n := len(res.Payments)
@@ -939,6 +969,7 @@ func downloadPayments(client lnrpc.LightningClient) bool {
 		if n > 0 {
 			// store the last timestamp
 			lastPaymentCreationTs = res.Payments[n-1].CreationTimeNs / 1_000_000_000
+			savePayments(records)
 		}
 		if n < 100 {
 			// all events retrieved
@@ -956,50 +987,157 @@ func downloadPayments(client lnrpc.LightningClient) bool {
 	return true
 }
 
-func appendPayment(payment *lnrpc.Payment) {
+// returns new records to persist
+func appendPayment(payment *lnrpc.Payment) []*paymentRecord {
+	var records []*paymentRecord
+
 	if payment == nil {
-		return
+		return records
 	}
 
 	if payment.Status == lnrpc.Payment_SUCCEEDED {
 		if DecodeAndProcessInvoice(payment.PaymentRequest, payment.ValueMsat) {
 			// related to peerswap
-			return
+			return records
 		}
 		for _, htlc := range payment.Htlcs {
 			if htlc.Status == lnrpc.HTLCAttempt_SUCCEEDED {
-				// get channel from the first hop
-				chanId := htlc.Route.Hops[0].ChanId
 				// get destination from the last hop
 				lastHop := htlc.Route.Hops[len(htlc.Route.Hops)-1]
-				if lastHop.PubKey == MyNodeId {
+				record := &paymentRecord{
+					// get channel from the first hop
+					ChanIdOut: htlc.Route.Hops[0].ChanId,
+					ChanIdIn:  lastHop.ChanId,
 					// this is a circular rebalancing
-					htlcs, ok := rebalanceOutHtlcs.Read(chanId)
-					if !ok {
-						htlcs = []*lnrpc.HTLCAttempt{} // Initialize an empty slice if the key does not exist
-					}
-					htlcs = append(htlcs, htlc)            // Append the new forwarding record
-					rebalanceOutHtlcs.Write(chanId, htlcs) // Write the updated slice
-
-					htlcs, ok = rebalanceInHtlcs.Read(lastHop.ChanId)
-					if !ok {
-						htlcs = []*lnrpc.HTLCAttempt{} // Initialize an empty slice if the key does not exist
-					}
-					htlcs = append(htlcs, htlc)                   // Append the new forwarding record
-					rebalanceInHtlcs.Write(lastHop.ChanId, htlcs) // Write the updated slice
-				} else {
-					htlcs, ok := paymentHtlcs.Read(chanId)
-					if !ok {
-						htlcs = []*lnrpc.HTLCAttempt{} // Initialize an empty slice if the key does not exist
-					}
-					htlcs = append(htlcs, htlc)       // Append the new forwarding record
-					paymentHtlcs.Write(chanId, htlcs) // Write the updated slice
+					IsRebalance:   lastHop.PubKey == MyNodeId,
+					AttemptTimeNs: htlc.AttemptTimeNs,
+					TotalAmtMsat:  htlc.Route.TotalAmtMsat,
+					TotalFeesMsat: htlc.Route.TotalFeesMsat,
 				}
+				cachePayment(record)
+				records = append(records, record)
 			}
 		}
 		// store the last timestamp
 		lastPaymentCreationTs = payment.CreationTimeNs / 1_000_000_000
 	}
+
+	return records
+}
+
+func cachePayment(r *paymentRecord) {
+	// only keep what channel stats need
+	htlc := &lnrpc.HTLCAttempt{
+		AttemptTimeNs: r.AttemptTimeNs,
+		Route: &lnrpc.Route{
+			TotalAmtMsat:  r.TotalAmtMsat,
+			TotalFeesMsat: r.TotalFeesMsat,
+		},
+	}
+
+	if r.IsRebalance {
+		htlcs, ok := rebalanceOutHtlcs.Read(r.ChanIdOut)
+		if !ok {
+			htlcs = []*lnrpc.HTLCAttempt{} // Initialize an empty slice if the key does not exist
+		}
+		htlcs = append(htlcs, htlc)                 // Append the new forwarding record
+		rebalanceOutHtlcs.Write(r.ChanIdOut, htlcs) // Write the updated slice
+
+		htlcs, ok = rebalanceInHtlcs.Read(r.ChanIdIn)
+		if !ok {
+			htlcs = []*lnrpc.HTLCAttempt{} // Initialize an empty slice if the key does not exist
+		}
+		htlcs = append(htlcs, htlc)               // Append the new forwarding record
+		rebalanceInHtlcs.Write(r.ChanIdIn, htlcs) // Write the updated slice
+	} else {
+		htlcs, ok := paymentHtlcs.Read(r.ChanIdOut)
+		if !ok {
+			htlcs = []*lnrpc.HTLCAttempt{} // Initialize an empty slice if the key does not exist
+		}
+		htlcs = append(htlcs, htlc)            // Append the new forwarding record
+		paymentHtlcs.Write(r.ChanIdOut, htlcs) // Write the updated slice
+	}
+}
+
+func appendForward(event *lnrpc.ForwardingEvent) {
+	fi, ok := forwardsIn.Read(event.ChanIdIn)
+	if !ok {
+		fi = []*lnrpc.ForwardingEvent{} // Initialize an empty slice if the key does not exist
+	}
+	fi = append(fi, event)               // Append the new forwarding record
+	forwardsIn.Write(event.ChanIdIn, fi) // Write the updated slice
+
+	fo, ok := forwardsOut.Read(event.ChanIdOut)
+	if !ok {
+		fo = []*lnrpc.ForwardingEvent{} // Initialize an empty slice if the key does not exist
+	}
+	fo = append(fo, event)                 // Append the new forwarding record
+	forwardsOut.Write(event.ChanIdOut, fo) // Write the updated slice
+
+	LastForwardTS.Write(event.ChanIdOut, int64(event.TimestampNs/1_000_000_000))
+}
+
+// persist new records with the download cursors,
+// so that restarts only fetch the delta
+func saveForwards(records []*lnrpc.ForwardingEvent) {
+	if err := db.Append("Forwards", records, lastForwardCreationTs); err != nil {
+		log.Println("Failed to persist forwards:", err)
+	}
+}
+
+func savePayments(records []*paymentRecord) {
+	if err := db.Append("Payments", records, lastPaymentCreationTs); err != nil {
+		log.Println("Failed to persist payments:", err)
+	}
+}
+
+func saveInvoices(records []*invoiceRecord) {
+	if err := db.Append("Invoices", records, lastInvoiceSettleIndex); err != nil {
+		log.Println("Failed to persist invoices:", err)
+	}
+}
+
+// load persisted history for the last 6 months
+// and set cursors for incremental downloads
+func loadHistory() {
+	start := time.Now()
+	fromTs := time.Now().AddDate(0, -6, 0).Unix()
+	fromNs := fromTs * 1_000_000_000
+	total := 0
+
+	err := db.LoadAll("Forwards", &lastForwardCreationTs, func(e *lnrpc.ForwardingEvent) {
+		if e.TimestampNs > uint64(fromNs) {
+			appendForward(e)
+			total++
+		}
+	})
+	if err != nil {
+		log.Println("Failed to load forwards:", err)
+	}
+
+	err = db.LoadAll("Payments", &lastPaymentCreationTs, func(r *paymentRecord) {
+		if r.AttemptTimeNs > fromNs {
+			cachePayment(r)
+			total++
+		}
+	})
+	if err != nil {
+		log.Println("Failed to load payments:", err)
+	}
+
+	err = db.LoadAll("Invoices", &lastInvoiceSettleIndex, func(r *invoiceRecord) {
+		if r.AcceptTime > fromTs {
+			cacheInvoice(r)
+			total++
+		}
+	})
+	if err != nil {
+		log.Println("Failed to load invoices:", err)
+	}
+
+	if total > 0 {
+		log.Printf("Loaded %d history records from db in %.2f seconds", total, time.Since(start).Seconds())
+	}
 }
 
 func subscribePayments(ctx context.Context, client routerrpc.RouterClient) error {
@@ -1016,7 +1154,9 @@ func subscribePayments(ctx context.Context, client routerrpc.RouterClient) error
 		if err != nil {
 			return err
 		}
-		appendPayment(payment)
+		if records := appendPayment(payment); len(records) > 0 {
+			savePayments(records)
+		}
 	}
 }
 
@@ -1106,23 +1246,17 @@ func subscribeForwards(ctx context.Context, client routerrpc.RouterClient) error
 						// ignore dust
 						if htlc.forwardingEvent.AmtOutMsat >= IGNORE_FORWARDS_MSAT {
 							// add our stored forwards
-							fi, ok := forwardsIn.Read(htlcEvent.IncomingChannelId)
-							if !ok {
-								fi = []*lnrpc.ForwardingEvent{} // Initialize an empty slice if the key does not exist
-							}
-							fi = append(fi, htlc.forwardingEvent)             // Append the new forwarding record
-							forwardsIn.Write(htlcEvent.IncomingChannelId, fi) // Write the updated slice
-
-							// settled htlcEvent has no Outgoing info, take from queue
-							fo, ok := forwardsOut.Read(htlc.OutgoingChannelId)
-							if !ok {
-								fo = []*lnrpc.ForwardingEvent{} // Initialize an empty slice if the key does not exist
-							}
-							fo = append(fo, htlc.forwardingEvent)         // Append the new forwarding record
-							forwardsOut.Write(htlc.OutgoingChannelId, fo) // Write the updated slice
-
-							// TS for autofee
-							LastForwardTS.Write(htlc.OutgoingChannelId, int64(htlc.forwardingEvent.TimestampNs/1_000_000_000))
+							// settled htlcEvent has no Outgoing info, taken from queue
+							appendForward(htlc.forwardingEvent)
+							saveForwards([]*lnrpc.ForwardingEvent{htlc.forwardingEvent})
+
+							events.Publish(events.FORWARD, &events.Forward{
+								ChannelIdIn:  htlc.forwardingEvent.ChanIdIn,
+								ChannelIdOut: htlc.forwardingEvent.ChanIdOut,
+								AmountIn:     htlc.forwardingEvent.AmtIn,
+								AmountOut:    htlc.forwardingEvent.AmtOut,
+								FeeMsat:      htlc.forwardingEvent.FeeMsat,
+							})
 
 							// execute autofee
 							client, cleanup, err := GetClient()
@@ -1201,6 +1335,12 @@ func DownloadAll() bool {
 		MyNodeId = res.GetIdentityPubkey()
 	}
 
+	if !historyLoaded {
+		// restore from db to download only the delta
+		loadHistory()
+		historyLoaded = true
+	}
+
 	// initial download
 	if !downloadInvoices(client) {
 		return false
@@ -1303,32 +1443,51 @@ func subscribeBlocks(conn *grpc.ClientConn) error {
 	}
 }
 
-func appendInvoice(invoice *lnrpc.Invoice) {
+// returns new records to persist
+func appendInvoice(invoice *lnrpc.Invoice) []*invoiceRecord {
+	var records []*invoiceRecord
+
 	if invoice == nil {
 		// precaution
-		return
+		return records
 	}
 
-	// save for incremental downloads
-	lastInvoiceCreationTs = invoice.CreationDate
-
 	// only append settled htlcs
 	if invoice.State == lnrpc.Invoice_SETTLED {
+		// downloaded by add index, so settle indexes come unordered
+		lastInvoiceSettleIndex = max(lastInvoiceSettleIndex, invoice.SettleIndex)
+
 		if processInvoice(invoice.Memo, invoice.AmtPaidMsat) {
 			// skip peerswap-related
-			return
+			return records
 		}
 		for _, htlc := range invoice.Htlcs {
 			if htlc.State == lnrpc.InvoiceHTLCState_SETTLED {
-				inv, ok := invoiceHtlcs.Read(htlc.ChanId)
-				if !ok {
-					inv = []*lnrpc.InvoiceHTLC{} // Initialize an empty slice if the key does not exist
+				record := &invoiceRecord{
+					ChanId:     htlc.ChanId,
+					AmtMsat:    htlc.AmtMsat,
+					AcceptTime: htlc.AcceptTime,
 				}
-				inv = append(inv, htlc)              // Append the new forwarding record
-				invoiceHtlcs.Write(htlc.ChanId, inv) // Write the updated slice
+				cacheInvoice(record)
+				records = append(records, record)
 			}
 		}
 	}
+
+	return records
+}
+
+func cacheInvoice(r *invoiceRecord) {
+	inv, ok := invoiceHtlcs.Read(r.ChanId)
+	if !ok {
+		inv = []*lnrpc.InvoiceHTLC{} // Initialize an empty slice if the key does not exist
+	}
+	inv = append(inv, &lnrpc.InvoiceHTLC{
+		ChanId:     r.ChanId,
+		AmtMsat:    r.AmtMsat,
+		AcceptTime: r.AcceptTime,
+	}) // Append the new forwarding record
+	invoiceHtlcs.Write(r.ChanId, inv) // Write the updated slice
 }
 
 func subscribeInvoices(ctx context.Context, client lnrpc.LightningClient) error {
@@ -1347,8 +1506,12 @@ func subscribeInvoices(ctx context.Context, client lnrpc.LightningClient) error
 		if err != nil {
 			return err
 		}
-		appendInvoice(invoice)
-		lastInvoiceSettleIndex = invoice.SettleIndex
+		if invoice.State == lnrpc.Invoice_SETTLED {
+			// saves the settle index even if no records
+			saveInvoices(appendInvoice(invoice))
+		} else {
+			appendInvoice(invoice)
+		}
 	}
 }
 
@@ -1511,6 +1674,42 @@ func GetForwardingStats(channelId uint64) *ForwardingStats {
 	return &result
 }
 
+// get lifetime routing totals for a channel
+func GetForwardingTotals(channelId uint64) *ForwardingTotals {
+	var (
+		result       ForwardingTotals
+		feeMsat      uint64
+		assistedMsat uint64
+	)
+
+	fo, ok := forwardsOut.Read(channelId)
+	if ok {
+		for _, e := range fo {
+			if e.AmtOutMsat >= IGNORE_FORWARDS_MSAT {
+				result.CountOut++
+				result.AmountOut += e.AmtOut
+				feeMsat += e.FeeMsat
+			}
+		}
+	}
+
+	fi, ok := forwardsIn.Read(channelId)
+	if ok {
+		for _, e := range fi {
+			if e.AmtOutMsat >= IGNORE_FORWARDS_MSAT {
+				result.CountIn++
+				result.AmountIn += e.AmtIn
+				assistedMsat += e.FeeMsat
+			}
+		}
+	}
+
+	result.FeeSat = feeMsat / 1000
+	result.AssistedFeeSat = assistedMsat / 1000
+
+	return &result
+}
+
 // get fees for the channel
 func GetChannelInfo(client lnrpc.LightningClient, channelId uint64, peerNodeId string) *ChanneInfo {
 	info := new(ChanneInfo)
@@ -1938,16 +2137,16 @@ func SetFeeRate(peerNodeId string,
 	return oldRate, nil
 }
 
-// set min or max HTLC size (Msat!!!) for a channel
+// set min or max HTLC size (Msat!!!) for a channel, return old size
 func SetHtlcSize(peerNodeId string,
 	channelId uint64,
 	htlcMsat int64,
-	isMax bool) error {
+	isMax bool) (int64, error) {
 
 	client, cleanup, err := GetClient()
 	if err != nil {
 		log.Println("SetHtlcSize:", err)
-		return err
+		return 0, err
 	}
 	defer cleanup()
 
@@ -1957,7 +2156,7 @@ func SetHtlcSize(peerNodeId string,
 	})
 	if err != nil {
 		log.Println("SetHtlcSize:", err)
-		return err
+		return 0, err
 	}
 
 	policy := r.Node1Policy
@@ -1970,7 +2169,7 @@ func SetHtlcSize(peerNodeId string,
 	outputIndex, err := strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
 		log.Println("SetHtlcSize:", err)
-		return err
+		return 0, err
 	}
 
 	var req lnrpc.PolicyUpdateRequest
@@ -1995,17 +2194,20 @@ func SetHtlcSize(peerNodeId string,
 		BaseFeeMsat: policy.InboundFeeBaseMsat,
 	}
 
+	oldSize := policy.MinHtlc
+
 	// change what's new
 	if isMax {
+		oldSize = int64(policy.MaxHtlcMsat)
 		if uint64(htlcMsat) == policy.MaxHtlcMsat {
 			// nothing to do
-			return nil
+			return oldSize, nil
 		}
 		req.MaxHtlcMsat = uint64(htlcMsat)
 	} else {
 		if htlcMsat == policy.MinHtlc {
 			// nothing to do
-			return nil
+			return oldSize, nil
 		}
 		req.MinHtlcMsat = uint64(htlcMsat)
 	}
@@ -2013,25 +2215,22 @@ func SetHtlcSize(peerNodeId string,
 	_, err = client.UpdateChannelPolicy(context.Background(), &req)
 	if err != nil {
 		log.Println("SetHtlcSize:", err)
-		return err
+		return oldSize, err
 	}
 
-	return nil
+	return oldSize, nil
 }
 
 // called after individual HTLC settles or fails
 func applyAutoFee(client lnrpc.LightningClient, channelId uint64, htlcFail bool) {
+	AutoFeeMu.Lock()
+	defer AutoFeeMu.Unlock()
 
-	if !AutoFeeEnabledAll || !AutoFeeEnabled[channelId] {
+	run, dryRun := autoFeeMode(channelId)
+	if !run {
 		return
 	}
 
-	params := &AutoFeeDefaults
-	if AutoFee[channelId] != nil {
-		// channel has custom parameters
-		params = AutoFee[channelId]
-	}
-
 	ctx := context.Background()
 	r, err := client.GetChanInfo(ctx, &lnrpc.ChanInfoRequest{
 		ChanId: channelId,
@@ -2041,14 +2240,21 @@ func applyAutoFee(client lnrpc.LightningClient, channelId uint64, htlcFail bool)
 	}
 
 	policy := r.Node1Policy
+	peerPolicy := r.Node2Policy
 	peerId := r.Node2Pub
 	if r.Node1Pub != MyNodeId {
 		// the first policy is not ours, use the second
 		policy = r.Node2Policy
+		peerPolicy = r.Node1Policy
 		peerId = r.Node1Pub
 	}
 
+	params, isPeerRule := AutoFeeAppliedRule(channelId, peerId)
+
 	oldFee := int(policy.FeeRateMilliMsat)
+	if dryRun {
+		oldFee = simulatedRate(channelId, oldFee, false)
+	}
 	newFee := oldFee
 
 	// get balances
@@ -2066,39 +2272,66 @@ func applyAutoFee(client lnrpc.LightningClient, channelId uint64, htlcFail bool)
 
 	localBalance := int64(0)
 	unsettledBalance := int64(0)
+	var channels []peerChannel
 	for _, ch := range res.Channels {
 		if ch.ChanId == channelId {
 			localBalance = ch.LocalBalance + ch.UnsettledBalance
 			unsettledBalance = ch.UnsettledBalance
-			break
 		}
+		channels = append(channels, peerChannel{
+			ChannelId: ch.ChanId,
+			Local:     uint64(ch.LocalBalance + ch.UnsettledBalance),
+			Capacity:  uint64(ch.Capacity),
+		})
 	}
 
 	liqPct := int(localBalance * 100 / r.Capacity)
+	note := ""
+
+	if htlcFail && !dryRun {
+		// max HTLC above the spendable balance fails
+		applyPolicyLimits(peerId, channelId, params, ownPolicy{
+			LocalMsat:    uint64(localBalance-unsettledBalance) * 1000,
+			CapacityMsat: uint64(r.Capacity) * 1000,
+			MinHtlcMsat:  uint64(policy.MinHtlc),
+			MaxHtlcMsat:  policy.MaxHtlcMsat,
+			BaseFeeMsat:  int(policy.FeeBaseMsat),
+		})
+	}
+
+	if isPeerRule {
+		// the timer sets the rates of all the peer's channels together
+		if htlcFail && !dryRun {
+			bumpPeerRule(peerId, params, peerLiqPct(channels), oldFee)
+		}
+		return
+	}
 
 	if htlcFail {
 		if liqPct < params.LowLiqPct {
 			// increase fee to help prevent further failed HTLCs
 			newFee += params.FailedBumpPPM
 
-			// bump LowLiqRate
-			if AutoFee[channelId] == nil {
-				// add custom parameters
-				AutoFee[channelId] = new(AutoFeeParams)
-				// clone default values
-				*AutoFee[channelId] = AutoFeeDefaults
+			if !dryRun {
+				// bump LowLiqRate
+				CustomAutoFeeRule(channelId).LowLiqRate = newFee
+				// persist to db
+				if err := SaveAutoFeeRule(channelId); err != nil {
+					log.Println("Failed to persist auto fee rule:", err)
+				}
 			}
-
-			AutoFee[channelId].LowLiqRate = newFee
-			// persist to db
-			db.Save("AutoFees", "AutoFee", AutoFee)
 		} else if liqPct > params.LowLiqPct {
 			// move threshold
-			moveLowLiqThreshold(channelId, params.FailedMoveThreshold)
+			if !dryRun {
+				moveLowLiqThreshold(channelId, params.FailedMoveThreshold)
+			}
 			return
 		}
 	} else {
-		newFee = calculateAutoFee(channelId, params, liqPct, oldFee)
+		newFee, note = calculateAutoFee(channelId, params, liqPct, oldFee, dryRun)
+		newFee = peerFeeBounds(params, newFee, int(peerPolicy.GetFeeRateMilliMsat()), func() []int {
+			return competitorRates(client, peerId)
+		})
 	}
 
 	// set the new rate
@@ -2108,24 +2341,56 @@ func applyAutoFee(client lnrpc.LightningClient, channelId uint64, htlcFail bool)
 			return
 		}
 
-		// check if the fee was already set
-		if lastFeeIsTheSame(channelId, newFee, false) {
-			return
+		if dryRun {
+			recordShadowFee(channelId, oldFee, newFee, false)
+			logScheduleNote(channelId, note, true)
+		} else if !lastFeeIsTheSame(channelId, newFee, false, false) {
+			// FlushFeeUpdates sends it with other triggers coalesced
+			// and logs the schedule note once it is set
+			queueFeeUpdate(peerId, channelId, oldFee, newFee, false, note)
 		}
+	} else {
+		// the current rate is right again, nothing to send
+		cancelFeeUpdate(channelId, false)
+		logScheduleNote(channelId, note, dryRun)
+	}
+}
 
-		if old, err := SetFeeRate(peerId, channelId, int64(newFee), false, false); err == nil {
-			if !lastFeeIsTheSame(channelId, newFee, false) {
-				// log the last change
-				LogFee(channelId, old, newFee, false, false)
-			}
+// rates other nodes charge toward the peer
+func competitorRates(client lnrpc.LightningClient, peerId string) []int {
+	info, err := client.GetNodeInfo(context.Background(), &lnrpc.NodeInfoRequest{
+		PubKey:          peerId,
+		IncludeChannels: true,
+	})
+	if err != nil {
+		log.Println("GetNodeInfo:", err)
+		return nil
+	}
+
+	var rates []int
+	for _, e := range info.Channels {
+		policy := e.Node1Policy
+		source := e.Node1Pub
+		if source == peerId {
+			policy = e.Node2Policy
+			source = e.Node2Pub
+		}
+		if source == MyNodeId || policy == nil || policy.Disabled {
+			continue
 		}
+		rates = append(rates, int(policy.FeeRateMilliMsat))
 	}
+
+	return rates
 }
 
 // review all fees on timer
 func ApplyAutoFees() {
+	AutoFeeMu.Lock()
+	enabled := AutoFeeEnabledAll || anyDryRun()
+	AutoFeeMu.Unlock()
 
-	if !AutoFeeEnabledAll {
+	if !enabled {
 		return
 	}
 
@@ -2135,6 +2400,14 @@ func ApplyAutoFees() {
 	}
 	defer cleanup()
 
+	applyAutoFees(client)
+}
+
+// forward events wait for the whole pass
+func applyAutoFees(client lnrpc.LightningClient) {
+	AutoFeeMu.Lock()
+	defer AutoFeeMu.Unlock()
+
 	ctx := context.Background()
 
 	res, err := client.ListChannels(ctx, &lnrpc.ListChannelsRequest{
@@ -2144,36 +2417,80 @@ func ApplyAutoFees() {
 		return
 	}
 
+	// the first channel with the peer decides for the peer rule
+	sort.Slice(res.Channels, func(i, j int) bool {
+		return res.Channels[i].ChanId < res.Channels[j].ChanId
+	})
+
+	byPeer := make(map[string][]peerChannel)
 	for _, ch := range res.Channels {
-		if !AutoFeeEnabled[ch.ChanId] {
+		byPeer[ch.RemotePubkey] = append(byPeer[ch.RemotePubkey], peerChannel{
+			ChannelId: ch.ChanId,
+			Local:     uint64(ch.LocalBalance + ch.UnsettledBalance),
+			Capacity:  uint64(ch.Capacity),
+		})
+	}
+	peerRates := make(map[string]peerRate)
+	competitors := make(competitorCache)
+
+	for _, ch := range res.Channels {
+		run, dryRun := autoFeeMode(ch.ChanId)
+		if !run {
 			continue
 		}
 
-		params := &AutoFeeDefaults
-		if AutoFee[ch.ChanId] != nil {
-			// channel has custom parameters
-			params = AutoFee[ch.ChanId]
-		}
+		params, isPeerRule := AutoFeeAppliedRule(ch.ChanId, ch.RemotePubkey)
 
 		r, err := client.GetChanInfo(ctx, &lnrpc.ChanInfoRequest{
 			ChanId: ch.ChanId,
 		})
 		if err != nil {
-			return
+			log.Println("ApplyAutoFees:", err)
+			continue
 		}
 
 		policy := r.Node1Policy
+		peerPolicy := r.Node2Policy
 		peerId := r.Node2Pub
 		if r.Node1Pub != MyNodeId {
 			// the first policy is not ours, use the second
 			policy = r.Node2Policy
+			peerPolicy = r.Node1Policy
 			peerId = r.Node1Pub
 		}
 
 		oldFee := int(policy.FeeRateMilliMsat)
+		inboundRate := int(policy.InboundFeeRateMilliMsat)
+		if dryRun {
+			oldFee = simulatedRate(ch.ChanId, oldFee, false)
+			inboundRate = simulatedRate(ch.ChanId, inboundRate, true)
+		}
 		liqPct := int((ch.LocalBalance + ch.UnsettledBalance) * 100 / r.Capacity)
 
-		newFee := calculateAutoFee(ch.ChanId, params, liqPct, oldFee)
+		var newFee int
+		var note string
+		if decided, ok := peerRates[peerId]; isPeerRule && ok {
+			newFee, note = decided.rate, decided.note
+		} else {
+			if isPeerRule {
+				newFee, note = calculatePeerAutoFee(ch.ChanId, byPeer[peerId], params, oldFee, dryRun)
+			} else {
+				newFee, note = calculateAutoFee(ch.ChanId, params, liqPct, oldFee, dryRun)
+			}
+			newFee = peerFeeBounds(params, newFee, int(peerPolicy.GetFeeRateMilliMsat()), func() []int {
+				return competitors.rates(peerId, func() []int {
+					return competitorRates(client, peerId)
+				})
+			})
+			if isPeerRule {
+				peerRates[peerId] = peerRate{newFee, note}
+			}
+		}
+
+		if isPeerRule {
+			// inbound discount follows the combined liquidity
+			liqPct = peerLiqPct(byPeer[peerId])
+		}
 
 		// set the new rate
 		if newFee != oldFee {
@@ -2182,43 +2499,40 @@ func ApplyAutoFees() {
 				continue
 			}
 
-			// check if the fee was already set
-			if lastFeeIsTheSame(ch.ChanId, newFee, false) {
-				continue
+			if dryRun {
+				recordShadowFee(ch.ChanId, oldFee, newFee, false)
+				logScheduleNote(ch.ChanId, note, true)
+			} else if !lastFeeIsTheSame(ch.ChanId, newFee, false, false) {
+				// FlushFeeUpdates sends it with other triggers coalesced
+				// and logs the schedule note once it is set
+				queueFeeUpdate(peerId, ch.ChanId, oldFee, newFee, false, note)
 			}
+		} else {
+			// the current rate is right again, nothing to send
+			cancelFeeUpdate(ch.ChanId, false)
+			logScheduleNote(ch.ChanId, note, dryRun)
+		}
 
-			_, err := SetFeeRate(peerId, ch.ChanId, int64(newFee), false, false)
-			if err == nil && !lastFeeIsTheSame(ch.ChanId, newFee, false) {
-				// log the last change
-				LogFee(ch.ChanId, oldFee, newFee, false, false)
-			}
+		if !dryRun {
+			applyPolicyLimits(peerId, ch.ChanId, params, ownPolicy{
+				LocalMsat:    uint64(ch.LocalBalance) * 1000,
+				CapacityMsat: uint64(r.Capacity) * 1000,
+				MinHtlcMsat:  uint64(policy.MinHtlc),
+				MaxHtlcMsat:  policy.MaxHtlcMsat,
+				BaseFeeMsat:  int(policy.FeeBaseMsat),
+			})
 		}
 
 		// do not change inbound fee during pending HTLCs
 		if HasInboundFees() && ch.UnsettledBalance == 0 {
-			toSet := false
-			discountRate := int64(0)
-
-			if liqPct < params.LowLiqPct && policy.InboundFeeRateMilliMsat > int32(params.LowLiqDiscount) {
-				// set inbound fee discount
-				discountRate = int64(params.LowLiqDiscount)
-				toSet = true
-			} else if liqPct > params.LowLiqPct && policy.InboundFeeRateMilliMsat < 0 {
-				// remove discount unless it was set manually or CoolOffHours did not pass
-				lastFee := LastAutoFeeLog(ch.ChanId, true)
-				if lastFee != nil {
-					if !lastFee.IsManual && lastFee.TimeStamp < time.Now().Add(-time.Duration(params.CoolOffHours)*time.Hour).Unix() {
-						toSet = true
-					}
-				}
-			}
-
-			if toSet && !lastFeeIsTheSame(ch.ChanId, int(discountRate), true) {
-				oldRate, err := SetFeeRate(peerId, ch.ChanId, discountRate, true, false)
-				if err == nil && !lastFeeIsTheSame(ch.ChanId, int(discountRate), true) {
-					// log the last change
-					LogFee(ch.ChanId, oldRate, int(discountRate), true, false)
-				}
+			inboundRateToSet, toSet := inboundTarget(ch.ChanId, params, liqPct, inboundRate, newFee, dryRun)
+
+			if toSet && dryRun {
+				recordShadowFee(ch.ChanId, inboundRate, inboundRateToSet, true)
+			} else if toSet && !lastFeeIsTheSame(ch.ChanId, inboundRateToSet, true, false) {
+				queueFeeUpdate(peerId, ch.ChanId, inboundRate, inboundRateToSet, true, "")
+			} else if !toSet {
+				cancelFeeUpdate(ch.ChanId, true)
 			}
 		}
 	}
@@ -0,0 +1,83 @@
+//go:build !cln
+
+package ln
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+// answers the calls AutoFee makes with one channel
+type fakeLightning struct {
+	lnrpc.LightningClient
+	channel *lnrpc.Channel
+	policy  *lnrpc.RoutingPolicy
+}
+
+func (f *fakeLightning) ListChannels(ctx context.Context, in *lnrpc.ListChannelsRequest, opts ...grpc.CallOption) (*lnrpc.ListChannelsResponse, error) {
+	return &lnrpc.ListChannelsResponse{Channels: []*lnrpc.Channel{f.channel}}, nil
+}
+
+func (f *fakeLightning) GetChanInfo(ctx context.Context, in *lnrpc.ChanInfoRequest, opts ...grpc.CallOption) (*lnrpc.ChannelEdge, error) {
+	return &lnrpc.ChannelEdge{
+		ChannelId:   f.channel.ChanId,
+		Capacity:    f.channel.Capacity,
+		Node1Pub:    MyNodeId,
+		Node2Pub:    f.channel.RemotePubkey,
+		Node1Policy: f.policy,
+		Node2Policy: &lnrpc.RoutingPolicy{FeeRateMilliMsat: 100},
+	}, nil
+}
+
+// failed HTLCs bump the rule while the timer reads it, run with -race
+func TestAutoFeeEventsDuringTimer(t *testing.T) {
+	const channelId = 601
+	client := &fakeLightning{
+		channel: &lnrpc.Channel{
+			ChanId:        channelId,
+			RemotePubkey:  "02aa",
+			Capacity:      1_000_000,
+			LocalBalance:  50_000, // below LowLiqPct
+			RemoteBalance: 950_000,
+		},
+		policy: &lnrpc.RoutingPolicy{FeeRateMilliMsat: 500, MaxHtlcMsat: 990_000_000},
+	}
+
+	enabledAll, version := AutoFeeEnabledAll, LndVerson
+	defer func() {
+		AutoFeeEnabledAll, LndVerson = enabledAll, version
+		delete(AutoFee, channelId)
+		delete(AutoFeeEnabled, channelId)
+		cancelFeeUpdate(channelId, false)
+		cancelPolicyUpdate(channelId, false, POLICY_MAX_HTLC)
+		cancelPolicyUpdate(channelId, false, POLICY_BASE_FEE)
+	}()
+	AutoFeeEnabledAll = true
+	AutoFeeEnabled[channelId] = true
+	// no inbound fees, keeps GetClient out
+	LndVerson = 0.17
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			applyAutoFee(client, channelId, true)
+		}()
+		go func() {
+			defer wg.Done()
+			applyAutoFees(client)
+		}()
+	}
+	wg.Wait()
+
+	AutoFeeMu.Lock()
+	defer AutoFeeMu.Unlock()
+	if rule := AutoFee[channelId]; rule == nil || rule.LowLiqRate != 500+rule.FailedBumpPPM {
+		t.Fatalf("bumped rule %+v", rule)
+	}
+}
@@ -0,0 +1,57 @@
+package ln
+
+import (
+	"slices"
+)
+
+// the peer's rate toward us and what other nodes charge
+// toward the same peer bound the outbound rate
+
+// applies peer-fee-aware bounds to the rate,
+// competitors is only called when the rule needs it
+// the floor wins over the ceilings, so that rebalancing
+// through the peer and back does not lose money
+func peerFeeBounds(params *AutoFeeParams, rate int, peerRate int, competitors func() []int) int {
+	if params.CompetitorPct > 0 {
+		if median := medianRate(competitors()); median > 0 {
+			rate = min(rate, median*params.CompetitorPct/100)
+		}
+	}
+
+	if peerRate > 0 {
+		if params.PeerCeilingPct > 0 {
+			rate = min(rate, peerRate*params.PeerCeilingPct/100)
+		}
+		if params.PeerFloorPct > 0 {
+			rate = max(rate, peerRate*params.PeerFloorPct/100)
+		}
+	}
+
+	return rate
+}
+
+// competitor rates by peer, looked up once per AutoFee run
+type competitorCache map[string][]int
+
+func (c competitorCache) rates(peerId string, lookup func() []int) []int {
+	rates, ok := c[peerId]
+	if !ok {
+		rates = lookup()
+		c[peerId] = rates
+	}
+	return rates
+}
+
+// 0 if none
+func medianRate(rates []int) int {
+	if len(rates) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(rates)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[n/2]
+}
@@ -0,0 +1,72 @@
+package ln
+
+import (
+	"testing"
+)
+
+func TestPeerFeeBounds(t *testing.T) {
+	competitors := func() []int { return []int{100, 400, 300, 900} }
+	noCall := func() []int {
+		t.Fatal("competitors fetched for a rule without CompetitorPct")
+		return nil
+	}
+
+	for _, tc := range []struct {
+		name                       string
+		floorPct, ceilPct, compPct int
+		rate, peerRate             int
+		want                       int
+	}{
+		{"off", 0, 0, 0, 500, 1000, 500},
+		{"below floor", 80, 0, 0, 500, 1000, 800},
+		{"above floor", 80, 0, 0, 900, 1000, 900},
+		{"above ceiling", 0, 120, 0, 1500, 1000, 1200},
+		{"peer rate unknown", 80, 120, 0, 500, 0, 500},
+		// median 350
+		{"competitors", 0, 0, 100, 500, 1000, 350},
+		{"competitors below", 0, 0, 100, 200, 1000, 200},
+		{"floor wins", 50, 0, 100, 500, 1000, 500},
+	} {
+		params := AutoFeeParams{PeerFloorPct: tc.floorPct, PeerCeilingPct: tc.ceilPct, CompetitorPct: tc.compPct}
+		fetch := noCall
+		if tc.compPct > 0 {
+			fetch = competitors
+		}
+		if got := peerFeeBounds(&params, tc.rate, tc.peerRate, fetch); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMedianRate(t *testing.T) {
+	for _, tc := range []struct {
+		rates []int
+		want  int
+	}{
+		{nil, 0},
+		{[]int{7}, 7},
+		{[]int{9, 1, 5}, 5},
+		{[]int{10, 1, 5, 3}, 4},
+	} {
+		if got := medianRate(tc.rates); got != tc.want {
+			t.Errorf("%v: got %d, want %d", tc.rates, got, tc.want)
+		}
+	}
+}
+
+func TestCompetitorCache(t *testing.T) {
+	cache := make(competitorCache)
+	calls := 0
+	lookup := func() []int {
+		calls++
+		return nil
+	}
+
+	// none found is cached too
+	cache.rates("02peer", lookup)
+	cache.rates("02peer", lookup)
+	cache.rates("03other", lookup)
+	if calls != 2 {
+		t.Errorf("got %d lookups, want one per peer", calls)
+	}
+}
@@ -0,0 +1,88 @@
+package ln
+
+import (
+	"log"
+)
+
+// a peer rule applies to all channels with the peer: liquidity is
+// summed over them and they all get the same rate. Without it
+// every channel follows its own rule.
+
+// balances of one channel with the peer, sats
+type peerChannel struct {
+	ChannelId uint64
+	Local     uint64
+	Capacity  uint64
+}
+
+// rate decided for the peer in one AutoFee run
+type peerRate struct {
+	rate int
+	note string
+}
+
+// returns the peer rule, nil if none
+func AutoFeePeerRule(peerId string) *AutoFeeParams {
+	if peerId == "" {
+		return nil
+	}
+	return AutoFeePeer[peerId]
+}
+
+// the rule AutoFee applies to the channel and whether it is the peer's
+func AutoFeeAppliedRule(channelId uint64, peerId string) (*AutoFeeParams, bool) {
+	if params := AutoFeePeerRule(peerId); params != nil {
+		return params, true
+	}
+	params, _ := AutoFeeRule(channelId)
+	return params, false
+}
+
+// liquidity % of all channels together
+func peerLiqPct(channels []peerChannel) int {
+	local, capacity := uint64(0), uint64(0)
+	for _, ch := range channels {
+		local += ch.Local
+		capacity += ch.Capacity
+	}
+	if capacity == 0 {
+		return 0
+	}
+	return int(local * 100 / capacity)
+}
+
+// the last outbound forward through any of the channels
+func peerLastForward(channels []peerChannel) int64 {
+	last := int64(0)
+	for _, ch := range channels {
+		if ts, ok := LastForwardTS.Read(ch.ChannelId); ok {
+			last = max(last, ts)
+		}
+	}
+	return last
+}
+
+// channelId is the first channel AutoFee runs for,
+// its fee log keeps the history of the peer rule
+func calculatePeerAutoFee(channelId uint64, channels []peerChannel, params *AutoFeeParams, oldFee int, dryRun bool) (int, string) {
+	return autoFeeRate(channelId, params, peerLiqPct(channels), oldFee, peerLastForward(channels), dryRun)
+}
+
+// an "Insufficient Balance" failure changes the peer rule,
+// the rates of all channels follow on the next run
+func bumpPeerRule(peerId string, params *AutoFeeParams, liqPct int, oldFee int) {
+	if liqPct < params.LowLiqPct {
+		params.LowLiqRate = max(params.LowLiqRate, oldFee+params.FailedBumpPPM)
+	} else if liqPct > params.LowLiqPct && params.FailedMoveThreshold > 0 &&
+		params.LowLiqPct+params.FailedMoveThreshold < params.ExcessPct {
+		// do not allow reaching high liquidity threshold
+		params.LowLiqPct += params.FailedMoveThreshold
+	} else {
+		return
+	}
+
+	// persist to db
+	if err := SaveAutoFeePeerRule(peerId); err != nil {
+		log.Println("Failed to persist auto fee rule:", err)
+	}
+}
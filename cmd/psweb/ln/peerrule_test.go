@@ -0,0 +1,52 @@
+package ln
+
+import (
+	"testing"
+)
+
+func TestPeerLiqPct(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		channels []peerChannel
+		want     int
+	}{
+		{"none", nil, 0},
+		{"single", []peerChannel{{1, 250_000, 1_000_000}}, 25},
+		// a drained small channel weighs less than a full large one
+		{"weighted", []peerChannel{{1, 0, 1_000_000}, {2, 3_000_000, 3_000_000}}, 75},
+		{"balanced", []peerChannel{{1, 100_000, 1_000_000}, {2, 900_000, 1_000_000}}, 50},
+	} {
+		if got := peerLiqPct(tc.channels); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAutoFeeAppliedRule(t *testing.T) {
+	const channelId = 501
+	const peerId = "02peer"
+	defer func() {
+		delete(AutoFee, channelId)
+		delete(AutoFeePeer, peerId)
+	}()
+
+	if params, isPeerRule := AutoFeeAppliedRule(channelId, peerId); params != &AutoFeeDefaults || isPeerRule {
+		t.Errorf("no rules: got %p %v, want defaults", params, isPeerRule)
+	}
+
+	AutoFee[channelId] = &AutoFeeParams{NormalRate: 100}
+	if params, isPeerRule := AutoFeeAppliedRule(channelId, peerId); params != AutoFee[channelId] || isPeerRule {
+		t.Errorf("channel rule: got %p %v, want the channel's", params, isPeerRule)
+	}
+
+	// peer rule overrides the channel rule
+	AutoFeePeer[peerId] = &AutoFeeParams{NormalRate: 200}
+	if params, isPeerRule := AutoFeeAppliedRule(channelId, peerId); params != AutoFeePeer[peerId] || !isPeerRule {
+		t.Errorf("peer rule: got %p %v, want the peer's", params, isPeerRule)
+	}
+
+	// unknown peer falls back
+	if params, isPeerRule := AutoFeeAppliedRule(channelId, ""); params != AutoFee[channelId] || isPeerRule {
+		t.Errorf("unknown peer: got %p %v, want the channel's", params, isPeerRule)
+	}
+}
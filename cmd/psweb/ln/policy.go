@@ -0,0 +1,96 @@
+package ln
+
+import (
+	"time"
+)
+
+// besides the rate, AutoFee can keep the outbound base fee
+// and limit max HTLC to what the channel can forward
+
+const (
+	BASE_FEE_MANUAL = 0
+	BASE_FEE_FIXED  = 1
+
+	// AutoFeeEvent.Policy, base fee logged in msat
+	POLICY_BASE_FEE = "base"
+	// max HTLC logged in sats
+	POLICY_MAX_HTLC = "max_htlc"
+
+	// max HTLC follows the balance in steps of this % to avoid gossip spam
+	MAX_HTLC_CHANGE_PCT = 10
+)
+
+// our side of the channel
+type ownPolicy struct {
+	LocalMsat    uint64
+	CapacityMsat uint64
+	MinHtlcMsat  uint64
+	MaxHtlcMsat  uint64
+	BaseFeeMsat  int
+}
+
+// returns the max HTLC to set in msat, 0 to keep the current one
+func maxHtlcTarget(params *AutoFeeParams, p ownPolicy) uint64 {
+	if params.MaxHtlcPct == 0 {
+		return 0
+	}
+
+	// whole sats, 1 sat at least
+	target := p.LocalMsat * uint64(params.MaxHtlcPct) / 100 / 1000 * 1000
+	target = min(max(target, p.MinHtlcMsat, 1000), p.CapacityMsat)
+
+	diff := max(target, p.MaxHtlcMsat) - min(target, p.MaxHtlcMsat)
+	if diff == 0 || diff*100 <= p.MaxHtlcMsat*MAX_HTLC_CHANGE_PCT && p.MaxHtlcMsat <= p.LocalMsat {
+		// close enough and can be forwarded
+		return 0
+	}
+
+	return target
+}
+
+// returns the base fee to set and whether it has to change
+func baseFeeTarget(params *AutoFeeParams, p ownPolicy) (int, bool) {
+	if params.BaseFeePolicy != BASE_FEE_FIXED || p.BaseFeeMsat == params.BaseFeeMsat {
+		return 0, false
+	}
+	return params.BaseFeeMsat, true
+}
+
+// a manual change holds off AutoFee for CoolOffHours
+func manualPolicyHold(channelId uint64, policy string, params *AutoFeeParams) bool {
+	events := feeEvents(channelId, false)
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Policy == policy {
+			return events[i].IsManual &&
+				events[i].TimeStamp > time.Now().Add(-time.Duration(params.CoolOffHours)*time.Hour).Unix()
+		}
+	}
+	return false
+}
+
+// queues base fee and max HTLC changes the rule requires,
+// FlushFeeUpdates sends them with the rates, dry run only simulates rates
+func applyPolicyLimits(peerId string, channelId uint64, params *AutoFeeParams, p ownPolicy) {
+	if target := maxHtlcTarget(params, p); target > 0 && !manualPolicyHold(channelId, POLICY_MAX_HTLC, params) {
+		queuePolicyUpdate(peerId, channelId, POLICY_MAX_HTLC, int(p.MaxHtlcMsat/1000), int(target/1000))
+	} else {
+		cancelPolicyUpdate(channelId, false, POLICY_MAX_HTLC)
+	}
+
+	if base, ok := baseFeeTarget(params, p); ok && !manualPolicyHold(channelId, POLICY_BASE_FEE, params) {
+		queuePolicyUpdate(peerId, channelId, POLICY_BASE_FEE, p.BaseFeeMsat, base)
+	} else {
+		cancelPolicyUpdate(channelId, false, POLICY_BASE_FEE)
+	}
+}
+
+// records a base fee or max HTLC change
+func LogPolicy(channelId uint64, policy string, oldValue int, newValue int, isManual bool) {
+	appendFeeLog(channelId, &AutoFeeEvent{
+		TimeStamp: time.Now().Unix(),
+		OldRate:   oldValue,
+		NewRate:   newValue,
+		IsManual:  isManual,
+		Policy:    policy,
+	}, false)
+}
@@ -0,0 +1,113 @@
+package ln
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxHtlcTarget(t *testing.T) {
+	params := &AutoFeeParams{MaxHtlcPct: 50}
+	channel := func(local, max uint64) ownPolicy {
+		return ownPolicy{LocalMsat: local, CapacityMsat: 10_000_000_000, MinHtlcMsat: 1000, MaxHtlcMsat: max}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params *AutoFeeParams
+		p      ownPolicy
+		want   uint64
+	}{
+		{"off", &AutoFeeParams{}, channel(2_000_000_000, 9_900_000_000), 0},
+		{"above balance", params, channel(2_000_000_000, 9_900_000_000), 1_000_000_000},
+		{"within step", params, channel(2_000_000_000, 950_000_000), 0},
+		{"outside step", params, channel(2_000_000_000, 800_000_000), 1_000_000_000},
+		{"whole sats", params, channel(2_000_001_999, 500_000_000), 1_000_000_000},
+		{"empty channel", params, channel(0, 500_000_000), 1000},
+		{"min htlc", params, ownPolicy{CapacityMsat: 10_000_000_000, MinHtlcMsat: 5000, MaxHtlcMsat: 500_000_000}, 5000},
+		{"capacity", &AutoFeeParams{MaxHtlcPct: 100}, ownPolicy{LocalMsat: 12_000_000_000, CapacityMsat: 10_000_000_000, MaxHtlcMsat: 5_000_000_000}, 10_000_000_000},
+		// even a small step when it cannot be forwarded
+		{"just above balance", &AutoFeeParams{MaxHtlcPct: 100}, channel(1_000_000_000, 1_050_000_000), 1_000_000_000},
+	} {
+		if got := maxHtlcTarget(tc.params, tc.p); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBaseFeeTarget(t *testing.T) {
+	if _, ok := baseFeeTarget(&AutoFeeParams{BaseFeeMsat: 0}, ownPolicy{BaseFeeMsat: 1000}); ok {
+		t.Error("manual base fee changed")
+	}
+	if base, ok := baseFeeTarget(&AutoFeeParams{BaseFeePolicy: BASE_FEE_FIXED}, ownPolicy{BaseFeeMsat: 1000}); !ok || base != 0 {
+		t.Errorf("got %d %v, want zero base", base, ok)
+	}
+	if _, ok := baseFeeTarget(&AutoFeeParams{BaseFeePolicy: BASE_FEE_FIXED, BaseFeeMsat: 1000}, ownPolicy{BaseFeeMsat: 1000}); ok {
+		t.Error("same base fee set again")
+	}
+}
+
+// policy changes share the fee log but are not rate changes
+func TestLogPolicy(t *testing.T) {
+	const channelId = 601
+	defer delete(AutoFeeLog, channelId)
+
+	params := &AutoFeeParams{CoolOffHours: 12}
+	AutoFeeLog[channelId] = []*AutoFeeEvent{{TimeStamp: time.Now().Unix() - 3600, OldRate: 100, NewRate: 200}}
+
+	LogPolicy(channelId, POLICY_MAX_HTLC, 500_000, 250_000, true)
+	if last := LastAutoFeeLog(channelId, false); last.NewRate != 200 {
+		t.Fatalf("last rate %d", last.NewRate)
+	}
+	if !manualPolicyHold(channelId, POLICY_MAX_HTLC, params) {
+		t.Error("manual max HTLC overridden")
+	}
+	if manualPolicyHold(channelId, POLICY_BASE_FEE, params) {
+		t.Error("base fee held by a max HTLC change")
+	}
+
+	LogPolicy(channelId, POLICY_MAX_HTLC, 250_000, 300_000, false)
+	if manualPolicyHold(channelId, POLICY_MAX_HTLC, params) {
+		t.Error("held after an auto change")
+	}
+}
+
+func TestApplyPolicyLimitsQueues(t *testing.T) {
+	const channelId = 704
+	defer func() {
+		for _, policy := range []string{"", POLICY_MAX_HTLC, POLICY_BASE_FEE} {
+			cancelPolicyUpdate(channelId, false, policy)
+		}
+	}()
+
+	params := &AutoFeeParams{MaxHtlcPct: 50, BaseFeePolicy: BASE_FEE_FIXED, BaseFeeMsat: 0}
+	p := ownPolicy{LocalMsat: 2_000_000_000, CapacityMsat: 10_000_000_000, MinHtlcMsat: 1000, MaxHtlcMsat: 9_900_000_000, BaseFeeMsat: 1000}
+
+	queueFeeUpdate("02peer", channelId, 300, 400, false, "")
+	applyPolicyLimits("02peer", channelId, params, p)
+	// the next trigger replaces the target
+	p.LocalMsat = 1_000_000_000
+	applyPolicyLimits("02peer", channelId, params, p)
+
+	pending := PendingFeeUpdates(channelId)
+	if len(pending) != 3 {
+		t.Fatalf("got %+v, want the rate, base fee and max HTLC pending", pending)
+	}
+	for _, u := range pending {
+		switch u.Policy {
+		case POLICY_BASE_FEE:
+			if u.OldRate != 1000 || u.NewRate != 0 || u.Coalesced != 0 {
+				t.Errorf("base fee: got %+v", u)
+			}
+		case POLICY_MAX_HTLC:
+			if u.OldRate != 9_900_000 || u.NewRate != 500_000 || u.Coalesced != 1 {
+				t.Errorf("max HTLC: got %+v", u)
+			}
+		}
+	}
+
+	// nothing to change any more
+	applyPolicyLimits("02peer", channelId, &AutoFeeParams{}, p)
+	if pending := PendingFeeUpdates(channelId); len(pending) != 1 || pending[0].Policy != "" {
+		t.Errorf("got %+v, want only the rate pending", pending)
+	}
+}
@@ -0,0 +1,265 @@
+package ln
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// every policy update is gossiped to the network and nodes rate-limit
+// the ones that update too often. AutoFee rate, base fee and max HTLC
+// changes wait in a queue for CoalesceMinutes, so that several triggers
+// end in one update, then go out while the daily budgets allow.
+
+type UpdateBudget struct {
+	DailyUpdates        int // all channels, 0 for no limit
+	ChannelDailyUpdates int // per channel, 0 for no limit
+	CoalesceMinutes     int
+}
+
+var AutoFeeBudget = UpdateBudget{
+	DailyUpdates:        0,
+	ChannelDailyUpdates: 12,
+	CoalesceMinutes:     5,
+}
+
+func (b *UpdateBudget) Validate() error {
+	if b.DailyUpdates < 0 || b.ChannelDailyUpdates < 0 {
+		return errors.New("daily updates cannot be negative")
+	}
+	if b.CoalesceMinutes < 0 || b.CoalesceMinutes > 1440 {
+		return errors.New("coalesce minutes must be between 0 and 1440")
+	}
+	return nil
+}
+
+// whether one more update fits, given the updates of the last 24h
+func (b *UpdateBudget) allows(global int, channel int) bool {
+	return (b.DailyUpdates == 0 || global < b.DailyUpdates) &&
+		(b.ChannelDailyUpdates == 0 || channel < b.ChannelDailyUpdates)
+}
+
+// a rate or policy change waiting to be sent
+type PendingFee struct {
+	ChannelId uint64
+	PeerId    string
+	IsInbound bool
+	Policy    string // empty for the rate, like AutoFeeEvent.Policy
+	OldRate   int    // the value in the units of the fee log
+	NewRate   int
+	QueuedTS  int64  // first trigger
+	Coalesced int    // earlier targets replaced by a later one
+	Deferred  bool   // the budget was used up at the last flush
+	Schedule  string // transition logged once the rate is set
+}
+
+// sent not before
+func (p *PendingFee) ReadyTS() int64 {
+	return p.QueuedTS + int64(AutoFeeBudget.CoalesceMinutes)*60
+}
+
+type pendingKey struct {
+	channelId uint64
+	isInbound bool
+	policy    string
+}
+
+var (
+	pendingFees   = make(map[pendingKey]*PendingFee)
+	pendingFeesMu sync.Mutex
+)
+
+// replaces the target of the pending rate change or queues a new one,
+// schedule is the note of the rate set the target belongs to
+func queueFeeUpdate(peerId string, channelId uint64, oldRate int, newRate int, isInbound bool, schedule string) {
+	queueUpdate(&PendingFee{
+		ChannelId: channelId,
+		PeerId:    peerId,
+		IsInbound: isInbound,
+		OldRate:   oldRate,
+		NewRate:   newRate,
+		Schedule:  schedule,
+	})
+}
+
+// same for base fee in msat or max HTLC in sats
+func queuePolicyUpdate(peerId string, channelId uint64, policy string, oldValue int, newValue int) {
+	queueUpdate(&PendingFee{
+		ChannelId: channelId,
+		PeerId:    peerId,
+		Policy:    policy,
+		OldRate:   oldValue,
+		NewRate:   newValue,
+	})
+}
+
+func queueUpdate(update *PendingFee) {
+	pendingFeesMu.Lock()
+	defer pendingFeesMu.Unlock()
+
+	key := pendingKey{update.ChannelId, update.IsInbound, update.Policy}
+	if p, ok := pendingFees[key]; ok {
+		if p.NewRate != update.NewRate {
+			p.NewRate = update.NewRate
+			p.Coalesced++
+		}
+		p.Schedule = update.Schedule
+		return
+	}
+
+	update.QueuedTS = time.Now().Unix()
+	pendingFees[key] = update
+}
+
+// the current rate is right again, nothing to send
+func cancelFeeUpdate(channelId uint64, isInbound bool) {
+	cancelPolicyUpdate(channelId, isInbound, "")
+}
+
+func cancelPolicyUpdate(channelId uint64, isInbound bool, policy string) {
+	pendingFeesMu.Lock()
+	defer pendingFeesMu.Unlock()
+
+	delete(pendingFees, pendingKey{channelId, isInbound, policy})
+}
+
+// AutoFee policy updates in the last 24h, of all channels if channelId is 0
+func UpdatesToday(channelId uint64) int {
+	since := time.Now().Add(-24 * time.Hour).Unix()
+	count := 0
+	for id, events := range FeeLogCopy() {
+		if channelId > 0 && id != channelId {
+			continue
+		}
+		for i := len(events) - 1; i >= 0 && events[i].TimeStamp > since; i-- {
+			if !events[i].IsManual && events[i].Schedule == "" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// pending changes oldest first, of all channels if channelId is 0
+func PendingFeeUpdates(channelId uint64) []PendingFee {
+	pendingFeesMu.Lock()
+	defer pendingFeesMu.Unlock()
+
+	var list []PendingFee
+	for _, p := range pendingFees {
+		if channelId == 0 || p.ChannelId == channelId {
+			list = append(list, *p)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].QueuedTS != list[j].QueuedTS {
+			return list[i].QueuedTS < list[j].QueuedTS
+		}
+		if list[i].ChannelId != list[j].ChannelId {
+			return list[i].ChannelId < list[j].ChannelId
+		}
+		if list[i].Policy != list[j].Policy {
+			return list[i].Policy < list[j].Policy
+		}
+		return !list[i].IsInbound
+	})
+
+	return list
+}
+
+// sends the changes that waited CoalesceMinutes while the budgets allow,
+// called every minute
+func FlushFeeUpdates() {
+	AutoFeeMu.Lock()
+	defer AutoFeeMu.Unlock()
+
+	now := time.Now().Unix()
+	global := UpdatesToday(0)
+
+	for _, p := range PendingFeeUpdates(0) {
+		key := pendingKey{p.ChannelId, p.IsInbound, p.Policy}
+
+		if run, dryRun := autoFeeMode(p.ChannelId); !run || dryRun {
+			// AutoFee was turned off meanwhile
+			cancelPolicyUpdate(p.ChannelId, p.IsInbound, p.Policy)
+			continue
+		}
+
+		if p.ReadyTS() > now {
+			continue
+		}
+
+		if !AutoFeeBudget.allows(global, UpdatesToday(p.ChannelId)) {
+			pendingFeesMu.Lock()
+			if pending, ok := pendingFees[key]; ok {
+				pending.Deferred = true
+			}
+			pendingFeesMu.Unlock()
+			continue
+		}
+
+		pendingFeesMu.Lock()
+		pending, ok := pendingFees[key]
+		if ok {
+			// the latest target
+			p = *pending
+			delete(pendingFees, key)
+		}
+		pendingFeesMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		if p.Policy != "" {
+			if sendPolicy(&p) {
+				global++
+			}
+			continue
+		}
+
+		if lastFeeIsTheSame(p.ChannelId, p.NewRate, p.IsInbound, false) {
+			// already set
+			logScheduleNote(p.ChannelId, p.Schedule, false)
+			continue
+		}
+
+		oldRate, err := SetFeeRate(p.PeerId, p.ChannelId, int64(p.NewRate), p.IsInbound, false)
+		if err != nil {
+			continue
+		}
+		if !lastFeeIsTheSame(p.ChannelId, p.NewRate, p.IsInbound, false) {
+			// log the last change
+			LogFee(p.ChannelId, oldRate, p.NewRate, p.IsInbound, false)
+			global++
+		}
+		// the new rate set is in effect
+		logScheduleNote(p.ChannelId, p.Schedule, false)
+	}
+}
+
+// sets base fee or max HTLC, returns whether it was changed
+func sendPolicy(p *PendingFee) bool {
+	var oldValue int
+	switch p.Policy {
+	case POLICY_MAX_HTLC:
+		old, err := SetHtlcSize(p.PeerId, p.ChannelId, int64(p.NewRate)*1000, true)
+		if err != nil {
+			return false
+		}
+		oldValue = int(old / 1000)
+	case POLICY_BASE_FEE:
+		old, err := SetFeeRate(p.PeerId, p.ChannelId, int64(p.NewRate), false, true)
+		if err != nil {
+			return false
+		}
+		oldValue = old
+	}
+
+	if oldValue == p.NewRate {
+		return false
+	}
+	LogPolicy(p.ChannelId, p.Policy, oldValue, p.NewRate, false)
+	return true
+}
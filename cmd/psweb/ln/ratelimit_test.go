@@ -0,0 +1,135 @@
+package ln
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueFeeUpdateCoalesces(t *testing.T) {
+	const channelId = 701
+	defer cancelFeeUpdate(channelId, false)
+
+	queueFeeUpdate("02peer", channelId, 300, 350, false, "")
+	queueFeeUpdate("02peer", channelId, 300, 350, false, "") // same target
+	queueFeeUpdate("02peer", channelId, 300, 400, false, "")
+
+	pending := PendingFeeUpdates(channelId)
+	if len(pending) != 1 {
+		t.Fatalf("got %d pending, want 1", len(pending))
+	}
+	if p := pending[0]; p.OldRate != 300 || p.NewRate != 400 || p.Coalesced != 1 {
+		t.Errorf("got %d -> %d coalesced %d, want 300 -> 400 coalesced 1", p.OldRate, p.NewRate, p.Coalesced)
+	}
+
+	// inbound is queued separately
+	queueFeeUpdate("02peer", channelId, 0, -50, true, "")
+	if len(PendingFeeUpdates(channelId)) != 2 {
+		t.Error("inbound change merged with outbound")
+	}
+	cancelFeeUpdate(channelId, true)
+
+	cancelFeeUpdate(channelId, false)
+	if len(PendingFeeUpdates(channelId)) != 0 {
+		t.Error("cancelled change still pending")
+	}
+}
+
+func TestUpdateBudgetAllows(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		budget          UpdateBudget
+		global, channel int
+		want            bool
+	}{
+		{"no limits", UpdateBudget{}, 1000, 1000, true},
+		{"channel left", UpdateBudget{ChannelDailyUpdates: 12}, 100, 11, true},
+		{"channel used up", UpdateBudget{ChannelDailyUpdates: 12}, 100, 12, false},
+		{"global used up", UpdateBudget{DailyUpdates: 100, ChannelDailyUpdates: 12}, 100, 0, false},
+	} {
+		if got := tc.budget.allows(tc.global, tc.channel); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFlushFeeUpdatesDefersOverBudget(t *testing.T) {
+	const channelId = 702
+	savedBudget, savedAll := AutoFeeBudget, AutoFeeEnabledAll
+	defer func() {
+		AutoFeeBudget, AutoFeeEnabledAll = savedBudget, savedAll
+		delete(AutoFeeEnabled, channelId)
+		feeLogMu.Lock()
+		delete(AutoFeeLog, channelId)
+		feeLogMu.Unlock()
+		cancelFeeUpdate(channelId, false)
+	}()
+
+	AutoFeeEnabledAll = true
+	AutoFeeEnabled[channelId] = true
+	AutoFeeBudget = UpdateBudget{ChannelDailyUpdates: 1}
+
+	now := time.Now().Unix()
+	feeLogMu.Lock()
+	AutoFeeLog[channelId] = []*AutoFeeEvent{
+		{TimeStamp: now - 100, OldRate: 100, NewRate: 200},
+		// manual changes and schedule notes do not count
+		{TimeStamp: now - 50, OldRate: 200, NewRate: 250, IsManual: true},
+		{TimeStamp: now - 40, Schedule: "weekend"},
+	}
+	feeLogMu.Unlock()
+
+	if got := UpdatesToday(channelId); got != 1 {
+		t.Fatalf("got %d updates today, want 1", got)
+	}
+
+	queueFeeUpdate("02peer", channelId, 250, 300, false, "")
+	FlushFeeUpdates()
+
+	pending := PendingFeeUpdates(channelId)
+	if len(pending) != 1 || !pending[0].Deferred {
+		t.Fatalf("got %+v, want one deferred change", pending)
+	}
+
+	// turning AutoFee off drops the queue
+	AutoFeeEnabled[channelId] = false
+	FlushFeeUpdates()
+	if len(PendingFeeUpdates(channelId)) != 0 {
+		t.Error("change of a disabled channel still pending")
+	}
+}
+
+func TestFlushFeeUpdatesLogsScheduleOnceSet(t *testing.T) {
+	const channelId = 703
+	savedBudget, savedAll := AutoFeeBudget, AutoFeeEnabledAll
+	defer func() {
+		AutoFeeBudget, AutoFeeEnabledAll = savedBudget, savedAll
+		delete(AutoFeeEnabled, channelId)
+		feeLogMu.Lock()
+		delete(AutoFeeLog, channelId)
+		feeLogMu.Unlock()
+		cancelFeeUpdate(channelId, false)
+	}()
+
+	AutoFeeEnabledAll = true
+	AutoFeeEnabled[channelId] = true
+	AutoFeeBudget = UpdateBudget{}
+
+	const note = "Schedule 1: Daily 00:00-00:00 UTC 100/300/900"
+	queueFeeUpdate("02peer", channelId, 900, 300, false, note)
+	if lastScheduleNote(channelId, false) != BASE_RATES {
+		t.Fatal("note logged while the change waits")
+	}
+
+	// the rate was set meanwhile
+	feeLogMu.Lock()
+	AutoFeeLog[channelId] = []*AutoFeeEvent{{TimeStamp: time.Now().Unix(), OldRate: 900, NewRate: 300}}
+	feeLogMu.Unlock()
+
+	FlushFeeUpdates()
+	if len(PendingFeeUpdates(channelId)) != 0 {
+		t.Fatal("change still pending")
+	}
+	if got := lastScheduleNote(channelId, false); got != note {
+		t.Errorf("got note %q, want %q", got, note)
+	}
+}
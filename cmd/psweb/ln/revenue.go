@@ -0,0 +1,168 @@
+package ln
+
+import (
+	"sort"
+	"time"
+)
+
+// revenue mode measures the fee income at each outbound rate
+// the channel had and steps toward the most profitable one
+
+// a rate needs this much observation to be compared
+const REVENUE_MIN_HOURS = 24
+
+type RateRevenue struct {
+	Rate     int
+	Hours    float64
+	Forwards int
+	Volume   uint64
+	// sats
+	Fees float64
+}
+
+// fee income while the rate was set
+func (r *RateRevenue) PerDay() float64 {
+	if r.Hours == 0 {
+		return 0
+	}
+	return r.Fees * 24 / r.Hours
+}
+
+func (r *RateRevenue) IsMeasured() bool {
+	return r.Hours >= REVENUE_MIN_HOURS
+}
+
+// RevenueByRate returns the income of the channel at each outbound rate
+// it had in the last days, ordered by rate
+func RevenueByRate(channelId uint64, currentRate int, days int) []*RateRevenue {
+	now := time.Now().Unix()
+	from := time.Now().AddDate(0, 0, -days).Unix()
+	return revenueByRate(channelId, *ForwardsLog(channelId, from), feeEvents(channelId, false), currentRate, from, now)
+}
+
+// splits the period by the outbound rate in effect,
+// forwards sorted descending, feeLog in the order logged
+func revenueByRate(channelId uint64, forwards []DataPoint, feeLog []*AutoFeeEvent, currentRate int, from, now int64) []*RateRevenue {
+	type segment struct {
+		start int64
+		rate  int
+	}
+
+	var segments []segment
+	for _, e := range feeLog {
+		if e.IsInbound || !e.IsRate() {
+			continue
+		}
+		if e.TimeStamp <= from {
+			// in effect at the start
+			segments = []segment{{from, e.NewRate}}
+		} else if e.TimeStamp < now {
+			if len(segments) == 0 {
+				segments = append(segments, segment{from, e.OldRate})
+			}
+			segments = append(segments, segment{e.TimeStamp, e.NewRate})
+		}
+	}
+	if len(segments) == 0 {
+		segments = append(segments, segment{from, currentRate})
+	}
+
+	levels := make(map[int]*RateRevenue)
+	level := func(rate int) *RateRevenue {
+		if levels[rate] == nil {
+			levels[rate] = &RateRevenue{Rate: rate}
+		}
+		return levels[rate]
+	}
+
+	for i, s := range segments {
+		end := now
+		if i+1 < len(segments) {
+			end = segments[i+1].start
+		}
+		level(s.rate).Hours += float64(end-s.start) / 3600
+	}
+
+	for _, f := range forwards {
+		ts := int64(f.TS)
+		if f.ChanIdOut != channelId || ts < from || ts > now {
+			continue
+		}
+		// last segment started before the forward
+		i := sort.Search(len(segments), func(i int) bool {
+			return segments[i].start > ts
+		}) - 1
+		l := level(segments[max(i, 0)].rate)
+		l.Forwards++
+		l.Volume += f.Amount
+		l.Fees += f.Fee
+	}
+
+	var result []*RateRevenue
+	for _, l := range levels {
+		result = append(result, l)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Rate < result[j].Rate
+	})
+
+	return result
+}
+
+// one step toward the best measured rate, when the current rate
+// earns the most, probes the neighbours not yet measured
+func revenueStep(params *AutoFeeParams, levels []*RateRevenue, currentRate int) int {
+	step := params.RevenueStepPPM
+	clamp := func(rate int) int {
+		return min(max(rate, params.RevenueMinPPM), params.RevenueMaxPPM)
+	}
+
+	if clamp(currentRate) != currentRate {
+		return clamp(currentRate)
+	}
+
+	var current, best *RateRevenue
+	for _, l := range levels {
+		if !l.IsMeasured() {
+			continue
+		}
+		if l.Rate == currentRate {
+			current = l
+		}
+		if best == nil || l.PerDay() > best.PerDay() {
+			best = l
+		}
+	}
+
+	if current == nil {
+		// keep observing
+		return currentRate
+	}
+
+	measured := func(rate int) bool {
+		for _, l := range levels {
+			if l.IsMeasured() && 2*abs(l.Rate-rate) <= step {
+				return true
+			}
+		}
+		return false
+	}
+
+	target := currentRate
+	if best.PerDay() > current.PerDay() {
+		target = best.Rate
+	} else if up := clamp(currentRate + step); !measured(up) {
+		target = up
+	} else if down := clamp(currentRate - step); !measured(down) {
+		target = down
+	}
+
+	return clamp(currentRate + min(max(target-currentRate, -step), step))
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,83 @@
+package ln
+
+import (
+	"testing"
+)
+
+func TestRevenueByRate(t *testing.T) {
+	const channelId = 501
+	const hour = 3600
+	from := int64(1_700_000_000)
+	now := from + 100*hour
+
+	feeLog := []*AutoFeeEvent{
+		// before the period, 300 in effect at the start
+		{TimeStamp: from - hour, OldRate: 500, NewRate: 300},
+		{TimeStamp: from + 40*hour, OldRate: 300, NewRate: 400},
+		{TimeStamp: from + 50*hour, OldRate: 400, NewRate: 1000, IsInbound: true},
+		{TimeStamp: from + 60*hour, Schedule: BASE_RATES},
+		{TimeStamp: from + 70*hour, OldRate: 400, NewRate: 300},
+	}
+	// descending like ForwardsLog
+	forwards := []DataPoint{
+		{TS: uint64(from + 80*hour), Amount: 100_000, Fee: 30, ChanIdOut: channelId},
+		{TS: uint64(from + 45*hour), Amount: 200_000, Fee: 80, ChanIdOut: channelId},
+		{TS: uint64(from + 41*hour), Amount: 100_000, Fee: 40, ChanIdOut: channelId},
+		{TS: uint64(from + 30*hour), Amount: 100_000, Fee: 30, ChanIdOut: 999},
+		{TS: uint64(from + 10*hour), Amount: 100_000, Fee: 30, ChanIdOut: channelId},
+	}
+
+	levels := revenueByRate(channelId, forwards, feeLog, 300, from, now)
+	if len(levels) != 2 {
+		t.Fatalf("got %d rates, want 2", len(levels))
+	}
+
+	low, high := levels[0], levels[1]
+	if low.Rate != 300 || low.Hours != 70 || low.Forwards != 2 || low.Volume != 200_000 || low.Fees != 60 {
+		t.Errorf("300 ppm: %+v", *low)
+	}
+	if high.Rate != 400 || high.Hours != 30 || high.Forwards != 2 || high.Fees != 120 {
+		t.Errorf("400 ppm: %+v", *high)
+	}
+	if !low.IsMeasured() || !high.IsMeasured() {
+		t.Error("rates set for over a day not measured")
+	}
+	if high.PerDay() != 96 {
+		t.Errorf("400 ppm earns %v/day, want 96", high.PerDay())
+	}
+
+	// no changes logged, all time at the current rate
+	levels = revenueByRate(channelId, forwards, nil, 250, from, now)
+	if len(levels) != 1 || levels[0].Rate != 250 || levels[0].Forwards != 4 {
+		t.Errorf("without fee log: %+v", levels)
+	}
+}
+
+func TestRevenueStep(t *testing.T) {
+	params := &AutoFeeParams{RevenueMinPPM: 100, RevenueMaxPPM: 1000, RevenueStepPPM: 50, RevenueDays: 14}
+	level := func(rate int, hours, fees float64) *RateRevenue {
+		return &RateRevenue{Rate: rate, Hours: hours, Fees: fees}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		levels  []*RateRevenue
+		current int
+		want    int
+	}{
+		{"below min", nil, 50, 100},
+		{"above max", nil, 1200, 1000},
+		{"current not measured", []*RateRevenue{level(300, 10, 5), level(400, 48, 100)}, 300, 300},
+		{"toward better", []*RateRevenue{level(300, 48, 20), level(500, 48, 100)}, 300, 350},
+		{"toward better below", []*RateRevenue{level(280, 48, 100), level(300, 48, 20)}, 300, 280},
+		{"probe up", []*RateRevenue{level(300, 48, 100)}, 300, 350},
+		{"probe down", []*RateRevenue{level(300, 48, 100), level(350, 48, 50)}, 300, 250},
+		{"max reached, probe down", []*RateRevenue{level(980, 48, 100)}, 980, 930},
+		{"probe up to max", []*RateRevenue{level(960, 48, 100)}, 960, 1000},
+		{"best known", []*RateRevenue{level(250, 48, 10), level(300, 48, 100), level(350, 48, 50)}, 300, 300},
+	} {
+		if got := revenueStep(params, tc.levels, tc.current); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package ln
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// note logged when no schedule applies
+const BASE_RATES = "Base rates"
+
+var Weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// alternate rates applied in a weekly UTC time window
+type AutoFeeSchedule struct {
+	// bit 0 is Sunday, 0 means every day
+	Days int
+	// minutes after UTC midnight
+	// the window continues past midnight when EndMin <= StartMin
+	StartMin int
+	EndMin   int
+	// replace the rates of the rule while active
+	LowLiqRate int
+	NormalRate int
+	ExcessRate int
+}
+
+// the window belongs to the day when it starts
+func (s *AutoFeeSchedule) IsActive(t time.Time) bool {
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+
+	if s.EndMin <= s.StartMin {
+		// overnight
+		if minute < s.EndMin {
+			// started yesterday
+			day = (day + 6) % 7
+		} else if minute < s.StartMin {
+			return false
+		}
+	} else if minute < s.StartMin || minute >= s.EndMin {
+		return false
+	}
+
+	return s.Days == 0 || s.Days&(1<<day) != 0
+}
+
+func (s *AutoFeeSchedule) DaysString() string {
+	if s.Days == 0 || s.Days == 127 {
+		return "Daily"
+	}
+	var days []string
+	for i, d := range Weekdays {
+		if s.Days&(1<<i) != 0 {
+			days = append(days, d)
+		}
+	}
+	return strings.Join(days, ",")
+}
+
+func (s *AutoFeeSchedule) Window() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", s.StartMin/60, s.StartMin%60, s.EndMin/60, s.EndMin%60)
+}
+
+func (s *AutoFeeSchedule) String() string {
+	return s.DaysString() + " " + s.Window() + " UTC " +
+		strconv.Itoa(s.ExcessRate) + "/" + strconv.Itoa(s.NormalRate) + "/" + strconv.Itoa(s.LowLiqRate)
+}
+
+func (s *AutoFeeSchedule) Validate() error {
+	if s.Days < 0 || s.Days > 127 {
+		return errors.New("invalid schedule days")
+	}
+	if s.StartMin < 0 || s.StartMin >= 1440 || s.EndMin < 0 || s.EndMin >= 1440 {
+		return errors.New("schedule time must be within 00:00-23:59")
+	}
+	if s.LowLiqRate < 0 || s.NormalRate < 0 || s.ExcessRate < 0 {
+		return errors.New("schedule rates cannot be negative")
+	}
+	return nil
+}
+
+// returns the rule with the rates of the schedule active at t,
+// and the index of that schedule or -1
+func ScheduledRule(params *AutoFeeParams, t time.Time) (*AutoFeeParams, int) {
+	for i := range params.Schedules {
+		s := &params.Schedules[i]
+		if s.IsActive(t) {
+			p := *params
+			p.LowLiqRate = s.LowLiqRate
+			p.NormalRate = s.NormalRate
+			p.ExcessRate = s.ExcessRate
+			return &p, i
+		}
+	}
+	return params, -1
+}
+
+func scheduleNote(params *AutoFeeParams, index int) string {
+	if index < 0 {
+		return BASE_RATES
+	}
+	return "Schedule " + strconv.Itoa(index+1) + ": " + params.Schedules[index].String()
+}
+
+// returns the last schedule transition logged for the channel
+func lastScheduleNote(channelId uint64, dryRun bool) string {
+	last := lastNote(feeEvents(channelId, false))
+	if dryRun {
+		last = newest(last, lastNote(feeEvents(channelId, true)))
+	}
+	if last == nil {
+		return BASE_RATES
+	}
+	return last.Schedule
+}
+
+// returns the note if another rate set applies now, empty otherwise
+func scheduleTransition(channelId uint64, params *AutoFeeParams, index int, dryRun bool) string {
+	note := scheduleNote(params, index)
+	if note == lastScheduleNote(channelId, dryRun) {
+		return ""
+	}
+	return note
+}
+
+// logs the transition, call it once the rate of the new set is in effect:
+// right away when the rate stays, after the queued change is sent
+// or after the dry run proposal is recorded,
+// until then every run starts it over
+func logScheduleNote(channelId uint64, note string, dryRun bool) {
+	if note == "" {
+		return
+	}
+
+	appendFeeLog(channelId, &AutoFeeEvent{
+		TimeStamp: time.Now().Unix(),
+		Schedule:  note,
+	}, dryRun)
+}
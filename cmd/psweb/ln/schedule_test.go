@@ -0,0 +1,91 @@
+package ln
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoFeeScheduleIsActive(t *testing.T) {
+	const (
+		sun = 1 << 0
+		mon = 1 << 1
+		fri = 1 << 5
+		sat = 1 << 6
+	)
+
+	// 2024-06-02 is a Sunday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 6, 2+day, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		schedule AutoFeeSchedule
+		t        time.Time
+		want     bool
+	}{
+		{"daily inside", AutoFeeSchedule{StartMin: 8 * 60, EndMin: 17 * 60}, at(3, 12, 0), true},
+		{"daily at start", AutoFeeSchedule{StartMin: 8 * 60, EndMin: 17 * 60}, at(3, 8, 0), true},
+		{"daily at end", AutoFeeSchedule{StartMin: 8 * 60, EndMin: 17 * 60}, at(3, 17, 0), false},
+		{"daily before", AutoFeeSchedule{StartMin: 8 * 60, EndMin: 17 * 60}, at(3, 7, 59), false},
+		{"other day", AutoFeeSchedule{Days: mon, StartMin: 8 * 60, EndMin: 17 * 60}, at(2, 12, 0), false},
+		{"local time", AutoFeeSchedule{Days: mon, StartMin: 8 * 60, EndMin: 17 * 60}, at(1, 12, 0).In(time.FixedZone("UTC+10", 10*3600)), true},
+
+		// 22:00-06:00 starting on Friday
+		{"overnight evening", AutoFeeSchedule{Days: fri, StartMin: 22 * 60, EndMin: 6 * 60}, at(5, 23, 0), true},
+		{"overnight after midnight", AutoFeeSchedule{Days: fri, StartMin: 22 * 60, EndMin: 6 * 60}, at(6, 5, 59), true},
+		{"overnight ended", AutoFeeSchedule{Days: fri, StartMin: 22 * 60, EndMin: 6 * 60}, at(6, 6, 0), false},
+		{"overnight afternoon", AutoFeeSchedule{Days: fri, StartMin: 22 * 60, EndMin: 6 * 60}, at(5, 15, 0), false},
+		{"overnight started yesterday", AutoFeeSchedule{Days: fri, StartMin: 22 * 60, EndMin: 6 * 60}, at(5, 3, 0), false},
+		{"overnight not started today", AutoFeeSchedule{Days: fri, StartMin: 22 * 60, EndMin: 6 * 60}, at(6, 23, 0), false},
+
+		// Saturday night wraps to Sunday morning
+		{"week wrap evening", AutoFeeSchedule{Days: sat, StartMin: 20 * 60, EndMin: 2 * 60}, at(6, 21, 0), true},
+		{"week wrap sunday", AutoFeeSchedule{Days: sat, StartMin: 20 * 60, EndMin: 2 * 60}, at(7, 1, 0), true},
+		{"week wrap previous sunday", AutoFeeSchedule{Days: sat, StartMin: 20 * 60, EndMin: 2 * 60}, at(0, 1, 0), true},
+		{"sunday night to monday", AutoFeeSchedule{Days: sun, StartMin: 20 * 60, EndMin: 2 * 60}, at(1, 1, 0), true},
+		{"sunday morning belongs to saturday", AutoFeeSchedule{Days: sun, StartMin: 20 * 60, EndMin: 2 * 60}, at(0, 1, 0), false},
+
+		// equal start and end is a full day
+		{"full day", AutoFeeSchedule{Days: mon, StartMin: 9 * 60, EndMin: 9 * 60}, at(2, 8, 0), true},
+		{"full day next", AutoFeeSchedule{Days: mon, StartMin: 9 * 60, EndMin: 9 * 60}, at(2, 9, 0), false},
+	} {
+		if got := tc.schedule.IsActive(tc.t); got != tc.want {
+			t.Errorf("%s: %s at %s: got %v, want %v", tc.name, tc.schedule.String(), tc.t.UTC().Format("Mon 15:04"), got, tc.want)
+		}
+	}
+}
+
+// the transition is logged by the caller once the rate is set
+func TestScheduleTransition(t *testing.T) {
+	const channelId = 201
+	defer delete(AutoFeeLog, channelId)
+	defer delete(AutoFeeShadowLog, channelId)
+
+	params := testRule()
+	params.Schedules = []AutoFeeSchedule{{StartMin: 0, EndMin: 0, LowLiqRate: 2000, NormalRate: 900, ExcessRate: 100}}
+
+	rate, note := calculateAutoFee(channelId, params, 50, 300, false)
+	if rate != 900 || note == "" {
+		t.Fatalf("got %d %q, want the scheduled normal rate and a note", rate, note)
+	}
+	if lastScheduleNote(channelId, false) != BASE_RATES {
+		t.Fatal("note logged before the rate was set")
+	}
+
+	// the rate was not set, try again
+	if _, again := calculateAutoFee(channelId, params, 50, 300, false); again != note {
+		t.Fatalf("transition lost: %q", again)
+	}
+
+	// dry run keeps its notes in the shadow log
+	logScheduleNote(channelId, note, true)
+	if lastScheduleNote(channelId, false) != BASE_RATES || lastScheduleNote(channelId, true) != note {
+		t.Fatal("dry run note written to the real log")
+	}
+
+	logScheduleNote(channelId, note, false)
+	if _, again := calculateAutoFee(channelId, params, 50, 900, false); again != "" {
+		t.Fatalf("logged transition repeated: %q", again)
+	}
+}
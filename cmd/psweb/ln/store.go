@@ -0,0 +1,274 @@
+package ln
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"peerswap-web/cmd/psweb/db"
+)
+
+// fee log entry as stored in the append-only log
+type feeLogEntry struct {
+	ChannelId uint64
+	AutoFeeEvent
+}
+
+// ClaimJoin variables persisted together
+type claimJoinState struct {
+	ClaimJoinHandler   string
+	ClaimJoinHandlerTS uint64
+	ClaimBlockHeight   uint32
+	JoinBlockHeight    uint32
+	ClaimStatus        string
+	MyRole             string
+	KeyToNodeId        map[string]string
+	ClaimParties       []ClaimParty
+	ClaimPSET          string
+}
+
+// typed repositories in psweb.db
+var (
+	autoFeeRules      = db.NewTable[*AutoFeeParams]("AutoFeeRules")     // by channel id
+	autoFeePeerRules  = db.NewTable[*AutoFeeParams]("AutoFeePeerRules") // by peer node id
+	autoFeeTemplates  = db.NewTable[*AutoFeeParams]("AutoFeeTemplates") // by name
+	autoFeeTags       = db.NewTable[string]("AutoFeeTags")              // by channel id
+	autoFeeEnabled    = db.NewTable[bool]("AutoFeeEnabled")             // by channel id
+	autoFeeDryRun     = db.NewTable[bool]("AutoFeeDryRun")              // by channel id
+	autoFeeDefaults   = db.NewValue[AutoFeeParams]("AutoFees", "AutoFeeDefaults")
+	autoFeeEnabledAll = db.NewValue[bool]("AutoFees", "AutoFeeEnabledAll")
+	autoFeeBudget     = db.NewValue[UpdateBudget]("AutoFees", "AutoFeeBudget")
+	feeLog            = db.NewLog[*feeLogEntry]("AutoFeeLog")
+	shadowLog         = db.NewLog[*feeLogEntry]("AutoFeeShadowLog")
+	swapRebates       = db.NewTable[int64]("SwapRebates") // by swap id
+	claimJoin         = db.NewValue[*claimJoinState]("ClaimJoin", "State")
+	claimJoinKey      = db.NewValue[[]byte]("ClaimJoin", "serializedPrivateKey")
+)
+
+func channelKey(channelId uint64) string {
+	return strconv.FormatUint(channelId, 10)
+}
+
+// SaveAutoFeeRule persists the custom rule of one channel, or deletes it if none
+func SaveAutoFeeRule(channelId uint64) error {
+	if AutoFee[channelId] == nil {
+		return autoFeeRules.Delete(channelKey(channelId))
+	}
+	return autoFeeRules.Put(channelKey(channelId), AutoFee[channelId])
+}
+
+// SaveAutoFeePeerRule persists the rule of one peer, or deletes it if none
+func SaveAutoFeePeerRule(peerId string) error {
+	if AutoFeePeer[peerId] == nil {
+		return autoFeePeerRules.Delete(peerId)
+	}
+	return autoFeePeerRules.Put(peerId, AutoFeePeer[peerId])
+}
+
+// SaveAutoFeeTemplate persists the named template, or deletes it if none
+func SaveAutoFeeTemplate(name string) error {
+	if AutoFeeTemplates[name] == nil {
+		return autoFeeTemplates.Delete(name)
+	}
+	return autoFeeTemplates.Put(name, AutoFeeTemplates[name])
+}
+
+// SaveAutoFeeTag persists the template name of the channel, or deletes it if none
+func SaveAutoFeeTag(channelId uint64) error {
+	if AutoFeeTags[channelId] == "" {
+		return autoFeeTags.Delete(channelKey(channelId))
+	}
+	return autoFeeTags.Put(channelKey(channelId), AutoFeeTags[channelId])
+}
+
+func SaveAutoFeeDefaults() error {
+	return autoFeeDefaults.Put(AutoFeeDefaults)
+}
+
+func SaveAutoFeeEnabled(channelId uint64) error {
+	return autoFeeEnabled.Put(channelKey(channelId), AutoFeeEnabled[channelId])
+}
+
+func SaveAutoFeeDryRun(channelId uint64) error {
+	if !AutoFeeDryRun[channelId] {
+		return autoFeeDryRun.Delete(channelKey(channelId))
+	}
+	return autoFeeDryRun.Put(channelKey(channelId), true)
+}
+
+func SaveAutoFeeEnabledAll() error {
+	return autoFeeEnabledAll.Put(AutoFeeEnabledAll)
+}
+
+func SaveAutoFeeBudget() error {
+	return autoFeeBudget.Put(AutoFeeBudget)
+}
+
+func saveSwapRebate(swapId string, rebate int64) error {
+	return swapRebates.Put(swapId, rebate)
+}
+
+// SaveClaimJoin persists the state of ClaimJoin
+func SaveClaimJoin() error {
+	return claimJoin.Put(&claimJoinState{
+		ClaimJoinHandler:   ClaimJoinHandler,
+		ClaimJoinHandlerTS: ClaimJoinHandlerTS,
+		ClaimBlockHeight:   ClaimBlockHeight,
+		JoinBlockHeight:    JoinBlockHeight,
+		ClaimStatus:        ClaimStatus,
+		MyRole:             MyRole,
+		KeyToNodeId:        keyToNodeId,
+		ClaimParties:       ClaimParties,
+		ClaimPSET:          claimPSET,
+	})
+}
+
+// ClaimJoin state changes often, log failures where they happen
+func persistClaimJoin() {
+	if err := SaveClaimJoin(); err != nil {
+		log.Println("Failed to persist ClaimJoin state:", err)
+	}
+}
+
+func loadClaimJoin() error {
+	state, err := claimJoin.Get()
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ClaimJoinHandler = state.ClaimJoinHandler
+	ClaimJoinHandlerTS = state.ClaimJoinHandlerTS
+	ClaimBlockHeight = state.ClaimBlockHeight
+	JoinBlockHeight = state.JoinBlockHeight
+	ClaimStatus = state.ClaimStatus
+	MyRole = state.MyRole
+	if state.KeyToNodeId != nil {
+		keyToNodeId = state.KeyToNodeId
+	}
+	ClaimParties = state.ClaimParties
+	claimPSET = state.ClaimPSET
+
+	return nil
+}
+
+func loadAutoFees() error {
+	// each repository loads on its own
+	var errs []error
+
+	if rules, err := autoFeeRules.All(); err == nil {
+		for key, rule := range rules {
+			channelId, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				continue
+			}
+			AutoFee[channelId] = rule
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	if rules, err := autoFeePeerRules.All(); err == nil {
+		for peerId, rule := range rules {
+			AutoFeePeer[peerId] = rule
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	if templates, err := autoFeeTemplates.All(); err == nil {
+		for name, rule := range templates {
+			AutoFeeTemplates[name] = rule
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	if tags, err := autoFeeTags.All(); err == nil {
+		for key, name := range tags {
+			channelId, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				continue
+			}
+			AutoFeeTags[channelId] = name
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	if enabled, err := autoFeeEnabled.All(); err == nil {
+		for key, isEnabled := range enabled {
+			channelId, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				continue
+			}
+			AutoFeeEnabled[channelId] = isEnabled
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	if dryRun, err := autoFeeDryRun.All(); err == nil {
+		for key := range dryRun {
+			channelId, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				continue
+			}
+			AutoFeeDryRun[channelId] = true
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	if defaults, err := autoFeeDefaults.Get(); err == nil {
+		AutoFeeDefaults = defaults
+	} else if !errors.Is(err, db.ErrNotFound) {
+		errs = append(errs, err)
+	}
+
+	if all, err := autoFeeEnabledAll.Get(); err == nil {
+		AutoFeeEnabledAll = all
+	} else if !errors.Is(err, db.ErrNotFound) {
+		errs = append(errs, err)
+	}
+
+	if budget, err := autoFeeBudget.Get(); err == nil {
+		AutoFeeBudget = budget
+	} else if !errors.Is(err, db.ErrNotFound) {
+		errs = append(errs, err)
+	}
+
+	feeLogMu.Lock()
+	defer feeLogMu.Unlock()
+
+	if err := feeLog.ForEach(func(e *feeLogEntry) {
+		event := e.AutoFeeEvent
+		AutoFeeLog[e.ChannelId] = append(AutoFeeLog[e.ChannelId], &event)
+	}); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := shadowLog.ForEach(func(e *feeLogEntry) {
+		event := e.AutoFeeEvent
+		AutoFeeShadowLog[e.ChannelId] = append(AutoFeeShadowLog[e.ChannelId], &event)
+	}); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func loadSwapRebates() error {
+	rebates, err := swapRebates.All()
+	if err != nil {
+		return err
+	}
+
+	for swapId, rebate := range rebates {
+		SwapRebates.Write(swapId, rebate)
+	}
+
+	return nil
+}
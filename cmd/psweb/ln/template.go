@@ -0,0 +1,63 @@
+package ln
+
+import (
+	"slices"
+	"sort"
+)
+
+// a template is a named rule shared by all channels tagged with
+// its name. A channel's own custom rule still comes first, the
+// defaults apply when the channel has neither.
+
+var (
+	AutoFeeTemplates = make(map[string]*AutoFeeParams) // by name
+	AutoFeeTags      = make(map[uint64]string)         // template name by channel id
+)
+
+// offered when adding a template
+var TemplateNames = []string{"sink", "source", "balanced", "exchange"}
+
+// returns the template the channel is tagged with, nil if none
+func AutoFeeTemplate(channelId uint64) (*AutoFeeParams, string) {
+	name := AutoFeeTags[channelId]
+	if name == "" {
+		return nil, ""
+	}
+	return AutoFeeTemplates[name], name
+}
+
+// template names in alphabetical order
+func TemplateList() []string {
+	var names []string
+	for name := range AutoFeeTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// channels tagged with the template
+func TaggedChannels(name string) []uint64 {
+	var ids []uint64
+	for channelId, tag := range AutoFeeTags {
+		if tag == name {
+			ids = append(ids, channelId)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// returns the custom rule of the channel,
+// adding a copy of the inherited one if none
+func CustomAutoFeeRule(channelId uint64) *AutoFeeParams {
+	if AutoFee[channelId] == nil {
+		inherited, _ := AutoFeeRule(channelId)
+		rule := *inherited
+		// do not share the arrays with the rule it was cloned from
+		rule.Schedules = slices.Clone(inherited.Schedules)
+		rule.InboundCurve = slices.Clone(inherited.InboundCurve)
+		AutoFee[channelId] = &rule
+	}
+	return AutoFee[channelId]
+}
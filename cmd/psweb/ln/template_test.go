@@ -0,0 +1,71 @@
+package ln
+
+import (
+	"testing"
+)
+
+func TestAutoFeeRuleInheritance(t *testing.T) {
+	const channelId = 601
+	defer func() {
+		delete(AutoFee, channelId)
+		delete(AutoFeeTags, channelId)
+		delete(AutoFeeTemplates, "sink")
+	}()
+
+	if params, isCustom := AutoFeeRule(channelId); params != &AutoFeeDefaults || isCustom {
+		t.Errorf("untagged: got %p %v, want defaults", params, isCustom)
+	}
+
+	// tag without a template falls back to defaults
+	AutoFeeTags[channelId] = "sink"
+	if params, _ := AutoFeeRule(channelId); params != &AutoFeeDefaults {
+		t.Errorf("missing template: got %p, want defaults", params)
+	}
+
+	AutoFeeTemplates["sink"] = &AutoFeeParams{NormalRate: 1000}
+	if params, isCustom := AutoFeeRule(channelId); params != AutoFeeTemplates["sink"] || isCustom {
+		t.Errorf("tagged: got %p %v, want the template", params, isCustom)
+	}
+
+	// custom rule comes first
+	AutoFee[channelId] = &AutoFeeParams{NormalRate: 500}
+	if params, isCustom := AutoFeeRule(channelId); params != AutoFee[channelId] || !isCustom {
+		t.Errorf("custom: got %p %v, want the channel's", params, isCustom)
+	}
+}
+
+func TestCustomAutoFeeRuleClonesTemplate(t *testing.T) {
+	const channelId = 602
+	defer func() {
+		delete(AutoFee, channelId)
+		delete(AutoFeeTags, channelId)
+		delete(AutoFeeTemplates, "source")
+	}()
+
+	template := &AutoFeeParams{
+		NormalRate:   50,
+		Schedules:    []AutoFeeSchedule{{StartMin: 60, EndMin: 120}},
+		InboundCurve: []InboundPoint{{LiqPct: 20, Rate: -100}, {LiqPct: 80, Rate: 0}},
+	}
+	AutoFeeTemplates["source"] = template
+	AutoFeeTags[channelId] = "source"
+
+	rule := CustomAutoFeeRule(channelId)
+	if rule == template || rule.NormalRate != 50 || len(rule.Schedules) != 1 || len(rule.InboundCurve) != 2 {
+		t.Fatalf("got %+v, want a copy of the template", rule)
+	}
+
+	rule.Schedules[0].StartMin = 0
+	if template.Schedules[0].StartMin != 60 {
+		t.Error("custom rule shares schedules with the template")
+	}
+
+	rule.InboundCurve[0].Rate = -500
+	if template.InboundCurve[0].Rate != -100 {
+		t.Error("custom rule shares the inbound curve with the template")
+	}
+
+	if CustomAutoFeeRule(channelId) != rule {
+		t.Error("existing custom rule replaced")
+	}
+}
@@ -10,10 +10,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
 	"peerswap-web/cmd/psweb/ln"
 
 	"github.com/elementsproject/glightning/glightning"
@@ -47,9 +50,11 @@ func main() {
 		showHelp    = flag.Bool("help", false, "Show help")
 		showVersion = flag.Bool("version", false, "Show version")
 		developer   = flag.Bool("developer", false, "Flag passed by clightningd")
+		dryRun      = flag.Bool("dry-run-migrations", false, "Report pending database migrations and exit")
 	)
 
 	flag.Parse()
+	dryRunMigrations = *dryRun
 
 	if *showHelp {
 		fmt.Println("A lightweight Web UI plugin for PeerSwap CLN")
@@ -74,8 +79,23 @@ func main() {
 
 	plugin.SubscribeSendPaySuccess(onSendPaySuccess)
 	plugin.SubscribeInvoicePaid(onInvoicePaid)
+	plugin.SubscribeForwardings(onForwardEvent)
+
+	// lightningd sends SIGTERM to plugins on shutdown
+	go func() {
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signalChan
+		log.Printf("Received termination signal: %s\n", sig)
+
+		db.Close()
+		os.Exit(0)
+	}()
 
 	err := plugin.Start(os.Stdin, os.Stdout)
+
+	// stdin closed by lightningd
+	db.Close()
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -134,3 +154,8 @@ func onInvoicePaid(p *glightning.Payment) {
 	// fetch and cache HTLCs by PaymentHash
 	ln.CacheHTLCs("payment_hash=x'" + hashHex + "'")
 }
+
+func onForwardEvent(f *glightning.Forwarding) {
+	// adjust AutoFee without blocking lightningd
+	go ln.OnForwardEvent(f.OutChannel, f.Status, f.FailCode)
+}
@@ -10,6 +10,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
 	"syscall"
 )
 
@@ -19,9 +20,11 @@ func main() {
 		password    = flag.String("password", "", "Run with HTTPS password authentication")
 		showHelp    = flag.Bool("help", false, "Show help")
 		showVersion = flag.Bool("version", false, "Show version")
+		dryRun      = flag.Bool("dry-run-migrations", false, "Report pending database migrations and exit")
 	)
 
 	flag.Parse()
+	dryRunMigrations = *dryRun
 
 	if *showHelp {
 		fmt.Println("A lightweight Web UI for PeerSwap LND")
@@ -64,5 +67,6 @@ func main() {
 	log.Printf("Received termination signal: %s\n", sig)
 
 	// Exit the program gracefully
+	db.Close()
 	os.Exit(0)
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"embed"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -39,8 +40,14 @@ const (
 	SWAP_OUT_CHANNEL_RESERVE = 10_000
 	// https://github.com/ElementsProject/peerswap/pull/304#issuecomment-2303931071
 	SWAP_LBTC_RESERVE = 1_200
+	// vsize of the BTC swap-in opening tx
+	BTC_SWAP_IN_VSIZE = 350
+	// BTC swap-out: the peer's opening tx paid via the fee invoice, and our claim
+	BTC_SWAP_OUT_VSIZE = 700
 	// Unusable BTC balance
 	ANCHOR_RESERVE = 25_000
+	// recent swaps averaged to estimate the cost of the next one
+	SWAP_COST_HISTORY = 10
 	// assume creatediscountct=1 for mainnet in elements.conf
 	ELEMENTS_DISCOUNTED_VSIZE_VERSION = 230203
 )
@@ -49,8 +56,11 @@ type SwapParams struct {
 	PeerAlias string
 	PeerId    string
 	ChannelId uint64
+	Asset     string // lbtc or btc
 	Amount    uint64
 	PPM       uint64
+	Cost      uint64  // expected, sats
+	Payback   float64 // days until routing fees cover the cost
 }
 
 var (
@@ -65,11 +75,10 @@ var (
 	// Bitcoin sat/vB from mempool.space
 	mempoolFeeRate = float64(0)
 	// onchain realized transaction costs
-	txFee = make(map[string]int64)
+	txFee  = safemap.New[string, int64]()
+	txFees = db.NewTable[int64]("TxFees") // by tx id
 	// Key used for cookie encryption
 	store *sessions.CookieStore
-	// pending Auto Swap Id to check the state later
-	autoSwapId string
 	// store peer pub mapped to channel Id
 	peerNodeId = make(map[uint64]string)
 	// only poll all peers once after peerswap initializes
@@ -85,6 +94,8 @@ var (
 	lightningHasStarted = false
 	// debug flag
 	debug = os.Getenv("DEBUG") == "1"
+	// report pending psweb.db migrations and exit
+	dryRunMigrations = false
 )
 
 func start() {
@@ -103,10 +114,40 @@ func start() {
 		peginBlocks = 10
 	}
 
+	// Open the database for the lifetime of the process
+	if err := db.Open(); err != nil {
+		log.Fatalln("Cannot open psweb.db:", err)
+	}
+
+	if dryRunMigrations {
+		// only report what an upgrade would do
+		if err := db.Migrate(true); err != nil {
+			log.Println("Dry run failed:", err)
+		}
+		db.Close()
+		os.Exit(0)
+	}
+
+	if err := db.Migrate(false); err != nil {
+		log.Fatalln("Cannot migrate psweb.db:", err)
+	}
+
 	// Load persisted data from database
-	ln.LoadDB()
-	db.Load("Peers", "NodeId", &peerNodeId)
-	db.Load("Swaps", "txFee", &txFee)
+	if err := ln.LoadDB(); err != nil {
+		log.Println("Error loading database:", err)
+	}
+	if err := db.Load("Peers", "NodeId", &peerNodeId); err != nil && !errors.Is(err, db.ErrNotFound) {
+		log.Println("Error loading peer node ids:", err)
+	}
+	if err := loadTxFees(); err != nil {
+		log.Println("Error loading tx fees:", err)
+	}
+	if err := loadAutoSwaps(); err != nil {
+		log.Println("Error loading auto swaps:", err)
+	}
+	if err := loadApiTokens(); err != nil {
+		log.Println("Error loading API tokens:", err)
+	}
 
 	// Get all HTML template files from the embedded filesystem
 	templateFiles, err := tplFolder.ReadDir("templates")
@@ -130,8 +171,10 @@ func start() {
 			"fmt":  formatWithThousandSeparators,
 			"fs":   formatSigned,
 			"ff":   formatFloat,
+			"pb":   formatPayback,
 			"m":    toMil,
 			"last": last,
+			"inc":  inc,
 		}).
 		ParseFS(tplFolder, templateNames...))
 
@@ -158,6 +201,8 @@ func start() {
 	r.HandleFunc("/log", logHandler)
 	r.HandleFunc("/logapi", logApiHandler)
 	r.HandleFunc("/backup", backupHandler)
+	r.HandleFunc("/export", exportStateHandler)
+	r.HandleFunc("/import", importStateHandler)
 	r.HandleFunc("/bitcoin", bitcoinHandler)
 	r.HandleFunc("/pegin", peginHandler)
 	r.HandleFunc("/bumpfee", bumpfeeHandler)
@@ -166,6 +211,12 @@ func start() {
 	r.HandleFunc("/logout", logoutHandler)
 	r.HandleFunc("/downloadca", downloadCaHandler)
 	r.HandleFunc("/af", afHandler)
+	r.HandleFunc("/backtest", backtestHandler)
+	r.HandleFunc("/events", eventsHandler)
+	r.HandleFunc("/metrics", metricsHandler)
+
+	// JSON API
+	registerApiRoutes(r)
 
 	if config.Config.SecureConnection {
 		// HTTP redirection
@@ -178,8 +229,20 @@ func start() {
 			}
 		}()
 
-		go serveHTTPS(authMiddleware(r))
+		clientAuth := tls.RequireAndVerifyClientCert
+		if config.Config.Password != "" {
+			// Do not require client certificate if Password auth enabled
+			clientAuth = tls.NoClientCert
+		}
+
+		go serveHTTPS(authMiddleware(r), config.Config.SecurePort, clientAuth)
 		log.Println("Listening HTTPS on port " + config.Config.SecurePort)
+
+		if config.Config.TokenPort != "" {
+			// opt-in listener for scripts that only hold a bearer token
+			go serveHTTPS(tokenOnlyMiddleware(authMiddleware(r)), config.Config.TokenPort, tls.NoClientCert)
+			log.Println("Listening HTTPS for API tokens on port " + config.Config.TokenPort)
+		}
 	} else {
 		// Start HTTP server
 		http.Handle("/", authMiddleware(r))
@@ -193,6 +256,9 @@ func start() {
 
 	// Start timer to run every minute
 	go startTimer()
+
+	// publish swap state transitions to /events
+	go watchSwaps()
 }
 
 func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
@@ -200,7 +266,7 @@ func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
-func serveHTTPS(handler http.Handler) {
+func serveHTTPS(handler http.Handler, port string, clientAuth tls.ClientAuthType) {
 	// Load your certificate and private key
 	certFile := filepath.Join(config.Config.DataDir, "server.crt")
 	keyFile := filepath.Join(config.Config.DataDir, "server.key")
@@ -232,17 +298,12 @@ func serveHTTPS(handler http.Handler) {
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		ClientCAs:    caCertPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert, // Require and verify client certificate
-		MinVersion:   tls.VersionTLS12,               // Force TLS 1.2 or higher
-	}
-
-	// Do not require client certificate if Password auth enabled
-	if config.Config.Password != "" {
-		tlsConfig.ClientAuth = tls.NoClientCert
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12, // Force TLS 1.2 or higher
 	}
 
 	server := &http.Server{
-		Addr:      ":" + config.Config.SecurePort,
+		Addr:      ":" + port,
 		Handler:   handler,
 		TLSConfig: tlsConfig,
 		// Assign the mute logger to prevent log spamming
@@ -344,6 +405,9 @@ func onTimer() {
 		// execute auto fees
 		ln.ApplyAutoFees()
 
+		// send the fee changes that waited long enough
+		ln.FlushFeeUpdates()
+
 		// Back up to Telegram if Liquid balance changed
 		liquidBackup(false)
 
@@ -356,10 +420,8 @@ func onTimer() {
 		// poll peers for their balances and ClaimJoin invites
 		pollBalances()
 
-		// see if possible to execute Automatic Liquid Swap In
-		if config.Config.AutoSwapEnabled {
-			executeAutoSwap()
-		}
+		// follow, queue and start automatic swaps
+		runAutoSwaps()
 	} else {
 		// run only once when lighting becomes available
 		go cacheAliases()
@@ -415,7 +477,7 @@ func liquidBackup(force bool) {
 
 	msg := formatWithThousandSeparators(satAmount) + " (" + sign + formatSigned(int64(satAmount)-int64(config.Config.ElementsBackupAmount)) + ")"
 
-	err = telegramSendFile(config.Config.DataDir, destinationZip, msg)
+	err = telegramSendFile(config.Config.DataDir, destinationZip, "🌊 Liquid Balance: "+msg)
 	if err != nil {
 		log.Println("Error sending zip:", err)
 		return
@@ -700,7 +762,7 @@ func convertPeersToHTMLTable(
 		if stringIsInSlice("btc", peer.SupportedAssets) {
 			peerTable += "<span title=\"BTC swaps enabled\" style=\"color: #FF9900; font-weight: bold;\">₿</span>&nbsp"
 
-			if ptr := ln.BitcoinBalances[peer.NodeId]; ptr != nil {
+			if ptr, ok := ln.BitcoinBalances.Read(peer.NodeId); ok {
 				btcBalance := ptr.Amount
 				tm := timePassedAgo(time.Unix(ptr.TimeStamp, 0).UTC())
 				flooredBalance := "<span style=\"color:grey\">0m</span>"
@@ -716,7 +778,7 @@ func convertPeersToHTMLTable(
 		if stringIsInSlice("lbtc", peer.SupportedAssets) {
 			peerTable += "<span title=\"L-BTC swaps enabled\">🌊</span>"
 
-			if ptr := ln.LiquidBalances[peer.NodeId]; ptr != nil {
+			if ptr, ok := ln.LiquidBalances.Read(peer.NodeId); ok {
 				lbtcBalance := ptr.Amount
 				tm := timePassedAgo(time.Unix(ptr.TimeStamp, 0).UTC())
 				flooredBalance := "<span style=\"color:grey\">0m</span>"
@@ -982,7 +1044,6 @@ func convertSwapsToHTMLTable(swaps []*peerswaprpc.PrettyPrintSwap, nodeId string
 		unsortedTable []Table
 		totalAmount   uint64
 		totalCost     int64
-		persist       = false // new tx costs to persist
 	)
 
 	for _, swap := range swaps {
@@ -1036,8 +1097,7 @@ func convertSwapsToHTMLTable(swaps []*peerswaprpc.PrettyPrintSwap, nodeId string
 			table += " ⚡&nbsp⇨&nbsp" + asset
 		}
 
-		cost, _, new := swapCost(swap)
-		persist = persist || new
+		cost, _ := swapCost(swap)
 
 		if cost != 0 {
 			totalCost += cost
@@ -1117,11 +1177,6 @@ func convertSwapsToHTMLTable(swaps []*peerswaprpc.PrettyPrintSwap, nodeId string
 	}
 	table += ": " + formatSigned(totalCost) + " sats, PPM: " + formatSigned(ppm) + "</p>"
 
-	// save to db
-	if persist {
-		db.Save("Swaps", "txFee", txFee)
-	}
-
 	return table
 }
 
@@ -1135,8 +1190,9 @@ func checkPegin() {
 		log.Println("Invitation expired from", ln.ClaimJoinHandler)
 
 		ln.ClaimJoinHandler = ""
-		db.Save("ClaimJoin", "ClaimStatus", ln.ClaimStatus)
-		db.Save("ClaimJoin", "ClaimJoinHandler", ln.ClaimJoinHandler)
+		if err := ln.SaveClaimJoin(); err != nil {
+			log.Println(err)
+		}
 	}
 
 	if config.Config.PeginTxId == "" {
@@ -1163,6 +1219,7 @@ func checkPegin() {
 		if config.Config.PeginClaimScript == "done" {
 			// finish by sending telegram message
 			telegramSendMessage("💸 Peg-in complete! Liquid TxId: `" + config.Config.PeginTxId + "`")
+			publishPegin(config.Config.PeginTxId, 0, "complete")
 			config.Config.PeginClaimScript = ""
 			config.Config.PeginTxId = ""
 			config.Config.PeginClaimJoin = false
@@ -1200,10 +1257,15 @@ func checkPegin() {
 		}
 	}
 
+	if confs >= 0 {
+		publishPegin(config.Config.PeginTxId, confs, "confirming")
+	}
+
 	if confs > 0 {
 		if config.Config.PeginClaimScript == "" {
 			log.Println("BTC withdrawal complete, txId: " + config.Config.PeginTxId)
 			telegramSendMessage("💸 BTC withdrawal complete. TxId: `" + config.Config.PeginTxId + "`")
+			publishPegin(config.Config.PeginTxId, confs, "complete")
 		} else if confs >= int32(peginBlocks) && ln.MyRole == "none" {
 			// claim individual peg-in
 			failed := false
@@ -1228,9 +1290,11 @@ func checkPegin() {
 			if failed {
 				log.Printf("Peg-in claim FAILED! Recover your funds manually with this command line:\n\nelements-cli claimpegin %s %s %s\n", rawTx, proof, config.Config.PeginClaimScript)
 				telegramSendMessage("❗ Peg-in claim FAILED! See log for instructions.")
+				publishPegin(config.Config.PeginTxId, confs, "failed")
 			} else {
 				log.Println("Peg-in complete! Liquid TxId:", txid)
 				telegramSendMessage("💸 Peg-in complete! Liquid TxId: `" + txid + "`")
+				publishPegin(txid, confs, "complete")
 			}
 		} else {
 			if config.Config.PeginClaimJoin {
@@ -1243,7 +1307,9 @@ func checkPegin() {
 							log.Println(t + " as " + ln.MyPublicKey())
 							telegramSendMessage("🧬 " + t)
 							ln.MyRole = "initiator"
-							db.Save("ClaimJoin", "MyRole", ln.MyRole)
+							if err := ln.SaveClaimJoin(); err != nil {
+								log.Println(err)
+							}
 						}
 					} else if currentBlockHeight <= ln.JoinBlockHeight {
 						// join by replying to initiator
@@ -1316,28 +1382,166 @@ func cacheAliases() {
 	}
 }
 
-// Finds a candidate for an automatic swap-in
-// The goal is to spend maximum available liquid
+// swap-in settings of the asset
+func autoSwapInPolicy(asset string) (enabled bool, thresholdAmount, maxAmount uint64) {
+	if asset == "btc" {
+		return config.Config.AutoSwapBtcEnabled && config.Config.BitcoinSwaps,
+			config.Config.AutoSwapBtcThresholdAmount, config.Config.AutoSwapBtcMaxAmount
+	}
+	return config.Config.AutoSwapEnabled, config.Config.AutoSwapThresholdAmount, config.Config.AutoSwapMaxAmount
+}
+
+// swap-outs are enabled per asset, the other settings are shared
+func autoSwapOutEnabled(asset string) bool {
+	if asset == "btc" {
+		return config.Config.AutoSwapOutBtcEnabled && config.Config.BitcoinSwaps
+	}
+	return config.Config.AutoSwapOutEnabled
+}
+
+func swapAssetName(asset string) string {
+	if asset == "btc" {
+		return "BTC"
+	}
+	return "L-BTC"
+}
+
+// sat/vB to expect for BTC swaps, the higher of
+// the bitcoin node's and mempool's estimates
+func btcSwapFeeRate() float64 {
+	return max(bitcoin.EstimateSatvB(6), mempoolFeeRate)
+}
+
+// Expected cost in sats of initiating a swap of the amount:
+// the average on-chain fees of the recent successful swaps of the
+// same direction and asset plus their average rebate per swapped sat.
+// BTC on-chain fees are not expected below what the mempool asks now
+func expectedSwapCost(swaps []*peerswaprpc.PrettyPrintSwap, direction, asset string, amount uint64, feeRate float64) uint64 {
+	var recent []*peerswaprpc.PrettyPrintSwap
+	for _, swap := range swaps {
+		if swap.Type+swap.Role == direction+"sender" && swap.Asset == asset && swap.Amount > 0 && simplifySwapState(swap.State) == "success" {
+			recent = append(recent, swap)
+		}
+	}
+
+	// newest first
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].CreatedAt > recent[j].CreatedAt
+	})
+	recent = recent[:min(len(recent), SWAP_COST_HISTORY)]
+
+	onchain, rebatePPM := uint64(0), uint64(0)
+	for _, swap := range recent {
+		cost, _ := swapCost(swap)
+		rebate, _ := ln.SwapRebates.Read(swap.Id)
+		rebate = max(rebate, 0)
+		onchain += uint64(max(cost-rebate, 0))
+		rebatePPM += uint64(rebate) * 1_000_000 / swap.Amount
+	}
+	if n := uint64(len(recent)); n > 0 {
+		onchain /= n
+		rebatePPM /= n
+	}
+
+	switch {
+	case asset == "btc" && direction == "swap-in":
+		onchain = max(onchain, uint64(math.Ceil(feeRate*BTC_SWAP_IN_VSIZE)))
+	case asset == "btc":
+		onchain = max(onchain, uint64(math.Ceil(feeRate*BTC_SWAP_OUT_VSIZE)))
+	case len(recent) == 0:
+		// at most what is reserved for Elements fees
+		onchain = SWAP_LBTC_RESERVE
+	}
+
+	return onchain + amount*rebatePPM/1_000_000
+}
+
+// Days until the fees earned by routing the swapped amount at the
+// channel's recent PPM and daily volume cover the swap cost,
+// +Inf if routing the whole amount would not cover it
+func paybackDays(cost, amount, ppm uint64, dailyVolume float64) float64 {
+	if cost == 0 {
+		return 0
+	}
+	if amount*ppm <= cost*1_000_000 || dailyVolume <= 0 {
+		return math.Inf(1)
+	}
+	return float64(cost) * 1_000_000 / (min(dailyVolume, float64(amount)) * float64(ppm))
+}
+
+// whether the expected payback allows the auto swap,
+// BTC swaps must always pay back
+func paybackAllowed(asset string, days float64) bool {
+	if asset == "btc" && math.IsInf(days, 1) {
+		return false
+	}
+	maxDays := config.Config.AutoSwapMaxPaybackDays
+	return maxDays == 0 || days <= float64(maxDays)
+}
+
+// own balance to keep when swapping in
+func swapInReserve(asset string, feeRate float64) uint64 {
+	if asset == "btc" {
+		return ANCHOR_RESERVE + uint64(math.Ceil(feeRate*BTC_SWAP_IN_VSIZE))
+	}
+	return SWAP_LBTC_RESERVE
+}
+
+// why a channel is or is not the auto swap-in candidate
+type SwapEvaluation struct {
+	SwapParams
+	LocalPct uint64
+	Reason   string // rejected because, empty if eligible
+	Selected bool   // the candidate
+}
+
+// Finds a candidate for an automatic swap-in of the asset
+// The goal is to spend maximum available balance
 // To rebalance a channel with high enough historic fee PPM
-func findSwapInCandidate(candidate *SwapParams) error {
-	minAmount := config.Config.AutoSwapThresholdAmount - SWAP_LBTC_RESERVE
+// The expected cost must pay back within AutoSwapMaxPaybackDays
+func findSwapInCandidate(asset string, candidate *SwapParams) error {
+	evaluations, err := evaluateSwapIn(asset)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range evaluations {
+		if e.Selected {
+			*candidate = e.SwapParams
+		}
+	}
+	return nil
+}
+
+// Evaluates every channel of the PeerSwap peers for a swap-in
+// of the asset, rejected with a reason or eligible with its score,
+// and selects the candidate
+func evaluateSwapIn(asset string) ([]*SwapEvaluation, error) {
+	feeRate := 0.0
+	if asset == "btc" {
+		feeRate = btcSwapFeeRate()
+	}
+
+	_, thresholdAmount, maxAmount := autoSwapInPolicy(asset)
+	reserve := swapInReserve(asset, feeRate)
+	minAmount := max(thresholdAmount, reserve) - reserve
 	minPPM := config.Config.AutoSwapThresholdPPM
 
 	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer cleanup()
 
 	res, err := ps.ListPeers(client)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	peers := res.GetPeers()
 
 	res2, err := ps.ListSwaps(client)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	swaps := res2.GetSwaps()
 
@@ -1346,11 +1550,18 @@ func findSwapInCandidate(candidate *SwapParams) error {
 	// true if initiated swap out or received swap in
 	lastWasSwapOut := make(map[uint64]bool)
 
+	// channels with a swap in progress
+	busy := make(map[uint64]bool)
+
 	for _, swap := range swaps {
+		if simplifySwapState(swap.State) == "pending" {
+			busy[swap.LndChanId] = true
+		}
 		if simplifySwapState(swap.State) == "success" && swapTimestamps[swap.LndChanId] < swap.CreatedAt {
 			swapTimestamps[swap.LndChanId] = swap.CreatedAt
 			lastWasSwapOut[swap.LndChanId] = false
-			if swap.Asset == "lbtc" && (swap.Type+swap.Role == "swap-outsender" || swap.Type+swap.Role == "swap-inreceiver") {
+			// in either asset
+			if swap.Type+swap.Role == "swap-outsender" || swap.Type+swap.Role == "swap-inreceiver" {
 				lastWasSwapOut[swap.LndChanId] = true
 			}
 		}
@@ -1358,22 +1569,57 @@ func findSwapInCandidate(candidate *SwapParams) error {
 
 	cl, clean, err := ln.GetClient()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer clean()
 
+	var evaluations []*SwapEvaluation
+	var best *SwapEvaluation
+
 	for _, peer := range peers {
-		// ignore peer with Liquid swaps disabled
-		if !peer.SwapsAllowed || !stringIsInSlice("lbtc", peer.SupportedAssets) {
-			continue
-		}
 		for _, channel := range peer.Channels {
+			e := &SwapEvaluation{
+				SwapParams: SwapParams{
+					PeerAlias: getNodeAlias(peer.NodeId),
+					PeerId:    peer.NodeId,
+					ChannelId: channel.ChannelId,
+					Asset:     asset,
+				},
+			}
+			evaluations = append(evaluations, e)
+
+			// ignore peer with swaps of the asset disabled
+			if !peer.SwapsAllowed || !stringIsInSlice(asset, peer.SupportedAssets) {
+				e.Reason = "swaps disabled"
+				continue
+			}
+
+			if !channel.Active {
+				e.Reason = "inactive"
+				continue
+			}
+
 			// ignore if there was an opposite peerswap
-			if !channel.Active || lastWasSwapOut[channel.ChannelId] {
+			if lastWasSwapOut[channel.ChannelId] {
+				e.Reason = "last was swap-out"
+				continue
+			}
+
+			// or one is in progress, queued or the peer rests after the last
+			if busy[channel.ChannelId] {
+				e.Reason = "swap in progress"
+				continue
+			}
+			if hold := autoSwapHold(peer.NodeId, channel.ChannelId); hold != "" {
+				e.Reason = hold
 				continue
 			}
 
 			chanInfo := ln.GetChannelInfo(cl, channel.ChannelId, peer.NodeId)
+			if chanInfo.Capacity > 0 {
+				e.LocalPct = channel.LocalBalance * 100 / chanInfo.Capacity
+			}
+
 			// find the potential swap amount to bring balance to target
 			targetBalance := chanInfo.Capacity * config.Config.AutoSwapTargetPct / 100
 
@@ -1381,6 +1627,7 @@ func findSwapInCandidate(candidate *SwapParams) error {
 			targetBalance = min(targetBalance, chanInfo.Capacity*99/100)
 
 			if targetBalance < channel.LocalBalance {
+				e.Reason = "target below local"
 				continue
 			}
 
@@ -1389,207 +1636,304 @@ func findSwapInCandidate(candidate *SwapParams) error {
 				lastSwapTimestamp = swapTimestamps[channel.ChannelId]
 			}
 
-			// only consider sink channels (net routing > 1k)
 			stats := ln.GetChannelStats(channel.ChannelId, uint64(lastSwapTimestamp))
-			if stats.RoutedOut-stats.RoutedIn <= 1000 {
+			if stats.RoutedOut > 100_000 { // ignore insignificant volume
+				e.PPM = stats.FeeSat * 1_000_000 / stats.RoutedOut
+			}
+
+			// only consider sink channels (net routing > 1k)
+			if stats.RoutedOut <= stats.RoutedIn+1000 {
+				e.Reason = "not a sink"
 				continue
 			}
 
 			swapAmount := targetBalance - channel.LocalBalance
 
 			// limit to peer's max HTLC setting and remote balance less reserve for LN fee
-			swapAmount = min(swapAmount, chanInfo.PeerMaxHtlc, channel.RemoteBalance-1000, config.Config.AutoSwapMaxAmount)
+			e.Amount = min(swapAmount, chanInfo.PeerMaxHtlc, channel.RemoteBalance-1000, maxAmount)
 
 			// only consider channels with enough remote balance
-			if swapAmount >= minAmount {
-				ppm := uint64(0)
-				if stats.RoutedOut > 100_000 { // ignore insignificant volume
-					ppm = stats.FeeSat * 1_000_000 / stats.RoutedOut
-				}
+			if e.Amount < minAmount {
+				e.Reason = "amount below minimum"
+				continue
+			}
 
-				// aim to maximize PPM
-				// if ppm ties, choose the candidate with larger potential swap amount
-				if ppm > minPPM || ppm == minPPM && swapAmount > candidate.Amount {
-					// set the candidate's PPM as the new target to beat
-					minPPM = ppm
-					// save the candidate
-					candidate.ChannelId = channel.ChannelId
-					candidate.PeerId = peer.NodeId
-					candidate.PeerAlias = getNodeAlias(peer.NodeId)
-					// set maximum possible amount
-					candidate.Amount = swapAmount
-					candidate.PPM = ppm
-				}
+			if e.PPM < minPPM {
+				e.Reason = "PPM too low"
+				continue
+			}
+
+			// the swapped amount will be routed out at the recent pace
+			e.Cost = expectedSwapCost(swaps, "swap-in", asset, e.Amount, feeRate)
+			days := time.Since(time.Unix(lastSwapTimestamp, 0)).Hours() / 24
+			e.Payback = paybackDays(e.Cost, e.Amount, e.PPM, float64(stats.RoutedOut)/days)
+			if !paybackAllowed(asset, e.Payback) {
+				e.Reason = "payback too long"
+				continue
+			}
+
+			// aim to maximize PPM
+			// if ppm ties, choose the candidate with larger potential swap amount
+			if best == nil || e.PPM > best.PPM || e.PPM == best.PPM && e.Amount > best.Amount {
+				best = e
 			}
 		}
 	}
-	return nil
+
+	if best != nil {
+		best.Selected = true
+	}
+
+	return evaluations, nil
 }
 
-func executeAutoSwap() {
+// swap-out amount to bring local balance down to the target,
+// 0 if the channel is not above the high-water mark
+func swapOutAmount(localBalance, capacity, ourMaxHtlc, peerBalance, peerReserve uint64) uint64 {
+	if localBalance*100 <= capacity*config.Config.AutoSwapOutThresholdPct {
+		return 0
+	}
+
+	targetBalance := capacity * config.Config.AutoSwapOutTargetPct / 100
+	if localBalance <= targetBalance+SWAP_OUT_CHANNEL_RESERVE || peerBalance <= peerReserve {
+		return 0
+	}
+
+	// the peer pays on-chain, limit to its advertised balance less reserve for the fee
+	return min(localBalance-targetBalance, ourMaxHtlc, peerBalance-peerReserve, config.Config.AutoSwapOutMaxAmount)
+}
+
+// Finds a candidate for an automatic swap-out to the asset
+// The goal is to restore inbound liquidity
+// of a source channel above the high-water mark
+// The expected cost must pay back within AutoSwapMaxPaybackDays
+func findSwapOutCandidate(asset string, candidate *SwapParams) error {
+	return searchSwapOutCandidate(asset, candidate, nil)
+}
+
+// same, calls held for channels the payback limit rejects if not nil
+func searchSwapOutCandidate(asset string, candidate *SwapParams, held func(*SwapParams)) error {
+	minAmount := config.Config.AutoSwapOutThresholdAmount
+
+	// advertised balances of the asset
+	balances := ln.LiquidBalances
+	feeRate := 0.0
+	peerReserve := uint64(SWAP_LBTC_RESERVE)
+	if asset == "btc" {
+		balances = ln.BitcoinBalances
+		feeRate = btcSwapFeeRate()
+		// for the peer's opening tx
+		peerReserve = uint64(math.Ceil(feeRate * BTC_SWAP_IN_VSIZE))
+	}
+
 	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
 	if err != nil {
-		return
+		return err
 	}
 	defer cleanup()
 
-	res2, err := ps.ListActiveSwaps(client)
+	res, err := ps.ListPeers(client)
 	if err != nil {
-		return
+		return err
 	}
+	peers := res.GetPeers()
 
-	activeSwaps := res2.GetSwaps()
-
-	if len(activeSwaps) > 0 {
-		// cannot have active swaps pending to initiate auto swap
-		return
+	res2, err := ps.ListSwaps(client)
+	if err != nil {
+		return err
 	}
+	swaps := res2.GetSwaps()
 
-	if autoSwapId != "" { // means autoswap is pending
-		disable := false
-		// no active swaps means completed or failed
-		// check the state
-		res, err := ps.GetSwap(client, autoSwapId)
-		if err != nil {
-			log.Println("GetSwap:", err)
-			// someting is wrong
-			disable = true
-		} else {
-			if res.GetSwap().State == "State_ClaimedPreimage" {
-				log.Println("AutoSwap complete")
-			} else {
-				log.Println("AutoSwap failed")
-				// to avoid paying more fees
-				disable = true
-			}
-		}
+	// find last swap timestamps per channel
+	swapTimestamps := make(map[uint64]int64)
+	// true if initiated swap in or received swap out
+	lastWasSwapIn := make(map[uint64]bool)
 
-		if disable {
-			// disable auto swap
-			config.Config.AutoSwapEnabled = false
-			config.Save()
-			log.Println("Automatic swap-ins Disabled")
-		}
+	// channels with a swap in progress
+	busy := make(map[uint64]bool)
 
-		// stop following
-		autoSwapId = ""
-		return
+	for _, swap := range swaps {
+		if simplifySwapState(swap.State) == "pending" {
+			busy[swap.LndChanId] = true
+		}
+		if simplifySwapState(swap.State) == "success" && swapTimestamps[swap.LndChanId] < swap.CreatedAt {
+			swapTimestamps[swap.LndChanId] = swap.CreatedAt
+			lastWasSwapIn[swap.LndChanId] = false
+			// in either asset
+			if swap.Type+swap.Role == "swap-insender" || swap.Type+swap.Role == "swap-outreceiver" {
+				lastWasSwapIn[swap.LndChanId] = true
+			}
+		}
 	}
 
-	res, err := ps.LiquidGetBalance(client)
+	cl, clean, err := ln.GetClient()
 	if err != nil {
-		return
+		return err
 	}
+	defer clean()
 
-	satAmount := res.GetSatAmount()
+	for _, peer := range peers {
+		// ignore peer with swaps of the asset disabled
+		if !peer.SwapsAllowed || !stringIsInSlice(asset, peer.SupportedAssets) {
+			continue
+		}
 
-	if satAmount < config.Config.AutoSwapThresholdAmount {
-		return
-	}
+		// only target peers that advertise enough balance to pay
+		peerBalance, ok := balances.Read(peer.NodeId)
+		if !ok {
+			continue
+		}
 
-	var candidate SwapParams
+		for _, channel := range peer.Channels {
+			// ignore if there was an opposite peerswap
+			if !channel.Active || lastWasSwapIn[channel.ChannelId] {
+				continue
+			}
 
-	if err := findSwapInCandidate(&candidate); err != nil {
-		// some error prevented candidate finding
-		return
-	}
+			// or one is in progress, queued or the peer rests after the last
+			if busy[channel.ChannelId] || !autoSwapAllowed(peer.NodeId, channel.ChannelId) {
+				continue
+			}
 
-	amount := candidate.Amount
+			chanInfo := ln.GetChannelInfo(cl, channel.ChannelId, peer.NodeId)
 
-	// no suitable candidates were found
-	if amount == 0 {
-		return
-	}
+			swapAmount := swapOutAmount(channel.LocalBalance, chanInfo.Capacity, chanInfo.OurMaxHtlc, peerBalance.Amount, peerReserve)
+			if swapAmount < minAmount {
+				continue
+			}
 
-	amount = min(amount, satAmount-SWAP_LBTC_RESERVE)
+			lastSwapTimestamp := time.Now().AddDate(0, -6, 0).Unix()
+			if swapTimestamps[channel.ChannelId] > lastSwapTimestamp {
+				lastSwapTimestamp = swapTimestamps[channel.ChannelId]
+			}
 
-	// execute swap
-	autoSwapId, err = ps.SwapIn(client, amount, candidate.ChannelId, "lbtc", false)
-	if err != nil {
-		log.Println("AutoSwap error:", err)
-		return
-	}
+			// only consider source channels (net routing in > 1k)
+			stats := ln.GetChannelStats(channel.ChannelId, uint64(lastSwapTimestamp))
+			if stats.RoutedIn <= stats.RoutedOut+1000 {
+				continue
+			}
 
-	// Log swap id
-	log.Println("Initiated Auto Swap-In, id: "+autoSwapId+", Peer: "+candidate.PeerAlias+", L-BTC Amount: "+formatWithThousandSeparators(amount)+", Channel's PPM: ", formatWithThousandSeparators(candidate.PPM))
+			// a source channel earns on the forwards it brings in
+			ppm := uint64(0)
+			if stats.RoutedIn > 100_000 { // ignore insignificant volume
+				ppm = stats.AssistedFeeSat * 1_000_000 / stats.RoutedIn
+			}
+
+			// the refilled inbound will be routed in at the recent pace
+			cost := expectedSwapCost(swaps, "swap-out", asset, swapAmount, feeRate)
+			days := time.Since(time.Unix(lastSwapTimestamp, 0)).Hours() / 24
+			payback := paybackDays(cost, swapAmount, ppm, float64(stats.RoutedIn)/days)
+			if !paybackAllowed(asset, payback) {
+				if held != nil {
+					held(&SwapParams{
+						PeerAlias: getNodeAlias(peer.NodeId),
+						PeerId:    peer.NodeId,
+						ChannelId: channel.ChannelId,
+						Asset:     asset,
+						Amount:    swapAmount,
+						PPM:       ppm,
+						Cost:      cost,
+						Payback:   payback,
+					})
+				}
+				continue
+			}
 
-	// Send telegram
-	telegramSendMessage("🤖 Initiated Auto Swap-In with " + candidate.PeerAlias + " for " + formatWithThousandSeparators(amount) + " Liquid sats. Channel's PPM: " + formatWithThousandSeparators(candidate.PPM))
+			// aim to refill the most inbound
+			// if amounts tie, choose the candidate with higher PPM
+			if swapAmount > candidate.Amount || swapAmount == candidate.Amount && ppm > candidate.PPM {
+				candidate.ChannelId = channel.ChannelId
+				candidate.PeerId = peer.NodeId
+				candidate.PeerAlias = getNodeAlias(peer.NodeId)
+				candidate.Asset = asset
+				candidate.Amount = swapAmount
+				candidate.PPM = ppm
+				candidate.Cost = cost
+				candidate.Payback = payback
+			}
+		}
+	}
+	return nil
 }
 
-// total cost, verbal breakdown, new changes to persist
-func swapCost(swap *peerswaprpc.PrettyPrintSwap) (int64, string, bool) {
+// total cost and verbal breakdown
+func swapCost(swap *peerswaprpc.PrettyPrintSwap) (int64, string) {
 	if swap == nil {
-		return 0, "", false
+		return 0, ""
 	}
 
 	fee := int64(0)
 	breakdown := ""
-	newChanges := false
-	new := false
 
 	switch swap.Type + swap.Role {
 	case "swap-outsender":
-		rebate, exists := ln.SwapRebates[swap.Id]
+		rebate, exists := ln.SwapRebates.Read(swap.Id)
 		if exists {
 			breakdown = fmt.Sprintf("rebate paid: %s", formatSigned(-rebate))
 			fee = rebate
 		}
-		claim, new := onchainTxFee(swap.Asset, swap.ClaimTxId)
+		claim := onchainTxFee(swap.Asset, swap.ClaimTxId)
 		if claim > 0 {
-			newChanges = newChanges || new
 			fee += claim
 			breakdown += fmt.Sprintf(", claim: %s", formatSigned(-claim))
 		}
 	case "swap-insender":
-		fee, new = onchainTxFee(swap.Asset, swap.OpeningTxId)
-		newChanges = newChanges || new
+		fee = onchainTxFee(swap.Asset, swap.OpeningTxId)
 		breakdown = fmt.Sprintf("opening: %s", formatSigned(-fee))
 		if swap.State == "State_ClaimedCoop" {
-			claim, new := onchainTxFee(swap.Asset, swap.ClaimTxId)
+			claim := onchainTxFee(swap.Asset, swap.ClaimTxId)
 			if claim > 0 {
-				newChanges = newChanges || new
 				fee += claim
 				breakdown += fmt.Sprintf(", claim: %s", formatSigned(-claim))
 			}
 		}
 
 	case "swap-outreceiver":
-		fee, new = onchainTxFee(swap.Asset, swap.OpeningTxId)
-		newChanges = newChanges || new
+		fee = onchainTxFee(swap.Asset, swap.OpeningTxId)
 		breakdown = fmt.Sprintf("opening: %s", formatSigned(-fee))
 		if swap.State == "State_ClaimedCoop" {
-			claim, new := onchainTxFee(swap.Asset, swap.OpeningTxId)
+			claim := onchainTxFee(swap.Asset, swap.OpeningTxId)
 			if claim > 0 {
-				newChanges = newChanges || new
 				fee += claim
 				breakdown += fmt.Sprintf(", claim: %s", formatSigned(-claim))
 			}
 		}
-		rebate, exists := ln.SwapRebates[swap.Id]
+		rebate, exists := ln.SwapRebates.Read(swap.Id)
 		if exists {
 			fee -= rebate
 			breakdown += fmt.Sprintf(", rebate received: +%s", formatSigned(rebate))
 		}
 	case "swap-inreceiver":
-		fee, new = onchainTxFee(swap.Asset, swap.ClaimTxId)
-		newChanges = newChanges || new
+		fee = onchainTxFee(swap.Asset, swap.ClaimTxId)
 		breakdown = fmt.Sprintf("claim: %s", formatSigned(-fee))
 	}
 
-	return fee, breakdown, newChanges
+	return fee, breakdown
+}
+
+func loadTxFees() error {
+	fees, err := txFees.All()
+	if err != nil {
+		return err
+	}
+
+	for txId, fee := range fees {
+		txFee.Write(txId, fee)
+	}
+
+	return nil
 }
 
 // get tx fee from cache or online
-func onchainTxFee(asset, txId string) (int64, bool) {
+func onchainTxFee(asset, txId string) int64 {
 	if txId == "" {
-		return 0, false
+		return 0
 	}
 
 	// try cache
-	fee, exists := txFee[txId]
+	fee, exists := txFee.Read(txId)
 	if exists {
-		return fee, false
+		return fee
 	}
 
 	switch asset {
@@ -1612,13 +1956,14 @@ func onchainTxFee(asset, txId string) (int64, bool) {
 
 	}
 
-	save := false
 	// save to cache
 	if fee > 0 {
-		txFee[txId] = fee
-		save = true
+		txFee.Write(txId, fee)
+		if err := txFees.Put(txId, fee); err != nil {
+			log.Println(err)
+		}
 	}
-	return fee, save
+	return fee
 }
 
 func showRestartScreen(w http.ResponseWriter, r *http.Request, enableHTTPS bool, password string, exit bool) {
@@ -1656,7 +2001,7 @@ func showRestartScreen(w http.ResponseWriter, r *http.Request, enableHTTPS bool,
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, html)
 
-	if !enableHTTPS && config.Config.Password != "" {
+	if !enableHTTPS && config.Config.Password != "" && store != nil {
 		// delete cookie
 		session, _ := store.Get(r, "session")
 		session.Values["authenticated"] = false
@@ -1678,6 +2023,7 @@ func showRestartScreen(w http.ResponseWriter, r *http.Request, enableHTTPS bool,
 	if exit {
 		log.Println("Restart requested, stopping PSWeb.")
 		// assume systemd will restart it
+		db.Close()
 		os.Exit(0)
 	}
 }
@@ -1711,7 +2057,12 @@ func feeInputField(peerNodeId string, channelId uint64, direction string, feePer
 		align = "text-align: right"
 	}
 
-	if ln.AutoFeeEnabledAll && ln.AutoFeeEnabled[channelId] {
+	ln.AutoFeeMu.Lock()
+	autoFee := ln.AutoFeeEnabledAll && ln.AutoFeeEnabled[channelId]
+	rates, custom := ln.AutoFeeRatesSummary(channelId, peerNodeId)
+	ln.AutoFeeMu.Unlock()
+
+	if autoFee {
 		align = "text-align: center"
 	}
 
@@ -1722,8 +2073,7 @@ func feeInputField(peerNodeId string, channelId uint64, direction string, feePer
 
 	t := `<td title="` + direction + ` fee PPM" id="scramble" style="width: 6ch; padding: 0px; ` + align + `">`
 	// for autofees show link
-	if ln.AutoFeeEnabledAll && ln.AutoFeeEnabled[channelId] {
-		rates, custom := ln.AutoFeeRatesSummary(channelId)
+	if autoFee {
 		if custom {
 			rates = "*" + rates
 		}
@@ -1766,6 +2116,11 @@ func feeInputField(peerNodeId string, channelId uint64, direction string, feePer
 	return t
 }
 
+// Template function for 1-based numbering
+func inc(i int) int {
+	return i + 1
+}
+
 // Template function to check if the element is the last one in the slice
 func last(x int, a interface{}) bool {
 	return x == len(*(a.(*[]ln.DataPoint)))-1
@@ -1819,18 +2174,18 @@ func advertiseBalances() {
 
 		// refresh balances received over 24 hours + 2 minutes ago
 		pollPeer := false
-		if ptr := ln.LiquidBalances[peer.NodeId]; ptr != nil {
+		if ptr, ok := ln.LiquidBalances.Read(peer.NodeId); ok {
 			if ptr.TimeStamp < cutOff {
 				pollPeer = true
 				// delete stale information
-				ln.LiquidBalances[peer.NodeId] = nil
+				ln.LiquidBalances.Delete(peer.NodeId)
 			}
 		}
-		if ptr := ln.BitcoinBalances[peer.NodeId]; ptr != nil {
+		if ptr, ok := ln.BitcoinBalances.Read(peer.NodeId); ok {
 			if ptr.TimeStamp < cutOff {
 				pollPeer = true
 				// delete stale information
-				ln.BitcoinBalances[peer.NodeId] = nil
+				ln.BitcoinBalances.Delete(peer.NodeId)
 			}
 		}
 
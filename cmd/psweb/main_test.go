@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/ln"
+	"peerswap-web/cmd/psweb/safemap"
+
+	"github.com/elementsproject/peerswap/peerswaprpc"
+)
+
+func TestSwapOutAmount(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+
+	config.Config.AutoSwapOutThresholdPct = 80
+	config.Config.AutoSwapOutTargetPct = 50
+	config.Config.AutoSwapOutMaxAmount = 10_000_000
+
+	for _, tc := range []struct {
+		name                                           string
+		local, capacity, ourMaxHtlc, peerBalance, want uint64
+	}{
+		{"below high-water mark", 7_000_000, 10_000_000, 10_000_000, 10_000_000, 0},
+		{"at high-water mark", 8_000_000, 10_000_000, 10_000_000, 10_000_000, 0},
+		{"down to target", 9_000_000, 10_000_000, 10_000_000, 10_000_000, 4_000_000},
+		{"peer cannot pay it all", 9_000_000, 10_000_000, 10_000_000, 1_000_000, 1_000_000 - SWAP_LBTC_RESERVE},
+		{"peer has nothing", 9_000_000, 10_000_000, 10_000_000, 0, 0},
+		{"our max HTLC", 9_000_000, 10_000_000, 500_000, 10_000_000, 500_000},
+		{"max amount", 90_000_000, 100_000_000, 100_000_000, 100_000_000, 10_000_000},
+	} {
+		if got := swapOutAmount(tc.local, tc.capacity, tc.ourMaxHtlc, tc.peerBalance, SWAP_LBTC_RESERVE); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPaybackDays(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		cost, amount, ppm uint64
+		dailyVolume, want float64
+	}{
+		{"free", 0, 1_000_000, 500, 100_000, 0},
+		{"eight days", 400, 1_000_000, 500, 100_000, 8},
+		{"volume above amount", 400, 1_000_000, 500, 5_000_000, 0.8},
+		{"cost equals potential", 500, 1_000_000, 500, 100_000, math.Inf(1)},
+		{"cost above potential", 600, 1_000_000, 500, 100_000, math.Inf(1)},
+		{"no volume", 400, 1_000_000, 500, 0, math.Inf(1)},
+	} {
+		if got := paybackDays(tc.cost, tc.amount, tc.ppm, tc.dailyVolume); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExpectedSwapCost(t *testing.T) {
+	savedFees, savedRebates := txFee, ln.SwapRebates
+	defer func() { txFee, ln.SwapRebates = savedFees, savedRebates }()
+
+	txFee = safemap.New[string, int64]()
+	for txId, fee := range map[string]int64{"claim1": 300, "claim2": 500, "open1": 2_000} {
+		txFee.Write(txId, fee)
+	}
+	ln.SwapRebates = safemap.New[string, int64]()
+	ln.SwapRebates.Write("out1", 1_000)
+	ln.SwapRebates.Write("out2", 3_000)
+
+	swaps := []*peerswaprpc.PrettyPrintSwap{
+		{Id: "out1", Type: "swap-out", Role: "sender", Asset: "lbtc", State: "State_ClaimedPreimage", Amount: 1_000_000, ClaimTxId: "claim1", CreatedAt: 1},
+		{Id: "out2", Type: "swap-out", Role: "sender", Asset: "lbtc", State: "State_ClaimedPreimage", Amount: 1_000_000, ClaimTxId: "claim2", CreatedAt: 2},
+		{Id: "out3", Type: "swap-out", Role: "sender", Asset: "lbtc", State: "State_SwapCanceled", Amount: 1_000_000, CreatedAt: 3},
+		{Id: "in1", Type: "swap-in", Role: "sender", Asset: "btc", State: "State_ClaimedPreimage", Amount: 2_000_000, OpeningTxId: "open1", CreatedAt: 4},
+	}
+
+	for _, tc := range []struct {
+		name             string
+		direction, asset string
+		amount           uint64
+		feeRate          float64
+		want             uint64
+	}{
+		// 400 on-chain and 2,000 ppm rebate on average
+		{"swap-out history", "swap-out", "lbtc", 2_000_000, 0, 400 + 4_000},
+		{"swap-in no history", "swap-in", "lbtc", 2_000_000, 0, SWAP_LBTC_RESERVE},
+		{"btc history", "swap-in", "btc", 2_000_000, 1, 2_000},
+		{"btc mempool above history", "swap-in", "btc", 2_000_000, 10, 3_500},
+		{"btc no history", "swap-out", "btc", 2_000_000, 2, 1_400},
+	} {
+		if got := expectedSwapCost(swaps, tc.direction, tc.asset, tc.amount, tc.feeRate); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
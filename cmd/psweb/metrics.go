@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"peerswap-web/cmd/psweb/bitcoin"
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/liquid"
+	"peerswap-web/cmd/psweb/ln"
+	"peerswap-web/cmd/psweb/ps"
+	"peerswap-web/cmd/psweb/safemap"
+
+	"github.com/elementsproject/peerswap/peerswaprpc"
+)
+
+// collects samples grouped by metric name,
+// as required by Prometheus text exposition format
+type metricsWriter struct {
+	names   []string
+	help    map[string]string
+	samples map[string][]string
+}
+
+func newMetricsWriter() *metricsWriter {
+	return &metricsWriter{
+		help:    make(map[string]string),
+		samples: make(map[string][]string),
+	}
+}
+
+// labels are given as name, value pairs
+func (m *metricsWriter) add(name, kind, help string, value float64, labels ...string) {
+	if _, ok := m.help[name]; !ok {
+		m.names = append(m.names, name)
+		m.help[name] = "# HELP " + name + " " + help + "\n# TYPE " + name + " " + kind + "\n"
+	}
+
+	sample := name
+	if len(labels) > 1 {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+		}
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	m.samples[name] = append(m.samples[name], sample+" "+strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (m *metricsWriter) String() string {
+	var sb strings.Builder
+	for _, name := range m.names {
+		sb.WriteString(m.help[name])
+		for _, s := range m.samples[name] {
+			sb.WriteString(s + "\n")
+		}
+	}
+	return sb.String()
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Prometheus metrics exporter
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	m := newMetricsWriter()
+
+	client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+	if err != nil {
+		log.Println("metrics:", err)
+	} else {
+		defer cleanup()
+
+		res, err := ps.ListPeers(client)
+		if err == nil {
+			channelMetrics(m, res.GetPeers())
+		}
+
+		res2, err := ps.ListSwaps(client)
+		if err == nil {
+			swapMetrics(m, res2.GetSwaps())
+		}
+
+		res3, err := ps.LiquidGetBalance(client)
+		if err == nil {
+			m.add("psweb_liquid_balance_sats", "gauge", "Liquid wallet balance", float64(res3.GetSatAmount()))
+		}
+	}
+
+	cl, clean, er := ln.GetClient()
+	if er == nil {
+		defer clean()
+		m.add("psweb_bitcoin_balance_sats", "gauge", "Confirmed on-chain BTC wallet balance", float64(ln.ConfirmedWalletBalance(cl)))
+	}
+
+	m.add("psweb_mempool_fee_rate_sat_vb", "gauge", "Mempool fee rate used for on-chain transactions", mempoolFeeRate)
+	m.add("psweb_autofee_enabled", "gauge", "Auto fees enabled globally", boolToFloat(ln.AutoFeeEnabledAll))
+
+	// the log is pruned, so this is not a counter
+	for channelId, entries := range ln.FeeLogCopy() {
+		counts := make(map[[2]string]int)
+		for _, e := range entries {
+			if !e.IsRate() {
+				// not a fee rate change
+				continue
+			}
+			direction := "outbound"
+			if e.IsInbound {
+				direction = "inbound"
+			}
+			source := "auto"
+			if e.IsManual {
+				source = "manual"
+			}
+			counts[[2]string{direction, source}]++
+		}
+		for k, n := range counts {
+			m.add("psweb_fee_changes", "gauge", "Fee rate changes in the kept log",
+				float64(n), "channel_id", strconv.FormatUint(channelId, 10), "direction", k[0], "source", k[1])
+		}
+	}
+
+	m.add("psweb_pegin_pending", "gauge", "Peg-in or BTC withdrawal awaiting confirmations", boolToFloat(config.Config.PeginTxId != ""))
+	m.add("psweb_claimjoin_info", "gauge", "ClaimJoin role and status", 1, "role", ln.MyRole, "status", ln.ClaimStatus)
+
+	lnClient := strings.ToLower(ln.IMPLEMENTATION)
+	m.add("psweb_rpc_errors_total", "counter", "Failed RPC calls by client", float64(ln.RpcErrors.Load()), "client", lnClient)
+	m.add("psweb_rpc_errors_total", "counter", "Failed RPC calls by client", float64(liquid.RpcErrors.Load()), "client", "elements")
+	m.add("psweb_rpc_errors_total", "counter", "Failed RPC calls by client", float64(bitcoin.RpcErrors.Load()), "client", "bitcoin")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, m.String())
+}
+
+// balances, fee rates and routing totals of all channels
+func channelMetrics(m *metricsWriter, peers []*peerswaprpc.PeerSwapPeer) {
+	cl, clean, er := ln.GetClient()
+	if er != nil {
+		return
+	}
+	defer clean()
+
+	// add non-peerswap peers
+	var psIds []string
+	for _, peer := range peers {
+		psIds = append(psIds, peer.NodeId)
+	}
+	res2, err := ln.ListPeers(cl, "", &psIds)
+	if err == nil {
+		peers = append(peers, res2.GetPeers()...)
+	}
+
+	outboundFeeRates := make(map[uint64]int64)
+	inboundFeeRates := make(map[uint64]int64)
+	ln.FeeReport(cl, outboundFeeRates, inboundFeeRates)
+
+	for _, peer := range peers {
+		alias := getNodeAlias(peer.NodeId)
+		for _, ch := range peer.Channels {
+			labels := []string{"channel_id", strconv.FormatUint(ch.ChannelId, 10), "peer_id", peer.NodeId, "alias", alias}
+
+			m.add("psweb_channel_local_balance_sats", "gauge", "Channel local balance", float64(ch.LocalBalance), labels...)
+			m.add("psweb_channel_remote_balance_sats", "gauge", "Channel remote balance", float64(ch.RemoteBalance), labels...)
+			m.add("psweb_channel_active", "gauge", "Channel is active", boolToFloat(ch.Active), labels...)
+
+			if rate, ok := outboundFeeRates[ch.ChannelId]; ok {
+				m.add("psweb_channel_fee_rate_ppm", "gauge", "Channel fee rate", float64(rate), append(labels, "direction", "outbound")...)
+			}
+			if rate, ok := inboundFeeRates[ch.ChannelId]; ok {
+				m.add("psweb_channel_fee_rate_ppm", "gauge", "Channel fee rate", float64(rate), append(labels, "direction", "inbound")...)
+			}
+
+			ln.AutoFeeMu.Lock()
+			autoFee := ln.AutoFeeEnabled[ch.ChannelId]
+			ln.AutoFeeMu.Unlock()
+			m.add("psweb_channel_autofee_enabled", "gauge", "Auto fees enabled for the channel", boolToFloat(autoFee), labels...)
+
+			// totals over the kept history, they drop as it is pruned
+			t := ln.GetForwardingTotals(ch.ChannelId)
+			m.add("psweb_channel_forwards", "gauge", "Settled forwards in the kept history", float64(t.CountOut), append(labels, "direction", "out")...)
+			m.add("psweb_channel_forwards", "gauge", "Settled forwards in the kept history", float64(t.CountIn), append(labels, "direction", "in")...)
+			m.add("psweb_channel_routed_sats", "gauge", "Routed volume in the kept history", float64(t.AmountOut), append(labels, "direction", "out")...)
+			m.add("psweb_channel_routed_sats", "gauge", "Routed volume in the kept history", float64(t.AmountIn), append(labels, "direction", "in")...)
+			m.add("psweb_channel_fees_sats", "gauge", "Fees earned on outbound forwards in the kept history", float64(t.FeeSat), labels...)
+			m.add("psweb_channel_assisted_fees_sats", "gauge", "Fees earned on forwards entering the channel in the kept history", float64(t.AssistedFeeSat), labels...)
+		}
+	}
+}
+
+// costs of completed swaps do not change
+var swapCosts = safemap.New[string, int64]()
+
+func cachedSwapCost(swap *peerswaprpc.PrettyPrintSwap) int64 {
+	if cost, ok := swapCosts.Read(swap.Id); ok {
+		return cost
+	}
+
+	cost, _ := swapCost(swap)
+	// zero may be a failed tx lookup, try again next time
+	if simplifySwapState(swap.State) != "pending" && cost != 0 {
+		swapCosts.Write(swap.Id, cost)
+	}
+
+	return cost
+}
+
+// swap counts and costs by type, asset, role and state
+func swapMetrics(m *metricsWriter, swaps []*peerswaprpc.PrettyPrintSwap) {
+	type swapKey struct {
+		swapType, asset, role, state string
+	}
+
+	counts := make(map[swapKey]int)
+	costs := make(map[swapKey]int64)
+
+	for _, swap := range swaps {
+		key := swapKey{swap.Type, swap.Asset, swap.Role, simplifySwapState(swap.State)}
+		counts[key]++
+
+		costs[key] += cachedSwapCost(swap)
+	}
+
+	for key, n := range counts {
+		labels := []string{"type", key.swapType, "asset", key.asset, "role", key.role, "state", key.state}
+		m.add("psweb_swaps", "gauge", "Number of swaps", float64(n), labels...)
+		m.add("psweb_swap_cost_sats", "gauge", "Total cost of swaps, negative is income", float64(costs[key]), labels...)
+	}
+}
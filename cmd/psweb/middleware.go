@@ -9,24 +9,49 @@ import (
 // Middleware to check authentication
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isApi := strings.HasPrefix(r.RequestURI, "/api/")
+
+		// bearer token is checked even when no other auth is configured
+		token, err := bearerToken(r)
+		if err != nil {
+			denyRequest(w, isApi, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if token != nil {
+			scope := requiredScope(r)
+			if scope == "" || !stringIsInSlice(scope, token.Scopes) {
+				msg := "Token does not have the required scope"
+				if scope != "" {
+					msg += " '" + scope + "'"
+				}
+				denyRequest(w, isApi, http.StatusForbidden, msg)
+				return
+			}
+		}
+
 		if config.Config.SecureConnection && !strings.HasPrefix(r.RequestURI, "/downloadca") {
 			if r.TLS != nil {
-				// Check client certificate
-				if len(r.TLS.PeerCertificates) == 0 {
+				// Check client certificate, unless a valid token was presented
+				if len(r.TLS.PeerCertificates) == 0 && token == nil {
 					if config.Config.Password != "" {
 						if !isAuthenticated(r) {
+							if isApi {
+								denyRequest(w, isApi, http.StatusUnauthorized, "Authentication required")
+								return
+							}
 							if !strings.HasPrefix(r.RequestURI, "/static/") && !strings.HasPrefix(r.RequestURI, "/login") {
 								http.Redirect(w, r, "/login", http.StatusFound)
 								return
 							}
 						}
 					} else {
-						http.Error(w, "Client certificate not provided", http.StatusForbidden)
+						denyRequest(w, isApi, http.StatusForbidden, "Client certificate not provided")
 						return
 					}
 				}
 			} else {
-				http.Error(w, "Requires TLS connection", http.StatusForbidden)
+				denyRequest(w, isApi, http.StatusForbidden, "Requires TLS connection")
 				return
 			}
 		}
@@ -36,6 +61,37 @@ func authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// the token listener serves only machine endpoints to token holders
+func tokenOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if !strings.HasPrefix(path, "/api/v1/") && path != "/events" && path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Header.Get("Authorization") == "" {
+			denyRequest(w, true, http.StatusUnauthorized, "Bearer token required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// JSON error for the API, plain text for the UI
+func denyRequest(w http.ResponseWriter, isApi bool, status int, msg string) {
+	if isApi {
+		code := "forbidden"
+		if status == http.StatusUnauthorized {
+			code = "unauthorized"
+		}
+		writeApiError(w, status, code, msg)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
 func isAuthenticated(r *http.Request) bool {
 	session, _ := store.Get(r, "session")
 	auth, ok := session.Values["authenticated"].(bool)
@@ -38,6 +38,17 @@ func (sm *SafeMap[K, V]) Delete(key K) {
 	delete(sm.m, key)
 }
 
+// Copy returns a snapshot of the map
+func (sm *SafeMap[K, V]) Copy() map[K]V {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	m := make(map[K]V, len(sm.m))
+	for key, value := range sm.m {
+		m[key] = value
+	}
+	return m
+}
+
 // Iterate iterates over the map and calls the given function for each key-value pair
 func (sm *SafeMap[K, V]) Iterate(fn func(key K, value V)) {
 	sm.mu.Lock()
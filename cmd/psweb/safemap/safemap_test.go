@@ -0,0 +1,32 @@
+package safemap
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCopyIsSnapshot(t *testing.T) {
+	sm := New[string, int]()
+	sm.Write("a", 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			sm.Write("b", i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_ = sm.Copy()
+	}
+	wg.Wait()
+
+	snapshot := sm.Copy()
+	sm.Write("a", 2)
+	sm.Delete("b")
+
+	if snapshot["a"] != 1 || snapshot["b"] != 999 {
+		t.Fatalf("snapshot changed with the map: %v", snapshot)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/events"
+	"peerswap-web/cmd/psweb/ps"
+)
+
+const (
+	// how often to poll peerswap for swap state changes
+	SWAP_POLL_SECONDS = 10
+	// comment line to keep proxies from closing idle streams
+	SSE_KEEPALIVE_SECONDS = 30
+)
+
+// Server-Sent Events stream of live node activity
+// optional ?kind=forward,fee filters the event kinds
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var kinds []string
+	if keys, ok := r.URL.Query()["kind"]; ok && len(keys[0]) > 0 {
+		for _, k := range keys {
+			kinds = append(kinds, strings.Split(k, ",")...)
+		}
+	}
+
+	ch, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disable nginx buffering
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// tell the browser how soon to reconnect
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(SSE_KEEPALIVE_SECONDS * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e := <-ch:
+			if len(kinds) > 0 && !stringIsInSlice(e.Kind, kinds) {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Kind, e.Data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// polls peerswap while anyone listens to /events
+// and publishes swap state transitions
+func watchSwaps() {
+	var states map[string]string
+
+	for range time.Tick(SWAP_POLL_SECONDS * time.Second) {
+		if !events.HasSubscribers() {
+			// start over when someone subscribes
+			states = nil
+			continue
+		}
+
+		client, cleanup, err := ps.GetClient(config.Config.RpcHost)
+		if err != nil {
+			continue
+		}
+
+		res, err := ps.ListSwaps(client)
+		cleanup()
+		if err != nil {
+			log.Println("watchSwaps:", err)
+			continue
+		}
+
+		newStates := make(map[string]string)
+		for _, swap := range res.GetSwaps() {
+			newStates[swap.Id] = swap.State
+			if states == nil {
+				// first poll only remembers states
+				continue
+			}
+			if oldState := states[swap.Id]; oldState != swap.State {
+				events.Publish(events.SWAP, &events.Swap{
+					Id:       swap.Id,
+					OldState: oldState,
+					NewState: swap.State,
+				})
+			}
+		}
+
+		states = newStates
+	}
+}
+
+func publishPegin(txid string, confs int32, status string) {
+	target := int32(peginBlocks)
+	if config.Config.PeginClaimScript == "" {
+		// BTC withdrawal
+		target = 1
+	}
+
+	events.Publish(events.PEGIN, &events.Pegin{
+		TxId:          txid,
+		Confirmations: confs,
+		Target:        target,
+		Status:        status,
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"peerswap-web/cmd/psweb/config"
+	"peerswap-web/cmd/psweb/db"
 	"peerswap-web/cmd/psweb/ln"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -82,12 +84,22 @@ func telegramStart() {
 	// Process updates
 	for update := range updates {
 		if update.Message != nil {
-			switch update.Message.Text {
+			if update.Message.Document != nil {
+				telegramImport(update.Message)
+				continue
+			}
+
+			// command may be followed by an argument
+			cmd, arg, _ := strings.Cut(update.Message.Text, " ")
+
+			switch cmd {
 			case "/start":
 				chatId = update.Message.Chat.ID
 				telegramConnect()
 			case "/backup":
 				liquidBackup(true)
+			case "/export":
+				telegramExport(update.Message, strings.TrimSpace(arg))
 			case "/pegin":
 				t := ""
 				if config.Config.PeginTxId == "" {
@@ -133,22 +145,64 @@ func telegramStart() {
 					t += "\nThreshold Amount: " + formatWithThousandSeparators(config.Config.AutoSwapThresholdAmount)
 					t += "\nMinimum PPM: " + formatWithThousandSeparators(config.Config.AutoSwapThresholdPPM)
 					t += "\nTarget Pct: " + formatWithThousandSeparators(config.Config.AutoSwapTargetPct)
+				} else {
+					t += "Disabled"
+				}
+				// explain the swap-in decision, also to tune before enabling
+				t += swapInReportText("lbtc")
+				t += "\n🤖 Liquid auto swap-outs are "
+				if config.Config.AutoSwapOutEnabled {
+					t += "Enabled"
+					t += "\nHigh-Water Mark Pct: " + formatWithThousandSeparators(config.Config.AutoSwapOutThresholdPct)
+					t += "\nTarget Pct: " + formatWithThousandSeparators(config.Config.AutoSwapOutTargetPct)
 
 					var candidate SwapParams
 
-					if err := findSwapInCandidate(&candidate); err == nil {
+					if err := findSwapOutCandidate("lbtc", &candidate); err == nil {
 						if candidate.Amount > 0 {
 							t += "\nCandidate: " + candidate.PeerAlias
 							t += "\nMax Amount: " + formatWithThousandSeparators(candidate.Amount)
-							t += "\nRecent PPM: " + formatWithThousandSeparators(candidate.PPM)
+							t += "\nPayback: " + formatPayback(candidate.Payback)
 						} else {
-							t += "No swap candidates"
+							t += "\nNo swap-out candidates"
 						}
 					}
 				} else {
 					t += "Disabled"
 				}
+				for _, direction := range []string{"ins", "outs"} {
+					enabled := config.Config.AutoSwapBtcEnabled
+					if direction == "outs" {
+						enabled = config.Config.AutoSwapOutBtcEnabled
+					}
+					t += "\n🤖 Bitcoin auto swap-" + direction + " are "
+					if enabled && config.Config.BitcoinSwaps {
+						t += "Enabled"
+						if direction == "ins" {
+							t += swapInReportText("btc")
+						}
+					} else {
+						t += "Disabled"
+					}
+				}
+				if config.Config.AutoSwapBtcEnabled || config.Config.AutoSwapOutBtcEnabled {
+					t += "\nBTC swaps wait for fees that routing pays back, now " + formatFloat(btcSwapFeeRate()) + " sat/vB"
+				}
+				running, waiting := 0, 0
+				for _, job := range autoSwapQueueCopy() {
+					if job.SwapId != "" {
+						running++
+					} else {
+						waiting++
+					}
+				}
+				if config.Config.AutoSwapMaxPaybackDays > 0 {
+					t += "\nMax Payback: " + formatWithThousandSeparators(config.Config.AutoSwapMaxPaybackDays) + " days"
+				}
+				t += "\nQueue: " + strconv.Itoa(running) + " running, " + strconv.Itoa(waiting) + " waiting, max concurrent " + formatWithThousandSeparators(config.Config.AutoSwapMaxConcurrent)
 				telegramSendMessage(t)
+			case "/dryrun":
+				telegramSendMessage(dryRunSummary())
 			case "/version":
 				t := "Current version: " + VERSION + "\n"
 				t += "Latest version: " + latestVersion
@@ -172,13 +226,21 @@ func telegramConnect() bool {
 				Command:     "backup",
 				Description: "Elements wallet backup",
 			},
+			tgbotapi.BotCommand{
+				Command:     "export",
+				Description: "Encrypted psweb state export: /export password",
+			},
 			tgbotapi.BotCommand{
 				Command:     "pegin",
 				Description: "Status of peg-in or BTC withdrawal",
 			},
 			tgbotapi.BotCommand{
 				Command:     "autoswaps",
-				Description: "Status of Liquid auto swaps",
+				Description: "Status of auto swaps and why",
+			},
+			tgbotapi.BotCommand{
+				Command:     "dryrun",
+				Description: "AutoFee dry run proposals",
 			},
 			tgbotapi.BotCommand{
 				Command:     "version",
@@ -201,6 +263,140 @@ func telegramConnect() bool {
 	return true
 }
 
+// last 24h of AutoFee proposals for channels in dry run
+func dryRunSummary() string {
+	proposals := ln.ShadowLogSince(time.Now().Add(-24 * time.Hour).Unix())
+	if len(proposals) == 0 {
+		return "🧪 No AutoFee dry run proposals in the last 24h"
+	}
+
+	t := "🧪 AutoFee dry run proposals in the last 24h:"
+	for channelId, events := range proposals {
+		last := events[len(events)-1]
+		direction := "out"
+		if last.IsInbound {
+			direction = "in"
+		}
+		t += "\n" + getNodeAlias(peerNodeId[channelId]) + ": " + strconv.Itoa(last.OldRate) + " → " + strconv.Itoa(last.NewRate) + " " + direction
+		if len(events) > 1 {
+			t += " (" + strconv.Itoa(len(events)) + " changes)"
+		}
+	}
+	return t
+}
+
+// sends state archive encrypted with the given password
+func telegramExport(message *tgbotapi.Message, password string) {
+	if !fromConnectedChat(message, "export") {
+		return
+	}
+
+	if password == "" {
+		telegramSendMessage("Usage: /export password")
+		return
+	}
+
+	fileName, err := exportState(password)
+	if err != nil {
+		telegramSendMessage("❗ Export failed: " + err.Error())
+		return
+	}
+
+	err = telegramSendFile(config.Config.DataDir, fileName, "💾 PSWeb state export")
+	if err != nil {
+		log.Println("Error sending export:", err)
+	}
+
+	// Delete zip archive
+	err = os.Remove(filepath.Join(config.Config.DataDir, fileName))
+	if err != nil {
+		log.Println("Error deleting zip file:", err)
+	}
+}
+
+// restores state archive sent with caption /import password
+// psweb state goes only to and from the connected chat
+func fromConnectedChat(message *tgbotapi.Message, what string) bool {
+	if config.Config.TelegramChatId == 0 || message.Chat.ID != config.Config.TelegramChatId {
+		log.Println("Ignored Telegram "+what+" from chat", message.Chat.ID)
+		return false
+	}
+	return true
+}
+
+func telegramImport(message *tgbotapi.Message) {
+	if !fromConnectedChat(message, "import") {
+		return
+	}
+
+	cmd, password, _ := strings.Cut(message.Caption, " ")
+	password = strings.TrimSpace(password)
+	if cmd != "/import" || password == "" {
+		telegramSendMessage("Add caption /import password to restore psweb state from this file")
+		return
+	}
+
+	fileUrl, err := bot.GetFileDirectURL(message.Document.FileID)
+	if err != nil {
+		telegramSendMessage("❗ Import failed: " + err.Error())
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fileUrl, nil)
+	if err != nil {
+		telegramSendMessage("❗ Import failed: " + err.Error())
+		return
+	}
+
+	// use the same proxy as the bot
+	resp, err := bot.Client.Do(req)
+	if err != nil {
+		telegramSendMessage("❗ Import failed: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		telegramSendMessage("❗ Import failed: " + err.Error())
+		return
+	}
+
+	if err = importStateBytes(data, password); err != nil {
+		telegramSendMessage("❗ Import failed: " + err.Error())
+		return
+	}
+
+	log.Println("State imported from Telegram, restarting")
+	telegramSendMessage("💾 PSWeb state restored, restarting...")
+
+	// assume systemd will restart it
+	db.Close()
+	os.Exit(0)
+}
+
+// dry run of the auto swap-in for /autoswaps
+func swapInReportText(asset string) string {
+	report, err := swapInReport(asset)
+	if err != nil {
+		return ""
+	}
+
+	t := "\nDry run: " + report.Status
+	for _, e := range report.Channels {
+		if e.Selected {
+			t += "\nCandidate: " + e.PeerAlias
+			t += "\nMax Amount: " + formatWithThousandSeparators(e.Amount)
+			t += "\nRecent PPM: " + formatWithThousandSeparators(e.PPM)
+			t += "\nPayback: " + formatPayback(e.Payback)
+		}
+	}
+	if rejected := report.RejectedSummary(); rejected != "" {
+		t += "\nRejected: " + rejected
+	}
+	return t
+}
+
 func telegramSendMessage(msgText string) bool {
 	if chatId == 0 {
 		return false
@@ -216,7 +412,7 @@ func telegramSendMessage(msgText string) bool {
 	return true
 }
 
-func telegramSendFile(folder, fileName, satAmount string) error {
+func telegramSendFile(folder, fileName, caption string) error {
 	// Open file
 	file, err := os.Open(filepath.Join(folder, fileName))
 	if err != nil {
@@ -230,7 +426,7 @@ func telegramSendFile(folder, fileName, satAmount string) error {
 	// Create message config
 	msg := tgbotapi.NewDocument(chatId, fileConfig)
 
-	msg.Caption = "🌊 Liquid Balance: " + satAmount
+	msg.Caption = caption
 
 	// Send file
 	_, err = bot.Send(msg)
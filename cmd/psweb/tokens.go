@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"peerswap-web/cmd/psweb/db"
+	"peerswap-web/cmd/psweb/safemap"
+)
+
+// API token scopes
+const (
+	SCOPE_READ   = "read"   // GET requests
+	SCOPE_FEES   = "fees"   // fee rates, HTLC limits and auto fees
+	SCOPE_SWAPS  = "swaps"  // swaps, auto swaps and peer policies
+	SCOPE_WALLET = "wallet" // anything that spends or reveals wallet funds
+	// prefix to tell tokens apart from other secrets
+	API_TOKEN_PREFIX = "psw_"
+)
+
+var allScopes = []string{SCOPE_READ, SCOPE_FEES, SCOPE_SWAPS, SCOPE_WALLET}
+
+type ApiToken struct {
+	Name      string
+	Hint      string // first characters to identify the token
+	Scopes    []string
+	CreatedAt int64
+	LastUsed  int64
+}
+
+// tokens keyed by sha256 hash, the secret itself is never stored
+var apiTokens = safemap.New[string, *ApiToken]()
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func loadApiTokens() error {
+	tokens := make(map[string]*ApiToken)
+	if err := db.Load("Tokens", "ApiTokens", &tokens); err != nil && !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	for hash, t := range tokens {
+		apiTokens.Write(hash, t)
+	}
+	return nil
+}
+
+func saveApiTokens() error {
+	tokens := make(map[string]*ApiToken)
+	apiTokens.Iterate(func(hash string, t *ApiToken) {
+		tokens[hash] = t
+	})
+	return db.Save("Tokens", "ApiTokens", tokens)
+}
+
+// creates new token, returns the secret to be shown once
+func createApiToken(name string, scopes []string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", badInput("token name cannot be blank")
+	}
+
+	var valid []string
+	for _, s := range scopes {
+		if !stringIsInSlice(s, allScopes) {
+			return "", badInput("unknown scope " + s)
+		}
+		if !stringIsInSlice(s, valid) {
+			valid = append(valid, s)
+		}
+	}
+
+	if len(valid) == 0 {
+		return "", badInput("select at least one scope")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := API_TOKEN_PREFIX + hex.EncodeToString(b)
+
+	apiTokens.Write(hashToken(token), &ApiToken{
+		Name:      name,
+		Hint:      token[:len(API_TOKEN_PREFIX)+6],
+		Scopes:    valid,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err := saveApiTokens(); err != nil {
+		// not shown, so cannot be used
+		apiTokens.Delete(hashToken(token))
+		return "", err
+	}
+
+	return token, nil
+}
+
+// revokes token by its hash
+func revokeApiToken(hash string) error {
+	if _, ok := apiTokens.Read(hash); !ok {
+		return badInput("token not found")
+	}
+	apiTokens.Delete(hash)
+	return saveApiTokens()
+}
+
+// token list for the config page, newest first
+func listApiTokens() []ApiTokenView {
+	var list []ApiTokenView
+	apiTokens.Iterate(func(hash string, t *ApiToken) {
+		lastUsed := "never"
+		if t.LastUsed > 0 {
+			lastUsed = timePassedAgo(time.Unix(t.LastUsed, 0))
+		}
+		list = append(list, ApiTokenView{
+			Id:        hash,
+			Name:      t.Name,
+			Hint:      t.Hint,
+			Scopes:    strings.Join(t.Scopes, ", "),
+			CreatedAt: t.CreatedAt,
+			Created:   time.Unix(t.CreatedAt, 0).UTC().Format("2006-01-02 15:04"),
+			LastUsed:  lastUsed,
+		})
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt > list[j].CreatedAt
+	})
+
+	return list
+}
+
+type ApiTokenView struct {
+	Id        string
+	Name      string
+	Hint      string
+	Scopes    string
+	CreatedAt int64
+	Created   string
+	LastUsed  string
+}
+
+// returns token from Authorization: Bearer header, or nil if none given
+func bearerToken(r *http.Request) (*ApiToken, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, nil
+	}
+
+	secret, found := strings.CutPrefix(auth, "Bearer ")
+	if !found || !strings.HasPrefix(secret, API_TOKEN_PREFIX) {
+		return nil, errors.New("invalid authorization header")
+	}
+
+	hash := hashToken(secret)
+
+	token, ok := apiTokens.Read(hash)
+	if !ok {
+		return nil, errors.New("invalid or revoked token")
+	}
+
+	now := time.Now().Unix()
+	if now-token.LastUsed > 3600 {
+		// do not write to db on every request
+		updated := *token
+		updated.LastUsed = now
+		apiTokens.Write(hash, &updated)
+		if err := saveApiTokens(); err != nil {
+			log.Println("Cannot save token last use:", err)
+		}
+		token = &updated
+	}
+
+	return token, nil
+}
+
+// scope needed to serve the request
+// empty string means the request is not allowed with a token
+func requiredScope(r *http.Request) string {
+	path := r.URL.Path
+
+	switch {
+	case path == "/backup" || path == "/pegin" || path == "/bumpfee":
+		// wallet backup or spending
+		return SCOPE_WALLET
+	case path == "/config" || path == "/save" || path == "/ca" || path == "/stop" || path == "/update" ||
+		path == "/login" || path == "/logout" || path == "/export" || path == "/import":
+		// admin only, config page reveals secrets
+		return ""
+	case path == "/submit":
+		r.ParseForm()
+		return actionScope(r.FormValue("action"))
+	case strings.HasPrefix(path, "/api/v1/"):
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return SCOPE_READ
+		}
+		return apiScope(strings.TrimPrefix(path, "/api/v1/"))
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return SCOPE_READ
+	}
+
+	return ""
+}
+
+// scope of a submitHandler action
+func actionScope(action string) string {
+	switch action {
+	case "saveAutoFee", "toggleAutoFee", "setFee", "setBase", "setHtlcSize", "addFeeSchedule", "deleteFeeSchedule",
+		"toggleDryRun", "addAutoFeeTemplate", "tagChannels", "saveAutoFeeBudget":
+		return SCOPE_FEES
+	case "doSwap", "setAutoSwap", "setAutoSwapOut", "setAutoSwapBtc", "setAutoSwapQueue", "addPeer", "removePeer", "suspectPeer", "unsuspectPeer",
+		"advertiseLiquidBalance", "advertiseBitcoinBalance":
+		return SCOPE_SWAPS
+	case "externalPeginTxId", "deleteTxId", "newBitcoinAddress", "newAddress", "sendLiquid", "keySend":
+		return SCOPE_WALLET
+	}
+	// enableHTTPS, token management etc.
+	return ""
+}
+
+// scope of a state-changing JSON API endpoint
+func apiScope(path string) string {
+	switch {
+	case strings.HasPrefix(path, "backtest/"):
+		// POST only carries a candidate rule
+		return SCOPE_READ
+	case strings.HasPrefix(path, "channels/"), strings.HasPrefix(path, "autofee/"):
+		return SCOPE_FEES
+	case strings.HasPrefix(path, "peers/") && strings.HasSuffix(path, "/keysend"):
+		return SCOPE_WALLET
+	case path == "swaps", path == "autoswap", path == "autoswap/out", path == "autoswap/btc", path == "autoswap/queue", strings.HasPrefix(path, "peers/"), strings.HasPrefix(path, "advertise/"):
+		return SCOPE_SWAPS
+	case strings.HasPrefix(path, "pegin"), strings.HasPrefix(path, "bitcoin/"), strings.HasPrefix(path, "liquid/"):
+		return SCOPE_WALLET
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequiredScope(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		path   string
+		action string // submit form action
+		want   string
+	}{
+		{http.MethodGet, "/", "", SCOPE_READ},
+		{http.MethodGet, "/af", "", SCOPE_READ},
+		{http.MethodGet, "/events", "", SCOPE_READ},
+		{http.MethodGet, "/backup", "", SCOPE_WALLET},
+		{http.MethodPost, "/pegin", "", SCOPE_WALLET},
+		{http.MethodPost, "/bumpfee", "", SCOPE_WALLET},
+		// admin only
+		{http.MethodGet, "/config", "", ""},
+		{http.MethodPost, "/save", "", ""},
+		{http.MethodGet, "/ca", "", ""},
+		{http.MethodPost, "/stop", "", ""},
+		{http.MethodGet, "/login", "", ""},
+		{http.MethodPost, "/export", "", ""},
+		{http.MethodPost, "/import", "", ""},
+		{http.MethodPost, "/somethingelse", "", ""},
+		// form actions
+		{http.MethodPost, "/submit", "saveAutoFee", SCOPE_FEES},
+		{http.MethodPost, "/submit", "toggleDryRun", SCOPE_FEES},
+		{http.MethodPost, "/submit", "doSwap", SCOPE_SWAPS},
+		{http.MethodPost, "/submit", "sendLiquid", SCOPE_WALLET},
+		{http.MethodPost, "/submit", "keySend", SCOPE_WALLET},
+		{http.MethodPost, "/submit", "createToken", ""},
+		{http.MethodPost, "/submit", "enableHTTPS", ""},
+		{http.MethodPost, "/submit", "", ""},
+		// JSON API
+		{http.MethodGet, "/api/v1/peers", "", SCOPE_READ},
+		{http.MethodGet, "/api/v1/balances", "", SCOPE_READ},
+		{http.MethodGet, "/api/v1/autoswap/evaluate", "", SCOPE_READ},
+		{http.MethodPost, "/api/v1/backtest/123", "", SCOPE_READ},
+		{http.MethodPut, "/api/v1/channels/123/feerate", "", SCOPE_FEES},
+		{http.MethodDelete, "/api/v1/autofee/rules/123", "", SCOPE_FEES},
+		{http.MethodPost, "/api/v1/swaps", "", SCOPE_SWAPS},
+		{http.MethodPut, "/api/v1/autoswap", "", SCOPE_SWAPS},
+		{http.MethodPut, "/api/v1/autoswap/out", "", SCOPE_SWAPS},
+		{http.MethodPut, "/api/v1/autoswap/btc", "", SCOPE_SWAPS},
+		{http.MethodPut, "/api/v1/autoswap/queue", "", SCOPE_SWAPS},
+		{http.MethodPut, "/api/v1/peers/abc/allowed", "", SCOPE_SWAPS},
+		{http.MethodPost, "/api/v1/peers/abc/keysend", "", SCOPE_WALLET},
+		{http.MethodPost, "/api/v1/pegin", "", SCOPE_WALLET},
+		{http.MethodPost, "/api/v1/liquid/send", "", SCOPE_WALLET},
+		{http.MethodPost, "/api/v1/unknown", "", ""},
+	} {
+		var r *http.Request
+		if tc.path == "/submit" {
+			form := url.Values{"action": {tc.action}}
+			r = httptest.NewRequest(tc.method, tc.path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(tc.method, tc.path, nil)
+		}
+
+		if got := requiredScope(r); got != tc.want {
+			t.Errorf("%s %s %s: got %q, want %q", tc.method, tc.path, tc.action, got, tc.want)
+		}
+	}
+}
+
+// every scoped form action must be a known scope
+func TestActionScopesAreKnown(t *testing.T) {
+	for _, action := range []string{
+		"saveAutoFee", "toggleAutoFee", "setFee", "setBase", "setHtlcSize", "addFeeSchedule", "deleteFeeSchedule",
+		"toggleDryRun", "addAutoFeeTemplate", "tagChannels", "saveAutoFeeBudget", "doSwap", "setAutoSwap", "setAutoSwapOut", "setAutoSwapBtc", "setAutoSwapQueue", "addPeer", "removePeer", "suspectPeer", "unsuspectPeer",
+		"advertiseLiquidBalance", "advertiseBitcoinBalance", "externalPeginTxId", "deleteTxId",
+		"newBitcoinAddress", "newAddress", "sendLiquid", "keySend",
+	} {
+		if scope := actionScope(action); !stringIsInSlice(scope, allScopes) {
+			t.Errorf("action %s maps to unknown scope %q", action, scope)
+		}
+	}
+}
+
+func TestTokenOnlyMiddleware(t *testing.T) {
+	handler := tokenOnlyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tc := range []struct {
+		path   string
+		bearer bool
+		want   int
+	}{
+		{"/api/v1/peers", true, http.StatusNoContent},
+		{"/events", true, http.StatusNoContent},
+		{"/metrics", true, http.StatusNoContent},
+		{"/api/v1/peers", false, http.StatusUnauthorized},
+		{"/config", true, http.StatusNotFound},
+		{"/static/js/chart.js", true, http.StatusNotFound},
+		{"/submit", true, http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.bearer {
+			r.Header.Set("Authorization", "Bearer "+API_TOKEN_PREFIX+"x")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s bearer=%v: got %d, want %d", tc.path, tc.bearer, w.Code, tc.want)
+		}
+	}
+}
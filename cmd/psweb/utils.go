@@ -64,6 +64,14 @@ func formatFloat(number float64) string {
 	}
 }
 
+// formats payback days as 2.5 days, or never
+func formatPayback(days float64) string {
+	if math.IsInf(days, 1) {
+		return "never"
+	}
+	return fmt.Sprintf("%.1f days", days)
+}
+
 // formats 100000 as 100,000
 func formatWithThousandSeparators(n uint64) string {
 	if n == 0 {